@@ -17,12 +17,10 @@ def run_test(filename):
 
 tests_path = os.path.dirname(os.path.abspath(__file__))
 base_path = os.path.dirname(tests_path)
-examples_path = os.path.join(base_path, 'examples')
 
-valid_path = os.path.join(examples_path, 'valid')
-invalid_path = os.path.join(examples_path, 'invalid')
-invalid_syntax_path = os.path.join(invalid_path, 'syntaxErr')
-invalid_semantic_path = os.path.join(invalid_path, 'semanticErr')
+# The examples shared with other compilers, and our own
+examples_paths = [os.path.join(base_path, 'examples'),
+                  os.path.join(base_path, 'tests')]
 
 categories = [
     'Valid',
@@ -30,20 +28,22 @@ categories = [
     'Invalid Semantic',
 ]
 
-paths = dict(zip(categories, [valid_path,
-                              invalid_syntax_path,
-                              invalid_semantic_path]))
+subdirectories = dict(zip(categories, ['valid',
+                                       os.path.join('invalid', 'syntaxErr'),
+                                       os.path.join('invalid', 'semanticErr')]))
 
 expected_error_codes = dict(zip(categories, [0, 100, 200]))
 
 file_extension = '.wacc'
 
 files = {}
-for category, path in paths.items():
+for category, subdirectory in subdirectories.items():
     files[category] = []
-    for root, dirnames, filenames in os.walk(path):
-        for filename in [f for f in filenames if f.endswith(file_extension)]:
-            files[category].append(os.path.join(root, filename))
+    for examples_path in examples_paths:
+        path = os.path.join(examples_path, subdirectory)
+        for root, dirnames, filenames in os.walk(path):
+            for filename in [f for f in filenames if f.endswith(file_extension)]:
+                files[category].append(os.path.join(root, filename))
 
 compile_script_path = os.path.join(base_path, 'compile')
 
@@ -9,13 +9,18 @@ import fnmatch
 import re
 import argparse
 from glob import glob
-from tempfile import NamedTemporaryFile
+from tempfile import NamedTemporaryFile, TemporaryDirectory
 
 
 COMPILE_FLAGS = ['--if=false', '--v=false']
 ASSEMBLER_FLAGS = ['-mcpu=arm1176jzf-s', '-mtune=arm1176jzf-s']
 EMULATOR_FLAGS = ['-L', '/usr/arm-linux-gnueabi']
+C_COMPILER_CMD = ['cc', '-std=c99', '-w']
 TIMEOUT = 30
+SIMULATE = False
+INTERPRET = False
+C_SOURCE = False
+VIRTUAL_MACHINE = False
 
 
 class CompilePipelineException(Exception):
@@ -131,6 +136,54 @@ def emulate(binary_file: NamedTemporaryFile, stdin: str) -> (str, int):
     return (stdout, exitcode)
 
 
+def compile_c(wacc_filename: str) -> NamedTemporaryFile:
+    c_file = NamedTemporaryFile(suffix='.c')
+    cmd = get_compiler_cmd() + ['-target', 'c', '-o', c_file.name] + [wacc_filename]
+    stdout, stderr, exitcode = call_external(cmd)
+    if exitcode is not 0:
+        raise CompilerException(stdout, stderr, exitcode)
+
+    return c_file
+
+
+def build_c(c_file: NamedTemporaryFile, binary_filename: str) -> None:
+    # Warnings from the C compiler are silenced, so anything on stderr means
+    # the program failed to build
+    cmd = C_COMPILER_CMD + ['-o', binary_filename] + [c_file.name]
+    stdout, stderr, exitcode = call_external(cmd)
+    if exitcode is not 0 or stderr:
+        raise AssemblerException(stdout, stderr, exitcode)
+
+
+def run_native(binary_filename: str, stdin: str) -> (str, int):
+    stdout, _, exitcode = call_external([binary_filename], stdin)
+    return (stdout, exitcode)
+
+
+def simulate(wacc_filename: str, stdin: str) -> (str, int):
+    cmd = get_compiler_cmd() + ['-sim', wacc_filename]
+    stdout, stderr, exitcode = call_external(cmd, stdin)
+    if stderr:
+        raise CompilerException(stdout, stderr, exitcode)
+    return (stdout, exitcode)
+
+
+def interpret(wacc_filename: str, stdin: str) -> (str, int):
+    cmd = get_compiler_cmd() + ['-interpret', wacc_filename]
+    stdout, stderr, exitcode = call_external(cmd, stdin)
+    if stderr:
+        raise CompilerException(stdout, stderr, exitcode)
+    return (stdout, exitcode)
+
+
+def run_bytecode(wacc_filename: str, stdin: str) -> (str, int):
+    cmd = get_compiler_cmd() + ['-vm', wacc_filename]
+    stdout, stderr, exitcode = call_external(cmd, stdin)
+    if stderr:
+        raise CompilerException(stdout, stderr, exitcode)
+    return (stdout, exitcode)
+
+
 def hashcode(s: str) -> str:
     n = len(s)
     h = 0
@@ -147,6 +200,19 @@ class RuntimeTests(unittest.TestCase):
     address_re = re.compile("0x[0-9a-f]+")
 
     def execute_file(self, wacc_filename: str, stdin: str) -> (str, str):
+        if SIMULATE:
+            return simulate(wacc_filename, stdin)
+        if INTERPRET:
+            return interpret(wacc_filename, stdin)
+        if C_SOURCE:
+            # The binary can't be run while a temporary file holds it open,
+            # so it is built in a directory of its own
+            with compile_c(wacc_filename) as c_file, TemporaryDirectory() as build_dir:
+                binary_filename = os.path.join(build_dir, 'program')
+                build_c(c_file, binary_filename)
+                return run_native(binary_filename, stdin)
+        if VIRTUAL_MACHINE:
+            return run_bytecode(wacc_filename, stdin)
         with compile(wacc_filename) as asm_file:
             with assemble(asm_file) as binary_file:
                 stdout, exitcode = emulate(binary_file, stdin)
@@ -222,7 +288,7 @@ def print_usage() -> None:
 
 
 def main() -> None:
-    global TIMEOUT
+    global COMPILE_FLAGS, TIMEOUT, SIMULATE, INTERPRET, C_SOURCE, VIRTUAL_MACHINE
     # Flags
     parser = argparse.ArgumentParser()
     group = parser.add_mutually_exclusive_group()
@@ -230,6 +296,22 @@ def main() -> None:
             help='Maximum number of seconds a single test is allowed to run')
     group.add_argument('--quick', default=False, action='store_true',
             help='Kills tests lasting more than a second. Alias for -t 1')
+    parser.add_argument('--optimise', '-O', type=int, choices=range(4),
+            help='Optimisation level to compile the programs at, instead of '
+                 'the compiler\'s default')
+    mode = parser.add_mutually_exclusive_group()
+    mode.add_argument('--simulate', '-s', default=False, action='store_true',
+            help='Run the generated code in the compiler\'s ARM simulator '
+                 'instead of assembling it and running it under qemu')
+    mode.add_argument('--interpret', '-i', default=False, action='store_true',
+            help='Run the programs in the compiler\'s interpreter instead of '
+                 'compiling them and running them under qemu')
+    mode.add_argument('--c', '-c', default=False, action='store_true',
+            help='Compile the programs to C and run them natively '
+                 'instead of under qemu')
+    mode.add_argument('--vm', default=False, action='store_true',
+            help='Compile the programs to bytecode and run them in the '
+                 'compiler\'s virtual machine instead of under qemu')
 
     # Positional args
     parser.add_argument('target', nargs='+',
@@ -239,6 +321,12 @@ def main() -> None:
     args = parser.parse_args()
 
     TIMEOUT = args.timeout
+    SIMULATE = args.simulate
+    INTERPRET = args.interpret
+    C_SOURCE = args.c
+    VIRTUAL_MACHINE = args.vm
+    if args.optimise is not None:
+        COMPILE_FLAGS = COMPILE_FLAGS + ['-O{}'.format(args.optimise)]
 
     if args.quick:
         TIMEOUT = 1
@@ -0,0 +1,83 @@
+#!/usr/bin/env node
+// Runs a WACC program compiled with -target=wasm and assembled to a binary
+// module, for example with wat2wasm from wabt:
+//
+//   ./compile -target=wasm -o prog.wat prog.wacc
+//   wat2wasm prog.wat -o prog.wasm
+//   node scripts/wasm_host.js prog.wasm
+
+'use strict';
+
+const fs = require('fs');
+
+if (process.argv.length !== 3) {
+    process.stderr.write('usage: wasm_host.js <module.wasm>\n');
+    process.exit(1);
+}
+
+// The exit import unwinds the program by throwing this
+class Exit {
+    constructor(code) {
+        this.code = code;
+    }
+}
+
+function write(s) {
+    fs.writeSync(1, s);
+}
+
+// Standard input is read in full the first time the program reads
+let input = null;
+let position = 0;
+
+function skipSpace() {
+    if (input === null) {
+        input = Array.from(fs.readFileSync(0, 'utf8'));
+    }
+    while (position < input.length && /\s/.test(input[position])) {
+        position++;
+    }
+}
+
+const imports = {
+    wacc: {
+        print_int: n => write(String(n)),
+        print_float: f => write(f.toFixed(6)),
+        print_char: c => write(String.fromCodePoint(c)),
+        print_addr: p => write(p === 0 ? '(nil)' : '0x' + (p >>> 0).toString(16)),
+
+        read_int: () => {
+            skipSpace();
+            let s = '';
+            if (input[position] === '-' || input[position] === '+') {
+                s += input[position++];
+            }
+            while (position < input.length && /[0-9]/.test(input[position])) {
+                s += input[position++];
+            }
+            const n = parseInt(s, 10);
+            return isNaN(n) ? 0 : n | 0;
+        },
+
+        read_char: () => {
+            skipSpace();
+            return position < input.length ? input[position++].codePointAt(0) : 0;
+        },
+
+        exit: code => {
+            throw new Exit(code);
+        },
+    },
+};
+
+const wasm = new WebAssembly.Module(fs.readFileSync(process.argv[2]));
+const instance = new WebAssembly.Instance(wasm, imports);
+try {
+    instance.exports.main();
+    process.exit(0);
+} catch (e) {
+    if (e instanceof Exit) {
+        process.exit(e.code & 0xff);
+    }
+    throw e;
+}
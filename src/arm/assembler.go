@@ -0,0 +1,759 @@
+package arm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Condition codes, as encoded in the top four bits of an instruction
+var conditions = map[string]uint32{
+	"eq": 0x0, "ne": 0x1, "cs": 0x2, "hs": 0x2, "cc": 0x3, "lo": 0x3,
+	"mi": 0x4, "pl": 0x5, "vs": 0x6, "vc": 0x7, "hi": 0x8, "ls": 0x9,
+	"ge": 0xa, "lt": 0xb, "gt": 0xc, "le": 0xd, "al": 0xe, "": 0xe,
+}
+
+const condAL = 0xe
+
+// Data processing opcodes
+var dataProcessing = map[string]uint32{
+	"and": 0x0, "eor": 0x1, "sub": 0x2, "rsb": 0x3,
+	"add": 0x4, "adc": 0x5, "sbc": 0x6, "rsc": 0x7,
+	"tst": 0x8, "teq": 0x9, "cmp": 0xa, "cmn": 0xb,
+	"orr": 0xc, "mov": 0xd, "bic": 0xe, "mvn": 0xf,
+}
+
+// Instructions which can be turned into each other when an immediate can
+// only be encoded negated (add, sub, cmp and cmn) or inverted (the others)
+var negatedOpcode = map[uint32]uint32{0x2: 0x4, 0x4: 0x2, 0xa: 0xb, 0xb: 0xa}
+var invertedOpcode = map[uint32]uint32{0xd: 0xf, 0xf: 0xd, 0x0: 0xe, 0xe: 0x0}
+
+var registers = map[string]uint32{
+	"sl": 10, "fp": 11, "ip": 12, "sp": 13, "lr": 14, "pc": 15,
+}
+
+var shifts = map[string]uint32{"lsl": 0, "lsr": 1, "asr": 2, "ror": 3}
+
+// Mnemonics without their condition and flag suffixes, longest first so that
+// bl is tried before b
+var mnemonics = []string{
+	"smull", "push", "pop", "ldr", "str", "bl", "b",
+	"and", "eor", "sub", "rsb", "add", "adc", "sbc", "rsc",
+	"tst", "teq", "cmp", "cmn", "orr", "mov", "bic", "mvn",
+}
+
+// An error in the assembly, with the line it was found on
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("arm: line %d: %s", e.Line, e.Msg)
+}
+
+// A literal waiting to be placed in the next pool
+type literal struct {
+	value  uint32
+	symbol string // if not empty, the literal is the address of this label
+
+	// Offsets of the ldr instructions loading it, and the lines they are on
+	loads []uint32
+	lines []int
+}
+
+// A branch waiting for its target to be defined
+type branch struct {
+	offset uint32
+	target *Symbol
+	link   bool
+	cond   uint32
+	line   int
+}
+
+type assembler struct {
+	obj     *Object
+	section *Section
+	line    int
+
+	labels  map[string]*Symbol
+	globals map[string]bool
+
+	pool     []*literal
+	branches []branch
+
+	// Every symbol, in the order it is first referenced or defined
+	order []*Symbol
+}
+
+// Assemble assembles the output of the ARM code generator into an object
+func Assemble(src string) (obj *Object, err error) {
+	a := &assembler{
+		obj:     &Object{Text: newSection(".text"), Data: newSection(".data")},
+		labels:  make(map[string]*Symbol),
+		globals: make(map[string]bool),
+	}
+	a.section = a.obj.Text
+
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(*Error); ok {
+				obj, err = nil, e
+				return
+			}
+			panic(r)
+		}
+	}()
+
+	for n, line := range strings.Split(src, "\n") {
+		a.line = n + 1
+		a.assembleLine(line)
+	}
+	a.flushPool()
+	a.resolve()
+	return a.obj, nil
+}
+
+func (a *assembler) errorf(format string, args ...interface{}) {
+	panic(&Error{a.line, fmt.Sprintf(format, args...)})
+}
+
+//
+// Parsing
+//
+func (a *assembler) assembleLine(line string) {
+	if i := strings.IndexByte(line, '@'); i >= 0 && !strings.ContainsAny(line[:i], "\"'") {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+
+	// Labels
+	for {
+		i := strings.IndexByte(line, ':')
+		if i < 0 || strings.ContainsAny(line[:i], " \t\"'") {
+			break
+		}
+		a.defineLabel(line[:i])
+		line = strings.TrimSpace(line[i+1:])
+	}
+	if line == "" {
+		return
+	}
+
+	name := line
+	rest := ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		name, rest = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	name = strings.ToLower(name)
+
+	if strings.HasPrefix(name, ".") {
+		a.directive(name, rest)
+	} else {
+		if a.section != a.obj.Text {
+			a.errorf("instruction outside of the text section")
+		}
+		a.section.mark(true)
+		a.instruction(name, splitOperands(rest))
+	}
+}
+
+// splitOperands splits a list of operands at the commas which aren't inside
+// brackets or braces
+func splitOperands(s string) []string {
+	operands := []string{}
+	depth := 0
+	start := 0
+	for i, c := range s {
+		switch c {
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				operands = append(operands, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if rest := strings.TrimSpace(s[start:]); rest != "" || len(operands) > 0 {
+		operands = append(operands, rest)
+	}
+	return operands
+}
+
+func (a *assembler) defineLabel(name string) {
+	if !isLabel(name) {
+		a.errorf("invalid label %s", name)
+	}
+	s := a.symbol(name)
+	if s.Section != nil {
+		a.errorf("label %s defined more than once", name)
+	}
+	s.Section, s.Value = a.section, a.section.size()
+	a.obj.Symbols = append(a.obj.Symbols, s)
+}
+
+// symbol returns the symbol for a label, which is left undefined if it is
+// never defined
+func (a *assembler) symbol(name string) *Symbol {
+	if s, ok := a.labels[name]; ok {
+		return s
+	}
+	s := &Symbol{Name: name}
+	a.labels[name] = s
+	a.order = append(a.order, s)
+	return s
+}
+
+func (a *assembler) directive(name, args string) {
+	switch name {
+	case ".text":
+		a.section = a.obj.Text
+
+	case ".data":
+		a.section = a.obj.Data
+
+	case ".global", ".globl":
+		for _, s := range splitOperands(args) {
+			a.globals[s] = true
+		}
+
+	case ".ltorg", ".pool":
+		a.flushPool()
+
+	case ".word":
+		a.section.mark(false)
+		for _, v := range splitOperands(args) {
+			if n, ok := parseNumber(v); ok {
+				a.section.appendWord(uint32(n))
+			} else if isLabel(v) {
+				offset := a.section.appendWord(0)
+				a.section.Relocs = append(a.section.Relocs, Reloc{offset, R_ARM_ABS32, a.symbol(v)})
+			} else {
+				a.errorf("invalid word %s", v)
+			}
+		}
+
+	case ".ascii", ".asciz":
+		a.section.mark(false)
+		s, ok := parseString(args)
+		if !ok {
+			a.errorf("invalid string %s", args)
+		}
+		a.section.Data = append(a.section.Data, s...)
+		if name == ".asciz" {
+			a.section.Data = append(a.section.Data, 0)
+		}
+
+	case ".align", ".balign", ".p2align":
+		n, ok := parseNumber(args)
+		if !ok {
+			a.errorf("invalid alignment %s", args)
+		}
+		if name != ".balign" {
+			n = 1 << uint(n)
+		}
+		for a.section.size()%uint32(n) != 0 {
+			a.section.Data = append(a.section.Data, 0)
+		}
+
+	default:
+		a.errorf("unsupported directive %s", name)
+	}
+}
+
+// parseString parses a quoted string with C escapes
+func parseString(s string) ([]byte, bool) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return nil, false
+	}
+	s = s[1 : len(s)-1]
+
+	b := []byte{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return nil, false
+		}
+		switch c := s[i]; {
+		case c >= '0' && c <= '7':
+			n := 0
+			for k := 0; k < 3 && i < len(s) && s[i] >= '0' && s[i] <= '7'; k++ {
+				n = n*8 + int(s[i]-'0')
+				i++
+			}
+			i--
+			b = append(b, byte(n))
+		case c == 'n':
+			b = append(b, '\n')
+		case c == 't':
+			b = append(b, '\t')
+		case c == 'r':
+			b = append(b, '\r')
+		default:
+			b = append(b, c)
+		}
+	}
+	return b, true
+}
+
+func parseNumber(s string) (int64, bool) {
+	if len(s) >= 3 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		b, ok := parseString("\"" + s[1:len(s)-1] + "\"")
+		if !ok || len(b) != 1 {
+			return 0, false
+		}
+		return int64(b[0]), true
+	}
+	n, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		return 0, false
+	}
+	if n < -1<<31 || n > 1<<32-1 {
+		return 0, false
+	}
+	return n, true
+}
+
+func isLabel(s string) bool {
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		return false
+	}
+	for _, c := range s {
+		if !(c == '_' || c == '.' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *assembler) register(s string) uint32 {
+	s = strings.ToLower(s)
+	if r, ok := registers[s]; ok {
+		return r
+	}
+	if len(s) >= 2 && s[0] == 'r' {
+		if n, err := strconv.Atoi(s[1:]); err == nil && n >= 0 && n < 16 {
+			return uint32(n)
+		}
+	}
+	a.errorf("invalid register %s", s)
+	return 0
+}
+
+func isRegister(s string) bool {
+	s = strings.ToLower(s)
+	if _, ok := registers[s]; ok {
+		return true
+	}
+	if len(s) >= 2 && s[0] == 'r' {
+		n, err := strconv.Atoi(s[1:])
+		return err == nil && n >= 0 && n < 16
+	}
+	return false
+}
+
+func (a *assembler) immediate(s string) int64 {
+	if !strings.HasPrefix(s, "#") {
+		a.errorf("expected an immediate, found %s", s)
+	}
+	n, ok := parseNumber(strings.TrimSpace(s[1:]))
+	if !ok {
+		a.errorf("invalid immediate %s", s)
+	}
+	return n
+}
+
+// registerList parses a list such as {r4-r11, lr} into a bitmask
+func (a *assembler) registerList(s string) uint32 {
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		a.errorf("expected a register list, found %s", s)
+	}
+	mask := uint32(0)
+	for _, item := range strings.Split(s[1:len(s)-1], ",") {
+		item = strings.TrimSpace(item)
+		if i := strings.IndexByte(item, '-'); i >= 0 {
+			first := a.register(strings.TrimSpace(item[:i]))
+			last := a.register(strings.TrimSpace(item[i+1:]))
+			if first > last {
+				a.errorf("invalid register range %s", item)
+			}
+			for r := first; r <= last; r++ {
+				mask |= 1 << r
+			}
+		} else {
+			mask |= 1 << a.register(item)
+		}
+	}
+	if mask == 0 {
+		a.errorf("empty register list")
+	}
+	return mask
+}
+
+// splitMnemonic separates a mnemonic into its base, condition and whether it
+// sets the flags. Both the unified (addseq) and the older (addeqs) orders of
+// the suffixes are accepted.
+func splitMnemonic(name string) (base string, cond uint32, setFlags bool, ok bool) {
+	for _, m := range mnemonics {
+		if !strings.HasPrefix(name, m) {
+			continue
+		}
+		suffix := name[len(m):]
+		_, isDP := dataProcessing[m]
+
+		if c, found := conditions[suffix]; found {
+			return m, c, false, true
+		}
+		if isDP && strings.HasPrefix(suffix, "s") {
+			if c, found := conditions[suffix[1:]]; found {
+				return m, c, true, true
+			}
+		}
+		if isDP && strings.HasSuffix(suffix, "s") {
+			if c, found := conditions[suffix[:len(suffix)-1]]; found {
+				return m, c, true, true
+			}
+		}
+	}
+	return "", 0, false, false
+}
+
+//
+// Encoding
+//
+func (a *assembler) emit(w uint32) uint32 {
+	return a.section.appendWord(w)
+}
+
+// encodeImmediate finds the rotated 8-bit form of a value, if it has one
+func encodeImmediate(v uint32) (uint32, bool) {
+	for rot := uint32(0); rot < 32; rot += 2 {
+		// Rotating left by rot undoes a rotation right by rot
+		r := v<<rot | v>>((32-rot)%32)
+		if r < 0x100 {
+			return rot/2<<8 | r, true
+		}
+	}
+	return 0, false
+}
+
+func (a *assembler) instruction(name string, ops []string) {
+	base, cond, setFlags, ok := splitMnemonic(name)
+	if !ok {
+		a.errorf("unknown instruction %s", name)
+	}
+	cond <<= 28
+
+	expect := func(n int) {
+		if len(ops) != n {
+			a.errorf("%s takes %d operands", base, n)
+		}
+	}
+
+	switch base {
+	case "b", "bl":
+		expect(1)
+		if !isLabel(ops[0]) {
+			a.errorf("invalid branch target %s", ops[0])
+		}
+		offset := a.emit(0)
+		a.branches = append(a.branches, branch{offset, a.symbol(ops[0]), base == "bl", cond >> 28, a.line})
+
+	case "push", "pop":
+		expect(1)
+		mask := a.registerList(ops[0])
+		if mask&(mask-1) == 0 {
+			// A single register is pushed with str and popped with ldr
+			r := uint32(0)
+			for mask>>r != 1 {
+				r++
+			}
+			if base == "push" {
+				a.emit(cond | 0x052d0004 | r<<12)
+			} else {
+				a.emit(cond | 0x049d0004 | r<<12)
+			}
+		} else if base == "push" {
+			a.emit(cond | 0x092d0000 | mask)
+		} else {
+			a.emit(cond | 0x08bd0000 | mask)
+		}
+
+	case "smull":
+		expect(4)
+		lo, hi := a.register(ops[0]), a.register(ops[1])
+		rm, rs := a.register(ops[2]), a.register(ops[3])
+		flags := uint32(0)
+		if setFlags {
+			flags = 1 << 20
+		}
+		a.emit(cond | 0x00c00090 | flags | hi<<16 | lo<<12 | rs<<8 | rm)
+
+	case "ldr", "str":
+		a.loadStore(cond, base == "ldr", ops)
+
+	default:
+		a.dataProcessing(cond, dataProcessing[base], setFlags, ops)
+	}
+}
+
+func (a *assembler) dataProcessing(cond, opcode uint32, setFlags bool, ops []string) {
+	var rd, rn uint32
+	var rest []string
+	switch opcode {
+	case 0xd, 0xf: // mov and mvn have no first operand
+		if len(ops) < 2 {
+			a.errorf("too few operands")
+		}
+		rd, rest = a.register(ops[0]), ops[1:]
+
+	case 0x8, 0x9, 0xa, 0xb: // Comparisons have no destination, and always set the flags
+		if len(ops) < 2 {
+			a.errorf("too few operands")
+		}
+		rn, rest = a.register(ops[0]), ops[1:]
+		setFlags = true
+
+	default:
+		if len(ops) < 3 {
+			a.errorf("too few operands")
+		}
+		rd, rn, rest = a.register(ops[0]), a.register(ops[1]), ops[2:]
+	}
+
+	var operand2 uint32
+	if strings.HasPrefix(rest[0], "#") {
+		if len(rest) != 1 {
+			a.errorf("an immediate operand can't be shifted")
+		}
+		v := uint32(a.immediate(rest[0]))
+		imm, ok := encodeImmediate(v)
+		if !ok {
+			// Try the equivalent instruction with the immediate negated or
+			// inverted, as the GNU assembler does
+			if other, found := negatedOpcode[opcode]; found {
+				imm, ok = encodeImmediate(-v)
+				if ok {
+					opcode = other
+				}
+			}
+			if other, found := invertedOpcode[opcode]; found && !ok {
+				imm, ok = encodeImmediate(^v)
+				if ok {
+					opcode = other
+				}
+			}
+		}
+		if !ok {
+			a.errorf("immediate %s can't be encoded", rest[0])
+		}
+		operand2 = 1<<25 | imm
+	} else {
+		rm := a.register(rest[0])
+		operand2 = rm
+		if len(rest) == 2 {
+			operand2 |= a.shift(rest[1])
+		} else if len(rest) != 1 {
+			a.errorf("too many operands")
+		}
+	}
+
+	flags := uint32(0)
+	if setFlags {
+		flags = 1 << 20
+	}
+	a.emit(cond | opcode<<21 | flags | rn<<16 | rd<<12 | operand2)
+}
+
+// shift encodes a shift by an immediate, such as lsl #2
+func (a *assembler) shift(s string) uint32 {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		a.errorf("invalid shift %s", s)
+	}
+	kind, ok := shifts[strings.ToLower(fields[0])]
+	if !ok {
+		a.errorf("invalid shift %s", s)
+	}
+	n := a.immediate(fields[1])
+	if n < 0 || n > 32 || (n == 32 && kind == 0) || (n == 0 && kind != 0) {
+		a.errorf("invalid shift amount %s", s)
+	}
+	return uint32(n%32)<<7 | kind<<5
+}
+
+func (a *assembler) loadStore(cond uint32, load bool, ops []string) {
+	if len(ops) != 2 {
+		a.errorf("ldr and str take 2 operands")
+	}
+	rd := a.register(ops[0])
+	l := uint32(0)
+	if load {
+		l = 1 << 20
+	}
+
+	// Loads of constants and addresses go through the literal pool
+	if strings.HasPrefix(ops[1], "=") {
+		if !load {
+			a.errorf("cannot store to a literal")
+		}
+		v := strings.TrimSpace(ops[1][1:])
+		if n, ok := parseNumber(v); ok {
+			// Constants which fit in a mov or mvn don't need the pool
+			if imm, ok := encodeImmediate(uint32(n)); ok {
+				a.emit(cond | 0x03a00000 | rd<<12 | imm)
+			} else if imm, ok := encodeImmediate(^uint32(n)); ok {
+				a.emit(cond | 0x03e00000 | rd<<12 | imm)
+			} else {
+				a.addLiteral(literal{value: uint32(n)}, a.emit(cond|0x059f0000|rd<<12))
+			}
+		} else if isLabel(v) {
+			offset := a.emit(cond | 0x059f0000 | rd<<12)
+			a.addLiteral(literal{symbol: v}, offset)
+		} else {
+			a.errorf("invalid literal %s", v)
+		}
+		return
+	}
+
+	addr := ops[1]
+	if !strings.HasPrefix(addr, "[") || !strings.HasSuffix(addr, "]") {
+		a.errorf("invalid address %s", addr)
+	}
+	parts := splitOperands(addr[1 : len(addr)-1])
+	rn := a.register(parts[0])
+	offset := int64(0)
+	if len(parts) == 2 {
+		offset = a.immediate(parts[1])
+	} else if len(parts) != 1 {
+		a.errorf("invalid address %s", addr)
+	}
+
+	up := uint32(1 << 23)
+	if offset < 0 {
+		up = 0
+		offset = -offset
+	}
+	if offset > 0xfff {
+		a.errorf("offset %d out of range", offset)
+	}
+	a.emit(cond | 0x05000000 | up | l | rn<<16 | rd<<12 | uint32(offset))
+}
+
+//
+// Literal pools
+//
+func (a *assembler) addLiteral(lit literal, load uint32) {
+	for _, existing := range a.pool {
+		if existing.value == lit.value && existing.symbol == lit.symbol {
+			existing.loads = append(existing.loads, load)
+			existing.lines = append(existing.lines, a.line)
+			return
+		}
+	}
+	lit.loads = []uint32{load}
+	lit.lines = []int{a.line}
+	a.pool = append(a.pool, &lit)
+}
+
+// flushPool places the pending literals at the current position in the text
+// section, and points the loads at them
+func (a *assembler) flushPool() {
+	if len(a.pool) == 0 {
+		return
+	}
+	text := a.obj.Text
+	for text.size()%4 != 0 {
+		text.Data = append(text.Data, 0)
+	}
+	text.mark(false)
+	for _, lit := range a.pool {
+		offset := text.appendWord(lit.value)
+		if lit.symbol != "" {
+			text.Relocs = append(text.Relocs, Reloc{offset, R_ARM_ABS32, a.symbol(lit.symbol)})
+		}
+
+		for k, load := range lit.loads {
+			distance := int64(offset) - int64(load) - 8
+			if distance < -0xfff || distance > 0xfff {
+				a.line = lit.lines[k]
+				a.errorf("literal pool out of range, use .ltorg")
+			}
+			word := text.word(load)
+			if distance < 0 {
+				word &^= 1 << 23
+				distance = -distance
+			}
+			text.setWord(load, word|uint32(distance))
+		}
+	}
+	a.pool = nil
+}
+
+//
+// Symbols
+//
+func (a *assembler) resolve() {
+	text := a.obj.Text
+
+	for name := range a.globals {
+		a.symbol(name).Global = true
+	}
+
+	// Branches to local labels in the text section are resolved here, and
+	// the rest are left to the linker, as global symbols can be preempted
+	for _, b := range a.branches {
+		a.line = b.line
+		target := b.target
+		word := b.cond<<28 | 0x0a000000
+		if b.link {
+			word |= 1 << 24
+		}
+
+		if target.Section == text && !target.Global {
+			distance := (int64(target.Value) - int64(b.offset) - 8) >> 2
+			if distance < -1<<23 || distance >= 1<<23 {
+				a.errorf("branch to %s out of range", target.Name)
+			}
+			text.setWord(b.offset, word|uint32(distance)&0xffffff)
+			continue
+		}
+
+		// Unconditional calls can be turned into blx by the linker, so they
+		// have a relocation of their own. The addend is -8.
+		kind := R_ARM_JUMP24
+		if b.link && b.cond == condAL {
+			kind = R_ARM_CALL
+		}
+		text.setWord(b.offset, word|0xfffffe)
+		text.Relocs = append(text.Relocs, Reloc{Offset: b.offset, Type: kind, Symbol: target})
+	}
+
+	// Addresses of local labels are relocated against the start of their
+	// section, with the label's offset as the addend, as the GNU assembler
+	// does
+	for _, s := range a.obj.Sections() {
+		for k := range s.Relocs {
+			r := &s.Relocs[k]
+			if r.Type == R_ARM_ABS32 && r.Symbol.Section != nil && !r.Symbol.Global {
+				s.setWord(r.Offset, s.word(r.Offset)+r.Symbol.Value)
+				r.Symbol = r.Symbol.Section.Symbol
+			}
+		}
+	}
+
+	// Symbols which are never defined are left for the linker
+	for _, s := range a.order {
+		if s.Section == nil {
+			s.Global = true
+			a.obj.Symbols = append(a.obj.Symbols, s)
+		}
+	}
+}
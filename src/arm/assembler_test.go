@@ -0,0 +1,176 @@
+package arm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func assemble(t *testing.T, src string) *Object {
+	obj, err := Assemble(src)
+	if err != nil {
+		t.Fatalf("Assemble(%q) returned %v", src, err)
+	}
+	return obj
+}
+
+func words(s *Section) []uint32 {
+	w := make([]uint32, len(s.Data)/4)
+	for k := range w {
+		w[k] = s.word(uint32(k * 4))
+	}
+	return w
+}
+
+// Encodings as produced by the GNU assembler
+func TestAssembleEncodings(t *testing.T) {
+	tests := []struct {
+		src  string
+		want uint32
+	}{
+		{"mov r0, #1", 0xe3a00001},
+		{"mov r0, #0x3fc", 0xe3a00fff},
+		{"mov r0, #-1", 0xe3e00000},
+		{"mvn r0, #0", 0xe3e00000},
+		{"movne r0, #0", 0x13a00000},
+		{"moveq r1, r2, lsl #2", 0x01a01102},
+		{"mov r0, r1, asr #31", 0xe1a00fc1},
+		{"add r1, r2, r3", 0xe0821003},
+		{"adds r1, r2, #4", 0xe2921004},
+		{"addeqs r1, r2, #4", 0x02921004},
+		{"add r0, r0, #-4", 0xe2400004},
+		{"sub sp, sp, #8", 0xe24dd008},
+		{"rsbs r0, r0, #0", 0xe2700000},
+		{"and r0, r0, #255", 0xe20000ff},
+		{"orr r0, r1, r2", 0xe1810002},
+		{"eor r0, r0, #1", 0xe2200001},
+		{"cmp r0, #-1", 0xe3700001},
+		{"tst r0, #1", 0xe3100001},
+		{"smull r0, r1, r2, r3", 0xe0c10392},
+		{"push {r4-r11, lr}", 0xe92d4ff0},
+		{"pop {r4-r11, pc}", 0xe8bd8ff0},
+		{"push {r0}", 0xe52d0004},
+		{"pop {r0}", 0xe49d0004},
+		{"ldr r0, [sp, #4]", 0xe59d0004},
+		{"ldr r0, [r1]", 0xe5910000},
+		{"str r1, [sp, #-4]", 0xe50d1004},
+		{"ldr r0, =5", 0xe3a00005},
+		{"ldr r0, =0xffffff00", 0xe3e000ff},
+	}
+
+	for _, test := range tests {
+		obj := assemble(t, "\t"+test.src+"\n")
+		if got := words(obj.Text); len(got) != 1 || got[0] != test.want {
+			t.Errorf("%s assembled to %08x, want %08x", test.src, got, test.want)
+		}
+	}
+}
+
+func TestAssembleBranches(t *testing.T) {
+	obj := assemble(t, strings.Join([]string{
+		"loop:",
+		"\tbeq done",
+		"\tb loop",
+		"done:",
+		"\tbl malloc",
+		"\tblne free",
+	}, "\n"))
+
+	want := []uint32{0x0a000000, 0xeafffffd, 0xebfffffe, 0x1bfffffe}
+	if got := words(obj.Text); !reflect.DeepEqual(got, want) {
+		t.Errorf("branches assembled to %08x, want %08x", got, want)
+	}
+
+	// Calls to other objects are left to the linker, and only unconditional
+	// ones can be turned into blx
+	relocs := obj.Text.Relocs
+	if len(relocs) != 2 ||
+		relocs[0] != (Reloc{8, R_ARM_CALL, relocs[0].Symbol}) || relocs[0].Symbol.Name != "malloc" ||
+		relocs[1] != (Reloc{12, R_ARM_JUMP24, relocs[1].Symbol}) || relocs[1].Symbol.Name != "free" {
+		t.Errorf("branches have relocations %+v, want a call to malloc and a jump to free", relocs)
+	}
+	if s, ok := obj.Lookup("malloc"); !ok || !s.Global || s.Section != nil {
+		t.Errorf("malloc isn't an undefined global symbol")
+	}
+}
+
+func TestAssembleLiteralPool(t *testing.T) {
+	obj := assemble(t, strings.Join([]string{
+		".data",
+		"\t.word 0",
+		"msg:",
+		"\t.word 3",
+		".text",
+		"\tldr r0, =0x12345678",
+		"\tldr r1, =0x12345678",
+		"\tldr r2, =msg",
+		"\t.ltorg",
+		"\tldr r3, =0x87654321",
+	}, "\n"))
+
+	// Equal literals share a slot, and the pool is placed at .ltorg. The
+	// literals left at the end go in a pool after the last instruction.
+	want := []uint32{
+		0xe59f0004, // ldr r0, [pc, #4]
+		0xe59f1000, // ldr r1, [pc, #0]
+		0xe59f2000, // ldr r2, [pc, #0]
+		0x12345678,
+		0x00000004, // Address of msg, as an offset into .data
+		0xe51f3004, // ldr r3, [pc, #-4]
+		0x87654321,
+	}
+	if got := words(obj.Text); !reflect.DeepEqual(got, want) {
+		t.Errorf("literal pool assembled to %08x, want %08x", got, want)
+	}
+
+	relocs := obj.Text.Relocs
+	if len(relocs) != 1 || relocs[0] != (Reloc{16, R_ARM_ABS32, obj.Data.Symbol}) {
+		t.Errorf("literal pool has relocations %+v, want the address of .data at 16", relocs)
+	}
+
+	wantMapping := []Mapping{{0, true}, {12, false}, {20, true}, {24, false}}
+	if !reflect.DeepEqual(obj.Text.Mapping, wantMapping) {
+		t.Errorf("mapping symbols %v, want %v", obj.Text.Mapping, wantMapping)
+	}
+}
+
+func TestAssembleLiteralPoolOutOfRange(t *testing.T) {
+	// A load can reach a literal at most 4KB after it
+	padding := strings.Repeat("\tmov r0, r0\n", 1100)
+	src := "\tmov r0, r0\n\tldr r0, =0x12345678\n" + padding
+
+	_, err := Assemble(src)
+	if e, ok := err.(*Error); !ok || e.Line != 2 || !strings.Contains(e.Msg, "literal pool out of range") {
+		t.Errorf("Assemble returned %v, want the literal pool out of range at line 2", err)
+	}
+
+	obj := assemble(t, src[:len(src)-len(padding)/2]+"\t.ltorg\n"+padding[len(padding)/2:])
+	if got := words(obj.Text)[1]; got != 0xe59f0894 {
+		t.Errorf("load from the pool assembled to %08x, want e59f0894", got)
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		line int
+		msg  string
+	}{
+		{"\tfoo r0, r1", 1, "unknown instruction foo"},
+		{"\tmov r0, r16", 1, "invalid register r16"},
+		{"\tmov r0, #0x101", 1, "immediate #0x101 can't be encoded"},
+		{"\tldr r0, [sp, #4096]", 1, "offset 4096 out of range"},
+		{"\tstr r0, =1", 1, "cannot store to a literal"},
+		{"\tmov r0, r1, lsl #32", 1, "invalid shift amount"},
+		{"\t.section .bss", 1, "unsupported directive .section"},
+		{"a:\n\tmov r0, r0\na:", 3, "label a defined more than once"},
+		{".data\n\tmov r0, r0", 2, "instruction outside of the text section"},
+	}
+
+	for _, test := range tests {
+		_, err := Assemble(test.src)
+		if e, ok := err.(*Error); !ok || e.Line != test.line || !strings.Contains(e.Msg, test.msg) {
+			t.Errorf("Assemble(%q) returned %v, want %q at line %d", test.src, err, test.msg, test.line)
+		}
+	}
+}
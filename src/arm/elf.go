@@ -0,0 +1,231 @@
+package arm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Values from the ELF specification and its ARM supplement
+const (
+	elfHeaderSize     = 52
+	elfSectionHdrSize = 40
+	elfSymbolSize     = 16
+	elfRelSize        = 8
+
+	etRel = 1
+	emARM = 40
+
+	// Version 5 of the ARM EABI
+	efARMEABIVer5 = 0x05000000
+
+	shtProgbits = 1
+	shtSymtab   = 2
+	shtStrtab   = 3
+	shtRel      = 9
+
+	shfWrite     = 0x1
+	shfAlloc     = 0x2
+	shfExecInstr = 0x4
+	shfInfoLink  = 0x40
+
+	stbLocal  = 0
+	stbGlobal = 1
+
+	sttNotype  = 0
+	sttSection = 3
+
+	shnUndef = 0
+)
+
+type elfSection struct {
+	name      string
+	kind      uint32
+	flags     uint32
+	link      uint32
+	info      uint32
+	align     uint32
+	entrySize uint32
+	data      []byte
+}
+
+// A string table, as a list of null-terminated names
+type stringTable struct {
+	data    []byte
+	offsets map[string]uint32
+}
+
+func newStringTable() *stringTable {
+	return &stringTable{data: []byte{0}, offsets: make(map[string]uint32)}
+}
+
+func (t *stringTable) add(s string) uint32 {
+	if s == "" {
+		return 0
+	}
+	if offset, ok := t.offsets[s]; ok {
+		return offset
+	}
+	offset := uint32(len(t.data))
+	t.data = append(t.data, s...)
+	t.data = append(t.data, 0)
+	t.offsets[s] = offset
+	return offset
+}
+
+// WriteELF writes the object as a relocatable ELF file
+func (o *Object) WriteELF(w io.Writer) error {
+	sections := []*elfSection{{}}
+	index := make(map[*Section]uint32)
+
+	// Sections with contents, each followed by its relocations
+	relocs := make(map[*Section]*elfSection)
+	for _, s := range o.Sections() {
+		flags := uint32(shfAlloc | shfWrite)
+		if s == o.Text {
+			flags = shfAlloc | shfExecInstr
+		}
+		index[s] = uint32(len(sections))
+		sections = append(sections, &elfSection{
+			name: s.Name, kind: shtProgbits, flags: flags, align: 4, data: s.Data,
+		})
+
+		if len(s.Relocs) > 0 {
+			rel := &elfSection{
+				name: ".rel" + s.Name, kind: shtRel, flags: shfInfoLink,
+				info: index[s], align: 4, entrySize: elfRelSize,
+			}
+			relocs[s] = rel
+			sections = append(sections, rel)
+		}
+	}
+
+	// Marks the stack as not executable
+	sections = append(sections, &elfSection{name: ".note.GNU-stack", kind: shtProgbits, align: 1})
+
+	symtab := &elfSection{name: ".symtab", kind: shtSymtab, align: 4, entrySize: elfSymbolSize}
+	strtab := &elfSection{name: ".strtab", kind: shtStrtab, align: 1}
+	shstrtab := &elfSection{name: ".shstrtab", kind: shtStrtab, align: 1}
+	symtabIndex := uint32(len(sections))
+	sections = append(sections, symtab, strtab, shstrtab)
+	symtab.link = symtabIndex + 1
+
+	// Symbols, with the local ones first as ELF requires
+	symbolNames := newStringTable()
+	symbols := new(bytes.Buffer)
+	symbolIndex := make(map[*Symbol]uint32)
+	count := uint32(0)
+	addSymbol := func(name string, value uint32, binding, kind int, section uint32) {
+		binary.Write(symbols, binary.LittleEndian, struct {
+			Name, Value, Size uint32
+			Info, Other       uint8
+			Section           uint16
+		}{symbolNames.add(name), value, 0, uint8(binding<<4 | kind), 0, uint16(section)})
+		count++
+	}
+
+	addSymbol("", 0, stbLocal, sttNotype, shnUndef)
+	for _, s := range o.Sections() {
+		symbolIndex[s.Symbol] = count
+		addSymbol("", 0, stbLocal, sttSection, index[s])
+	}
+	for _, s := range o.Sections() {
+		for _, m := range s.Mapping {
+			name := "$d"
+			if m.Code {
+				name = "$a"
+			}
+			addSymbol(name, m.Offset, stbLocal, sttNotype, index[s])
+		}
+	}
+	for _, s := range o.Symbols {
+		if !s.Global {
+			symbolIndex[s] = count
+			addSymbol(s.Name, s.Value, stbLocal, sttNotype, index[s.Section])
+		}
+	}
+	symtab.info = count
+	for _, s := range o.Symbols {
+		if s.Global {
+			symbolIndex[s] = count
+			section := uint32(shnUndef)
+			if s.Section != nil {
+				section = index[s.Section]
+			}
+			addSymbol(s.Name, s.Value, stbGlobal, sttNotype, section)
+		}
+	}
+	symtab.data = symbols.Bytes()
+	strtab.data = symbolNames.data
+
+	// Relocations, in the order of the fields they apply to
+	for s, rel := range relocs {
+		rel.link = symtabIndex
+		sorted := make([]Reloc, len(s.Relocs))
+		copy(sorted, s.Relocs)
+		for i := 1; i < len(sorted); i++ {
+			for j := i; j > 0 && sorted[j].Offset < sorted[j-1].Offset; j-- {
+				sorted[j], sorted[j-1] = sorted[j-1], sorted[j]
+			}
+		}
+
+		buf := new(bytes.Buffer)
+		for _, r := range sorted {
+			binary.Write(buf, binary.LittleEndian, []uint32{r.Offset, symbolIndex[r.Symbol]<<8 | uint32(r.Type)})
+		}
+		rel.data = buf.Bytes()
+	}
+
+	names := newStringTable()
+	nameOffsets := make([]uint32, len(sections))
+	for k, s := range sections {
+		nameOffsets[k] = names.add(s.name)
+	}
+	shstrtab.data = names.data
+
+	// Lay out the contents after the header, and the section headers after
+	// them
+	offsets := make([]uint32, len(sections))
+	offset := uint32(elfHeaderSize)
+	for k, s := range sections[1:] {
+		if s.align > 1 {
+			offset = (offset + s.align - 1) &^ (s.align - 1)
+		}
+		offsets[k+1] = offset
+		offset += uint32(len(s.data))
+	}
+	headers := (offset + 3) &^ 3
+
+	out := new(bytes.Buffer)
+	out.Write([]byte{0x7f, 'E', 'L', 'F', 1, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	binary.Write(out, binary.LittleEndian, struct {
+		Type, Machine                      uint16
+		Version, Entry, Phoff, Shoff, Flag uint32
+		Ehsize, Phentsize, Phnum           uint16
+		Shentsize, Shnum, Shstrndx         uint16
+	}{
+		etRel, emARM, 1, 0, 0, headers, efARMEABIVer5,
+		elfHeaderSize, 0, 0,
+		elfSectionHdrSize, uint16(len(sections)), uint16(len(sections) - 1),
+	})
+
+	for k, s := range sections[1:] {
+		for uint32(out.Len()) < offsets[k+1] {
+			out.WriteByte(0)
+		}
+		out.Write(s.data)
+	}
+	for uint32(out.Len()) < headers {
+		out.WriteByte(0)
+	}
+
+	for k, s := range sections {
+		binary.Write(out, binary.LittleEndian, []uint32{
+			nameOffsets[k], s.kind, s.flags, 0, offsets[k], uint32(len(s.data)),
+			s.link, s.info, s.align, s.entrySize,
+		})
+	}
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
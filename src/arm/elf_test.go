@@ -0,0 +1,112 @@
+package arm
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteELF(t *testing.T) {
+	obj := assemble(t, strings.Join([]string{
+		".data",
+		"msg:",
+		"\t.word 5",
+		".text",
+		".global main",
+		"main:",
+		"\tpush {lr}",
+		"\tldr r0, =msg",
+		"\tbl puts",
+		"\tpop {pc}",
+		"\t.ltorg",
+	}, "\n"))
+
+	var buf bytes.Buffer
+	if err := obj.WriteELF(&buf); err != nil {
+		t.Fatalf("WriteELF returned %v", err)
+	}
+	f, err := elf.NewFile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("WriteELF wrote an invalid ELF file: %v", err)
+	}
+
+	if f.Class != elf.ELFCLASS32 || f.Data != elf.ELFDATA2LSB || f.Type != elf.ET_REL || f.Machine != elf.EM_ARM {
+		t.Errorf("header %+v, want a 32-bit little-endian ARM relocatable file", f.FileHeader)
+	}
+	if flags := binary.LittleEndian.Uint32(buf.Bytes()[36:]); flags != efARMEABIVer5 {
+		t.Errorf("header flags %#x, want EABI version 5", flags)
+	}
+
+	names := []string{}
+	for _, s := range f.Sections {
+		names = append(names, s.Name)
+	}
+	wantNames := []string{"", ".text", ".rel.text", ".data", ".note.GNU-stack", ".symtab", ".strtab", ".shstrtab"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Fatalf("sections %v, want %v", names, wantNames)
+	}
+
+	text := f.Sections[1]
+	if text.Flags != elf.SHF_ALLOC|elf.SHF_EXECINSTR || text.Addralign != 4 {
+		t.Errorf(".text has flags %v and alignment %v", text.Flags, text.Addralign)
+	}
+	if data, _ := text.Data(); !bytes.Equal(data, obj.Text.Data) {
+		t.Errorf(".text holds %x, want %x", data, obj.Text.Data)
+	}
+	if data := f.Sections[3]; data.Flags != elf.SHF_ALLOC|elf.SHF_WRITE {
+		t.Errorf(".data has flags %v", data.Flags)
+	}
+
+	// Section symbols, then mapping symbols, then local labels, and the
+	// global symbols last
+	type symbol struct {
+		name    string
+		bind    elf.SymBind
+		typ     elf.SymType
+		section elf.SectionIndex
+		value   uint64
+	}
+	symbols, err := f.Symbols()
+	if err != nil {
+		t.Fatalf("symbol table can't be read: %v", err)
+	}
+	got := []symbol{}
+	for _, s := range symbols {
+		got = append(got, symbol{s.Name, elf.ST_BIND(s.Info), elf.ST_TYPE(s.Info), s.Section, s.Value})
+	}
+	want := []symbol{
+		{"", elf.STB_LOCAL, elf.STT_SECTION, 1, 0},
+		{"", elf.STB_LOCAL, elf.STT_SECTION, 3, 0},
+		{"$a", elf.STB_LOCAL, elf.STT_NOTYPE, 1, 0},
+		{"$d", elf.STB_LOCAL, elf.STT_NOTYPE, 1, 16},
+		{"$d", elf.STB_LOCAL, elf.STT_NOTYPE, 3, 0},
+		{"msg", elf.STB_LOCAL, elf.STT_NOTYPE, 3, 0},
+		{"main", elf.STB_GLOBAL, elf.STT_NOTYPE, 1, 0},
+		{"puts", elf.STB_GLOBAL, elf.STT_NOTYPE, elf.SHN_UNDEF, 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("symbols\n%v\nwant\n%v", got, want)
+	}
+	if symtab := f.Sections[5]; symtab.Info != 7 || symtab.Link != 6 {
+		t.Errorf(".symtab has info %v and link %v, want 7 and 6", symtab.Info, symtab.Link)
+	}
+
+	// Relocations are sorted by offset, and refer to symbols by their index
+	rel := f.Sections[2]
+	if rel.Type != elf.SHT_REL || rel.Link != 5 || rel.Info != 1 {
+		t.Errorf(".rel.text has type %v, link %v and info %v", rel.Type, rel.Link, rel.Info)
+	}
+	relData, _ := rel.Data()
+	relocs := make([]uint32, len(relData)/4)
+	binary.Read(bytes.NewReader(relData), binary.LittleEndian, relocs)
+	wantRelocs := []uint32{
+		8, 8<<8 | R_ARM_CALL,
+		16, 2<<8 | R_ARM_ABS32,
+	}
+	if !reflect.DeepEqual(relocs, wantRelocs) {
+		t.Errorf("relocations %v, want %v", relocs, wantRelocs)
+	}
+}
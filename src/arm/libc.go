@@ -0,0 +1,413 @@
+package arm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The functions of the C library and the ARM run-time ABI which generated code
+// calls. They take their arguments and return their results as the procedure
+// call standard says: in r0-r3, and then on the stack.
+var libc = map[string]func(m *machine){
+	"wprintf":   (*machine).wprintf,
+	"wscanf":    (*machine).wscanf,
+	"putwchar":  (*machine).putwchar,
+	"fflush":    (*machine).fflush,
+	"setlocale": (*machine).setlocale,
+	"malloc":    (*machine).malloc,
+	"free":      (*machine).free,
+	"exit":      (*machine).exit,
+
+	"__aeabi_idiv": (*machine).idiv,
+	"__aeabi_fadd": floatOperation(func(a, b float32) float32 { return a + b }),
+	"__aeabi_fsub": floatOperation(func(a, b float32) float32 { return a - b }),
+	"__aeabi_fmul": floatOperation(func(a, b float32) float32 { return a * b }),
+	"__aeabi_fdiv": floatOperation(func(a, b float32) float32 { return a / b }),
+	"__aeabi_f2d":  (*machine).f2d,
+}
+
+// The arguments of a variadic function
+type varargs struct {
+	m    *machine
+	next uint32
+}
+
+func (a *varargs) word() uint32 {
+	n := a.next
+	a.next++
+	if n < 4 {
+		return a.m.r[n]
+	}
+	return a.m.load32(a.m.r[13] + 4*(n-4))
+}
+
+// Doubles are passed in an even numbered register, or aligned to 8 bytes on
+// the stack
+func (a *varargs) double() float64 {
+	a.next += a.next & 1
+	lo := uint64(a.word())
+	hi := uint64(a.word())
+	return math.Float64frombits(hi<<32 | lo)
+}
+
+// wideString reads a string of wchar_t, stopping at a null character or after
+// limit characters if limit isn't negative
+func (m *machine) wideString(address uint32, limit int) []rune {
+	s := []rune{}
+	for ; limit < 0 || len(s) < limit; address += 4 {
+		c := m.load32(address)
+		if c == 0 {
+			break
+		}
+		s = append(s, rune(c))
+	}
+	return s
+}
+
+// narrowString reads a null-terminated multibyte string, in UTF-8
+func (m *machine) narrowString(address uint32) []rune {
+	b := []byte{}
+	for ; ; address++ {
+		c := m.load8(address)
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	return []rune(string(b))
+}
+
+//
+// Output
+//
+func (m *machine) wprintf() {
+	format := m.wideString(m.r[0], -1)
+	args := &varargs{m: m, next: 1}
+
+	out := []rune{}
+	for k := 0; k < len(format); k++ {
+		if format[k] != '%' {
+			out = append(out, format[k])
+			continue
+		}
+
+		// A conversion is %[flags][width][.precision][length]verb
+		k++
+		flags := ""
+		for k < len(format) && strings.ContainsRune("-+ #0", format[k]) {
+			flags += string(format[k])
+			k++
+		}
+		width := ""
+		if k < len(format) && format[k] == '*' {
+			width = strconv.Itoa(int(int32(args.word())))
+			k++
+		}
+		for k < len(format) && format[k] >= '0' && format[k] <= '9' {
+			width += string(format[k])
+			k++
+		}
+		precision := -1
+		if k < len(format) && format[k] == '.' {
+			k++
+			precision = 0
+			if k < len(format) && format[k] == '*' {
+				precision = int(int32(args.word()))
+				k++
+			}
+			for k < len(format) && format[k] >= '0' && format[k] <= '9' {
+				precision = precision*10 + int(format[k]-'0')
+				k++
+			}
+		}
+		long := false
+		for k < len(format) && strings.ContainsRune("hlLqjzt", format[k]) {
+			long = long || format[k] == 'l'
+			k++
+		}
+		if k == len(format) {
+			break
+		}
+
+		spec := "%" + flags + width
+		if precision >= 0 {
+			spec += "." + strconv.Itoa(precision)
+		}
+		pad := "%" + flags + width + "s"
+
+		var s string
+		switch verb := format[k]; verb {
+		case 'd', 'i':
+			s = fmt.Sprintf(spec+"d", int32(args.word()))
+
+		case 'u':
+			s = fmt.Sprintf(spec+"d", args.word())
+
+		case 'x', 'X', 'o':
+			s = fmt.Sprintf(spec+string(verb), args.word())
+
+		case 'f', 'F', 'e', 'E', 'g', 'G':
+			f := args.double()
+			switch {
+			case math.IsNaN(f):
+				s = fmt.Sprintf(pad, "nan")
+			case math.IsInf(f, 1):
+				s = fmt.Sprintf(pad, "inf")
+			case math.IsInf(f, -1):
+				s = fmt.Sprintf(pad, "-inf")
+			default:
+				if precision < 0 && verb != 'g' && verb != 'G' {
+					spec += ".6"
+				}
+				s = fmt.Sprintf(spec+string(unicode.ToLower(verb)), f)
+			}
+
+		case 'c':
+			s = fmt.Sprintf(pad, string(rune(args.word())))
+
+		case 's':
+			var str []rune
+			if long {
+				str = m.wideString(args.word(), precision)
+			} else {
+				str = m.narrowString(args.word())
+				if precision >= 0 && precision < len(str) {
+					str = str[:precision]
+				}
+			}
+			s = fmt.Sprintf(pad, string(str))
+
+		case 'p':
+			if p := args.word(); p == 0 {
+				s = fmt.Sprintf(pad, "(nil)")
+			} else {
+				s = fmt.Sprintf(pad, fmt.Sprintf("0x%x", p))
+			}
+
+		case '%':
+			s = "%"
+
+		default:
+			m.errorf("wprintf conversion %%%c isn't simulated", verb)
+		}
+		out = append(out, []rune(s)...)
+	}
+
+	m.stdout.WriteString(string(out))
+	m.r[0] = uint32(len(out))
+}
+
+func (m *machine) putwchar() {
+	m.stdout.WriteRune(rune(m.r[0]))
+}
+
+func (m *machine) fflush() {
+	m.stdout.Flush()
+	m.r[0] = 0
+}
+
+// setlocale always succeeds, returning the name it was given
+func (m *machine) setlocale() {
+	m.r[0] = m.r[1]
+}
+
+//
+// Input, parsed as wscanf parses it
+//
+func (m *machine) skipSpace() {
+	for {
+		r, _, err := m.stdin.ReadRune()
+		if err != nil {
+			return
+		}
+		if !unicode.IsSpace(r) {
+			m.stdin.UnreadRune()
+			return
+		}
+	}
+}
+
+// scanInt reads a decimal integer, clamped to the range of an int as strtol
+// clamps it
+func (m *machine) scanInt() (int32, bool) {
+	digits := ""
+	if r, _, err := m.stdin.ReadRune(); err == nil {
+		if r == '-' || r == '+' || (r >= '0' && r <= '9') {
+			digits += string(r)
+		} else {
+			m.stdin.UnreadRune()
+		}
+	}
+	for {
+		r, _, err := m.stdin.ReadRune()
+		if err != nil {
+			break
+		}
+		if r < '0' || r > '9' {
+			m.stdin.UnreadRune()
+			break
+		}
+		digits += string(r)
+	}
+
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		if numErr, ok := err.(*strconv.NumError); !ok || numErr.Err != strconv.ErrRange {
+			return 0, false
+		}
+	}
+	if n > math.MaxInt32 {
+		return math.MaxInt32, true
+	}
+	if n < math.MinInt32 {
+		return math.MinInt32, true
+	}
+	return int32(n), true
+}
+
+func (m *machine) wscanf() {
+	format := m.wideString(m.r[0], -1)
+	args := &varargs{m: m, next: 1}
+
+	// The result is the number of values assigned, or -1 if the input ended
+	// before the first one
+	assigned := uint32(0)
+	m.r[0] = ^uint32(0)
+	if _, _, err := m.stdin.ReadRune(); err == nil {
+		m.stdin.UnreadRune()
+		m.r[0] = 0
+	}
+
+	for k := 0; k < len(format); k++ {
+		c := format[k]
+		if unicode.IsSpace(c) {
+			m.skipSpace()
+			continue
+		}
+		if c != '%' || (k+1 < len(format) && format[k+1] == '%') {
+			if c == '%' {
+				k++
+			}
+			r, _, err := m.stdin.ReadRune()
+			if err != nil {
+				return
+			}
+			if r != c {
+				m.stdin.UnreadRune()
+				return
+			}
+			continue
+		}
+
+		k++
+		for k < len(format) && strings.ContainsRune("hlLqjzt", format[k]) {
+			k++
+		}
+		if k == len(format) {
+			break
+		}
+
+		switch format[k] {
+		case 'd':
+			m.skipSpace()
+			n, ok := m.scanInt()
+			if !ok {
+				return
+			}
+			m.store32(args.word(), uint32(n))
+
+		case 'c':
+			r, _, err := m.stdin.ReadRune()
+			if err != nil {
+				return
+			}
+			m.store32(args.word(), uint32(r))
+
+		default:
+			m.errorf("wscanf conversion %%%c isn't simulated", format[k])
+		}
+		assigned++
+		m.r[0] = assigned
+	}
+}
+
+//
+// Memory allocation. Blocks are preceded by their size, and freed blocks are
+// kept in a list threaded through their first word.
+//
+func (m *machine) malloc() {
+	size := (m.r[0] + 7) &^ 7
+	if size == 0 {
+		size = 8
+	}
+
+	// Reuse the first freed block which is big enough
+	link := uint32(0)
+	for block := m.freeList; block != 0; block = m.load32(block) {
+		if m.load32(block-4) >= size {
+			if link == 0 {
+				m.freeList = m.load32(block)
+			} else {
+				m.store32(link, m.load32(block))
+			}
+			m.r[0] = block
+			return
+		}
+		link = block
+	}
+
+	if uint64(m.heapEnd)+8+uint64(size) > MemorySize-StackSize {
+		m.r[0] = 0
+		return
+	}
+	block := m.heapEnd + 8
+	m.heapEnd = block + size
+	m.store32(block-4, size)
+	m.r[0] = block
+}
+
+func (m *machine) free() {
+	if m.r[0] == 0 {
+		return
+	}
+	m.store32(m.r[0], m.freeList)
+	m.freeList = m.r[0]
+}
+
+func (m *machine) exit() {
+	m.stdout.Flush()
+	panic(exitStatus{int(uint8(m.r[0]))})
+}
+
+//
+// Helpers from the run-time ABI
+//
+
+// As in libgcc, division by zero gives zero, and dividing the smallest integer
+// by -1 gives itself
+func (m *machine) idiv() {
+	a, b := int32(m.r[0]), int32(m.r[1])
+	switch b {
+	case 0:
+		m.r[0] = 0
+	case -1:
+		m.r[0] = uint32(-a)
+	default:
+		m.r[0] = uint32(a / b)
+	}
+}
+
+func floatOperation(op func(a, b float32) float32) func(m *machine) {
+	return func(m *machine) {
+		a, b := math.Float32frombits(m.r[0]), math.Float32frombits(m.r[1])
+		m.r[0] = math.Float32bits(op(a, b))
+	}
+}
+
+func (m *machine) f2d() {
+	d := math.Float64bits(float64(math.Float32frombits(m.r[0])))
+	m.r[0], m.r[1] = uint32(d), uint32(d>>32)
+}
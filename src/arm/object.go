@@ -0,0 +1,113 @@
+// Package arm assembles the ARM code produced by the backend into relocatable
+// objects, and writes them as ELF files which can be linked by any ARM Linux
+// linker. Only the subset of the instruction set and directives the code
+// generator uses is supported.
+package arm
+
+// Relocation types, from the ELF for the ARM Architecture specification
+const (
+	R_ARM_ABS32  = 2
+	R_ARM_CALL   = 28
+	R_ARM_JUMP24 = 29
+)
+
+// A reference to a symbol, to be filled in by the linker. ARM objects use REL
+// relocations, so the addend is stored in the field being relocated.
+type Reloc struct {
+	Offset uint32
+	Type   int
+	Symbol *Symbol
+}
+
+type Section struct {
+	Name   string
+	Data   []byte
+	Relocs []Reloc
+
+	// Symbol standing for the start of the section, which relocations
+	// against local labels refer to
+	Symbol *Symbol
+
+	// Offsets at which the contents switch between code and data, marked
+	// with the $a and $d mapping symbols
+	Mapping []Mapping
+}
+
+type Mapping struct {
+	Offset uint32
+	Code   bool
+}
+
+type Symbol struct {
+	Name string
+
+	// Section the symbol is defined in, or nil if it is undefined
+	Section *Section
+	Value   uint32
+
+	Global    bool
+	IsSection bool
+}
+
+type Object struct {
+	Text *Section
+	Data *Section
+
+	// Labels in the order they are defined, followed by undefined symbols
+	// in the order they are referenced
+	Symbols []*Symbol
+}
+
+func (o *Object) Sections() []*Section {
+	return []*Section{o.Text, o.Data}
+}
+
+// Lookup finds a symbol by name
+func (o *Object) Lookup(name string) (*Symbol, bool) {
+	for _, s := range o.Symbols {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+func newSection(name string) *Section {
+	s := &Section{Name: name}
+	s.Symbol = &Symbol{Name: name, Section: s, IsSection: true}
+	return s
+}
+
+func (s *Section) size() uint32 {
+	return uint32(len(s.Data))
+}
+
+func (s *Section) word(offset uint32) uint32 {
+	d := s.Data[offset:]
+	return uint32(d[0]) | uint32(d[1])<<8 | uint32(d[2])<<16 | uint32(d[3])<<24
+}
+
+func (s *Section) setWord(offset uint32, w uint32) {
+	d := s.Data[offset:]
+	d[0], d[1], d[2], d[3] = byte(w), byte(w>>8), byte(w>>16), byte(w>>24)
+}
+
+func (s *Section) appendWord(w uint32) uint32 {
+	offset := s.size()
+	s.Data = append(s.Data, byte(w), byte(w>>8), byte(w>>16), byte(w>>24))
+	return offset
+}
+
+// mark records a switch between code and data at the current offset
+func (s *Section) mark(code bool) {
+	n := len(s.Mapping)
+	if n > 0 && s.Mapping[n-1].Code == code {
+		return
+	}
+	if n > 0 && s.Mapping[n-1].Offset == s.size() {
+		s.Mapping = s.Mapping[:n-1]
+		s.mark(code)
+		return
+	}
+	s.Mapping = append(s.Mapping, Mapping{s.size(), code})
+}
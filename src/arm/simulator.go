@@ -0,0 +1,614 @@
+package arm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Layout of the simulated address space. The stubs for library functions
+// live in the first page, which is never mapped, so that calling them can be
+// told apart from running code. The stack grows down from the top of memory,
+// and the heap up from the end of the data section.
+const (
+	MemorySize = 1 << 25
+	StackSize  = 1 << 23
+
+	stubBase = 0x1000
+	textBase = 0x10000
+
+	// Address main returns to, which exits with its result
+	returnAddress = stubBase - 4
+)
+
+// Used to unwind the simulator when the program terminates
+type exitStatus struct {
+	code int
+}
+
+// A library function, simulated in Go. Functions which aren't implemented
+// have a nil call, and stop the program if they are ever called.
+type stub struct {
+	name string
+	call func(m *machine)
+}
+
+type machine struct {
+	// Registers, with r15 holding the address of the instruction being run,
+	// and the condition flags
+	r          [16]uint32
+	n, z, c, v bool
+
+	// Set when the current instruction writes the pc
+	branched bool
+
+	memory []byte
+	stubs  map[uint32]stub
+
+	// Bounds of the heap, and the blocks freed on it
+	heapStart, heapEnd uint32
+	freeList           uint32
+
+	stdin  *bufio.Reader
+	stdout *bufio.Writer
+}
+
+// RunAssembly assembles the output of the ARM code generator and runs it
+func RunAssembly(src string, stdin io.Reader, stdout io.Writer) (int, error) {
+	obj, err := Assemble(src)
+	if err != nil {
+		return 0, err
+	}
+	return Run(obj, stdin, stdout)
+}
+
+// Run links an object in memory against a simulated C library, and executes
+// it from main. It returns the program's exit code. An error is only returned
+// if the program does something the simulator can't, such as running an
+// unsupported instruction, calling a library function which isn't simulated
+// or accessing memory outside of its sections, heap and stack.
+func Run(obj *Object, stdin io.Reader, stdout io.Writer) (code int, err error) {
+	m := &machine{
+		memory: make([]byte, MemorySize),
+		stubs:  make(map[uint32]stub),
+		stdin:  bufio.NewReader(stdin),
+		stdout: bufio.NewWriter(stdout),
+	}
+
+	defer func() {
+		m.stdout.Flush()
+		if r := recover(); r != nil {
+			switch r := r.(type) {
+			case exitStatus:
+				code = r.code
+			case error:
+				code, err = 0, r
+			default:
+				panic(r)
+			}
+		}
+	}()
+
+	m.r[15] = m.load(obj)
+	m.r[13] = MemorySize
+	m.r[14] = returnAddress
+	m.stubs[returnAddress] = stub{"main", func(m *machine) {
+		panic(exitStatus{int(uint8(m.r[0]))})
+	}}
+	m.run()
+	return 0, nil
+}
+
+func (m *machine) errorf(format string, args ...interface{}) {
+	panic(fmt.Errorf("arm: "+format+" (pc 0x%x)", append(args, m.r[15])...))
+}
+
+//
+// Linking
+//
+
+// load places the sections of the object in memory, applies its relocations
+// and returns the address of main
+func (m *machine) load(obj *Object) uint32 {
+	bases := make(map[*Section]uint32)
+	address := uint32(textBase)
+	for _, s := range obj.Sections() {
+		bases[s] = address
+		copy(m.memory[address:], s.Data)
+		address = (address + s.size() + 15) &^ 15
+	}
+	m.heapStart, m.heapEnd = address, address
+
+	// Undefined symbols are resolved to stubs, whether or not they are
+	// simulated
+	stubs := make(map[*Symbol]uint32)
+	resolve := func(s *Symbol) uint32 {
+		if s.Section != nil {
+			return bases[s.Section] + s.Value
+		}
+		if a, ok := stubs[s]; ok {
+			return a
+		}
+		a := stubBase + 4*uint32(len(stubs))
+		if a >= textBase {
+			panic(fmt.Errorf("arm: too many undefined symbols"))
+		}
+		stubs[s] = a
+		m.stubs[a] = stub{s.Name, libc[s.Name]}
+		return a
+	}
+
+	for _, s := range obj.Sections() {
+		for _, r := range s.Relocs {
+			place := bases[s] + r.Offset
+			target := resolve(r.Symbol)
+			word := m.load32(place)
+			switch r.Type {
+			case R_ARM_ABS32:
+				m.store32(place, word+target)
+
+			case R_ARM_CALL, R_ARM_JUMP24:
+				addend := uint32(int32(word<<8) >> 6)
+				offset := int32(target + addend - place)
+				if offset < -1<<25 || offset >= 1<<25 {
+					panic(fmt.Errorf("arm: branch to %s out of range", r.Symbol.Name))
+				}
+				m.store32(place, word&0xff000000|uint32(offset>>2)&0xffffff)
+
+			default:
+				panic(fmt.Errorf("arm: unsupported relocation type %d", r.Type))
+			}
+		}
+	}
+
+	main, ok := obj.Lookup("main")
+	if !ok || main.Section != obj.Text {
+		panic(fmt.Errorf("arm: no main function"))
+	}
+	return resolve(main)
+}
+
+//
+// Memory
+//
+func (m *machine) check(address, size uint32) {
+	end := uint64(address) + uint64(size)
+	heap := address >= textBase && end <= uint64(m.heapEnd)
+	stack := address >= MemorySize-StackSize && end <= MemorySize
+	if !heap && !stack {
+		m.errorf("invalid memory access at 0x%x", address)
+	}
+}
+
+// Words can be accessed at any alignment, as on ARMv6
+func (m *machine) load32(address uint32) uint32 {
+	m.check(address, 4)
+	b := m.memory[address:]
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
+
+func (m *machine) store32(address, w uint32) {
+	m.check(address, 4)
+	b := m.memory[address:]
+	b[0], b[1], b[2], b[3] = byte(w), byte(w>>8), byte(w>>16), byte(w>>24)
+}
+
+func (m *machine) load8(address uint32) uint32 {
+	m.check(address, 1)
+	return uint32(m.memory[address])
+}
+
+func (m *machine) store8(address, b uint32) {
+	m.check(address, 1)
+	m.memory[address] = byte(b)
+}
+
+//
+// Execution
+//
+func (m *machine) run() {
+	for {
+		pc := m.r[15]
+		if pc < textBase {
+			s, ok := m.stubs[pc]
+			if !ok {
+				m.errorf("jump to unmapped address")
+			}
+			if s.call == nil {
+				m.errorf("call to %s, which isn't simulated", s.name)
+			}
+			s.call(m)
+			m.r[15] = m.r[14]
+			continue
+		}
+
+		i := m.load32(pc)
+		m.branched = false
+		if m.condition(i >> 28) {
+			m.execute(i)
+		}
+		if !m.branched {
+			m.r[15] = pc + 4
+		}
+	}
+}
+
+// reg reads a register, where the pc reads as the address of the current
+// instruction plus 8
+func (m *machine) reg(n uint32) uint32 {
+	if n == 15 {
+		return m.r[15] + 8
+	}
+	return m.r[n]
+}
+
+// setReg writes a register, where writing the pc branches
+func (m *machine) setReg(n uint32, value uint32) {
+	if n == 15 {
+		if value&3 != 0 {
+			m.errorf("branch to Thumb code at 0x%x", value)
+		}
+		m.r[15] = value
+		m.branched = true
+		return
+	}
+	m.r[n] = value
+}
+
+func (m *machine) condition(cond uint32) bool {
+	switch cond {
+	case 0x0:
+		return m.z
+	case 0x1:
+		return !m.z
+	case 0x2:
+		return m.c
+	case 0x3:
+		return !m.c
+	case 0x4:
+		return m.n
+	case 0x5:
+		return !m.n
+	case 0x6:
+		return m.v
+	case 0x7:
+		return !m.v
+	case 0x8:
+		return m.c && !m.z
+	case 0x9:
+		return !m.c || m.z
+	case 0xa:
+		return m.n == m.v
+	case 0xb:
+		return m.n != m.v
+	case 0xc:
+		return !m.z && m.n == m.v
+	case 0xd:
+		return m.z || m.n != m.v
+	case 0xe:
+		return true
+	}
+	m.errorf("unsupported instruction 0x%08x", m.load32(m.r[15]))
+	return false
+}
+
+func (m *machine) execute(i uint32) {
+	switch {
+	case i&0x0fc000f0 == 0x00000090:
+		m.multiply(i)
+
+	case i&0x0f8000f0 == 0x00800090:
+		m.multiplyLong(i)
+
+	case i&0x0ffffff0 == 0x012fff10: // bx
+		m.setReg(15, m.reg(i&0xf))
+
+	case i&0x0e000090 == 0x00000090:
+		m.errorf("unsupported instruction 0x%08x", i)
+
+	case i&0x0c000000 == 0x00000000:
+		// The comparisons without the S bit set encode other instructions
+		if i&0x01900000 == 0x01000000 {
+			m.errorf("unsupported instruction 0x%08x", i)
+		}
+		m.dataProcessing(i)
+
+	case i&0x0c000000 == 0x04000000:
+		if i&0x02000010 == 0x02000010 {
+			m.errorf("unsupported instruction 0x%08x", i)
+		}
+		m.loadStore(i)
+
+	case i&0x0e000000 == 0x08000000:
+		m.loadStoreMultiple(i)
+
+	case i&0x0e000000 == 0x0a000000:
+		if i&0x01000000 != 0 {
+			m.r[14] = m.r[15] + 4
+		}
+		m.setReg(15, m.reg(15)+uint32(int32(i<<8)>>6))
+
+	default:
+		m.errorf("unsupported instruction 0x%08x", i)
+	}
+}
+
+func (m *machine) setNZ(result uint32) {
+	m.n = result>>31 == 1
+	m.z = result == 0
+}
+
+// addWithCarry adds two words and a carry, returning the result and the carry
+// and overflow flags
+func addWithCarry(x, y uint32, carry bool) (uint32, bool, bool) {
+	sum := uint64(x) + uint64(y)
+	if carry {
+		sum++
+	}
+	result := uint32(sum)
+	return result, sum>>32 != 0, (x^result)&(y^result)>>31 == 1
+}
+
+// shift applies one of the barrel shifter's operations, returning the result
+// and the carry out. Shifts by an immediate encode a shift by 32 (and rrx) as
+// a shift by 0.
+func (m *machine) shift(value, kind, amount uint32, immediate bool) (uint32, bool) {
+	if immediate && amount == 0 {
+		switch kind {
+		case 1, 2:
+			amount = 32
+		case 3:
+			carry := m.c
+			result := value >> 1
+			if carry {
+				result |= 1 << 31
+			}
+			return result, value&1 == 1
+		}
+	}
+	if amount == 0 {
+		return value, m.c
+	}
+
+	switch kind {
+	case 0: // lsl
+		if amount > 32 {
+			return 0, false
+		}
+		return value << amount, value>>(32-amount)&1 == 1
+
+	case 1: // lsr
+		if amount > 32 {
+			return 0, false
+		}
+		return value >> amount, value>>(amount-1)&1 == 1
+
+	case 2: // asr
+		if amount >= 32 {
+			amount = 32
+			sign := uint32(int32(value) >> 31)
+			return sign, sign&1 == 1
+		}
+		return uint32(int32(value) >> amount), value>>(amount-1)&1 == 1
+
+	default: // ror
+		amount &= 31
+		if amount == 0 {
+			return value, value>>31 == 1
+		}
+		result := value>>amount | value<<(32-amount)
+		return result, result>>31 == 1
+	}
+}
+
+// operand2 decodes the second operand of a data processing instruction,
+// returning it with the shifter's carry out
+func (m *machine) operand2(i uint32) (uint32, bool) {
+	if i&(1<<25) != 0 {
+		rotate := (i >> 8 & 0xf) * 2
+		imm := i & 0xff
+		result := imm>>rotate | imm<<(32-rotate)
+		if rotate == 0 {
+			return result, m.c
+		}
+		return result, result>>31 == 1
+	}
+
+	rm := m.reg(i & 0xf)
+	kind := i >> 5 & 3
+	if i&(1<<4) == 0 {
+		return m.shift(rm, kind, i>>7&0x1f, true)
+	}
+	return m.shift(rm, kind, m.reg(i>>8&0xf)&0xff, false)
+}
+
+func (m *machine) dataProcessing(i uint32) {
+	opcode := i >> 21 & 0xf
+	setFlags := i&(1<<20) != 0
+	rn := m.reg(i >> 16 & 0xf)
+	rd := i >> 12 & 0xf
+	op2, shifterCarry := m.operand2(i)
+
+	var result uint32
+	carry, overflow := m.c, m.v
+	logical := false
+	switch opcode {
+	case 0x0, 0x8: // and, tst
+		result, logical = rn&op2, true
+	case 0x1, 0x9: // eor, teq
+		result, logical = rn^op2, true
+	case 0x2, 0xa: // sub, cmp
+		result, carry, overflow = addWithCarry(rn, ^op2, true)
+	case 0x3: // rsb
+		result, carry, overflow = addWithCarry(op2, ^rn, true)
+	case 0x4, 0xb: // add, cmn
+		result, carry, overflow = addWithCarry(rn, op2, false)
+	case 0x5: // adc
+		result, carry, overflow = addWithCarry(rn, op2, m.c)
+	case 0x6: // sbc
+		result, carry, overflow = addWithCarry(rn, ^op2, m.c)
+	case 0x7: // rsc
+		result, carry, overflow = addWithCarry(op2, ^rn, m.c)
+	case 0xc: // orr
+		result, logical = rn|op2, true
+	case 0xd: // mov
+		result, logical = op2, true
+	case 0xe: // bic
+		result, logical = rn&^op2, true
+	case 0xf: // mvn
+		result, logical = ^op2, true
+	}
+	if logical {
+		carry = shifterCarry
+	}
+
+	if setFlags {
+		if rd == 15 && (opcode < 0x8 || opcode > 0xb) {
+			m.errorf("unsupported instruction 0x%08x", i)
+		}
+		m.setNZ(result)
+		m.c, m.v = carry, overflow
+	}
+	if opcode < 0x8 || opcode > 0xb {
+		m.setReg(rd, result)
+	}
+}
+
+func (m *machine) multiply(i uint32) {
+	result := m.reg(i&0xf) * m.reg(i>>8&0xf)
+	if i&(1<<21) != 0 {
+		result += m.reg(i >> 12 & 0xf)
+	}
+	if i&(1<<20) != 0 {
+		m.setNZ(result)
+	}
+	m.setReg(i>>16&0xf, result)
+}
+
+func (m *machine) multiplyLong(i uint32) {
+	rm, rs := m.reg(i&0xf), m.reg(i>>8&0xf)
+	hi, lo := i>>16&0xf, i>>12&0xf
+
+	var result uint64
+	if i&(1<<22) != 0 {
+		result = uint64(int64(int32(rm)) * int64(int32(rs)))
+	} else {
+		result = uint64(rm) * uint64(rs)
+	}
+	if i&(1<<21) != 0 {
+		result += uint64(m.reg(hi))<<32 | uint64(m.reg(lo))
+	}
+	if i&(1<<20) != 0 {
+		m.n = result>>63 == 1
+		m.z = result == 0
+	}
+	m.setReg(lo, uint32(result))
+	m.setReg(hi, uint32(result>>32))
+}
+
+func (m *machine) loadStore(i uint32) {
+	pre := i&(1<<24) != 0
+	up := i&(1<<23) != 0
+	byteSized := i&(1<<22) != 0
+	writeBack := i&(1<<21) != 0 || !pre
+	load := i&(1<<20) != 0
+	rn, rd := i>>16&0xf, i>>12&0xf
+
+	offset := i & 0xfff
+	if i&(1<<25) != 0 {
+		offset, _ = m.shift(m.reg(i&0xf), i>>5&3, i>>7&0x1f, true)
+	}
+
+	base := m.reg(rn)
+	moved := base + offset
+	if !up {
+		moved = base - offset
+	}
+	address := base
+	if pre {
+		address = moved
+	}
+
+	if load {
+		var value uint32
+		if byteSized {
+			value = m.load8(address)
+		} else {
+			value = m.load32(address)
+		}
+		if writeBack {
+			m.setReg(rn, moved)
+		}
+		m.setReg(rd, value)
+		return
+	}
+
+	value := m.reg(rd)
+	if byteSized {
+		m.store8(address, value)
+	} else {
+		m.store32(address, value)
+	}
+	if writeBack {
+		m.setReg(rn, moved)
+	}
+}
+
+func (m *machine) loadStoreMultiple(i uint32) {
+	if i&(1<<22) != 0 {
+		m.errorf("unsupported instruction 0x%08x", i)
+	}
+	pre := i&(1<<24) != 0
+	up := i&(1<<23) != 0
+	writeBack := i&(1<<21) != 0
+	load := i&(1<<20) != 0
+	rn := i >> 16 & 0xf
+	list := i & 0xffff
+
+	count := uint32(0)
+	for r := uint32(0); r < 16; r++ {
+		count += list >> r & 1
+	}
+	if count == 0 {
+		m.errorf("unsupported instruction 0x%08x", i)
+	}
+
+	// The registers are always transferred in order, from the lowest address
+	base := m.reg(rn)
+	address := base
+	switch {
+	case pre && up:
+		address += 4
+	case pre && !up:
+		address -= 4 * count
+	case !pre && !up:
+		address -= 4*count - 4
+	}
+	end := base + 4*count
+	if !up {
+		end = base - 4*count
+	}
+
+	if !load {
+		for r := uint32(0); r < 16; r++ {
+			if list>>r&1 == 1 {
+				m.store32(address, m.reg(r))
+				address += 4
+			}
+		}
+		if writeBack {
+			m.setReg(rn, end)
+		}
+		return
+	}
+
+	if writeBack {
+		m.setReg(rn, end)
+	}
+	for r := uint32(0); r < 16; r++ {
+		if list>>r&1 == 1 {
+			m.setReg(r, m.load32(address))
+			address += 4
+		}
+	}
+}
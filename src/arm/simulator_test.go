@@ -0,0 +1,101 @@
+package arm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// wide is a directive placing a null-terminated wide string in memory, as
+// the code generator does for format strings
+func wide(s string) string {
+	words := []string{}
+	for _, r := range s + "\x00" {
+		words = append(words, fmt.Sprint(int(r)))
+	}
+	return "\t.word " + strings.Join(words, ", ")
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		source []string
+		stdin  string
+		stdout string
+		code   int
+
+		// Part of the error, or empty if there shouldn't be one
+		err string
+	}{
+		{
+			"return from main",
+			[]string{"main:", "\tmov r0, #300", "\tmov pc, lr"},
+			"", "", 300 % 256, "",
+		},
+		{
+			"exit",
+			[]string{"main:", "\tpush {lr}", "\tmov r0, #3", "\tbl exit", "\tpop {pc}"},
+			"", "", 3, "",
+		},
+		{
+			"wprintf",
+			[]string{
+				".data", "fmt:", wide("%d %lc\n"),
+				".text", "main:", "\tpush {lr}",
+				"\tldr r0, =fmt", "\tldr r1, =-12", "\tmov r2, #65", "\tbl wprintf",
+				"\tmov r0, #0", "\tpop {pc}", "\t.ltorg",
+			},
+			"", "-12 A\n", 0, "",
+		},
+		{
+			"wscanf",
+			[]string{
+				".data", "fmt:", wide(" %d"),
+				".text", "main:", "\tpush {lr}", "\tsub sp, sp, #4",
+				"\tldr r0, =fmt", "\tmov r1, sp", "\tbl wscanf",
+				"\tldr r0, [sp]", "\tadd r0, r0, r0", "\tadd r0, r0, #48", "\tbl putwchar",
+				"\tadd sp, sp, #4", "\tmov r0, #0", "\tpop {pc}", "\t.ltorg",
+			},
+			"3\n", "6", 0, "",
+		},
+		{
+			"flags",
+			[]string{
+				"main:", "\tldr r0, =2147483647", "\tadds r0, r0, #1",
+				"\tmovvs r0, #1", "\tmovvc r0, #2", "\tmov pc, lr", "\t.ltorg",
+			},
+			"", "", 1, "",
+		},
+		{
+			"division",
+			[]string{"main:", "\tpush {lr}", "\tmov r0, #-7", "\tmov r1, #2", "\tbl __aeabi_idiv", "\trsb r0, r0, #0", "\tpop {pc}"},
+			"", "", 3, "",
+		},
+		{
+			"missing library function",
+			[]string{"main:", "\tpush {lr}", "\tbl fopen", "\tpop {pc}"},
+			"", "", 0, "fopen",
+		},
+		{
+			"memory out of range",
+			[]string{"main:", "\tmov r0, #0", "\tldr r0, [r0]", "\tmov pc, lr"},
+			"", "", 0, "arm:",
+		},
+	}
+	for _, test := range tests {
+		var stdout bytes.Buffer
+		source := ".text\n.global main\n" + strings.Join(test.source, "\n") + "\n"
+		code, err := RunAssembly(source, strings.NewReader(test.stdin), &stdout)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%v: unexpected error %v", test.name, err)
+		case test.err != "" && err == nil:
+			t.Errorf("%v: no error, want %q", test.name, test.err)
+		case test.err != "" && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%v: got error %q, want %q", test.name, err, test.err)
+		case code != test.code || stdout.String() != test.stdout:
+			t.Errorf("%v: exited with %v and printed %q, want %v and %q", test.name, code, stdout.String(), test.code, test.stdout)
+		}
+	}
+}
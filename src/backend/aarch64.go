@@ -0,0 +1,665 @@
+package backend
+
+import (
+	"fmt"
+	"math"
+
+	"../frontend"
+)
+
+// Code generation for AArch64 Linux, from the same register allocated IF as
+// the ARM generator.
+//
+// WACC values stay 32 bits wide, so everything is computed in the w registers
+// and overflow is detected exactly as for 32-bit ARM: adds, subs and negs set
+// the V flag, and multiplications are checked by comparing the 64-bit product
+// against its low word sign extended. Writing a w register clears the top half
+// of the x register, so 32-bit pointers can be used as addresses directly. As
+// on x86-64, programs must be linked with -no-pie, and the runtime stops
+// malloc from using mmap, which keeps every address below 4GB.
+//
+// The registers of the IF map onto AArch64 registers as follows. r0-r3 are
+// the first four argument registers, so calls into WACC functions follow the
+// AAPCS64 for up to four arguments, and results come back in r0. r4-r11 are
+// callee-saved registers, so they survive calls into C without any help.
+// x9-x11 are scratch registers and x29 is the frame pointer. The stack pointer
+// has to stay 16-byte aligned, so every push takes 16 bytes and scopes are
+// rounded up to a multiple of 16.
+var aarch64Registers = [...]int{0, 1, 2, 3, 19, 20, 21, 22, 23, 24, 25, 26}
+
+// Registers saved in the prologue of every function, in pairs, in the order
+// they are pushed. Stack arguments start just above them.
+var aarch64SavedRegisters = [][2]string{
+	{"x29", "x30"},
+	{"x19", "x20"},
+	{"x21", "x22"},
+	{"x23", "x24"},
+	{"x25", "x26"},
+}
+
+// Largest immediate accepted by add and sub
+const aarch64MaxImmediate = 4095
+
+type aarch64GeneratorContext struct {
+	target Target
+	data   string
+	text   string
+
+	// Stack reserved by each scope, innermost last
+	scopeSizes []int
+
+	currentFunction string
+
+	stageErrors
+}
+
+func (ctx *aarch64GeneratorContext) pushLabel(label string) {
+	ctx.text += fmt.Sprintf("%v:\n", label)
+}
+
+func (ctx *aarch64GeneratorContext) pushCode(s string, a ...interface{}) {
+	ctx.text += "\t" + fmt.Sprintf(s, a...) + "\n"
+}
+
+func aarch64Register(r *RegisterExpr) string {
+	return fmt.Sprintf("w%d", aarch64Registers[r.Id])
+}
+
+func aarch64Address(r *RegisterExpr) string {
+	return fmt.Sprintf("x%d", aarch64Registers[r.Id])
+}
+
+// aarch64StackSize rounds the size of a scope up to keep the stack aligned
+func aarch64StackSize(size int) int {
+	return (size + 15) &^ 15
+}
+
+// aarch64Constant returns the 32-bit value of a constant expression
+func aarch64Constant(e Expr) (int64, bool) {
+	switch e := e.(type) {
+	case *IntConstExpr:
+		return int64(e.Value), true
+
+	case *FloatConstExpr:
+		return int64(math.Float32bits(e.Value)), true
+
+	case *BoolConstExpr:
+		if e.Value {
+			return 1, true
+		}
+		return 0, true
+
+	case *CharConstExpr:
+		return int64(e.Value), true
+
+	case *PointerConstExpr:
+		return int64(e.Value), true
+
+	default:
+		return 0, false
+	}
+}
+
+// memory returns the addressing mode for a location in memory, computing its
+// address into x11 if it can't be reached with an offset
+func (ctx *aarch64GeneratorContext) memory(e Expr) string {
+	switch e := e.(type) {
+	case *MemExpr:
+		if e.Offset == 0 {
+			return fmt.Sprintf("[%v]", aarch64Address(e.Address))
+		}
+		return fmt.Sprintf("[%v, #%v]", aarch64Address(e.Address), e.Offset)
+
+	case *StackLocationExpr:
+		// Slots are counted down from the frame pointer, so the first one
+		// ends where the saved registers start
+		offset := ctx.target.WordSize() * (e.Id + 1)
+		if offset > aarch64MaxImmediate {
+			ctx.pushCode("mov x11, #%v", offset)
+			ctx.pushCode("sub x11, x29, x11")
+			return "[x11]"
+		}
+		ctx.pushCode("sub x11, x29, #%v", offset)
+		return "[x11]"
+
+	case *StackArgumentExpr:
+		// Arguments are pushed above the saved registers, the last one lowest
+		offset := 16 * (len(aarch64SavedRegisters) + e.Id)
+		return fmt.Sprintf("[x29, #%v]", offset)
+
+	default:
+		ctx.fail("Unhandled memory operand %T", e)
+		return "[x29]"
+	}
+}
+
+// load moves the value of an expression into a w register
+func (ctx *aarch64GeneratorContext) load(dst string, e Expr) {
+	if n, ok := aarch64Constant(e); ok {
+		ctx.pushCode("ldr %v, =%v", dst, n)
+		return
+	}
+
+	switch e := e.(type) {
+	case *RegisterExpr:
+		if src := aarch64Register(e); src != dst {
+			ctx.pushCode("mov %v, %v", dst, src)
+		}
+
+	case *LocationExpr:
+		x := "x" + dst[1:]
+		ctx.pushCode("adrp %v, %v", x, e.Label)
+		ctx.pushCode("add %v, %v, :lo12:%v", x, x, e.Label)
+
+	case *MemExpr, *StackLocationExpr, *StackArgumentExpr:
+		ctx.pushCode("ldr %v, %v", dst, ctx.memory(e))
+
+	default:
+		ctx.fail("Unhandled operand type %T", e)
+	}
+}
+
+// operand returns a w register holding the value of an expression, loading it
+// into scratch if it isn't in a register already
+func (ctx *aarch64GeneratorContext) operand(e Expr, scratch string) string {
+	if r, ok := e.(*RegisterExpr); ok {
+		return aarch64Register(r)
+	}
+	ctx.load(scratch, e)
+	return scratch
+}
+
+// store moves a w register into the location an expression refers to
+func (ctx *aarch64GeneratorContext) store(src string, e Expr) {
+	switch e := e.(type) {
+	case *RegisterExpr:
+		if dst := aarch64Register(e); dst != src {
+			ctx.pushCode("mov %v, %v", dst, src)
+		}
+
+	case *MemExpr, *StackLocationExpr:
+		ctx.pushCode("str %v, %v", src, ctx.memory(e))
+
+	default:
+		ctx.fail("Unhandled dst type of mov %T", e)
+	}
+}
+
+//
+// Instructions
+//
+func (ctx *aarch64GeneratorContext) generateInstr(instr Instr) {
+	switch i := instr.(type) {
+	case *NoOpInstr, *EvalInstr, *DeclareInstr:
+
+	case *LabelInstr:
+		ctx.pushLabel(i.Label)
+
+	case *ReadInstr:
+		if i.Type.Equals(frontend.BasicType{frontend.CHAR}) {
+			ctx.pushCode("bl _wacc_read_char")
+		} else {
+			ctx.pushCode("bl _wacc_read_int")
+		}
+		ctx.store("w0", i.Dst)
+
+	case *FreeInstr:
+		ctx.load("w0", i.Object)
+		ctx.pushCode("bl " + RuntimeCheckNullPointerLabel)
+		ctx.pushCode("bl free")
+
+	case *ReturnInstr:
+		ctx.load("w0", i.Expr)
+		ctx.pushCode("b _" + ctx.currentFunction + "_end")
+
+	case *ExitInstr:
+		ctx.load("w0", i.Expr)
+		ctx.pushCode("bl exit")
+
+	case *PrintInstr:
+		ctx.generatePrint(i)
+
+	case *MoveInstr:
+		switch i.Dst.(type) {
+		case *MemExpr, *StackLocationExpr:
+			ctx.store(aarch64Register(i.Src.(*RegisterExpr)), i.Dst)
+
+		case *RegisterExpr:
+			ctx.load(aarch64Register(i.Dst.(*RegisterExpr)), i.Src)
+
+		default:
+			ctx.fail("Unhandled dst type of mov %T", i.Dst)
+		}
+
+	case *NotInstr:
+		ctx.pushCode("mvn w9, %v", ctx.operand(i.Src, "w9"))
+		ctx.store("w9", i.Dst)
+
+	case *NegInstr:
+		r := aarch64Register(i.Expr.(*RegisterExpr))
+		ctx.pushCode("negs %v, %v", r, r)
+		ctx.pushCode("b.vs " + RuntimeOverflowLabel)
+
+	case *CmpInstr:
+		cc := map[string]string{EQ: "eq", NE: "ne", LT: "lt", GT: "gt", LE: "le", GE: "ge"}[i.Operator]
+		left := ctx.operand(i.Left, "w9")
+		right := ctx.operand(i.Right, "w10")
+		ctx.pushCode("cmp %v, %v", left, right)
+		ctx.pushCode("cset w9, %v", cc)
+		ctx.store("w9", i.Dst)
+
+	case *JmpInstr:
+		ctx.pushCode("b %v", i.Dst.Instr.(*LabelInstr).Label)
+
+	case *JmpCondInstr:
+		if _, ok := i.Cond.(*RegisterExpr); !ok {
+			ctx.fail("condition is not a register, abort")
+			break
+		}
+		ctx.pushCode("cbnz %v, %v", ctx.operand(i.Cond, "w9"), i.Dst.Instr.(*LabelInstr).Label)
+
+	case *AddInstr:
+		ctx.generateArithmetic("add", i.Dst, i.Op1, i.Op2, i.Op2Shift, i.Type)
+
+	case *SubInstr:
+		ctx.generateArithmetic("sub", i.Dst, i.Op1, i.Op2, i.Op2Shift, i.Type)
+
+	case *MulInstr:
+		ctx.generateArithmetic("mul", i.Dst, i.Op1, i.Op2, nil, i.Type)
+
+	case *DivInstr:
+		if i.Type.Equals(frontend.BasicType{frontend.FLOAT}) {
+			ctx.generateArithmetic("div", i.Dst, i.Op1, i.Op2, nil, i.Type)
+		} else {
+			// sdiv gives the smallest integer when dividing it by -1, as
+			// __aeabi_idiv does, but 0 rather than an error for 0
+			ctx.load("w10", i.Op2)
+			ctx.load("w9", i.Op1)
+			ctx.pushCode("mov w1, w10")
+			ctx.pushCode("bl " + RuntimeCheckDivZeroLabel)
+			ctx.pushCode("sdiv %v, w9, w10", aarch64Register(i.Dst))
+		}
+
+	case *AndInstr:
+		ctx.pushCode("and %v, %v, %v", aarch64Register(i.Dst), aarch64Register(i.Op1), aarch64Register(i.Op2))
+
+	case *OrInstr:
+		ctx.pushCode("orr %v, %v, %v", aarch64Register(i.Dst), aarch64Register(i.Op1), aarch64Register(i.Op2))
+
+	case *PhiInstr:
+		ctx.fail("Phi instructions must be removed before code generation")
+
+	case *PushScopeInstr:
+		ctx.adjustStack("sub", aarch64StackSize(i.StackSize))
+		ctx.scopeSizes = append(ctx.scopeSizes, aarch64StackSize(i.StackSize))
+
+	case *PopScopeInstr:
+		ctx.adjustStack("add", aarch64StackSize(i.StackSize))
+		ctx.scopeSizes = ctx.scopeSizes[:len(ctx.scopeSizes)-1]
+
+	case *UnwindScopesInstr:
+		size := 0
+		for _, s := range ctx.scopeSizes[len(ctx.scopeSizes)-i.Scopes:] {
+			size += s
+		}
+		ctx.adjustStack("add", size)
+
+	case *CheckNullDereferenceInstr:
+		ctx.pushCode("str x0, [sp, #-16]!")
+		ctx.load("w0", i.Ptr)
+		ctx.pushCode("bl " + RuntimeCheckNullPointerLabel)
+		ctx.pushCode("ldr x0, [sp], #16")
+
+	case *CallInstr:
+		ctx.pushCode("bl %v", i.Label.Label)
+
+	case *HeapAllocInstr:
+		ctx.pushCode("ldr w0, =%v", i.Size)
+		ctx.pushCode("bl malloc")
+		ctx.store("w0", i.Dst)
+
+	case *PushInstr:
+		ctx.pushCode("str %v, [sp, #-16]!", aarch64Address(i.Op))
+
+	case *PopInstr:
+		ctx.pushCode("ldr %v, [sp], #16", aarch64Address(i.Op))
+
+	case *LocaleInstr:
+		ctx.pushCode("bl _wacc_init")
+
+	default:
+		ctx.fail("Unhandled instruction %T", instr)
+	}
+}
+
+func (ctx *aarch64GeneratorContext) adjustStack(op string, size int) {
+	for size > 0 {
+		thisTime := size
+		if thisTime > aarch64MaxImmediate&^15 {
+			thisTime = aarch64MaxImmediate &^ 15
+		}
+		ctx.pushCode("%s sp, sp, #%v", op, thisTime)
+		size -= thisTime
+	}
+}
+
+// generateArithmetic computes dst = op1 <op> op2. Integer operations raise an
+// overflow error; float ones are done in the FP registers.
+func (ctx *aarch64GeneratorContext) generateArithmetic(op string, dst, op1 *RegisterExpr, op2 Expr, shift Shift, t frontend.Type) {
+	if t.Equals(frontend.BasicType{frontend.FLOAT}) {
+		ctx.pushCode("fmov s0, %v", aarch64Register(op1))
+		ctx.pushCode("fmov s1, %v", ctx.operand(op2, "w9"))
+		ctx.pushCode("f%s s0, s0, s1", op)
+		ctx.pushCode("fmov %v, s0", aarch64Register(dst))
+		return
+	}
+
+	if op == "mul" {
+		ctx.pushCode("smull x9, %v, %v", aarch64Register(op1), ctx.operand(op2, "w10"))
+		ctx.pushCode("cmp x9, w9, sxtw")
+		ctx.pushCode("b.ne " + RuntimeOverflowLabel)
+		ctx.pushCode("mov %v, w9", aarch64Register(dst))
+		return
+	}
+
+	second := ""
+	if n, ok := aarch64Constant(op2); ok && shift == nil && n >= 0 && n <= aarch64MaxImmediate {
+		second = fmt.Sprintf("#%v", n)
+	} else {
+		second = ctx.operand(op2, "w9")
+		if shift != nil {
+			second += ", " + shift.Repr()
+		}
+	}
+	ctx.pushCode("%ss %v, %v, %v", op, aarch64Register(dst), aarch64Register(op1), second)
+	ctx.pushCode("b.vs " + RuntimeOverflowLabel)
+}
+
+func (ctx *aarch64GeneratorContext) generatePrint(i *PrintInstr) {
+	if v, ok := i.Expr.(*CharConstExpr); ok && v.Value == '\n' {
+		ctx.pushCode("bl _wacc_print_nl")
+		return
+	}
+
+	switch obj := i.Expr.(type) {
+	case *IntConstExpr, *BoolConstExpr, *CharConstExpr, *LocationExpr, *RegisterExpr:
+		ctx.load("w1", obj)
+
+	default:
+		ctx.fail("Cannot print an object of type %T", obj)
+	}
+
+	derivedType := i.Type
+	if derivedType.Equals(frontend.BasicType{frontend.INT}) {
+		ctx.pushCode("bl _wacc_print_int")
+	} else if derivedType.Equals(frontend.BasicType{frontend.FLOAT}) {
+		ctx.pushCode("bl _wacc_print_float")
+	} else if derivedType.Equals(frontend.BasicType{frontend.BOOL}) {
+		ctx.pushCode("bl _wacc_print_bool")
+	} else if derivedType.Equals(frontend.BasicType{frontend.CHAR}) {
+		ctx.pushCode("bl _wacc_print_char")
+	} else if derivedType.Equals(frontend.BasicType{frontend.STRING}) {
+		ctx.pushCode("bl _wacc_print_wstr")
+	} else if derivedType.Equals(frontend.ArrayType{frontend.BasicType{frontend.CHAR}}) {
+		ctx.pushCode("bl _wacc_print_wstr")
+	} else {
+		ctx.pushCode("bl _wacc_print_addr")
+	}
+}
+
+func (ctx *aarch64GeneratorContext) generateData(ifCtx *IFContext) {
+	encodeRuneToUTF32 := func(r rune) string {
+		return fmt.Sprintf("\\%03o\\%03o\\%03o\\000", r%0x100, (r>>8)%0x100, (r>>16)%0x100)
+	}
+
+	for k, v := range ifCtx.dataStore {
+		wideString := ""
+		length := 0
+		for _, r := range v.Value {
+			wideString += encodeRuneToUTF32(r)
+			length += 1
+		}
+		ctx.data += fmt.Sprintf("%s:\n\t.word %v\n\t.ascii \"%s\"\n", k, length, wideString)
+	}
+}
+
+func (ctx *aarch64GeneratorContext) generateFunction(n *InstrNode) {
+	ctx.currentFunction = n.Instr.(*LabelInstr).Label
+	ctx.stage = "generating AArch64 code for " + ctx.currentFunction
+
+	ctx.generateInstr(n.Instr)
+	for _, pair := range aarch64SavedRegisters {
+		ctx.pushCode("stp %v, %v, [sp, #-16]!", pair[0], pair[1])
+	}
+	ctx.pushCode("mov x29, sp")
+
+	for node := n.Next; node != nil; node = node.Next {
+		ctx.generateInstr(node.Instr)
+	}
+
+	ctx.pushLabel("_" + ctx.currentFunction + "_end")
+	ctx.pushCode("mov sp, x29")
+	for k := len(aarch64SavedRegisters) - 1; k >= 0; k-- {
+		pair := aarch64SavedRegisters[k]
+		ctx.pushCode("ldp %v, %v, [sp], #16", pair[0], pair[1])
+	}
+	ctx.pushCode("ret")
+
+	// Assemble the current literal pool immediately
+	ctx.pushCode(".ltorg")
+}
+
+// The same numbering as on ARM, mapped by aarch64Registers: r0-r3 are x0-x3,
+// and the registers used for temporaries and variables are x19-x26
+var aarch64RegisterFile = &RegisterFile{
+	Count:          len(aarch64Registers),
+	FirstTemporary: 4,
+	LastTemporary:  11,
+	FirstVariable:  8,
+	LastVariable:   11,
+}
+
+// 64-bit ARM Linux, using the AAPCS64
+var AArch64Target Target = aarch64Target{}
+
+type aarch64Target struct{}
+
+func (aarch64Target) Name() string                                  { return "aarch64-linux" }
+func (aarch64Target) Description() string                           { return "64-bit ARM Linux" }
+func (aarch64Target) WordSize() int                                 { return 4 }
+func (aarch64Target) ArgumentRegisters() int                        { return 4 }
+func (aarch64Target) Registers() *RegisterFile                      { return aarch64RegisterFile }
+func (aarch64Target) OutputExtension() string                       { return ".s" }
+func (aarch64Target) GenerateCode(ifCtx *IFContext) (string, error) { return GenerateAArch64Code(ifCtx) }
+
+// GenerateAArch64Code generates GNU assembler source for AArch64 Linux. As
+// with GenerateCode, an error is a compiler bug.
+func GenerateAArch64Code(ifCtx *IFContext) (string, error) {
+	ctx := new(aarch64GeneratorContext)
+	ctx.target = AArch64Target
+
+	ctx.data += aarch64RuntimeData
+	ctx.generateData(ifCtx)
+
+	for _, f := range ifCtx.functions {
+		ctx.text += fmt.Sprintf(".global %v\n", f.Instr.(*LabelInstr).Label)
+	}
+	ctx.text += ".global main\n"
+
+	for _, f := range ifCtx.functions {
+		ctx.generateFunction(f)
+	}
+	ctx.generateFunction(ifCtx.main)
+
+	if ctx.err != nil {
+		return "", ctx.err
+	}
+	return ".data\n" + ctx.data + ".text\n" + ctx.text + aarch64RuntimeText +
+		"\t.section .note.GNU-stack,\"\",@progbits\n", nil
+}
+
+//
+// Runtime
+//
+const aarch64RuntimeData = `
+	.balign 4
+printf_fmt_int:
+	.ascii "%\000\000\000d\000\000\000\000\000\000\000"
+scanf_fmt_int:
+	.ascii "%\000\000\000d\000\000\000\000\000\000\000"
+printf_fmt_float:
+	.ascii "%\000\000\000f\000\000\000\000\000\000\000"
+printf_fmt_char:
+	.ascii "%\000\000\000l\000\000\000c\000\000\000\000\000\000\000"
+scanf_fmt_char:
+	.ascii " \000\000\000%\000\000\000l\000\000\000c\000\000\000\000\000\000\000"
+printf_fmt_str:
+	.ascii "%\000\000\000s\000\000\000\000\000\000\000"
+printf_fmt_wstr:
+	.ascii "%\000\000\000.\000\000\000*\000\000\000l\000\000\000s\000\000\000\000\000\000\000"
+printf_fmt_addr:
+	.ascii "%\000\000\000p\000\000\000\000\000\000\000"
+printf_true:
+	.asciz "true"
+printf_false:
+	.asciz "false"
+printf_nil:
+	.asciz "(nil)"
+_wacc_overflow_error_msg:
+	.asciz "OverflowError: the result is too small/large to store in a 4-byte signed-integer.\n"
+_wacc_divide_by_zero_msg:
+	.asciz "DivideByZeroError: divide or modulo by zero\n"
+_wacc_array_index_negative_msg:
+	.asciz "ArrayIndexOutOfBoundsError: negative index\n"
+_wacc_array_index_large_msg:
+	.asciz "ArrayIndexOutOfBoundsError: index too large\n"
+_wacc_null_dereference_msg:
+	.asciz "NullReferenceError: dereference a null reference\n"
+_wacc_null:
+	.ascii "\000"
+	.balign 4
+_wacc_read_buffer:
+	.word 0
+`
+
+// Runtime functions which call into C keep their own frame, as bl overwrites
+// the link register
+const aarch64RuntimeText = `
+_wacc_init:
+	stp x29, x30, [sp, #-16]!
+	mov w0, #6
+	adrp x1, _wacc_null
+	add x1, x1, :lo12:_wacc_null
+	bl setlocale
+	mov w0, #-4
+	mov w1, #0
+	bl mallopt
+	ldp x29, x30, [sp], #16
+	ret
+` + RuntimeCheckArrayBoundsLabel + `:
+	cbz w1, _wacc_throw_null_dereference
+	ldr w9, [x1]
+	cmp w0, #0
+	b.lt _wacc_throw_array_index_negative
+	cmp w0, w9
+	b.ge _wacc_throw_array_index_large
+	ret
+_wacc_throw_array_index_negative:
+	adrp x1, _wacc_array_index_negative_msg
+	add x1, x1, :lo12:_wacc_array_index_negative_msg
+	b _wacc_throw_runtime_error
+_wacc_throw_array_index_large:
+	adrp x1, _wacc_array_index_large_msg
+	add x1, x1, :lo12:_wacc_array_index_large_msg
+	b _wacc_throw_runtime_error
+` + RuntimeCheckDivZeroLabel + `:
+	cbz w1, _wacc_throw_divide_by_zero
+	ret
+` + RuntimeOverflowLabel + `:
+	adrp x1, _wacc_overflow_error_msg
+	add x1, x1, :lo12:_wacc_overflow_error_msg
+	b _wacc_throw_runtime_error
+_wacc_throw_divide_by_zero:
+	adrp x1, _wacc_divide_by_zero_msg
+	add x1, x1, :lo12:_wacc_divide_by_zero_msg
+	b _wacc_throw_runtime_error
+` + RuntimeCheckNullPointerLabel + `:
+	cbz w0, _wacc_throw_null_dereference
+	ret
+_wacc_throw_null_dereference:
+	adrp x1, _wacc_null_dereference_msg
+	add x1, x1, :lo12:_wacc_null_dereference_msg
+_wacc_throw_runtime_error:
+	bl _wacc_print_str
+	mov w0, #-1
+	bl exit
+_wacc_read_int:
+	adrp x0, scanf_fmt_int
+	add x0, x0, :lo12:scanf_fmt_int
+	b _wacc_read
+_wacc_read_char:
+	adrp x0, scanf_fmt_char
+	add x0, x0, :lo12:scanf_fmt_char
+_wacc_read:
+	stp x29, x30, [sp, #-16]!
+	adrp x1, _wacc_read_buffer
+	add x1, x1, :lo12:_wacc_read_buffer
+	str wzr, [x1]
+	bl wscanf
+	adrp x1, _wacc_read_buffer
+	ldr w0, [x1, :lo12:_wacc_read_buffer]
+	ldp x29, x30, [sp], #16
+	ret
+_wacc_print_bool:
+	adrp x9, printf_true
+	add x9, x9, :lo12:printf_true
+	adrp x10, printf_false
+	add x10, x10, :lo12:printf_false
+	cmp w1, #0
+	csel x1, x9, x10, ne
+_wacc_print_str:
+	adrp x0, printf_fmt_str
+	add x0, x0, :lo12:printf_fmt_str
+	b _wacc_print
+_wacc_print_int:
+	adrp x0, printf_fmt_int
+	add x0, x0, :lo12:printf_fmt_int
+	b _wacc_print
+_wacc_print_char:
+	adrp x0, printf_fmt_char
+	add x0, x0, :lo12:printf_fmt_char
+	b _wacc_print
+_wacc_print_wstr:
+	add x2, x1, #4
+	ldr w1, [x1]
+	adrp x0, printf_fmt_wstr
+	add x0, x0, :lo12:printf_fmt_wstr
+	b _wacc_print
+_wacc_print_addr:
+	adrp x0, printf_fmt_addr
+	add x0, x0, :lo12:printf_fmt_addr
+	cbnz w1, _wacc_print
+	adrp x0, printf_fmt_str
+	add x0, x0, :lo12:printf_fmt_str
+	adrp x1, printf_nil
+	add x1, x1, :lo12:printf_nil
+	b _wacc_print
+_wacc_print_float:
+	fmov s0, w1
+	fcvt d0, s0
+	adrp x0, printf_fmt_float
+	add x0, x0, :lo12:printf_fmt_float
+_wacc_print:
+	stp x29, x30, [sp, #-16]!
+	bl wprintf
+	mov x0, #0
+	bl fflush
+	ldp x29, x30, [sp], #16
+	ret
+_wacc_print_nl:
+	stp x29, x30, [sp, #-16]!
+	mov w0, #10
+	bl putwchar
+	ldp x29, x30, [sp], #16
+	ret
+`
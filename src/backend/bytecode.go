@@ -0,0 +1,519 @@
+package backend
+
+import (
+	"bytes"
+	"math"
+
+	"../bytecode"
+	"../frontend"
+)
+
+// Compilation of the IF to bytecode for the virtual machine, before register
+// allocation. The machine has as many registers as a function needs, so every
+// variable gets one of its own: r0-r3 hold the parameters passed in
+// registers, the variables follow, and the temporaries used while evaluating
+// an instruction come last. Objects are laid out in memory exactly as on ARM.
+
+// A location which can be assigned to: a register, or a word in memory
+type bytecodeLocation struct {
+	reg    int32
+	offset int32
+	memory bool
+}
+
+type bytecodeGeneratorContext struct {
+	target Target
+
+	// Function being generated
+	function  *bytecode.Function
+	variables int32
+	temps     int32
+	maxTemps  int32
+	scope     variableScopes
+
+	// Positions of the labels in the function, and the jumps to them
+	labels map[string]int32
+	jumps  map[int]string
+
+	// Index of each function, and the calls in the function being generated
+	functions map[string]int32
+	calls     map[int]string
+
+	// String literals, and their addresses
+	literals map[string]int32
+	data     []int32
+
+	stageErrors
+}
+
+func (ctx *bytecodeGeneratorContext) emit(op bytecode.Opcode, a, b, c int32) {
+	ctx.function.Code = append(ctx.function.Code, bytecode.Instr{Op: op, A: a, B: b, C: c})
+}
+
+// temp returns a register for a temporary. Temporaries only live until the
+// end of the instruction they are used in, and they are numbered negatively
+// until the number of variables is known.
+func (ctx *bytecodeGeneratorContext) temp() int32 {
+	ctx.temps++
+	if ctx.temps > ctx.maxTemps {
+		ctx.maxTemps = ctx.temps
+	}
+	return -ctx.temps
+}
+
+func (ctx *bytecodeGeneratorContext) literal(s string) int32 {
+	if address, ok := ctx.literals[s]; ok {
+		return address
+	}
+
+	address := int32(bytecode.DataStart + len(ctx.data)*ctx.target.WordSize())
+	ctx.data = append(ctx.data, int32(len([]rune(s))))
+	for _, r := range s {
+		ctx.data = append(ctx.data, int32(r))
+	}
+	ctx.literals[s] = address
+	return address
+}
+
+//
+// Variables
+//
+func (ctx *bytecodeGeneratorContext) declare(v *VarExpr) {
+	reg := int32(ctx.target.ArgumentRegisters()) + ctx.variables
+	ctx.variables++
+	ctx.scope.declare(v, reg)
+}
+
+// lookup finds the register holding a variable
+func (ctx *bytecodeGeneratorContext) lookup(v *VarExpr) int32 {
+	reg, ok := ctx.scope.lookup(v)
+	if !ok {
+		ctx.fail("Trying to access non-existent variable '%s'", v.Name)
+		return 0
+	}
+	return reg.(int32)
+}
+
+// initialise finds the register of the variable an expression assigns to
+func (ctx *bytecodeGeneratorContext) initialise(v *VarExpr) int32 {
+	reg, ok := ctx.scope.initialise(v)
+	if !ok {
+		ctx.fail("Trying to initialise non-existent variable '%s'", v.Name)
+		return 0
+	}
+	return reg.(int32)
+}
+
+//
+// Expressions
+//
+func (ctx *bytecodeGeneratorContext) constant(n int32) int32 {
+	t := ctx.temp()
+	ctx.emit(bytecode.OpConst, t, n, 0)
+	return t
+}
+
+// lvalue returns the location an expression refers to, which is about to be
+// assigned to
+func (ctx *bytecodeGeneratorContext) lvalue(e Expr) bytecodeLocation {
+	switch e := e.(type) {
+	case *VarExpr:
+		return bytecodeLocation{reg: ctx.initialise(e)}
+
+	case *ArrayElemExpr:
+		array := ctx.value(e.Array)
+		index := ctx.value(e.Index)
+		if !e.InBounds {
+			ctx.emit(bytecode.OpCheckBounds, array, index, 0)
+		}
+
+		// The address of the element is array + 4 + index * 4
+		address := ctx.temp()
+		ctx.emit(bytecode.OpMul, address, index, ctx.constant(int32(ctx.target.WordSize())))
+		ctx.emit(bytecode.OpAdd, address, address, array)
+		return bytecodeLocation{address, int32(ctx.target.WordSize()), true}
+
+	case *PairElemExpr:
+		offset := 0
+		if !e.Fst {
+			offset = ctx.target.WordSize()
+		}
+		pair := ctx.value(e.Operand)
+		if !e.NotNull {
+			ctx.emit(bytecode.OpCheckNull, pair, 0, 0)
+		}
+		return bytecodeLocation{pair, int32(offset), true}
+
+	case *StructElemExpr:
+		object := ctx.value(e.StructIdent)
+		if !e.NotNull {
+			ctx.emit(bytecode.OpCheckNull, object, 0, 0)
+		}
+		return bytecodeLocation{object, int32(e.ElemOffset), true}
+
+	default:
+		ctx.fail("Unhandled lvalue %T", e)
+		return bytecodeLocation{reg: ctx.temp()}
+	}
+}
+
+func (ctx *bytecodeGeneratorContext) store(loc bytecodeLocation, v int32) {
+	if loc.memory {
+		ctx.emit(bytecode.OpStore, loc.reg, v, loc.offset)
+	} else {
+		ctx.emit(bytecode.OpMove, loc.reg, v, 0)
+	}
+}
+
+// Opcodes for each binary operator, on integers and on floats
+var bytecodeOperators = map[string][2]bytecode.Opcode{
+	Add: {bytecode.OpAdd, bytecode.OpFAdd},
+	Sub: {bytecode.OpSub, bytecode.OpFSub},
+	Mul: {bytecode.OpMul, bytecode.OpFMul},
+	Div: {bytecode.OpDiv, bytecode.OpFDiv},
+	Mod: {bytecode.OpMod, bytecode.OpMod},
+	And: {bytecode.OpAnd, bytecode.OpAnd},
+	Or:  {bytecode.OpOr, bytecode.OpOr},
+	EQ:  {bytecode.OpEq, bytecode.OpEq},
+	NE:  {bytecode.OpNe, bytecode.OpNe},
+	LT:  {bytecode.OpLt, bytecode.OpLt},
+	LE:  {bytecode.OpLe, bytecode.OpLe},
+	GT:  {bytecode.OpGt, bytecode.OpGt},
+	GE:  {bytecode.OpGe, bytecode.OpGe},
+}
+
+// value evaluates an expression, returning the register holding its value
+func (ctx *bytecodeGeneratorContext) value(e Expr) int32 {
+	switch e := e.(type) {
+	case *IntConstExpr:
+		return ctx.constant(int32(e.Value))
+
+	case *FloatConstExpr:
+		return ctx.constant(int32(math.Float32bits(e.Value)))
+
+	case *BoolConstExpr:
+		if e.Value {
+			return ctx.constant(1)
+		}
+		return ctx.constant(0)
+
+	case *CharConstExpr:
+		return ctx.constant(int32(e.Value))
+
+	case *PointerConstExpr:
+		return ctx.constant(int32(e.Value))
+
+	case *StringConstExpr:
+		return ctx.constant(ctx.literal(e.Value))
+
+	case *RegisterExpr:
+		// Only parameters are read from registers before allocation
+		return int32(e.Id)
+
+	case *StackArgumentExpr:
+		t := ctx.temp()
+		ctx.emit(bytecode.OpParam, t, int32(e.Id), 0)
+		return t
+
+	case *VarExpr:
+		return ctx.lookup(e)
+
+	case *ArrayElemExpr, *PairElemExpr, *StructElemExpr:
+		loc := ctx.lvalue(e)
+		t := ctx.temp()
+		ctx.emit(bytecode.OpLoad, t, loc.reg, loc.offset)
+		return t
+
+	case *UnaryExpr:
+		operand := ctx.value(e.Operand)
+		switch e.Operator {
+		case Not:
+			t := ctx.temp()
+			ctx.emit(bytecode.OpNot, t, operand, 0)
+			return t
+
+		case Ord, Chr:
+			return operand
+
+		case Neg:
+			t := ctx.temp()
+			if e.Type.Equals(frontend.BasicType{frontend.FLOAT}) {
+				ctx.emit(bytecode.OpFSub, t, ctx.constant(0), operand)
+			} else {
+				ctx.emit(bytecode.OpSub, t, ctx.constant(0), operand)
+			}
+			return t
+
+		case Len:
+			t := ctx.temp()
+			ctx.emit(bytecode.OpLoad, t, operand, 0)
+			return t
+
+		default:
+			ctx.fail("Unhandled unary operator %v", e.Operator)
+			return operand
+		}
+
+	case *BinaryExpr:
+		// Evaluate the operands in the same order as the register allocator
+		var left, right int32
+		if e.Left.Weight() > e.Right.Weight() {
+			left = ctx.value(e.Left)
+			right = ctx.value(e.Right)
+		} else {
+			right = ctx.value(e.Right)
+			left = ctx.value(e.Left)
+		}
+
+		ops, ok := bytecodeOperators[e.Operator]
+		if !ok {
+			ctx.fail("Unknown operator %v", e.Operator)
+			return left
+		}
+		op := ops[0]
+		if e.Type.Equals(frontend.BasicType{frontend.FLOAT}) {
+			op = ops[1]
+		}
+
+		t := ctx.temp()
+		ctx.emit(op, t, left, right)
+		return t
+
+	case *ArrayConstExpr:
+		array := ctx.temp()
+		ctx.emit(bytecode.OpAlloc, array, int32((len(e.Elems)+1)*ctx.target.WordSize()), 0)
+		ctx.emit(bytecode.OpStore, array, ctx.constant(int32(len(e.Elems))), 0)
+		for i, elem := range e.Elems {
+			ctx.emit(bytecode.OpStore, array, ctx.value(elem), int32((i+1)*ctx.target.WordSize()))
+		}
+		return array
+
+	case *NewStructExpr:
+		object := ctx.temp()
+		ctx.emit(bytecode.OpAlloc, object, int32(len(e.Args)*ctx.target.WordSize()), 0)
+		for i, arg := range e.Args {
+			ctx.emit(bytecode.OpStore, object, ctx.value(arg), int32(i*ctx.target.WordSize()))
+		}
+		return object
+
+	case *NewPairExpr:
+		pair := ctx.temp()
+		ctx.emit(bytecode.OpAlloc, pair, int32(2*ctx.target.WordSize()), 0)
+		ctx.emit(bytecode.OpStore, pair, ctx.value(e.Left), 0)
+		ctx.emit(bytecode.OpStore, pair, ctx.value(e.Right), int32(ctx.target.WordSize()))
+		return pair
+
+	case *CallExpr:
+		// Every argument is evaluated before any is passed, as evaluating one
+		// can involve another call
+		args := []int32{}
+		for _, arg := range e.Args {
+			args = append(args, ctx.value(arg))
+		}
+		for _, arg := range args {
+			ctx.emit(bytecode.OpArg, arg, 0, 0)
+		}
+		t := ctx.temp()
+		ctx.calls[len(ctx.function.Code)] = e.Label.Label
+		ctx.emit(bytecode.OpCall, t, 0, 0)
+		return t
+
+	default:
+		ctx.fail("Unhandled expression %T", e)
+		return ctx.temp()
+	}
+}
+
+//
+// Instructions
+//
+func (ctx *bytecodeGeneratorContext) generateInstr(instr Instr) {
+	ctx.temps = 0
+
+	switch i := instr.(type) {
+	case *NoOpInstr, *LocaleInstr, *UnwindScopesInstr:
+
+	case *LabelInstr:
+		ctx.labels[i.Label] = int32(len(ctx.function.Code))
+
+	case *DeclareInstr:
+		ctx.declare(i.Var)
+
+	case *PushScopeInstr:
+		ctx.scope.push()
+
+	case *PopScopeInstr:
+		ctx.scope.pop()
+
+	case *EvalInstr:
+		ctx.value(i.Expr)
+
+	case *ReadInstr:
+		dst := ctx.lvalue(i.Dst)
+		kind := bytecode.KindInt
+		if i.Type.Equals(frontend.BasicType{frontend.CHAR}) {
+			kind = bytecode.KindChar
+		}
+		t := ctx.temp()
+		ctx.emit(bytecode.OpRead, t, kind, 0)
+		ctx.store(dst, t)
+
+	case *FreeInstr:
+		ctx.emit(bytecode.OpFree, ctx.value(i.Object), 0, 0)
+
+	case *ReturnInstr:
+		ctx.emit(bytecode.OpReturn, ctx.value(i.Expr), 0, 0)
+
+	case *ExitInstr:
+		ctx.emit(bytecode.OpExit, ctx.value(i.Expr), 0, 0)
+
+	case *PrintInstr:
+		v := ctx.value(i.Expr)
+		t := i.Type
+		var kind int32
+		if t.Equals(frontend.BasicType{frontend.INT}) {
+			kind = bytecode.KindInt
+		} else if t.Equals(frontend.BasicType{frontend.FLOAT}) {
+			kind = bytecode.KindFloat
+		} else if t.Equals(frontend.BasicType{frontend.BOOL}) {
+			kind = bytecode.KindBool
+		} else if t.Equals(frontend.BasicType{frontend.CHAR}) {
+			kind = bytecode.KindChar
+		} else if t.Equals(frontend.BasicType{frontend.STRING}) ||
+			t.Equals(frontend.ArrayType{frontend.BasicType{frontend.CHAR}}) {
+			kind = bytecode.KindString
+		} else {
+			kind = bytecode.KindAddress
+		}
+		ctx.emit(bytecode.OpPrint, v, kind, 0)
+
+	case *MoveInstr:
+		v := ctx.value(i.Src)
+		ctx.store(ctx.lvalue(i.Dst), v)
+
+	case *JmpInstr:
+		ctx.jumps[len(ctx.function.Code)] = i.Dst.Instr.(*LabelInstr).Label
+		ctx.emit(bytecode.OpJmp, 0, 0, 0)
+
+	case *JmpCondInstr:
+		cond := ctx.value(i.Cond)
+		ctx.jumps[len(ctx.function.Code)] = i.Dst.Instr.(*LabelInstr).Label
+		ctx.emit(bytecode.OpJmpIf, cond, 0, 0)
+
+	case *PhiInstr:
+		ctx.fail("Phi instructions must be removed before code generation")
+
+	default:
+		ctx.fail("Unhandled instruction %T", instr)
+	}
+}
+
+func (ctx *bytecodeGeneratorContext) generateFunction(n *InstrNode) *bytecode.Function {
+	ctx.function = &bytecode.Function{Name: n.Instr.(*LabelInstr).Label}
+	ctx.stage = "generating bytecode for " + ctx.function.Name
+	ctx.variables = 0
+	ctx.maxTemps = 0
+	ctx.scope = newVariableScopes()
+	ctx.labels = make(map[string]int32)
+	ctx.jumps = make(map[int]string)
+	ctx.calls = make(map[int]string)
+
+	for node := n.Next; node != nil; node = node.Next {
+		ctx.generateInstr(node.Instr)
+	}
+
+	// Place the temporaries after the variables, and resolve the jumps and
+	// calls
+	f := ctx.function
+	firstTemp := int32(ctx.target.ArgumentRegisters()) + ctx.variables
+	f.Registers = int(firstTemp + ctx.maxTemps)
+	for pc := range f.Code {
+		for _, r := range f.Code[pc].Registers() {
+			if *r < 0 {
+				*r = firstTemp - *r - 1
+			}
+		}
+	}
+	for pc, label := range ctx.jumps {
+		target, ok := ctx.labels[label]
+		if !ok {
+			ctx.fail("Jump to unknown label %v", label)
+			continue
+		}
+		if f.Code[pc].Op == bytecode.OpJmp {
+			f.Code[pc].A = target
+		} else {
+			f.Code[pc].B = target
+		}
+	}
+	for pc, name := range ctx.calls {
+		callee, ok := ctx.functions[name]
+		if !ok {
+			ctx.fail("Bytecode cannot call the external function %v", name)
+			continue
+		}
+		f.Code[pc].B = callee
+	}
+
+	// The end of the function is never reached, other than at the end of
+	// main, so a jump to a label there leaves the function
+	for _, target := range ctx.labels {
+		if int(target) == len(f.Code) {
+			ctx.emit(bytecode.OpNop, 0, 0, 0)
+			break
+		}
+	}
+	return f
+}
+
+// CompileBytecode compiles a program whose IF hasn't been register allocated
+// to bytecode. Programs which call external functions can't be compiled, as
+// the virtual machine has no way of calling them.
+func CompileBytecode(ifCtx *IFContext) (*bytecode.Program, error) {
+	ctx := new(bytecodeGeneratorContext)
+	ctx.target = BytecodeTarget
+	ctx.functions = make(map[string]int32)
+	ctx.literals = make(map[string]int32)
+
+	program := new(bytecode.Program)
+	for n, branch := range ifCtx.Branches() {
+		ctx.functions[branch.Instr.(*LabelInstr).Label] = int32(n)
+		if branch == ifCtx.main {
+			program.Main = n
+		}
+	}
+	for _, branch := range ifCtx.Branches() {
+		program.Functions = append(program.Functions, ctx.generateFunction(branch))
+	}
+	if ctx.err != nil {
+		return nil, ctx.err
+	}
+	program.Data = ctx.data
+	return program, nil
+}
+
+// Bytecode for the virtual machine, generated before register allocation
+var BytecodeTarget Target = bytecodeTarget{}
+
+type bytecodeTarget struct{}
+
+func (bytecodeTarget) Name() string                                  { return "bytecode" }
+func (bytecodeTarget) Description() string                           { return "WACC virtual machine bytecode" }
+func (bytecodeTarget) WordSize() int                                 { return 4 }
+func (bytecodeTarget) ArgumentRegisters() int                        { return bytecode.ArgumentRegisters }
+func (bytecodeTarget) Registers() *RegisterFile                      { return nil }
+func (bytecodeTarget) OutputExtension() string                       { return ".wbc" }
+func (bytecodeTarget) GenerateCode(ifCtx *IFContext) (string, error) { return GenerateBytecode(ifCtx) }
+
+// GenerateBytecode compiles a program to bytecode, returning its encoding
+func GenerateBytecode(ifCtx *IFContext) (string, error) {
+	program, err := CompileBytecode(ifCtx)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := program.Encode(&buf); err != nil {
+		return "", &InternalError{"encoding bytecode", err.Error()}
+	}
+	return buf.String(), nil
+}
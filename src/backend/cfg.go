@@ -0,0 +1,390 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+)
+
+// A maximal run of instructions with a single entry at the top and a single
+// exit at the bottom
+type BasicBlock struct {
+	Id     int
+	Instrs []*InstrNode
+
+	Succs []*BasicBlock
+	Preds []*BasicBlock
+
+	// Immediate dominator, nil for the entry block and unreachable blocks
+	Idom *BasicBlock
+
+	// Blocks immediately dominated by this one
+	Children []*BasicBlock
+
+	// Blocks where the dominance of this one ends
+	Frontier []*BasicBlock
+
+	// Innermost loop containing this block, if any
+	Loop *Loop
+
+	// Position in reverse postorder, -1 if the block is unreachable
+	rpo int
+}
+
+// A natural loop, formed by one or more back edges to the same header
+type Loop struct {
+	Header *BasicBlock
+	Blocks []*BasicBlock
+	Parent *Loop
+	Depth  int
+}
+
+// The control flow graph of a single branch of the IF (a function or main)
+type CFG struct {
+	Branch *InstrNode
+	Entry  *BasicBlock
+
+	// Blocks in the order they appear in the branch
+	Blocks []*BasicBlock
+
+	// Reachable blocks in reverse postorder
+	Order []*BasicBlock
+
+	Loops []*Loop
+
+	// Block each instruction belongs to
+	blockOf map[*InstrNode]*BasicBlock
+}
+
+func (b *BasicBlock) First() *InstrNode {
+	return b.Instrs[0]
+}
+
+func (b *BasicBlock) Last() *InstrNode {
+	return b.Instrs[len(b.Instrs)-1]
+}
+
+func (b *BasicBlock) Reachable() bool {
+	return b.rpo != -1
+}
+
+// LoopDepth is the number of loops containing the block
+func (b *BasicBlock) LoopDepth() int {
+	if b.Loop == nil {
+		return 0
+	}
+	return b.Loop.Depth
+}
+
+// Dominates reports whether every path from the entry to other passes
+// through b
+func (b *BasicBlock) Dominates(other *BasicBlock) bool {
+	for other != nil {
+		if other == b {
+			return true
+		}
+		other = other.Idom
+	}
+	return false
+}
+
+func (l *Loop) Contains(b *BasicBlock) bool {
+	for inner := b.Loop; inner != nil; inner = inner.Parent {
+		if inner == l {
+			return true
+		}
+	}
+	return false
+}
+
+// BuildCFG partitions a branch of the IF into basic blocks and analyses its
+// control flow. The CFG refers to the nodes of the branch rather than copying
+// them, so it must be rebuilt whenever a pass changes the branch.
+func BuildCFG(branch *InstrNode) *CFG {
+	cfg := &CFG{Branch: branch}
+	cfg.Rebuild()
+	return cfg
+}
+
+// Rebuild recomputes the CFG from the current contents of the branch
+func (cfg *CFG) Rebuild() {
+	cfg.Entry = nil
+	cfg.Blocks = nil
+	cfg.Order = nil
+	cfg.Loops = nil
+	cfg.blockOf = make(map[*InstrNode]*BasicBlock)
+
+	cfg.buildBlocks()
+	cfg.linkBlocks()
+	cfg.computeOrder()
+	cfg.computeDominators()
+	cfg.computeFrontiers()
+	cfg.computeLoops()
+}
+
+func (cfg *CFG) BlockOf(node *InstrNode) *BasicBlock {
+	return cfg.blockOf[node]
+}
+
+//
+// Basic blocks
+//
+func endsBlock(i Instr) bool {
+	switch i.(type) {
+	case *JmpInstr, *JmpCondInstr, *ReturnInstr, *ExitInstr:
+		return true
+	default:
+		return false
+	}
+}
+
+func (cfg *CFG) buildBlocks() {
+	var current *BasicBlock
+	for node := cfg.Branch; node != nil; node = node.Next {
+		// Labels start a new block, as they can be jumped to
+		if _, ok := node.Instr.(*LabelInstr); ok {
+			current = nil
+		}
+		if current == nil {
+			current = &BasicBlock{Id: len(cfg.Blocks), rpo: -1}
+			cfg.Blocks = append(cfg.Blocks, current)
+		}
+
+		current.Instrs = append(current.Instrs, node)
+		cfg.blockOf[node] = current
+
+		if endsBlock(node.Instr) {
+			current = nil
+		}
+	}
+	cfg.Entry = cfg.Blocks[0]
+}
+
+func (cfg *CFG) linkBlocks() {
+	// Jump targets are resolved by name, as jumps don't always point at the
+	// node in the list
+	labels := make(map[string]*BasicBlock)
+	for _, b := range cfg.Blocks {
+		if label, ok := b.First().Instr.(*LabelInstr); ok {
+			labels[label.Label] = b
+		}
+	}
+
+	target := func(node *InstrNode) *BasicBlock {
+		label := node.Instr.(*LabelInstr).Label
+		b, ok := labels[label]
+		if !ok {
+			panic(fmt.Sprintf("Jump to unknown label %v", label))
+		}
+		return b
+	}
+
+	link := func(from, to *BasicBlock) {
+		for _, s := range from.Succs {
+			if s == to {
+				return
+			}
+		}
+		from.Succs = append(from.Succs, to)
+		to.Preds = append(to.Preds, from)
+	}
+
+	for n, b := range cfg.Blocks {
+		fallsThrough := true
+		switch i := b.Last().Instr.(type) {
+		case *JmpInstr:
+			link(b, target(i.Dst))
+			fallsThrough = false
+
+		case *JmpCondInstr:
+			if n+1 < len(cfg.Blocks) {
+				link(b, cfg.Blocks[n+1])
+			}
+			link(b, target(i.Dst))
+			fallsThrough = false
+
+		case *ReturnInstr, *ExitInstr:
+			fallsThrough = false
+		}
+
+		if fallsThrough && n+1 < len(cfg.Blocks) {
+			link(b, cfg.Blocks[n+1])
+		}
+	}
+}
+
+func (cfg *CFG) computeOrder() {
+	visited := make(map[*BasicBlock]bool)
+	postorder := []*BasicBlock{}
+
+	var visit func(b *BasicBlock)
+	visit = func(b *BasicBlock) {
+		visited[b] = true
+		for _, s := range b.Succs {
+			if !visited[s] {
+				visit(s)
+			}
+		}
+		postorder = append(postorder, b)
+	}
+	visit(cfg.Entry)
+
+	for i := len(postorder) - 1; i >= 0; i-- {
+		postorder[i].rpo = len(cfg.Order)
+		cfg.Order = append(cfg.Order, postorder[i])
+	}
+}
+
+//
+// Dominators, using the algorithm from "A Simple, Fast Dominance Algorithm"
+// by Cooper, Harvey and Kennedy
+//
+func (cfg *CFG) computeDominators() {
+	intersect := func(a, b *BasicBlock) *BasicBlock {
+		for a != b {
+			for a.rpo > b.rpo {
+				a = a.Idom
+			}
+			for b.rpo > a.rpo {
+				b = b.Idom
+			}
+		}
+		return a
+	}
+
+	// The entry temporarily dominates itself so that intersect terminates
+	cfg.Entry.Idom = cfg.Entry
+	for changed := true; changed; {
+		changed = false
+		for _, b := range cfg.Order[1:] {
+			var idom *BasicBlock
+			for _, p := range b.Preds {
+				if p.Idom == nil {
+					continue
+				}
+				if idom == nil {
+					idom = p
+				} else {
+					idom = intersect(p, idom)
+				}
+			}
+			if b.Idom != idom {
+				b.Idom = idom
+				changed = true
+			}
+		}
+	}
+	cfg.Entry.Idom = nil
+
+	for _, b := range cfg.Order[1:] {
+		b.Idom.Children = append(b.Idom.Children, b)
+	}
+}
+
+func (cfg *CFG) computeFrontiers() {
+	for _, b := range cfg.Order {
+		if len(b.Preds) < 2 {
+			continue
+		}
+		for _, p := range b.Preds {
+			if !p.Reachable() {
+				continue
+			}
+			for runner := p; runner != nil && runner != b.Idom; runner = runner.Idom {
+				if n := len(runner.Frontier); n > 0 && runner.Frontier[n-1] == b {
+					break
+				}
+				runner.Frontier = append(runner.Frontier, b)
+			}
+		}
+	}
+}
+
+//
+// Natural loops
+//
+func (cfg *CFG) computeLoops() {
+	headers := make(map[*BasicBlock]*Loop)
+
+	for _, b := range cfg.Order {
+		for _, s := range b.Succs {
+			if !s.Dominates(b) {
+				continue
+			}
+
+			// b -> s is a back edge. Everything which reaches b without going
+			// through s is part of the loop.
+			loop, ok := headers[s]
+			if !ok {
+				loop = &Loop{Header: s, Blocks: []*BasicBlock{s}}
+				headers[s] = loop
+				cfg.Loops = append(cfg.Loops, loop)
+			}
+
+			inLoop := make(map[*BasicBlock]bool)
+			for _, lb := range loop.Blocks {
+				inLoop[lb] = true
+			}
+			worklist := []*BasicBlock{b}
+			for len(worklist) > 0 {
+				n := worklist[len(worklist)-1]
+				worklist = worklist[:len(worklist)-1]
+				if inLoop[n] {
+					continue
+				}
+				inLoop[n] = true
+				loop.Blocks = append(loop.Blocks, n)
+				for _, p := range n.Preds {
+					if p.Reachable() {
+						worklist = append(worklist, p)
+					}
+				}
+			}
+		}
+	}
+
+	// Loops with later headers in reverse postorder are nested inside the
+	// ones they share blocks with, so visiting loops outermost first leaves
+	// each block pointing at its innermost loop
+	for i := 1; i < len(cfg.Loops); i++ {
+		for j := i; j > 0 && cfg.Loops[j].Header.rpo < cfg.Loops[j-1].Header.rpo; j-- {
+			cfg.Loops[j], cfg.Loops[j-1] = cfg.Loops[j-1], cfg.Loops[j]
+		}
+	}
+	for _, loop := range cfg.Loops {
+		loop.Parent = loop.Header.Loop
+		loop.Depth = 1
+		if loop.Parent != nil {
+			loop.Depth = loop.Parent.Depth + 1
+		}
+		for _, b := range loop.Blocks {
+			b.Loop = loop
+		}
+	}
+}
+
+// DrawCFG prints each block of the CFG along with its edges and dominator
+func DrawCFG(w io.Writer, cfg *CFG) {
+	for _, b := range cfg.Blocks {
+		fmt.Fprintf(w, "block %d", b.Id)
+		if b.Idom != nil {
+			fmt.Fprintf(w, " (idom %d)", b.Idom.Id)
+		}
+		if !b.Reachable() {
+			fmt.Fprint(w, " (unreachable)")
+		}
+		if depth := b.LoopDepth(); depth > 0 {
+			fmt.Fprintf(w, " (loop depth %d, header %d)", depth, b.Loop.Header.Id)
+		}
+		fmt.Fprintln(w, ":")
+
+		for _, node := range b.Instrs {
+			fmt.Fprintf(w, "\t%v\n", node.Instr.Repr())
+		}
+
+		fmt.Fprint(w, "\t->")
+		for _, s := range b.Succs {
+			fmt.Fprintf(w, " %d", s.Id)
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,165 @@
+package backend
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newBranch links instructions into a branch of the IF
+func newBranch(instrs ...Instr) *InstrNode {
+	var first, last *InstrNode
+	for _, i := range instrs {
+		node := &InstrNode{Instr: i, Prev: last}
+		if last == nil {
+			first = node
+		} else {
+			last.Next = node
+		}
+		last = node
+	}
+	return first
+}
+
+func label(name string) Instr {
+	return &LabelInstr{name}
+}
+
+func jmp(name string) Instr {
+	return &JmpInstr{&InstrNode{Instr: &LabelInstr{name}}}
+}
+
+func jmpIf(name string) Instr {
+	return &JmpCondInstr{&InstrNode{Instr: &LabelInstr{name}}, &BoolConstExpr{true}}
+}
+
+func ret() Instr {
+	return &ReturnInstr{&IntConstExpr{0}}
+}
+
+// blockName is the label a block starts with
+func blockName(b *BasicBlock) string {
+	if b == nil {
+		return ""
+	}
+	return b.First().Instr.(*LabelInstr).Label
+}
+
+func TestDominatorsAndLoops(t *testing.T) {
+	tests := []struct {
+		name   string
+		branch *InstrNode
+
+		// Immediate dominator of each block
+		idoms map[string]string
+
+		// Blocks in each loop, keyed by header
+		loops map[string]string
+
+		// Loop depth of each block in a loop
+		depths map[string]int
+	}{
+		{
+			"straight line",
+			newBranch(label("a"), &EvalInstr{&IntConstExpr{1}}, ret()),
+			map[string]string{"a": ""},
+			map[string]string{},
+			map[string]int{},
+		},
+		{
+			"if",
+			newBranch(label("a"), jmpIf("c"), label("b"), jmp("d"), label("c"), label("d"), ret()),
+			map[string]string{"a": "", "b": "a", "c": "a", "d": "a"},
+			map[string]string{},
+			map[string]int{},
+		},
+		{
+			"while",
+			newBranch(label("a"), jmp("c"), label("b"), label("c"), jmpIf("b"), label("d"), ret()),
+			map[string]string{"a": "", "b": "c", "c": "a", "d": "c"},
+			map[string]string{"c": "b c"},
+			map[string]int{"b": 1, "c": 1, "d": 0},
+		},
+		{
+			"self loop",
+			newBranch(label("a"), label("b"), jmpIf("b"), label("c"), ret()),
+			map[string]string{"a": "", "b": "a", "c": "b"},
+			map[string]string{"b": "b"},
+			map[string]int{"a": 0, "b": 1, "c": 0},
+		},
+		{
+			"nested loops",
+			newBranch(
+				label("a"), jmp("f"),
+				label("b"), jmp("d"),
+				label("c"),
+				label("d"), jmpIf("c"),
+				label("e"),
+				label("f"), jmpIf("b"),
+				label("g"), ret()),
+			map[string]string{"a": "", "b": "f", "c": "d", "d": "b", "e": "d", "f": "a", "g": "f"},
+			map[string]string{"f": "b c d e f", "d": "c d"},
+			map[string]int{"a": 0, "b": 1, "c": 2, "d": 2, "e": 1, "f": 1, "g": 0},
+		},
+		{
+			"two back edges",
+			newBranch(label("a"), label("b"), jmpIf("e"), label("c"), jmpIf("b"), label("d"), jmp("b"), label("e"), ret()),
+			map[string]string{"a": "", "b": "a", "c": "b", "d": "c", "e": "b"},
+			map[string]string{"b": "b c d"},
+			map[string]int{"b": 1, "c": 1, "d": 1, "e": 0},
+		},
+		{
+			"unreachable",
+			newBranch(label("a"), ret(), label("b"), jmp("a")),
+			map[string]string{"a": "", "b": ""},
+			map[string]string{},
+			map[string]int{},
+		},
+	}
+	for _, test := range tests {
+		cfg := BuildCFG(test.branch)
+		blocks := make(map[string]*BasicBlock)
+		for _, b := range cfg.Blocks {
+			blocks[blockName(b)] = b
+		}
+
+		for name, idom := range test.idoms {
+			if got := blockName(blocks[name].Idom); got != idom {
+				t.Errorf("%v: idom of %v is %q, want %q", test.name, name, got, idom)
+			}
+			if idom != "" && !blocks[idom].Dominates(blocks[name]) {
+				t.Errorf("%v: %v doesn't dominate %v", test.name, idom, name)
+			}
+		}
+
+		loops := make(map[string]string)
+		for _, loop := range cfg.Loops {
+			names := []string{}
+			for _, b := range loop.Blocks {
+				names = append(names, blockName(b))
+			}
+			sort.Strings(names)
+			loops[blockName(loop.Header)] = strings.Join(names, " ")
+		}
+		if len(loops) != len(test.loops) {
+			t.Errorf("%v: got loops %v, want %v", test.name, loops, test.loops)
+		}
+		for header, want := range test.loops {
+			if loops[header] != want {
+				t.Errorf("%v: loop at %v contains %q, want %q", test.name, header, loops[header], want)
+			}
+		}
+
+		for name, depth := range test.depths {
+			if got := blocks[name].LoopDepth(); got != depth {
+				t.Errorf("%v: loop depth of %v is %v, want %v", test.name, name, got, depth)
+			}
+		}
+	}
+
+	// Blocks which can't be reached have no place in the order
+	cfg := BuildCFG(newBranch(label("a"), ret(), label("b"), jmp("a")))
+	if cfg.Blocks[1].Reachable() || len(cfg.Order) != 1 {
+		t.Errorf("unreachable block is in the order %v", cfg.Order)
+	}
+}
@@ -1,7 +1,5 @@
 package backend
 
-var regWidth = 4
-
 const (
 	Sub string = "-"
 	Add string = "+"
@@ -36,6 +34,7 @@ const (
 	RuntimeCheckNullPointerLabel string = "_wacc_check_null_pointer"
 )
 
+// Default values of the tuning parameters of the unroll and inline passes
 const (
 	OPTIMISER_LOOPUNROLL_MAX int = 10
 	OPTIMISER_INLINER_MAX    int = 20
@@ -0,0 +1,774 @@
+package backend
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"../frontend"
+)
+
+// Generation of a self-contained C99 translation unit from the IF, before
+// register allocation. Like the LLVM backend, every WACC value is an int32_t
+// and the heap is an array owned by the runtime, so objects are laid out
+// exactly as on ARM and the output behaves the same on any platform. Control
+// flow is kept as labels and gotos.
+
+// Size of the memory holding string literals and the heap
+const cMemorySize = 1 << 26
+
+// Start of the string literals. Offsets below this are never allocated, so
+// that null is never a valid address.
+const cDataStart = 8
+
+type cGeneratorContext struct {
+	target Target
+
+	// Function being generated
+	text       string
+	locals     []string
+	temps      int
+	terminated bool
+	scope      variableScopes
+
+	// Labels which are jumped to. Other labels are left out, as C compilers
+	// warn about them.
+	targets map[string]bool
+
+	// Parameters read by the function, by register or stack argument
+	registerParams int
+	stackParams    int
+
+	// Number of arguments passed to each function called
+	callees map[string]int
+
+	// String literals, and the offsets they are copied to
+	literals    map[string]int
+	literalDefs string
+	literalInit string
+	dataEnd     int
+
+	stageErrors
+}
+
+func (ctx *cGeneratorContext) emit(s string, a ...interface{}) {
+	ctx.text += "\t" + fmt.Sprintf(s, a...) + "\n"
+}
+
+func (ctx *cGeneratorContext) temp(s string, a ...interface{}) string {
+	ctx.temps++
+	t := fmt.Sprintf("t%d", ctx.temps)
+	ctx.locals = append(ctx.locals, t)
+	ctx.emit("%s = %s;", t, fmt.Sprintf(s, a...))
+	return t
+}
+
+func (ctx *cGeneratorContext) literal(s string) int {
+	if offset, ok := ctx.literals[s]; ok {
+		return offset
+	}
+
+	name := fmt.Sprintf("_wacc_literal%d", len(ctx.literals))
+	words := []string{fmt.Sprint(len([]rune(s)))}
+	for _, r := range s {
+		words = append(words, fmt.Sprint(r))
+	}
+	ctx.literalDefs += fmt.Sprintf("static const int32_t %s[] = {%s};\n", name, strings.Join(words, ", "))
+	ctx.literalInit += fmt.Sprintf("\tmemcpy(&WACC_WORD(%d), %s, sizeof %s);\n", ctx.dataEnd, name, name)
+
+	offset := ctx.dataEnd
+	ctx.literals[s] = offset
+	ctx.dataEnd += len(words) * ctx.target.WordSize()
+	return offset
+}
+
+//
+// Variables
+//
+func (ctx *cGeneratorContext) declare(v *VarExpr) {
+	// Names of versions and inlined variables contain characters which C
+	// doesn't allow
+	name := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+		return '_'
+	}, v.Name)
+	name = fmt.Sprintf("v_%s_%d", name, len(ctx.locals))
+
+	ctx.locals = append(ctx.locals, name)
+	ctx.scope.declare(v, name)
+}
+
+// lookup finds the C local of the variable an expression reads
+func (ctx *cGeneratorContext) lookup(v *VarExpr) string {
+	name, ok := ctx.scope.lookup(v)
+	if !ok {
+		ctx.fail("Trying to access non-existent variable '%s'", v.Name)
+		return "0"
+	}
+	return name.(string)
+}
+
+// initialise finds the C local of the variable an expression assigns to
+func (ctx *cGeneratorContext) initialise(v *VarExpr) string {
+	name, ok := ctx.scope.initialise(v)
+	if !ok {
+		ctx.fail("Trying to initialise non-existent variable '%s'", v.Name)
+		return "WACC_WORD(0)"
+	}
+	return name.(string)
+}
+
+//
+// Expressions
+//
+
+// lvalue returns a C lvalue for the location an expression refers to, which
+// is about to be assigned to
+func (ctx *cGeneratorContext) lvalue(e Expr) string {
+	switch e := e.(type) {
+	case *VarExpr:
+		return ctx.initialise(e)
+
+	case *ArrayElemExpr:
+		array := ctx.value(e.Array)
+		index := ctx.value(e.Index)
+		if !e.InBounds {
+			ctx.emit("%s(%s, %s);", RuntimeCheckArrayBoundsLabel, index, array)
+		}
+		return fmt.Sprintf("WACC_WORD(%s + %d + %s * %d)", array, ctx.target.WordSize(), index, ctx.target.WordSize())
+
+	case *PairElemExpr:
+		offset := 0
+		if !e.Fst {
+			offset = ctx.target.WordSize()
+		}
+		pair := ctx.value(e.Operand)
+		if !e.NotNull {
+			ctx.emit("%s(%s);", RuntimeCheckNullPointerLabel, pair)
+		}
+		return fmt.Sprintf("WACC_WORD(%s + %d)", pair, offset)
+
+	case *StructElemExpr:
+		object := ctx.value(e.StructIdent)
+		if !e.NotNull {
+			ctx.emit("%s(%s);", RuntimeCheckNullPointerLabel, object)
+		}
+		return fmt.Sprintf("WACC_WORD(%s + %d)", object, e.ElemOffset)
+
+	default:
+		ctx.fail("Unhandled lvalue %T", e)
+		return "WACC_WORD(0)"
+	}
+}
+
+// value evaluates an expression, returning a C expression for its value which
+// has no side effects
+func (ctx *cGeneratorContext) value(e Expr) string {
+	switch e := e.(type) {
+	case *IntConstExpr:
+		if e.Value == frontend.INT_MIN {
+			return "INT32_MIN"
+		}
+		return fmt.Sprint(e.Value)
+
+	case *FloatConstExpr:
+		return fmt.Sprint(int32(math.Float32bits(e.Value)))
+
+	case *BoolConstExpr:
+		if e.Value {
+			return "1"
+		}
+		return "0"
+
+	case *CharConstExpr:
+		return fmt.Sprint(e.Value)
+
+	case *PointerConstExpr:
+		return fmt.Sprint(e.Value)
+
+	case *StringConstExpr:
+		return fmt.Sprint(ctx.literal(e.Value))
+
+	case *RegisterExpr:
+		// Only parameters are read from registers before allocation
+		if e.Id >= ctx.registerParams {
+			ctx.registerParams = e.Id + 1
+		}
+		return fmt.Sprintf("arg%d", e.Id)
+
+	case *StackArgumentExpr:
+		if e.Id >= ctx.stackParams {
+			ctx.stackParams = e.Id + 1
+		}
+		return fmt.Sprintf("stackarg%d", e.Id)
+
+	case *VarExpr:
+		return ctx.lookup(e)
+
+	case *ArrayElemExpr, *PairElemExpr, *StructElemExpr:
+		return ctx.temp(ctx.lvalue(e))
+
+	case *UnaryExpr:
+		operand := ctx.value(e.Operand)
+		switch e.Operator {
+		case Not:
+			return ctx.temp("%s ^ 1", operand)
+
+		case Ord, Chr:
+			return operand
+
+		case Neg:
+			if e.Type.Equals(frontend.BasicType{frontend.FLOAT}) {
+				return ctx.temp("_wacc_fsub(0, %s)", operand)
+			}
+			return ctx.temp("_wacc_sub(0, %s)", operand)
+
+		case Len:
+			return ctx.temp("WACC_WORD(%s)", operand)
+
+		default:
+			ctx.fail("Unhandled unary operator %v", e.Operator)
+			return "0"
+		}
+
+	case *BinaryExpr:
+		// Evaluate the operands in the same order as the register allocator
+		var left, right string
+		if e.Left.Weight() > e.Right.Weight() {
+			left = ctx.value(e.Left)
+			right = ctx.value(e.Right)
+		} else {
+			right = ctx.value(e.Right)
+			left = ctx.value(e.Left)
+		}
+
+		switch e.Operator {
+		case Add, Sub, Mul, Div, Mod:
+			function := map[string]string{Add: "add", Sub: "sub", Mul: "mul", Div: "div", Mod: "mod"}[e.Operator]
+			if e.Type.Equals(frontend.BasicType{frontend.FLOAT}) {
+				function = "f" + function
+			}
+			return ctx.temp("_wacc_%s(%s, %s)", function, left, right)
+
+		case And:
+			return ctx.temp("%s & %s", left, right)
+
+		case Or:
+			return ctx.temp("%s | %s", left, right)
+
+		case LT, GT, LE, GE, EQ, NE:
+			return ctx.temp("%s %s %s", left, e.Operator, right)
+
+		default:
+			ctx.fail("Unknown operator %v", e.Operator)
+			return "0"
+		}
+
+	case *ArrayConstExpr:
+		array := ctx.temp("_wacc_malloc(%d)", (len(e.Elems)+1)*ctx.target.WordSize())
+		ctx.emit("WACC_WORD(%s) = %d;", array, len(e.Elems))
+		for i, elem := range e.Elems {
+			v := ctx.value(elem)
+			ctx.emit("WACC_WORD(%s + %d) = %s;", array, (i+1)*ctx.target.WordSize(), v)
+		}
+		return array
+
+	case *NewStructExpr:
+		object := ctx.temp("_wacc_malloc(%d)", len(e.Args)*ctx.target.WordSize())
+		for i, arg := range e.Args {
+			v := ctx.value(arg)
+			ctx.emit("WACC_WORD(%s + %d) = %s;", object, i*ctx.target.WordSize(), v)
+		}
+		return object
+
+	case *NewPairExpr:
+		pair := ctx.temp("_wacc_malloc(%d)", 2*ctx.target.WordSize())
+		left := ctx.value(e.Left)
+		ctx.emit("WACC_WORD(%s) = %s;", pair, left)
+		right := ctx.value(e.Right)
+		ctx.emit("WACC_WORD(%s + %d) = %s;", pair, ctx.target.WordSize(), right)
+		return pair
+
+	case *CallExpr:
+		args := []string{}
+		for _, arg := range e.Args {
+			args = append(args, ctx.value(arg))
+		}
+		if len(e.Args) > ctx.callees[e.Label.Label] {
+			ctx.callees[e.Label.Label] = len(e.Args)
+		}
+		return ctx.temp("%s(%s)", e.Label.Label, strings.Join(args, ", "))
+
+	default:
+		ctx.fail("Unhandled expression %T", e)
+		return "0"
+	}
+}
+
+//
+// Instructions
+//
+func (ctx *cGeneratorContext) generateInstr(instr Instr) {
+	switch i := instr.(type) {
+	case *NoOpInstr, *UnwindScopesInstr:
+
+	case *LabelInstr:
+		// A label must be followed by a statement
+		if ctx.targets[i.Label] {
+			ctx.text += i.Label + ":;\n"
+		}
+		ctx.terminated = false
+
+	case *DeclareInstr:
+		ctx.declare(i.Var)
+
+	case *PushScopeInstr:
+		ctx.scope.push()
+
+	case *PopScopeInstr:
+		ctx.scope.pop()
+
+	case *EvalInstr:
+		ctx.value(i.Expr)
+
+	case *ReadInstr:
+		dst := ctx.lvalue(i.Dst)
+		if i.Type.Equals(frontend.BasicType{frontend.CHAR}) {
+			ctx.emit("%s = _wacc_read_char();", dst)
+		} else {
+			ctx.emit("%s = _wacc_read_int();", dst)
+		}
+
+	case *FreeInstr:
+		object := ctx.value(i.Object)
+		ctx.emit("%s(%s);", RuntimeCheckNullPointerLabel, object)
+		ctx.emit("_wacc_free(%s);", object)
+
+	case *ReturnInstr:
+		ctx.emit("return %s;", ctx.value(i.Expr))
+		ctx.terminated = true
+
+	case *ExitInstr:
+		ctx.emit("exit(%s);", ctx.value(i.Expr))
+		ctx.terminated = true
+
+	case *PrintInstr:
+		if v, ok := i.Expr.(*CharConstExpr); ok && v.Value == '\n' {
+			ctx.emit("_wacc_print_nl();")
+			return
+		}
+
+		v := ctx.value(i.Expr)
+		t := i.Type
+		if t.Equals(frontend.BasicType{frontend.INT}) {
+			ctx.emit("_wacc_print_int(%s);", v)
+		} else if t.Equals(frontend.BasicType{frontend.FLOAT}) {
+			ctx.emit("_wacc_print_float(%s);", v)
+		} else if t.Equals(frontend.BasicType{frontend.BOOL}) {
+			ctx.emit("_wacc_print_bool(%s);", v)
+		} else if t.Equals(frontend.BasicType{frontend.CHAR}) {
+			ctx.emit("_wacc_print_char(%s);", v)
+		} else if t.Equals(frontend.BasicType{frontend.STRING}) ||
+			t.Equals(frontend.ArrayType{frontend.BasicType{frontend.CHAR}}) {
+			ctx.emit("_wacc_print_wstr(%s);", v)
+		} else {
+			ctx.emit("_wacc_print_addr(%s);", v)
+		}
+
+	case *MoveInstr:
+		v := ctx.value(i.Src)
+		ctx.emit("%s = %s;", ctx.lvalue(i.Dst), v)
+
+	case *JmpInstr:
+		ctx.emit("goto %s;", i.Dst.Instr.(*LabelInstr).Label)
+		ctx.terminated = true
+
+	case *JmpCondInstr:
+		ctx.emit("if (%s) goto %s;", ctx.value(i.Cond), i.Dst.Instr.(*LabelInstr).Label)
+
+	case *LocaleInstr:
+		ctx.emit("_wacc_init();")
+
+	case *PhiInstr:
+		ctx.fail("Phi instructions must be removed before code generation")
+
+	default:
+		ctx.fail("Unhandled instruction %T", instr)
+	}
+}
+
+// generateFunction returns the body of a function, leaving its parameters to
+// be declared once every call to it has been seen
+func (ctx *cGeneratorContext) generateFunction(n *InstrNode, isMain bool) string {
+	ctx.stage = "generating C for " + n.Instr.(*LabelInstr).Label
+	ctx.text = ""
+	ctx.locals = nil
+	ctx.temps = 0
+	ctx.terminated = false
+	ctx.scope = newVariableScopes()
+	ctx.registerParams = 0
+	ctx.stackParams = 0
+
+	ctx.targets = make(map[string]bool)
+	for node := n.Next; node != nil; node = node.Next {
+		switch i := node.Instr.(type) {
+		case *JmpInstr:
+			ctx.targets[i.Dst.Instr.(*LabelInstr).Label] = true
+		case *JmpCondInstr:
+			ctx.targets[i.Dst.Instr.(*LabelInstr).Label] = true
+		}
+	}
+
+	for node := n.Next; node != nil; node = node.Next {
+		ctx.generateInstr(node.Instr)
+	}
+	if !ctx.terminated {
+		if isMain {
+			ctx.emit("return 0;")
+		} else {
+			ctx.emit("abort();")
+		}
+	}
+
+	body := ""
+	for _, local := range ctx.locals {
+		body += fmt.Sprintf("\tint32_t %s = 0;\n", local)
+	}
+	return body + ctx.text
+}
+
+// Portable C99, generated before register allocation
+var CTarget Target = cTarget{}
+
+type cTarget struct{}
+
+func (cTarget) Name() string                                  { return "c" }
+func (cTarget) Description() string                           { return "C99 source" }
+func (cTarget) WordSize() int                                 { return 4 }
+func (cTarget) ArgumentRegisters() int                        { return 4 }
+func (cTarget) Registers() *RegisterFile                      { return nil }
+func (cTarget) OutputExtension() string                       { return ".c" }
+func (cTarget) GenerateCode(ifCtx *IFContext) (string, error) { return GenerateCCode(ifCtx) }
+
+// GenerateCCode generates a C99 translation unit for a program whose IF
+// hasn't been register allocated. As with GenerateCode, an error is a
+// compiler bug.
+func GenerateCCode(ifCtx *IFContext) (string, error) {
+	ctx := new(cGeneratorContext)
+	ctx.target = CTarget
+	ctx.callees = make(map[string]int)
+	ctx.literals = make(map[string]int)
+	ctx.dataEnd = cDataStart
+
+	type function struct {
+		name           string
+		body           string
+		registerParams int
+		stackParams    int
+	}
+	functions := []function{}
+	defined := make(map[string]bool)
+	for _, branch := range ifCtx.Branches() {
+		name := branch.Instr.(*LabelInstr).Label
+		body := ctx.generateFunction(branch, branch == ifCtx.main)
+		functions = append(functions, function{name, body, ctx.registerParams, ctx.stackParams})
+		defined[name] = true
+	}
+	if ctx.err != nil {
+		return "", ctx.err
+	}
+
+	prototypes := ""
+	code := ""
+	for _, f := range functions {
+		if f.name == ifCtx.main.Instr.(*LabelInstr).Label {
+			code += "int main(void)\n{\n" + f.body + "}\n\n"
+			continue
+		}
+
+		// Parameters after the fourth are numbered from the last, as on the
+		// stack
+		params := f.registerParams
+		if f.stackParams > 0 {
+			params = ctx.target.ArgumentRegisters() + f.stackParams
+		}
+		if ctx.callees[f.name] > params {
+			params = ctx.callees[f.name]
+		}
+		names := []string{}
+		for k := 0; k < params; k++ {
+			if k < ctx.target.ArgumentRegisters() {
+				names = append(names, fmt.Sprintf("int32_t arg%d", k))
+			} else {
+				names = append(names, fmt.Sprintf("int32_t stackarg%d", params-1-k))
+			}
+		}
+		if len(names) == 0 {
+			names = append(names, "void")
+		}
+		signature := fmt.Sprintf("int32_t %s(%s)", f.name, strings.Join(names, ", "))
+		prototypes += signature + ";\n"
+		code += signature + "\n{\n" + f.body + "}\n\n"
+	}
+
+	// Functions defined elsewhere
+	external := []string{}
+	for name := range ctx.callees {
+		if !defined[name] {
+			external = append(external, name)
+		}
+	}
+	sort.Strings(external)
+	for _, name := range external {
+		params := strings.TrimSuffix(strings.Repeat("int32_t, ", ctx.callees[name]), ", ")
+		if params == "" {
+			params = "void"
+		}
+		prototypes += fmt.Sprintf("extern int32_t %s(%s);\n", name, params)
+	}
+
+	data := ctx.literalDefs
+	data += fmt.Sprintf("static uint32_t _wacc_heap_top = %d;\n", ctx.dataEnd)
+	data += "\nstatic void _wacc_init_data(void)\n{\n" + ctx.literalInit + "}\n"
+
+	runtime := strings.Replace(cRuntime, "$memory_size", fmt.Sprint(cMemorySize), -1)
+	return runtime + "\n" + data + "\n" + prototypes + "\n" + code, nil
+}
+
+//
+// Runtime
+//
+const cRuntime = `/* Generated by the WACC compiler */
+#include <locale.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <wchar.h>
+
+/* String literals and the heap. WACC pointers are offsets into this. */
+#define WACC_MEMORY_SIZE $memory_size
+#define WACC_WORD(a) _wacc_memory[(uint32_t)(a) / 4]
+static int32_t _wacc_memory[WACC_MEMORY_SIZE / 4];
+static uint32_t _wacc_heap_top;
+static uint32_t _wacc_free_list;
+
+static void _wacc_init_data(void);
+
+void _wacc_throw_runtime_error(const char *msg)
+{
+	wprintf(L"%s", msg);
+	fflush(stdout);
+	exit(-1);
+}
+
+void _wacc_init(void)
+{
+	setlocale(LC_ALL, "");
+	_wacc_init_data();
+}
+
+/*
+ * Blocks are preceded by their size, and freed blocks are kept in a list
+ * threaded through their first word. The first block in the list which is big
+ * enough is reused, otherwise a new one is taken from the top of the heap.
+ */
+int32_t _wacc_malloc(uint32_t size)
+{
+	uint32_t *link = &_wacc_free_list;
+	uint32_t block;
+
+	size = (size + 3) & ~3u;
+	for (block = *link; block != 0; block = *link) {
+		if ((uint32_t)WACC_WORD(block - 4) >= size) {
+			*link = (uint32_t)WACC_WORD(block);
+			return (int32_t)block;
+		}
+		link = (uint32_t *)&WACC_WORD(block);
+	}
+
+	if (_wacc_heap_top + 4 + size > WACC_MEMORY_SIZE) {
+		_wacc_throw_runtime_error("OutOfMemoryError: the heap is full\n");
+	}
+	WACC_WORD(_wacc_heap_top) = (int32_t)size;
+	block = _wacc_heap_top + 4;
+	_wacc_heap_top = block + size;
+	return (int32_t)block;
+}
+
+void _wacc_free(int32_t block)
+{
+	WACC_WORD(block) = (int32_t)_wacc_free_list;
+	_wacc_free_list = (uint32_t)block;
+}
+
+void _wacc_throw_overflow_error(void)
+{
+	_wacc_throw_runtime_error("OverflowError: the result is too small/large to store in a 4-byte signed-integer.\n");
+}
+
+void _wacc_check_null_pointer(int32_t ptr)
+{
+	if (ptr == 0) {
+		_wacc_throw_runtime_error("NullReferenceError: dereference a null reference\n");
+	}
+}
+
+void _wacc_check_array_bounds(int32_t index, int32_t array)
+{
+	_wacc_check_null_pointer(array);
+	if (index < 0) {
+		_wacc_throw_runtime_error("ArrayIndexOutOfBoundsError: negative index\n");
+	}
+	if (index >= WACC_WORD(array)) {
+		_wacc_throw_runtime_error("ArrayIndexOutOfBoundsError: index too large\n");
+	}
+}
+
+void _wacc_check_divide_by_zero(int32_t divisor)
+{
+	if (divisor == 0) {
+		_wacc_throw_runtime_error("DivideByZeroError: divide or modulo by zero\n");
+	}
+}
+
+/* Integer arithmetic, raising an error when the result doesn't fit */
+int32_t _wacc_checked(int64_t result)
+{
+	if (result < INT32_MIN || result > INT32_MAX) {
+		_wacc_throw_overflow_error();
+	}
+	return (int32_t)result;
+}
+
+int32_t _wacc_add(int32_t a, int32_t b)
+{
+	return _wacc_checked((int64_t)a + b);
+}
+
+int32_t _wacc_sub(int32_t a, int32_t b)
+{
+	return _wacc_checked((int64_t)a - b);
+}
+
+int32_t _wacc_mul(int32_t a, int32_t b)
+{
+	return _wacc_checked((int64_t)a * b);
+}
+
+/* As __aeabi_idiv, dividing the smallest integer by -1 gives itself */
+int32_t _wacc_div(int32_t a, int32_t b)
+{
+	_wacc_check_divide_by_zero(b);
+	if (b == -1) {
+		return (int32_t)(0u - (uint32_t)a);
+	}
+	return a / b;
+}
+
+int32_t _wacc_mod(int32_t a, int32_t b)
+{
+	return _wacc_sub(a, _wacc_mul(_wacc_div(a, b), b));
+}
+
+/* Floats are kept as their bits */
+float _wacc_float(int32_t bits)
+{
+	float f;
+	memcpy(&f, &bits, sizeof f);
+	return f;
+}
+
+int32_t _wacc_bits(float f)
+{
+	int32_t bits;
+	memcpy(&bits, &f, sizeof bits);
+	return bits;
+}
+
+int32_t _wacc_fadd(int32_t a, int32_t b)
+{
+	return _wacc_bits(_wacc_float(a) + _wacc_float(b));
+}
+
+int32_t _wacc_fsub(int32_t a, int32_t b)
+{
+	return _wacc_bits(_wacc_float(a) - _wacc_float(b));
+}
+
+int32_t _wacc_fmul(int32_t a, int32_t b)
+{
+	return _wacc_bits(_wacc_float(a) * _wacc_float(b));
+}
+
+int32_t _wacc_fdiv(int32_t a, int32_t b)
+{
+	return _wacc_bits(_wacc_float(a) / _wacc_float(b));
+}
+
+int32_t _wacc_read_int(void)
+{
+	int n = 0;
+	wscanf(L"%d", &n);
+	return n;
+}
+
+int32_t _wacc_read_char(void)
+{
+	wchar_t c = 0;
+	wscanf(L" %lc", &c);
+	return (int32_t)c;
+}
+
+void _wacc_print_int(int32_t n)
+{
+	wprintf(L"%d", (int)n);
+	fflush(stdout);
+}
+
+void _wacc_print_float(int32_t bits)
+{
+	wprintf(L"%f", (double)_wacc_float(bits));
+	fflush(stdout);
+}
+
+void _wacc_print_bool(int32_t b)
+{
+	wprintf(L"%s", b ? "true" : "false");
+	fflush(stdout);
+}
+
+void _wacc_print_char(int32_t c)
+{
+	wprintf(L"%lc", (wint_t)c);
+	fflush(stdout);
+}
+
+void _wacc_print_wstr(int32_t s)
+{
+	int32_t i;
+	for (i = 0; i < WACC_WORD(s); i++) {
+		wprintf(L"%lc", (wint_t)WACC_WORD(s + 4 + i * 4));
+	}
+	fflush(stdout);
+}
+
+void _wacc_print_addr(int32_t p)
+{
+	if (p == 0) {
+		wprintf(L"%s", "(nil)");
+	} else {
+		wprintf(L"%p", (void *)(uintptr_t)(uint32_t)p);
+	}
+	fflush(stdout);
+}
+
+void _wacc_print_nl(void)
+{
+	putwchar(L'\n');
+}
+`
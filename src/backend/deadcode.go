@@ -0,0 +1,356 @@
+package backend
+
+import (
+	"../frontend"
+)
+
+// Dead code elimination over the IF in SSA form. Code which can never run is
+// removed first, then every instruction whose result is never needed. An
+// instruction is needed if it has an effect of its own, such as printing or
+// raising a runtime error, or if it defines a variable read by a needed
+// instruction.
+
+type spDeadCodeContext struct {
+	ifCtx  *IFContext
+	branch *InstrNode
+	cfg    *CFG
+}
+
+// hasSideEffects reports whether evaluating an expression can do anything
+// other than produce its value. Integer arithmetic and memory accesses count,
+// as they can raise runtime errors.
+func hasSideEffects(e Expr) bool {
+	switch e := e.(type) {
+	case *IntConstExpr, *FloatConstExpr, *BoolConstExpr, *CharConstExpr,
+		*StringConstExpr, *PointerConstExpr, *VarExpr:
+		return false
+
+	case *UnaryExpr:
+		switch e.Operator {
+		case Not, Ord, Chr, Len:
+			return hasSideEffects(e.Operand)
+		default:
+			return true
+		}
+
+	case *BinaryExpr:
+		switch e.Operator {
+		case And, Or, LT, LE, GT, GE, EQ, NE:
+		default:
+			if !e.Type.Equals(frontend.BasicType{frontend.FLOAT}) {
+				return true
+			}
+		}
+		return hasSideEffects(e.Left) || hasSideEffects(e.Right)
+
+	case *ArrayConstExpr:
+		for _, elem := range e.Elems {
+			if hasSideEffects(elem) {
+				return true
+			}
+		}
+		return false
+
+	case *NewStructExpr:
+		for _, arg := range e.Args {
+			if hasSideEffects(arg) {
+				return true
+			}
+		}
+		return false
+
+	case *NewPairExpr:
+		return hasSideEffects(e.Left) || hasSideEffects(e.Right)
+
+	default:
+		return true
+	}
+}
+
+// isRemovable reports whether an instruction can be deleted when nothing
+// reads what it defines
+func isRemovable(i Instr) bool {
+	switch i := i.(type) {
+	case *MoveInstr:
+		_, ok := i.Dst.(*VarExpr)
+		return ok && !hasSideEffects(i.Src)
+
+	case *EvalInstr:
+		return !hasSideEffects(i.Expr)
+
+	case *PhiInstr:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// removeNode deletes an instruction from the branch, leaving a no-op behind if
+// it is all that's left of its block so that the edges of the CFG stay the
+// same
+func (ctx *spDeadCodeContext) removeNode(node *InstrNode, remaining map[*BasicBlock]int) {
+	b := ctx.cfg.BlockOf(node)
+	if remaining[b] == 1 {
+		node.Instr = &NoOpInstr{}
+		return
+	}
+	remaining[b]--
+	unlinkNode(node)
+}
+
+//
+// Unreachable code
+//
+// removeUnreachable deletes the instructions in blocks which can't be reached.
+// Labels and scope changes are kept for now, as the code generator tracks the
+// stack through them.
+func (ctx *spDeadCodeContext) removeUnreachable() {
+	edges := phiEdges(ctx.cfg)
+	for _, b := range ctx.cfg.Blocks {
+		if b.Reachable() {
+			continue
+		}
+		for _, node := range b.Instrs {
+			switch node.Instr.(type) {
+			case *LabelInstr, *PushScopeInstr, *PopScopeInstr:
+			default:
+				unlinkNode(node)
+			}
+		}
+	}
+	ctx.cfg.Rebuild()
+	remapPhis(ctx.cfg, edges)
+}
+
+// removeEmptyScope deletes a scope with nothing in it, other than the
+// outermost one
+func (ctx *spDeadCodeContext) removeEmptyScope(node *InstrNode, remaining map[*BasicBlock]int) bool {
+	if _, ok := node.Instr.(*PushScopeInstr); !ok || node.Next == nil || node.Next.Next == nil {
+		return false
+	}
+	if _, ok := node.Next.Instr.(*PopScopeInstr); !ok {
+		return false
+	}
+
+	b := ctx.cfg.BlockOf(node)
+	if b != ctx.cfg.BlockOf(node.Next) || (remaining[b] <= 2 && b.Reachable()) {
+		return false
+	}
+	remaining[b] -= 2
+	unlinkNode(node.Next)
+	unlinkNode(node)
+	return true
+}
+
+// removeJumpToNext deletes a jump to the instruction which follows it anyway
+func (ctx *spDeadCodeContext) removeJumpToNext(node *InstrNode, remaining map[*BasicBlock]int) bool {
+	jmp, ok := node.Instr.(*JmpInstr)
+	if !ok || node.Next == nil {
+		return false
+	}
+	label, ok := node.Next.Instr.(*LabelInstr)
+	if !ok || label.Label != jmp.Dst.Instr.(*LabelInstr).Label {
+		return false
+	}
+
+	b := ctx.cfg.BlockOf(node)
+	if remaining[b] <= 1 && b.Reachable() {
+		return false
+	}
+	remaining[b]--
+	unlinkNode(node)
+	return true
+}
+
+// removeUnusedLabels deletes the labels nothing jumps to, other than the one
+// naming the branch. A label which is all that's left of its block becomes a
+// no-op instead, as without it the jump and the fall through into the next
+// block would become a single edge.
+func (ctx *spDeadCodeContext) removeUnusedLabels(remaining map[*BasicBlock]int) bool {
+	targets := make(map[string]bool)
+	for node := ctx.branch; node != nil; node = node.Next {
+		switch i := node.Instr.(type) {
+		case *JmpInstr:
+			targets[i.Dst.Instr.(*LabelInstr).Label] = true
+		case *JmpCondInstr:
+			targets[i.Dst.Instr.(*LabelInstr).Label] = true
+		}
+	}
+
+	changed := false
+	for node := ctx.branch.Next; node != nil; node = node.Next {
+		if label, ok := node.Instr.(*LabelInstr); ok && !targets[label.Label] {
+			ctx.removeNode(node, remaining)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// tidy removes what is left behind once the dead code has gone. Blocks in
+// code which can be reached are never emptied, as that could change the edges
+// of the CFG.
+func (ctx *spDeadCodeContext) tidy() {
+	// The blocks still hold the instructions removed since the CFG was
+	// built, so they have to be counted again
+	ctx.cfg.Rebuild()
+	edges := phiEdges(ctx.cfg)
+	remaining := make(map[*BasicBlock]int)
+	for _, b := range ctx.cfg.Blocks {
+		remaining[b] = len(b.Instrs)
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for node := ctx.branch; node != nil; node = node.Next {
+			if ctx.removeEmptyScope(node, remaining) || ctx.removeJumpToNext(node, remaining) {
+				changed = true
+			}
+		}
+		if ctx.removeUnusedLabels(remaining) {
+			changed = true
+		}
+	}
+
+	ctx.cfg.Rebuild()
+	remapPhis(ctx.cfg, edges)
+}
+
+//
+// Dead instructions
+//
+// removeDeadInstrs marks every instruction which is needed, starting from the
+// ones which can't be removed and following the variables they read back to
+// their definitions, and deletes the rest
+func (ctx *spDeadCodeContext) removeDeadInstrs() {
+	defs := make(map[string]*InstrNode)
+	for node := ctx.branch; node != nil; node = node.Next {
+		if v := definedVar(node.Instr); v != nil {
+			defs[v.Name] = node
+		}
+	}
+
+	needed := make(map[*InstrNode]bool)
+	worklist := []*InstrNode{}
+	for node := ctx.branch; node != nil; node = node.Next {
+		if _, ok := node.Instr.(*DeclareInstr); !ok && !isRemovable(node.Instr) {
+			needed[node] = true
+			worklist = append(worklist, node)
+		}
+	}
+
+	need := func(v *VarExpr) Expr {
+		if def, ok := defs[v.Name]; ok && !needed[def] {
+			needed[def] = true
+			worklist = append(worklist, def)
+		}
+		return v
+	}
+	for len(worklist) > 0 {
+		node := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+
+		if phi, ok := node.Instr.(*PhiInstr); ok {
+			for _, arg := range phi.Args {
+				mapVars(arg, need)
+			}
+		} else {
+			rewriteUses(node.Instr, need)
+		}
+	}
+
+	remaining := make(map[*BasicBlock]int)
+	for _, b := range ctx.cfg.Blocks {
+		remaining[b] = len(b.Instrs)
+	}
+	for node := ctx.branch; node != nil; node = node.Next {
+		if _, ok := node.Instr.(*DeclareInstr); !ok && !needed[node] {
+			ctx.removeNode(node, remaining)
+		}
+	}
+}
+
+//
+// Unused variables
+//
+// removeDeclarations deletes the declarations of variables which are no longer
+// mentioned, and frees the stack they were given by the translator
+func (ctx *spDeadCodeContext) removeDeclarations() {
+	mentioned := make(map[string]bool)
+	mention := func(v *VarExpr) Expr {
+		mentioned[v.Name] = true
+		return v
+	}
+	for node := ctx.branch; node != nil; node = node.Next {
+		if phi, ok := node.Instr.(*PhiInstr); ok {
+			for _, arg := range phi.Args {
+				mapVars(arg, mention)
+			}
+		} else {
+			rewriteUses(node.Instr, mention)
+		}
+		if v := definedVar(node.Instr); v != nil {
+			mention(v)
+		}
+	}
+
+	type scope struct {
+		push     *PushScopeInstr
+		declared int
+		removed  int
+	}
+	// Declarations outside of any scope have no stack to free
+	scopes := []*scope{{push: new(PushScopeInstr)}}
+
+	aligned := func(variables int) int {
+		size := variables * ctx.ifCtx.target.WordSize()
+		if (size % 8) != 0 {
+			size += 8 - (size % 8)
+		}
+		return size
+	}
+
+	for node := ctx.branch; node != nil; node = node.Next {
+		switch i := node.Instr.(type) {
+		case *PushScopeInstr:
+			scopes = append(scopes, &scope{push: i})
+
+		case *DeclareInstr:
+			s := scopes[len(scopes)-1]
+			s.declared++
+			if !mentioned[i.Var.Name] {
+				s.removed++
+				unlinkNode(node)
+			}
+
+		case *PopScopeInstr:
+			// Scopes sized by the register allocator have no stack for
+			// their variables yet
+			s := scopes[len(scopes)-1]
+			scopes = scopes[:len(scopes)-1]
+			if s.push.StackSize >= aligned(s.declared) {
+				s.push.StackSize += aligned(s.declared-s.removed) - aligned(s.declared)
+			}
+			i.StackSize = s.push.StackSize
+		}
+	}
+}
+
+func (ctx *spDeadCodeContext) optimizePath(branch *InstrNode) {
+	ctx.branch = branch
+	ctx.cfg = BuildCFG(branch)
+
+	ctx.removeUnreachable()
+	ctx.removeDeadInstrs()
+	ctx.tidy()
+	ctx.removeDeclarations()
+}
+
+func (ctx *spDeadCodeContext) Optimize(ifCtx *IFContext) {
+	ctx.ifCtx = ifCtx
+
+	for _, branch := range ifCtx.Branches() {
+		ctx.optimizePath(branch)
+	}
+}
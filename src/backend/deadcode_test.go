@@ -0,0 +1,153 @@
+package backend
+
+import (
+	"testing"
+)
+
+// optimise runs the second optimisation pass over a program in SSA form
+func optimise(t *testing.T, source string) *IFContext {
+	ifCtx := translate(t, source)
+	if err := ConvertToSSA(ifCtx); err != nil {
+		t.Fatalf("ConvertToSSA returned %v for %q", err, source)
+	}
+	OptimiseSecondPassIF(ifCtx)
+	return ifCtx
+}
+
+// assignedVars returns the variables of the original program which are still
+// assigned to in a branch in SSA form
+func assignedVars(branch *InstrNode) map[string]bool {
+	assigned := make(map[string]bool)
+	for node := branch; node != nil; node = node.Next {
+		if v := definedVar(node.Instr); v != nil {
+			name, _ := versionOf(v.Name)
+			assigned[name] = true
+		}
+	}
+	return assigned
+}
+
+// checkPhis checks that every phi has an argument for each edge into its block
+func checkPhis(t *testing.T, name string, branch *InstrNode) {
+	cfg := BuildCFG(branch)
+	for node := branch; node != nil; node = node.Next {
+		if phi, ok := node.Instr.(*PhiInstr); ok {
+			if preds := len(cfg.BlockOf(node).Preds); len(phi.Args) != preds {
+				t.Errorf("%v: %v has %v arguments for %v edges", name, phi.Repr(), len(phi.Args), preds)
+			}
+		}
+	}
+}
+
+func TestDeadCodeElimination(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+
+		// Variables which should and shouldn't be assigned afterwards
+		kept    []string
+		removed []string
+	}{
+		{
+			"dead copy",
+			"begin\n  int x = 0 ;\n  read x ;\n  int y = x ;\n  bool b = x > 0 ;\n  println x\nend\n",
+			[]string{"x"},
+			[]string{"y", "b"},
+		},
+		{
+			"overwritten",
+			"begin\n  int x = 0 ;\n  read x ;\n  int y = x ;\n  y = 2 ;\n  println y\nend\n",
+			[]string{"x"},
+			[]string{"y"},
+		},
+		{
+			"could fail",
+			"begin\n  int x = 0 ;\n  read x ;\n  int y = 10 / x ;\n  int z = x + 1 ;\n  println x\nend\n",
+			[]string{"x", "y", "z"},
+			nil,
+		},
+		{
+			"dead in a loop",
+			"begin\n  int i = 0 ;\n  int d = 0 ;\n  while i < 3 do\n    d = i ;\n    i = i + 1\n  done ;\n  println i\nend\n",
+			[]string{"i"},
+			[]string{"d"},
+		},
+		{
+			"needed by a phi",
+			"begin\n  int x = 0 ;\n  read x ;\n  int y = 0 ;\n  if x > 0 then y = x else y = 1 fi ;\n  println y\nend\n",
+			[]string{"x", "y"},
+			nil,
+		},
+		{
+			"empty branches",
+			"begin\n  int x = 0 ;\n  read x ;\n  int y = 0 ;\n  if x > 0 then y = 1 else skip fi ;\n  if x > 1 then skip else y = 2 fi ;\n  println x\nend\n",
+			[]string{"x"},
+			[]string{"y"},
+		},
+	}
+	for _, test := range tests {
+		ifCtx := optimise(t, test.source)
+		assigned := assignedVars(ifCtx.main)
+		for _, v := range test.kept {
+			if !assigned[v] {
+				t.Errorf("%v: %v is no longer assigned", test.name, v)
+			}
+		}
+		for _, v := range test.removed {
+			if assigned[v] {
+				t.Errorf("%v: %v is still assigned", test.name, v)
+			}
+		}
+		checkPhis(t, test.name, ifCtx.main)
+	}
+}
+
+func TestUnreachableCodeElimination(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		prints int
+	}{
+		{"if false", "begin\n  if false then println 1 else println 2 fi\nend\n", 1},
+		{"if true", "begin\n  if 1 < 2 then println 1 else println 2 fi\nend\n", 1},
+		{"while false", "begin\n  while false do println 1 done ;\n  println 2\nend\n", 1},
+		{"after exit", "begin\n  int x = 0 ;\n  read x ;\n  if x > 0 then exit 1 else skip fi ;\n  println x\nend\n", 1},
+	}
+	for _, test := range tests {
+		ifCtx := optimise(t, test.source)
+		prints := 0
+		for node := ifCtx.main; node != nil; node = node.Next {
+			if print, ok := node.Instr.(*PrintInstr); ok {
+				if _, ok := print.Expr.(*CharConstExpr); !ok {
+					prints++
+				}
+			}
+		}
+		if prints != test.prints {
+			t.Errorf("%v: %v prints are left, want %v", test.name, prints, test.prints)
+		}
+		checkPhis(t, test.name, ifCtx.main)
+	}
+}
+
+func TestDeadDeclarationsFreeStack(t *testing.T) {
+	// Without SSA form, the scopes are still sized by the translator
+	ifCtx := translate(t, "begin\n  int x = 1 ;\n  int y = 2 ;\n  int z = 3 ;\n  println z\nend\n")
+	push := ifCtx.main.Next.Next.Instr.(*PushScopeInstr)
+	if push.StackSize != 16 {
+		t.Fatalf("three variables are given %v bytes, want 16", push.StackSize)
+	}
+	new(spDeadCodeContext).Optimize(ifCtx)
+
+	if push.StackSize != 8 {
+		t.Errorf("one variable is given %v bytes, want 8", push.StackSize)
+	}
+	for node := ifCtx.main; node != nil; node = node.Next {
+		if pop, ok := node.Instr.(*PopScopeInstr); ok && pop.StackSize != push.StackSize {
+			t.Errorf("scope pushes %v bytes and pops %v", push.StackSize, pop.StackSize)
+		}
+	}
+	if vars := declaredVars(ifCtx.main); len(vars) != 1 || vars[0] != "z" {
+		t.Errorf("declared variables are %v, want z", vars)
+	}
+}
@@ -0,0 +1,29 @@
+package backend
+
+import "fmt"
+
+// An InternalError is a bug in the compiler rather than a problem with the
+// program being compiled: something in the AST or the IF which an earlier
+// stage should have ruled out.
+type InternalError struct {
+	Stage   string
+	Message string
+}
+
+func (e *InternalError) Error() string {
+	return e.Stage + ": " + e.Message
+}
+
+// stageErrors keeps the first internal error a stage runs into. Rather than
+// checking for an error after every step, the stage carries on with a
+// placeholder and returns the error once it has finished.
+type stageErrors struct {
+	stage string
+	err   error
+}
+
+func (s *stageErrors) fail(format string, a ...interface{}) {
+	if s.err == nil {
+		s.err = &InternalError{s.stage, fmt.Sprintf(format, a...)}
+	}
+}
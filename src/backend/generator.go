@@ -8,16 +8,32 @@ import (
 )
 
 type GeneratorContext struct {
+	target        Target
 	stringCounter int
 	data          string
 	text          string
 	stackDistance int
 
+	// Stack reserved by each scope, innermost last
+	scopeSizes []int
+
 	currentFunction string
+
+	// Instructions generated since the literal pool was last placed, and the
+	// number of pools placed inside functions so far
+	poolDistance int
+	poolCount    int
+
+	stageErrors
 }
 
+// An ldr from the literal pool only reaches 4KB, so long functions have pools
+// placed inside them, with a branch around each. A pool holds at most one
+// word for each load since the last one, so this keeps both well in range.
+const literalPoolInterval = 256
+
 func (ctx *GeneratorContext) generateStackOffset(stack *StackLocationExpr) int {
-	return ctx.stackDistance - regWidth*stack.Id
+	return ctx.stackDistance - ctx.target.WordSize()*stack.Id
 }
 
 func (ctx *GeneratorContext) pushLabel(label string) {
@@ -26,20 +42,116 @@ func (ctx *GeneratorContext) pushLabel(label string) {
 
 func (ctx *GeneratorContext) pushCode(s string, a ...interface{}) {
 	ctx.text += "\t" + fmt.Sprintf(s, a...) + "\n"
+
+	ctx.poolDistance++
+	if s == ".ltorg" {
+		ctx.poolDistance = 0
+	} else if ctx.poolDistance >= literalPoolInterval {
+		label := fmt.Sprintf("_pool_%d", ctx.poolCount)
+		ctx.poolCount++
+		ctx.text += fmt.Sprintf("\tb %v\n", label)
+		ctx.pushCode(".ltorg")
+		ctx.pushLabel(label)
+	}
 }
 
 //
 // Instructions
 //
-func (i *NoOpInstr) generateCode(*GeneratorContext) {}
+func (ctx *GeneratorContext) generateInstr(instr Instr) {
+	switch instr := instr.(type) {
+	case *NoOpInstr, *EvalInstr, *DeclareInstr:
 
-func (i *LabelInstr) generateCode(ctx *GeneratorContext) {
-	ctx.pushLabel(i.Label)
-}
+	case *LabelInstr:
+		ctx.pushLabel(instr.Label)
+
+	case *ReadInstr:
+		ctx.generateRead(instr)
+
+	case *FreeInstr:
+		ctx.generateFree(instr)
+
+	case *ReturnInstr:
+		ctx.generateReturn(instr)
+
+	case *ExitInstr:
+		ctx.generateExit(instr)
+
+	case *PrintInstr:
+		ctx.generatePrint(instr)
+
+	case *MoveInstr:
+		ctx.generateMove(instr)
+
+	case *NotInstr:
+		ctx.generateNot(instr)
+
+	case *NegInstr:
+		ctx.generateNeg(instr)
+
+	case *CmpInstr:
+		ctx.generateCmp(instr)
+
+	case *JmpInstr:
+		ctx.generateJmp(instr)
+
+	case *JmpCondInstr:
+		ctx.generateJmpCond(instr)
+
+	case *AddInstr:
+		ctx.generateAdd(instr)
+
+	case *SubInstr:
+		ctx.generateSub(instr)
+
+	case *MulInstr:
+		ctx.generateMul(instr)
+
+	case *DivInstr:
+		ctx.generateDiv(instr)
+
+	case *AndInstr:
+		ctx.generateAnd(instr)
+
+	case *OrInstr:
+		ctx.generateOr(instr)
+
+	case *PushScopeInstr:
+		ctx.generatePushScope(instr)
+
+	case *PopScopeInstr:
+		ctx.generatePopScope(instr)
 
-func (i *EvalInstr) generateCode(*GeneratorContext) {}
+	case *UnwindScopesInstr:
+		ctx.generateUnwindScopes(instr)
 
-func (i *ReadInstr) generateCode(ctx *GeneratorContext) {
+	case *CheckNullDereferenceInstr:
+		ctx.generateCheckNullDereference(instr)
+
+	case *CallInstr:
+		ctx.generateCall(instr)
+
+	case *HeapAllocInstr:
+		ctx.generateHeapAlloc(instr)
+
+	case *PushInstr:
+		ctx.generatePush(instr)
+
+	case *PopInstr:
+		ctx.generatePop(instr)
+
+	case *LocaleInstr:
+		ctx.generateLocale(instr)
+
+	case *PhiInstr:
+		ctx.fail("Phi instructions must be removed before code generation")
+
+	default:
+		ctx.fail("Unhandled instruction %T", instr)
+	}
+}
+
+func (ctx *GeneratorContext) generateRead(i *ReadInstr) {
 	ctx.pushCode("mov r1, #0")
 	ctx.pushCode("str r1, [sp]")
 	ctx.pushCode("add r1, sp, #0")
@@ -67,24 +179,24 @@ func (i *ReadInstr) generateCode(ctx *GeneratorContext) {
 	}
 }
 
-func (i *FreeInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateFree(i *FreeInstr) {
 	ctx.pushCode("mov r0, %v", i.Object.(*RegisterExpr).Repr())
 	ctx.pushCode("bl " + RuntimeCheckNullPointerLabel)
 	ctx.pushCode("bl free")
 }
 
-func (i *ReturnInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateReturn(i *ReturnInstr) {
 	ctx.pushCode("mov r0, %v", i.Expr.Repr())
 	ctx.pushCode("add sp, sp, #%v", ctx.stackDistance)
 	ctx.pushCode("b _" + ctx.currentFunction + "_end")
 }
 
-func (i *ExitInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateExit(i *ExitInstr) {
 	ctx.pushCode("mov r0, %v", i.Expr.Repr())
 	ctx.pushCode("bl exit")
 }
 
-func (i *PrintInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generatePrint(i *PrintInstr) {
 	// save regs r0 and r1
 	//ctx.pushCode("push {r0,r1}")
 
@@ -118,7 +230,7 @@ func (i *PrintInstr) generateCode(ctx *GeneratorContext) {
 		ctx.pushCode("mov r1, %v", obj.Repr())
 
 	default:
-		panic(fmt.Sprintf("Cannot print an object of type %T", obj))
+		ctx.fail("Cannot print an object of type %T", obj)
 	}
 
 	derivedType := i.Type
@@ -142,7 +254,7 @@ func (i *PrintInstr) generateCode(ctx *GeneratorContext) {
 	//ctx.pushCode("pop {r0,r1}")
 }
 
-func (i *MoveInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateMove(i *MoveInstr) {
 	switch dst := i.Dst.(type) {
 	case *MemExpr:
 		if dst.Offset == 0 {
@@ -188,7 +300,7 @@ func (i *MoveInstr) generateCode(ctx *GeneratorContext) {
 		case *StackArgumentExpr:
 			// 9 here signifies size different of the stack after push {r4-r11, lr}
 			saveRegsPushSize := 9
-			ctx.pushCode("ldr %v, [sp, #%v]", dst.Repr(), ctx.stackDistance+(src.Id+saveRegsPushSize)*regWidth)
+			ctx.pushCode("ldr %v, [sp, #%v]", dst.Repr(), ctx.stackDistance+(src.Id+saveRegsPushSize)*ctx.target.WordSize())
 
 		case *MemExpr:
 			if src.Offset == 0 {
@@ -198,29 +310,29 @@ func (i *MoveInstr) generateCode(ctx *GeneratorContext) {
 			}
 
 		default:
-			panic(fmt.Sprintf("Unhandled src type of mov %T", src))
+			ctx.fail("Unhandled src type of mov %T", src)
 		}
 
 	default:
-		panic(fmt.Sprintf("Unhandled dst type of mov %T", dst))
+		ctx.fail("Unhandled dst type of mov %T", dst)
 	}
 }
 
-func (i *NotInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateNot(i *NotInstr) {
 	dst := i.Dst.(*RegisterExpr).Repr()
 	src := i.Src.(*RegisterExpr).Repr()
 
 	ctx.pushCode("mvn %v, %v", dst, src)
 }
 
-func (i *NegInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateNeg(i *NegInstr) {
 	arg := i.Expr.(*RegisterExpr).Repr()
 
 	ctx.pushCode("rsbs %v, %v, #0", arg, arg)
 	ctx.pushCode("blvs " + RuntimeOverflowLabel)
 }
 
-func (i *CmpInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateCmp(i *CmpInstr) {
 	cc := "al"
 	switch i.Operator {
 	case EQ:
@@ -241,19 +353,20 @@ func (i *CmpInstr) generateCode(ctx *GeneratorContext) {
 	ctx.pushCode("mov%s %v, #1", cc, i.Dst.Repr())
 }
 
-func (i *JmpInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateJmp(i *JmpInstr) {
 	ctx.pushCode("b %v", i.Dst.Instr.(*LabelInstr).Label)
 }
 
-func (i *JmpCondInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateJmpCond(i *JmpCondInstr) {
 	if _, ok := i.Cond.(*RegisterExpr); !ok {
-		panic("condition is not a register, abort")
+		ctx.fail("condition is not a register, abort")
+		return
 	}
 	ctx.pushCode("cmp %v, #0", i.Cond.Repr())
 	ctx.pushCode("bne %v", i.Dst.Instr.(*LabelInstr).Label)
 }
 
-func (i *AddInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateAdd(i *AddInstr) {
 	if i.Type.Equals(frontend.BasicType{frontend.FLOAT}) {
 		ctx.pushCode("mov r0, %v", i.Op1.Repr())
 		ctx.pushCode("mov r1, %v", i.Op2.Repr())
@@ -275,7 +388,7 @@ func (i *AddInstr) generateCode(ctx *GeneratorContext) {
 	}
 }
 
-func (i *SubInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateSub(i *SubInstr) {
 	if i.Type.Equals(frontend.BasicType{frontend.FLOAT}) {
 		ctx.pushCode("mov r0, %v", i.Op1.Repr())
 		ctx.pushCode("mov r1, %v", i.Op2.Repr())
@@ -297,7 +410,7 @@ func (i *SubInstr) generateCode(ctx *GeneratorContext) {
 	}
 }
 
-func (i *MulInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateMul(i *MulInstr) {
 	if i.Type.Equals(frontend.BasicType{frontend.FLOAT}) {
 		ctx.pushCode("mov r0, %v", i.Op1.Repr())
 		ctx.pushCode("mov r1, %v", i.Op2.Repr())
@@ -314,7 +427,7 @@ func (i *MulInstr) generateCode(ctx *GeneratorContext) {
 	}
 }
 
-func (i *DivInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateDiv(i *DivInstr) {
 	if i.Type.Equals(frontend.BasicType{frontend.FLOAT}) {
 		ctx.pushCode("mov r0, %v", i.Op1.Repr())
 		ctx.pushCode("mov r1, %v", i.Op2.Repr())
@@ -329,17 +442,15 @@ func (i *DivInstr) generateCode(ctx *GeneratorContext) {
 	}
 }
 
-func (i *AndInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateAnd(i *AndInstr) {
 	ctx.pushCode("and %v, %v, %v", i.Dst.Repr(), i.Op1.Repr(), i.Op2.Repr())
 }
 
-func (i *OrInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateOr(i *OrInstr) {
 	ctx.pushCode("orr %v, %v, %v", i.Dst.Repr(), i.Op1.Repr(), i.Op2.Repr())
 }
 
-func (*DeclareInstr) generateCode(*GeneratorContext) {}
-
-func (i *PushScopeInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generatePushScope(i *PushScopeInstr) {
 	stackSpace := i.StackSize
 	for stackSpace > 0 {
 		thisTime := stackSpace
@@ -350,11 +461,26 @@ func (i *PushScopeInstr) generateCode(ctx *GeneratorContext) {
 		stackSpace -= thisTime
 	}
 	ctx.stackDistance += i.StackSize
+	ctx.scopeSizes = append(ctx.scopeSizes, i.StackSize)
 }
 
-func (i *PopScopeInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generatePopScope(i *PopScopeInstr) {
 	ctx.stackDistance -= i.StackSize
-	stackSpace := i.StackSize
+	ctx.scopeSizes = ctx.scopeSizes[:len(ctx.scopeSizes)-1]
+	ctx.freeStack(i.StackSize)
+}
+
+// The scopes being left stay open for the code after the jump, so the stack
+// distance is left alone
+func (ctx *GeneratorContext) generateUnwindScopes(i *UnwindScopesInstr) {
+	stackSpace := 0
+	for _, size := range ctx.scopeSizes[len(ctx.scopeSizes)-i.Scopes:] {
+		stackSpace += size
+	}
+	ctx.freeStack(stackSpace)
+}
+
+func (ctx *GeneratorContext) freeStack(stackSpace int) {
 	for stackSpace > 0 {
 		thisTime := stackSpace
 		if thisTime > 1024 {
@@ -365,34 +491,34 @@ func (i *PopScopeInstr) generateCode(ctx *GeneratorContext) {
 	}
 }
 
-func (i *CheckNullDereferenceInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateCheckNullDereference(i *CheckNullDereferenceInstr) {
 	ctx.pushCode("push {r0}")
 	ctx.pushCode("mov r0, r%v", i.Ptr.(*RegisterExpr).Id)
 	ctx.pushCode("bl " + RuntimeCheckNullPointerLabel)
 	ctx.pushCode("pop {r0}")
 }
 
-func (i *CallInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateCall(i *CallInstr) {
 	ctx.pushCode("bl %v", i.Label.Label)
 }
 
-func (i *HeapAllocInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateHeapAlloc(i *HeapAllocInstr) {
 	ctx.pushCode("ldr r0, =%v", i.Size)
 	ctx.pushCode("bl malloc")
 	ctx.pushCode("mov %v, r0", i.Dst.Repr())
 }
 
-func (i *PushInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generatePush(i *PushInstr) {
 	ctx.pushCode("push {%v}", i.Op.Repr())
 	ctx.stackDistance += 4
 }
 
-func (i *PopInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generatePop(i *PopInstr) {
 	ctx.stackDistance -= 4
 	ctx.pushCode("pop {%v}", i.Op.Repr())
 }
 
-func (i *LocaleInstr) generateCode(ctx *GeneratorContext) {
+func (ctx *GeneratorContext) generateLocale(i *LocaleInstr) {
 	ctx.pushCode("mov r0, #6")
 	ctx.pushCode("ldr r1, =_wacc_null")
 	ctx.pushCode("bl setlocale")
@@ -416,15 +542,16 @@ func (ctx *GeneratorContext) generateData(ifCtx *IFContext) {
 
 func (ctx *GeneratorContext) generateFunction(n *InstrNode) {
 	ctx.currentFunction = n.Instr.(*LabelInstr).Label
+	ctx.stage = "generating code for " + ctx.currentFunction
 
 	// Generate the label
-	n.Instr.generateCode(ctx)
+	ctx.generateInstr(n.Instr)
 	ctx.pushCode("push {r4-r11,lr}")
 
 	// Generate code for each instruction in the function
 	node := n.Next
 	for node != nil {
-		node.Instr.generateCode(ctx)
+		ctx.generateInstr(node.Instr)
 		node = node.Next
 	}
 
@@ -436,8 +563,35 @@ func (ctx *GeneratorContext) generateFunction(n *InstrNode) {
 	ctx.pushCode(".ltorg")
 }
 
-func GenerateCode(ifCtx *IFContext) string {
+// The registers r4-r11 are callee-saved in the EABI, so the allocator can use
+// them across calls into the C library. r0-r3 pass arguments.
+var armRegisterFile = &RegisterFile{
+	Count:          12,
+	FirstTemporary: 4,
+	LastTemporary:  11,
+	FirstVariable:  8,
+	LastVariable:   11,
+}
+
+// 32-bit ARM Linux, using the EABI
+var ARMTarget Target = armTarget{}
+
+type armTarget struct{}
+
+func (armTarget) Name() string                                  { return "arm-linux" }
+func (armTarget) Description() string                           { return "32-bit ARM Linux" }
+func (armTarget) WordSize() int                                 { return 4 }
+func (armTarget) ArgumentRegisters() int                        { return 4 }
+func (armTarget) Registers() *RegisterFile                      { return armRegisterFile }
+func (armTarget) OutputExtension() string                       { return ".s" }
+func (armTarget) GenerateCode(ifCtx *IFContext) (string, error) { return GenerateCode(ifCtx) }
+
+// GenerateCode returns the ARM assembly for register allocated IF. An error
+// means the IF contained something with no ARM equivalent, which is a compiler
+// bug.
+func GenerateCode(ifCtx *IFContext) (string, error) {
 	ctx := new(GeneratorContext)
+	ctx.target = ARMTarget
 
 	// Printf format strings
 	ctx.data += `
@@ -492,6 +646,10 @@ _wacc_null:
 	// Generate program code
 	ctx.generateFunction(ifCtx.main)
 
+	if ctx.err != nil {
+		return "", ctx.err
+	}
+
 	// Combine data and text sections
 	return ".data\n" + ctx.data + ".text\n" + ctx.text + `
 ` + RuntimeCheckArrayBoundsLabel + `:
@@ -590,5 +748,5 @@ _wacc_print_nl:
 	mov r0, #'\n'
 	bl putwchar
 	pop {pc}
-`
+`, nil
 }
@@ -2,6 +2,7 @@ package backend
 
 import (
 	"fmt"
+	"io"
 	"strings"
 	"unicode"
 
@@ -84,17 +85,26 @@ type StackArgumentExpr struct {
 type ArrayElemExpr struct {
 	Array Expr
 	Index Expr
+
+	// The index is known to be in range, so no bounds check is needed
+	InBounds bool
 }
 
 type PairElemExpr struct {
 	Fst     bool
 	Operand *VarExpr
+
+	// The pair is known not to be null, so no null check is needed
+	NotNull bool
 }
 
 type StructElemExpr struct {
 	StructIdent *VarExpr
 	ElemIdent   *VarExpr
 	ElemOffset  int
+
+	// The struct is known not to be null, so no null check is needed
+	NotNull bool
 }
 
 type UnaryExpr struct {
@@ -218,7 +228,9 @@ func (e ArrayElemExpr) Repr() string {
 	return fmt.Sprintf("ARRAY ELEM %v IN %v", e.Index.Repr(), e.Array.Repr())
 }
 func (ArrayElemExpr) Weight() int  { return 1 }
-func (e ArrayElemExpr) Copy() Expr { return &ArrayElemExpr{e.Array.Copy(), e.Index.Copy()} }
+func (e ArrayElemExpr) Copy() Expr {
+	return &ArrayElemExpr{e.Array.Copy(), e.Index.Copy(), e.InBounds}
+}
 
 func (PairElemExpr) expr() {}
 func (e PairElemExpr) Repr() string {
@@ -229,7 +241,9 @@ func (e PairElemExpr) Repr() string {
 	}
 }
 func (PairElemExpr) Weight() int  { return 1 }
-func (e PairElemExpr) Copy() Expr { return &PairElemExpr{e.Fst, e.Operand.Copy().(*VarExpr)} }
+func (e PairElemExpr) Copy() Expr {
+	return &PairElemExpr{e.Fst, e.Operand.Copy().(*VarExpr), e.NotNull}
+}
 
 func (StructElemExpr) expr() {}
 func (e StructElemExpr) Repr() string {
@@ -241,6 +255,7 @@ func (e StructElemExpr) Copy() Expr {
 		e.StructIdent.Copy().(*VarExpr),
 		e.ElemIdent.Copy().(*VarExpr),
 		e.ElemOffset,
+		e.NotNull,
 	}
 }
 
@@ -331,13 +346,35 @@ func (i *InstrNode) Copy() *InstrNode {
 	}
 }
 
+func insertBefore(node *InstrNode, i Instr) *InstrNode {
+	newNode := &InstrNode{i, 0, node, node.Prev}
+	node.Prev.Next = newNode
+	node.Prev = newNode
+	return newNode
+}
+
+func insertAfter(node *InstrNode, i Instr) *InstrNode {
+	newNode := &InstrNode{i, 0, node.Next, node}
+	if node.Next != nil {
+		node.Next.Prev = newNode
+	}
+	node.Next = newNode
+	return newNode
+}
+
+func unlinkNode(node *InstrNode) {
+	node.Prev.Next = node.Next
+	if node.Next != nil {
+		node.Next.Prev = node.Prev
+	}
+}
+
 type Instr interface {
 	instr()
 	Repr() string
 	Copy() Instr
 
 	allocateRegisters(*RegisterAllocatorContext)
-	generateCode(*GeneratorContext)
 }
 
 type NoOpInstr struct {
@@ -403,9 +440,24 @@ type PopScopeInstr struct {
 	StackSize int
 }
 
+// Frees the stack of the innermost scopes before jumping out of them. The
+// scopes aren't closed, as the instructions after the jump are still inside
+// them, so the stack freed is whatever their PushScopeInstrs reserved.
+type UnwindScopesInstr struct {
+	Scopes int
+}
+
 type LocaleInstr struct {
 }
 
+// Selects the value of a variable depending on which predecessor of its
+// block control came from. Args are in the same order as the predecessors in
+// the CFG of the branch. Only present while the IF is in SSA form.
+type PhiInstr struct {
+	Dst  *VarExpr
+	Args []Expr
+}
+
 func (DeclareInstr) instr() {}
 func (e DeclareInstr) Repr() string {
 	return fmt.Sprintf("DECLARE %v OF TYPE %v", e.Var.Name, e.Type.Repr())
@@ -430,6 +482,14 @@ func (e PopScopeInstr) Copy() Instr {
 	return &PopScopeInstr{}
 }
 
+func (UnwindScopesInstr) instr() {}
+func (e UnwindScopesInstr) Repr() string {
+	return fmt.Sprintf("UNWIND %v SCOPES", e.Scopes)
+}
+func (e UnwindScopesInstr) Copy() Instr {
+	return &UnwindScopesInstr{e.Scopes}
+}
+
 func (LocaleInstr) instr() {}
 func (e LocaleInstr) Repr() string {
 	return fmt.Sprintf("SET LOCALE")
@@ -438,6 +498,22 @@ func (e LocaleInstr) Copy() Instr {
 	return &LocaleInstr{}
 }
 
+func (PhiInstr) instr() {}
+func (e PhiInstr) Repr() string {
+	args := make([]string, len(e.Args))
+	for i, arg := range e.Args {
+		args[i] = arg.Repr()
+	}
+	return fmt.Sprintf("PHI %v (%v)", e.Dst.Name, strings.Join(args, ", "))
+}
+func (e PhiInstr) Copy() Instr {
+	args := make([]Expr, len(e.Args))
+	for i, arg := range e.Args {
+		args[i] = arg.Copy()
+	}
+	return &PhiInstr{e.Dst.Copy().(*VarExpr), args}
+}
+
 //
 // Second stage instructions
 //
@@ -778,7 +854,7 @@ func (i CheckNullDereferenceInstr) Copy() Instr {
 
 		To whoever reads from here onwards, I'm sorry...
 */
-func DrawIFGraph(iform *IFContext) {
+func DrawIFGraph(w io.Writer, iform *IFContext) {
 	// Transform into a list
 	var list []Instr
 
@@ -805,7 +881,7 @@ func DrawIFGraph(iform *IFContext) {
 
 	// Iterate
 	for i, instr := range list {
-		fmt.Printf("%d  ", i)
+		fmt.Fprintf(w, "%d  ", i)
 
 		// Are we a label?
 		if _, ok := instr.(*LabelInstr); ok {
@@ -821,26 +897,26 @@ func DrawIFGraph(iform *IFContext) {
 				}
 			}
 
-			fmt.Printf("|")
+			fmt.Fprintf(w, "|")
 			for l := 0; l < referStack; l++ {
-				fmt.Printf("<-")
+				fmt.Fprintf(w, "<-")
 			}
 		} else {
-			fmt.Printf("|")
+			fmt.Fprintf(w, "|")
 
 			// Have we reached the referred by?
 			if instr == referredBy {
 				referStack--
 				referredBy = nil
-				fmt.Printf("-'")
+				fmt.Fprintf(w, "-'")
 			}
 
 			for l := 0; l < referStack; l++ {
-				fmt.Printf(" |")
+				fmt.Fprintf(w, " |")
 			}
 		}
 
 		// Instruction
-		fmt.Printf("  %s\n", instr.Repr())
+		fmt.Fprintf(w, "  %s\n", instr.Repr())
 	}
 }
@@ -0,0 +1,398 @@
+package backend
+
+import (
+	"sort"
+)
+
+// Uses inside loops are weighted by this factor per level of nesting when
+// deciding which variables to keep in registers
+const loopWeightFactor = 10
+
+// A variable, as identified by the instruction declaring it
+type liveVariable struct {
+	id   int
+	decl *DeclareInstr
+
+	// First and last instruction at which the variable is live
+	start int
+	end   int
+
+	// Estimated cost of keeping the variable on the stack
+	weight int
+
+	reg int
+}
+
+// A set of variables, indexed by id
+type variableSet []uint64
+
+func newVariableSet(n int) variableSet {
+	return make(variableSet, (n+63)/64)
+}
+
+func (s variableSet) add(id int)           { s[id/64] |= 1 << uint(id%64) }
+func (s variableSet) remove(id int)        { s[id/64] &^= 1 << uint(id%64) }
+func (s variableSet) contains(id int) bool { return s[id/64]&(1<<uint(id%64)) != 0 }
+
+type scopedVariable struct {
+	v           *liveVariable
+	initialised bool
+}
+
+type livenessContext struct {
+	// Variables visible at the current point of the walk, innermost scope
+	// last. Mirrors the scoping rules of the register allocator.
+	scope []map[string]*scopedVariable
+
+	variables []*liveVariable
+
+	// Instructions in the branch, and the variables each uses and defines
+	instrs []*InstrNode
+	uses   [][]*liveVariable
+	defs   [][]*liveVariable
+
+	succ      [][]int
+	loopDepth []int
+
+	// Registers handed out by linear scan
+	registers *RegisterFile
+}
+
+//
+// Resolving variables to their declarations
+//
+func (ctx *livenessContext) lookup(name string) *liveVariable {
+	for i := len(ctx.scope) - 1; i >= 0; i-- {
+		if v, ok := ctx.scope[i][name]; ok && v.initialised {
+			return v.v
+		}
+	}
+	return nil
+}
+
+func (ctx *livenessContext) initialise(name string) *liveVariable {
+	for i := len(ctx.scope) - 1; i >= 0; i-- {
+		if v, ok := ctx.scope[i][name]; ok {
+			v.initialised = true
+			return v.v
+		}
+	}
+	return nil
+}
+
+func (ctx *livenessContext) use(n int, v *liveVariable) {
+	if v != nil {
+		ctx.uses[n] = append(ctx.uses[n], v)
+	}
+}
+
+func (ctx *livenessContext) def(n int, v *liveVariable) {
+	if v != nil {
+		ctx.defs[n] = append(ctx.defs[n], v)
+	}
+}
+
+func (ctx *livenessContext) useExpr(n int, e Expr) {
+	switch e := e.(type) {
+	case *VarExpr:
+		ctx.use(n, ctx.lookup(e.Name))
+
+	case *ArrayElemExpr:
+		ctx.useExpr(n, e.Array)
+		ctx.useExpr(n, e.Index)
+
+	case *PairElemExpr:
+		ctx.useExpr(n, e.Operand)
+
+	case *StructElemExpr:
+		ctx.useExpr(n, e.StructIdent)
+
+	case *UnaryExpr:
+		ctx.useExpr(n, e.Operand)
+
+	case *BinaryExpr:
+		ctx.useExpr(n, e.Left)
+		ctx.useExpr(n, e.Right)
+
+	case *ArrayConstExpr:
+		for _, elem := range e.Elems {
+			ctx.useExpr(n, elem)
+		}
+
+	case *NewStructExpr:
+		for _, arg := range e.Args {
+			ctx.useExpr(n, arg)
+		}
+
+	case *NewPairExpr:
+		ctx.useExpr(n, e.Left)
+		ctx.useExpr(n, e.Right)
+
+	case *CallExpr:
+		for _, arg := range e.Args {
+			ctx.useExpr(n, arg)
+		}
+	}
+}
+
+func (ctx *livenessContext) resolve(n int, i Instr) {
+	switch i := i.(type) {
+	case *PushScopeInstr:
+		ctx.scope = append(ctx.scope, make(map[string]*scopedVariable))
+
+	case *PopScopeInstr:
+		ctx.scope = ctx.scope[:len(ctx.scope)-1]
+
+	case *DeclareInstr:
+		v := &liveVariable{id: len(ctx.variables), decl: i, start: -1, end: -1, reg: -1}
+		ctx.variables = append(ctx.variables, v)
+		ctx.scope[len(ctx.scope)-1][i.Var.Name] = &scopedVariable{v, false}
+
+	case *MoveInstr:
+		ctx.useExpr(n, i.Src)
+		if v, ok := i.Dst.(*VarExpr); ok {
+			ctx.def(n, ctx.initialise(v.Name))
+		} else {
+			ctx.useExpr(n, i.Dst)
+		}
+
+	case *ReadInstr:
+		if v, ok := i.Dst.(*VarExpr); ok {
+			ctx.def(n, ctx.initialise(v.Name))
+		} else {
+			ctx.useExpr(n, i.Dst)
+		}
+
+	case *EvalInstr:
+		ctx.useExpr(n, i.Expr)
+
+	case *FreeInstr:
+		ctx.useExpr(n, i.Object)
+
+	case *ReturnInstr:
+		ctx.useExpr(n, i.Expr)
+
+	case *ExitInstr:
+		ctx.useExpr(n, i.Expr)
+
+	case *PrintInstr:
+		ctx.useExpr(n, i.Expr)
+
+	case *JmpCondInstr:
+		ctx.useExpr(n, i.Cond)
+	}
+}
+
+//
+// Control flow
+//
+func (ctx *livenessContext) buildSuccessors(cfg *CFG) {
+	index := make(map[*InstrNode]int)
+	for n, node := range ctx.instrs {
+		index[node] = n
+	}
+
+	ctx.succ = make([][]int, len(ctx.instrs))
+	ctx.loopDepth = make([]int, len(ctx.instrs))
+	for n, node := range ctx.instrs {
+		b := cfg.BlockOf(node)
+		ctx.loopDepth[n] = b.LoopDepth()
+
+		if node != b.Last() {
+			ctx.succ[n] = []int{n + 1}
+			continue
+		}
+		for _, s := range b.Succs {
+			ctx.succ[n] = append(ctx.succ[n], index[s.First()])
+		}
+	}
+}
+
+//
+// Liveness
+//
+func (ctx *livenessContext) computeLiveness() []variableSet {
+	numVars := len(ctx.variables)
+	liveIn := make([]variableSet, len(ctx.instrs))
+	for n := range liveIn {
+		liveIn[n] = newVariableSet(numVars)
+	}
+
+	// Iterate backwards until nothing changes
+	liveOut := newVariableSet(numVars)
+	for changed := true; changed; {
+		changed = false
+		for n := len(ctx.instrs) - 1; n >= 0; n-- {
+			for k := range liveOut {
+				liveOut[k] = 0
+			}
+			for _, s := range ctx.succ[n] {
+				for k := range liveOut {
+					liveOut[k] |= liveIn[s][k]
+				}
+			}
+
+			for _, v := range ctx.defs[n] {
+				liveOut.remove(v.id)
+			}
+			for _, v := range ctx.uses[n] {
+				liveOut.add(v.id)
+			}
+
+			for k := range liveOut {
+				if liveOut[k] != liveIn[n][k] {
+					liveIn[n][k] = liveOut[k]
+					changed = true
+				}
+			}
+		}
+	}
+
+	return liveIn
+}
+
+func (ctx *livenessContext) buildIntervals(liveIn []variableSet) {
+	extend := func(v *liveVariable, n int) {
+		if v.start == -1 || n < v.start {
+			v.start = n
+		}
+		if n > v.end {
+			v.end = n
+		}
+	}
+
+	weight := func(n int) int {
+		w := 1
+		for d := 0; d < ctx.loopDepth[n]; d++ {
+			w *= loopWeightFactor
+		}
+		return w
+	}
+
+	for n := range ctx.instrs {
+		for _, v := range ctx.variables {
+			if liveIn[n].contains(v.id) {
+				extend(v, n)
+			}
+		}
+		for _, v := range ctx.defs[n] {
+			extend(v, n)
+			v.weight += weight(n)
+		}
+		for _, v := range ctx.uses[n] {
+			v.weight += weight(n)
+		}
+	}
+}
+
+//
+// Linear scan
+//
+type byStart []*liveVariable
+
+func (s byStart) Len() int           { return len(s) }
+func (s byStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byStart) Less(i, j int) bool { return s[i].start < s[j].start }
+
+func (ctx *livenessContext) linearScan() {
+	intervals := []*liveVariable{}
+	for _, v := range ctx.variables {
+		if v.start != -1 {
+			intervals = append(intervals, v)
+		}
+	}
+	sort.Stable(byStart(intervals))
+
+	free := make(map[int]bool)
+	for r := ctx.registers.FirstVariable; r <= ctx.registers.LastVariable; r++ {
+		free[r] = true
+	}
+
+	active := []*liveVariable{}
+	for _, current := range intervals {
+		// Expire intervals which have ended
+		stillActive := active[:0]
+		for _, v := range active {
+			if v.end < current.start {
+				free[v.reg] = true
+			} else {
+				stillActive = append(stillActive, v)
+			}
+		}
+		active = stillActive
+
+		// Take the lowest free register
+		for r := ctx.registers.FirstVariable; r <= ctx.registers.LastVariable; r++ {
+			if free[r] {
+				current.reg = r
+				free[r] = false
+				break
+			}
+		}
+		if current.reg != -1 {
+			active = append(active, current)
+			continue
+		}
+
+		// Otherwise keep whichever variable is cheapest to access on the stack
+		// there
+		cheapest := -1
+		for k, v := range active {
+			if cheapest == -1 || v.weight < active[cheapest].weight ||
+				(v.weight == active[cheapest].weight && v.end > active[cheapest].end) {
+				cheapest = k
+			}
+		}
+		if v := active[cheapest]; v.weight < current.weight {
+			current.reg = v.reg
+			v.reg = -1
+			active[cheapest] = current
+		}
+	}
+}
+
+// analyseLiveness resolves the variables used by each instruction of a branch
+// of the IF, and works out which of them are live before each instruction
+func analyseLiveness(branch *InstrNode) (*livenessContext, []variableSet) {
+	ctx := new(livenessContext)
+	ctx.scope = append(ctx.scope, make(map[string]*scopedVariable))
+
+	for node := branch; node != nil; node = node.Next {
+		n := len(ctx.instrs)
+		ctx.instrs = append(ctx.instrs, node)
+		ctx.uses = append(ctx.uses, nil)
+		ctx.defs = append(ctx.defs, nil)
+		ctx.resolve(n, node.Instr)
+	}
+
+	ctx.buildSuccessors(BuildCFG(branch))
+	return ctx, ctx.computeLiveness()
+}
+
+// liveOut returns the variables live after an instruction
+func (ctx *livenessContext) liveOut(liveIn []variableSet, n int) variableSet {
+	out := newVariableSet(len(ctx.variables))
+	for _, s := range ctx.succ[n] {
+		for k := range out {
+			out[k] |= liveIn[s][k]
+		}
+	}
+	return out
+}
+
+// allocateVariableRegisters decides which variables declared in a branch of
+// the IF can be kept in registers for their whole lifetime
+func allocateVariableRegisters(branch *InstrNode, registers *RegisterFile) map[*DeclareInstr]*RegisterExpr {
+	ctx, liveIn := analyseLiveness(branch)
+	ctx.registers = registers
+	ctx.buildIntervals(liveIn)
+	ctx.linearScan()
+
+	assignments := make(map[*DeclareInstr]*RegisterExpr)
+	for _, v := range ctx.variables {
+		if v.reg != -1 {
+			assignments[v.decl] = &RegisterExpr{v.reg}
+		}
+	}
+	return assignments
+}
@@ -0,0 +1,140 @@
+package backend
+
+import (
+	"testing"
+)
+
+// liveVariables returns the variables declared in the main branch of a
+// program, by name. Names must be unique.
+func liveVariables(t *testing.T, source string) (*livenessContext, map[string]*liveVariable) {
+	ctx, liveIn := analyseLiveness(translate(t, source).main)
+	ctx.registers = ARMTarget.Registers()
+	ctx.buildIntervals(liveIn)
+	vars := make(map[string]*liveVariable)
+	for _, v := range ctx.variables {
+		vars[v.decl.Var.Name] = v
+	}
+	return ctx, vars
+}
+
+func TestLiveIntervals(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		check  func(vars map[string]*liveVariable) bool
+	}{
+		{
+			"dies at its last use",
+			"begin\n  int x = 1 ;\n  int y = x + 1 ;\n  println y\nend\n",
+			func(vars map[string]*liveVariable) bool {
+				return vars["x"].end == vars["y"].start && vars["y"].end > vars["y"].start
+			},
+		},
+		{
+			"never used",
+			"begin\n  int x = 1 ;\n  println 2\nend\n",
+			func(vars map[string]*liveVariable) bool {
+				return vars["x"].start == vars["x"].end
+			},
+		},
+		{
+			"declared in a branch",
+			"begin\n  int x = 1 ;\n  if x > 0 then int y = 2 ; println y else skip fi\nend\n",
+			func(vars map[string]*liveVariable) bool {
+				return vars["x"].end < vars["y"].start
+			},
+		},
+		{
+			"live across a loop",
+			"begin\n  int x = 1 ;\n  int i = 0 ;\n  while i < 3 do\n    i = i + 1\n  done ;\n  println x\nend\n",
+			func(vars map[string]*liveVariable) bool {
+				return vars["x"].start < vars["i"].start && vars["x"].end > vars["i"].end
+			},
+		},
+		{
+			"live around a loop's back edge",
+			"begin\n  int i = 0 ;\n  int j = 0 ;\n  while i < 3 do\n    println j ;\n    j = i ;\n    i = i + 1\n  done\nend\n",
+			func(vars map[string]*liveVariable) bool {
+				// j is assigned after its use, so is live for the whole loop
+				return vars["j"].end >= vars["i"].end-1
+			},
+		},
+		{
+			"declared in a loop",
+			"begin\n  int i = 0 ;\n  while i < 3 do\n    int y = i * 2 ;\n    println y ;\n    i = i + 1\n  done\nend\n",
+			func(vars map[string]*liveVariable) bool {
+				return vars["y"].start > vars["i"].start && vars["y"].end < vars["i"].end
+			},
+		},
+	}
+	for _, test := range tests {
+		_, vars := liveVariables(t, test.source)
+		if !test.check(vars) {
+			intervals := make(map[string][2]int)
+			for name, v := range vars {
+				intervals[name] = [2]int{v.start, v.end}
+			}
+			t.Errorf("%v: wrong intervals %v", test.name, intervals)
+		}
+	}
+}
+
+func TestLinearScan(t *testing.T) {
+	tests := []struct {
+		name      string
+		source    string
+		registers []string
+		stack     []string
+	}{
+		{
+			"all fit",
+			"begin\n  int a = 1 ;\n  int b = 2 ;\n  println a + b\nend\n",
+			[]string{"a", "b"},
+			nil,
+		},
+		{
+			"too many live at once",
+			"begin\n  int a = 1 ;\n  int b = 2 ;\n  int c = 3 ;\n  int d = 4 ;\n  int e = 5 ;\n  int i = 0 ;\n" +
+				"  while i < 10 do\n    i = i + a + b + c + d\n  done ;\n  println e\nend\n",
+			// i is used most inside the loop, and e isn't used inside it at all
+			[]string{"i"},
+			[]string{"e"},
+		},
+		{
+			"registers reused",
+			"begin\n  int a = 1 ;\n  println a ;\n  int b = 2 ;\n  println b ;\n  int c = 3 ;\n  println c ;\n" +
+				"  int d = 4 ;\n  println d ;\n  int e = 5 ;\n  println e\nend\n",
+			[]string{"a", "b", "c", "d", "e"},
+			nil,
+		},
+	}
+	for _, test := range tests {
+		ctx, vars := liveVariables(t, test.source)
+		ctx.linearScan()
+
+		used := make(map[int]*liveVariable)
+		for _, v := range ctx.variables {
+			if v.reg == -1 {
+				continue
+			}
+			if v.reg < ctx.registers.FirstVariable || v.reg > ctx.registers.LastVariable {
+				t.Errorf("%v: %v is given r%v", test.name, v.decl.Var.Name, v.reg)
+			}
+			if other, ok := used[v.reg]; ok && other.end >= v.start {
+				t.Errorf("%v: %v and %v overlap in r%v", test.name, other.decl.Var.Name, v.decl.Var.Name, v.reg)
+			}
+			used[v.reg] = v
+		}
+
+		for _, name := range test.registers {
+			if vars[name].reg == -1 {
+				t.Errorf("%v: %v isn't given a register", test.name, name)
+			}
+		}
+		for _, name := range test.stack {
+			if vars[name].reg != -1 {
+				t.Errorf("%v: %v is given r%v, want it on the stack", test.name, name, vars[name].reg)
+			}
+		}
+	}
+}
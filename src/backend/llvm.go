@@ -0,0 +1,965 @@
+package backend
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+
+	"../frontend"
+)
+
+// Generation of textual LLVM IR from the IF. Unlike the assembly generators,
+// this works on the IF before register allocation: variables become allocas,
+// which LLVM promotes to registers itself, and calls become LLVM calls.
+//
+// Every WACC value is an i32, as in the IF. The heap is an array of bytes
+// owned by the runtime, and a WACC pointer is an offset into it, so objects
+// are laid out exactly as on ARM whatever the size of a native pointer. The
+// runtime checks become explicit branches to error blocks, or calls to the
+// runtime library, which is itself written as IR.
+
+// Size of the memory holding string literals and the heap
+const llvmMemorySize = 1 << 26
+
+// Start of the string literals. Offsets below this are never allocated, so
+// that null is never a valid address.
+const llvmDataStart = 8
+
+type llvmGeneratorContext struct {
+	target Target
+
+	// Function being generated
+	text       string
+	allocas    string
+	temps      int
+	labels     int
+	terminated bool
+	scope      variableScopes
+	variables  int
+
+	// Parameters read by the function, by register or stack argument
+	registerParams int
+	stackParams    int
+
+	// Error blocks branched to by the function
+	errorBlocks map[string]bool
+
+	// Number of arguments passed to each function called
+	callees map[string]int
+
+	// String literals, and the offsets they are copied to
+	literals    map[string]int
+	literalDefs string
+	literalInit string
+	dataEnd     int
+
+	stageErrors
+}
+
+func (ctx *llvmGeneratorContext) emit(s string, a ...interface{}) {
+	ctx.text += "\t" + fmt.Sprintf(s, a...) + "\n"
+}
+
+func (ctx *llvmGeneratorContext) temp() string {
+	ctx.temps++
+	return fmt.Sprintf("%%t%d", ctx.temps)
+}
+
+func (ctx *llvmGeneratorContext) newLabel(prefix string) string {
+	ctx.labels++
+	return fmt.Sprintf("%s%d", prefix, ctx.labels)
+}
+
+// startBlock begins a basic block, falling through from the previous one if
+// it hasn't already jumped away
+func (ctx *llvmGeneratorContext) startBlock(label string) {
+	if !ctx.terminated {
+		ctx.emit("br label %%%s", label)
+	}
+	ctx.text += label + ":\n"
+	ctx.terminated = false
+}
+
+func (ctx *llvmGeneratorContext) terminate(s string, a ...interface{}) {
+	ctx.emit(s, a...)
+	ctx.terminated = true
+}
+
+// branchToError leaves the current block for an error block if cond holds
+func (ctx *llvmGeneratorContext) branchToError(cond, block string) {
+	ctx.errorBlocks[block] = true
+	ok := ctx.newLabel("ok")
+	ctx.terminate("br i1 %s, label %%%s, label %%%s", cond, block, ok)
+	ctx.startBlock(ok)
+}
+
+//
+// Memory
+//
+func (ctx *llvmGeneratorContext) address(addr string) string {
+	p := ctx.temp()
+	ctx.emit("%s = call i32* @_wacc_address(i32 %s)", p, addr)
+	return p
+}
+
+func (ctx *llvmGeneratorContext) offset(addr string, offset int) string {
+	if offset == 0 {
+		return addr
+	}
+	t := ctx.temp()
+	ctx.emit("%s = add i32 %s, %d", t, addr, offset)
+	return t
+}
+
+func (ctx *llvmGeneratorContext) load(ptr string) string {
+	t := ctx.temp()
+	ctx.emit("%s = load i32, i32* %s, align 4", t, ptr)
+	return t
+}
+
+func (ctx *llvmGeneratorContext) store(value, ptr string) {
+	ctx.emit("store i32 %s, i32* %s, align 4", value, ptr)
+}
+
+func (ctx *llvmGeneratorContext) malloc(size int) string {
+	t := ctx.temp()
+	ctx.emit("%s = call i32 @_wacc_malloc(i32 %d)", t, size)
+	return t
+}
+
+func (ctx *llvmGeneratorContext) literal(s string) int {
+	if offset, ok := ctx.literals[s]; ok {
+		return offset
+	}
+
+	name := fmt.Sprintf("@stringlit%d", len(ctx.literals))
+	words := []string{fmt.Sprintf("i32 %d", len([]rune(s)))}
+	for _, r := range s {
+		words = append(words, fmt.Sprintf("i32 %d", r))
+	}
+	array := fmt.Sprintf("[%d x i32]", len(words))
+	ctx.literalDefs += fmt.Sprintf("%s = private unnamed_addr constant %s [%s]\n",
+		name, array, strings.Join(words, ", "))
+	ctx.literalInit += fmt.Sprintf("\tcall void @_wacc_copy(i32 %d, i32* getelementptr inbounds (%s, %s* %s, i32 0, i32 0), i32 %d)\n",
+		ctx.dataEnd, array, array, name, len(words))
+
+	offset := ctx.dataEnd
+	ctx.literals[s] = offset
+	ctx.dataEnd += len(words) * ctx.target.WordSize()
+	return offset
+}
+
+//
+// Variables
+//
+func (ctx *llvmGeneratorContext) declare(v *VarExpr) {
+	// Names of versions and inlined variables contain characters which LLVM
+	// doesn't allow
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			return r
+		}
+		return '.'
+	}, v.Name)
+
+	ctx.variables++
+	alloca := fmt.Sprintf("%%v.%s.%d", name, ctx.variables)
+	ctx.allocas += fmt.Sprintf("\t%s = alloca i32, align 4\n\tstore i32 0, i32* %s, align 4\n", alloca, alloca)
+	ctx.scope.declare(v, alloca)
+}
+
+// lookup finds the alloca of the variable an expression reads
+func (ctx *llvmGeneratorContext) lookup(v *VarExpr) string {
+	alloca, ok := ctx.scope.lookup(v)
+	if !ok {
+		ctx.fail("Trying to access non-existent variable '%s'", v.Name)
+		return "null"
+	}
+	return alloca.(string)
+}
+
+// initialise finds the alloca of the variable an expression assigns to
+func (ctx *llvmGeneratorContext) initialise(v *VarExpr) string {
+	alloca, ok := ctx.scope.initialise(v)
+	if !ok {
+		ctx.fail("Trying to initialise non-existent variable '%s'", v.Name)
+		return "null"
+	}
+	return alloca.(string)
+}
+
+//
+// Arithmetic
+//
+
+// checked performs an integer operation, branching to the overflow error if
+// the result doesn't fit
+func (ctx *llvmGeneratorContext) checked(op, a, b string) string {
+	t := ctx.temp()
+	ctx.emit("%s = call { i32, i1 } @llvm.%s.with.overflow.i32(i32 %s, i32 %s)", t, op, a, b)
+	result := ctx.temp()
+	ctx.emit("%s = extractvalue { i32, i1 } %s, 0", result, t)
+	overflow := ctx.temp()
+	ctx.emit("%s = extractvalue { i32, i1 } %s, 1", overflow, t)
+	ctx.branchToError(overflow, "_wacc_overflow")
+	return result
+}
+
+// divide divides two integers as __aeabi_idiv does, so that dividing the
+// smallest integer by -1 gives itself rather than trapping
+func (ctx *llvmGeneratorContext) divide(a, b string) string {
+	zero := ctx.temp()
+	ctx.emit("%s = icmp eq i32 %s, 0", zero, b)
+	ctx.branchToError(zero, "_wacc_divide_by_zero")
+
+	minusOne := ctx.temp()
+	ctx.emit("%s = icmp eq i32 %s, -1", minusOne, b)
+	divisor := ctx.temp()
+	ctx.emit("%s = select i1 %s, i32 1, i32 %s", divisor, minusOne, b)
+	quotient := ctx.temp()
+	ctx.emit("%s = sdiv i32 %s, %s", quotient, a, divisor)
+	negated := ctx.temp()
+	ctx.emit("%s = sub i32 0, %s", negated, a)
+	result := ctx.temp()
+	ctx.emit("%s = select i1 %s, i32 %s, i32 %s", result, minusOne, negated, quotient)
+	return result
+}
+
+func (ctx *llvmGeneratorContext) float(op, a, b string) string {
+	x := ctx.temp()
+	ctx.emit("%s = bitcast i32 %s to float", x, a)
+	y := ctx.temp()
+	ctx.emit("%s = bitcast i32 %s to float", y, b)
+	z := ctx.temp()
+	ctx.emit("%s = %s float %s, %s", z, op, x, y)
+	result := ctx.temp()
+	ctx.emit("%s = bitcast float %s to i32", result, z)
+	return result
+}
+
+//
+// Expressions
+//
+
+// lvalue returns a pointer to the location an expression refers to, which is
+// about to be assigned to
+func (ctx *llvmGeneratorContext) lvalue(e Expr) string {
+	switch e := e.(type) {
+	case *VarExpr:
+		return ctx.initialise(e)
+
+	case *ArrayElemExpr:
+		array := ctx.value(e.Array)
+		index := ctx.value(e.Index)
+		if !e.InBounds {
+			ctx.emit("call void @%s(i32 %s, i32 %s)", RuntimeCheckArrayBoundsLabel, index, array)
+		}
+
+		scaled := ctx.temp()
+		ctx.emit("%s = shl i32 %s, 2", scaled, index)
+		elem := ctx.temp()
+		ctx.emit("%s = add i32 %s, %s", elem, array, scaled)
+		return ctx.address(ctx.offset(elem, ctx.target.WordSize()))
+
+	case *PairElemExpr:
+		offset := 0
+		if !e.Fst {
+			offset = ctx.target.WordSize()
+		}
+		pair := ctx.value(e.Operand)
+		if !e.NotNull {
+			ctx.emit("call void @%s(i32 %s)", RuntimeCheckNullPointerLabel, pair)
+		}
+		return ctx.address(ctx.offset(pair, offset))
+
+	case *StructElemExpr:
+		object := ctx.value(e.StructIdent)
+		if !e.NotNull {
+			ctx.emit("call void @%s(i32 %s)", RuntimeCheckNullPointerLabel, object)
+		}
+		return ctx.address(ctx.offset(object, e.ElemOffset))
+
+	default:
+		ctx.fail("Unhandled lvalue %T", e)
+		return "null"
+	}
+}
+
+// value evaluates an expression, returning the i32 operand holding its value
+func (ctx *llvmGeneratorContext) value(e Expr) string {
+	switch e := e.(type) {
+	case *IntConstExpr:
+		return fmt.Sprintf("%d", e.Value)
+
+	case *FloatConstExpr:
+		return fmt.Sprintf("%d", int32(math.Float32bits(e.Value)))
+
+	case *BoolConstExpr:
+		if e.Value {
+			return "1"
+		}
+		return "0"
+
+	case *CharConstExpr:
+		return fmt.Sprintf("%d", e.Value)
+
+	case *PointerConstExpr:
+		return fmt.Sprintf("%d", e.Value)
+
+	case *StringConstExpr:
+		return fmt.Sprintf("%d", ctx.literal(e.Value))
+
+	case *RegisterExpr:
+		// Only parameters are read from registers before allocation
+		if e.Id >= ctx.registerParams {
+			ctx.registerParams = e.Id + 1
+		}
+		return fmt.Sprintf("%%arg%d", e.Id)
+
+	case *StackArgumentExpr:
+		if e.Id >= ctx.stackParams {
+			ctx.stackParams = e.Id + 1
+		}
+		return fmt.Sprintf("%%stackarg%d", e.Id)
+
+	case *VarExpr:
+		return ctx.load(ctx.lookup(e))
+
+	case *ArrayElemExpr, *PairElemExpr, *StructElemExpr:
+		return ctx.load(ctx.lvalue(e))
+
+	case *UnaryExpr:
+		operand := ctx.value(e.Operand)
+		switch e.Operator {
+		case Not:
+			t := ctx.temp()
+			ctx.emit("%s = xor i32 %s, 1", t, operand)
+			return t
+
+		case Ord, Chr:
+			return operand
+
+		case Neg:
+			if e.Type.Equals(frontend.BasicType{frontend.FLOAT}) {
+				return ctx.float("fsub", fmt.Sprintf("%d", int32(math.Float32bits(0))), operand)
+			}
+			return ctx.checked("ssub", "0", operand)
+
+		case Len:
+			return ctx.load(ctx.address(operand))
+
+		default:
+			ctx.fail("Unhandled unary operator %v", e.Operator)
+			return "0"
+		}
+
+	case *BinaryExpr:
+		// Evaluate the operands in the same order as the register allocator
+		var left, right string
+		if e.Left.Weight() > e.Right.Weight() {
+			left = ctx.value(e.Left)
+			right = ctx.value(e.Right)
+		} else {
+			right = ctx.value(e.Right)
+			left = ctx.value(e.Left)
+		}
+
+		isFloat := e.Type.Equals(frontend.BasicType{frontend.FLOAT})
+		switch e.Operator {
+		case Add, Sub, Mul:
+			if isFloat {
+				return ctx.float(map[string]string{Add: "fadd", Sub: "fsub", Mul: "fmul"}[e.Operator], left, right)
+			}
+			return ctx.checked(map[string]string{Add: "sadd", Sub: "ssub", Mul: "smul"}[e.Operator], left, right)
+
+		case Div:
+			if isFloat {
+				return ctx.float("fdiv", left, right)
+			}
+			return ctx.divide(left, right)
+
+		case Mod:
+			quotient := ctx.divide(left, right)
+			return ctx.checked("ssub", left, ctx.checked("smul", quotient, right))
+
+		case And, Or:
+			t := ctx.temp()
+			ctx.emit("%s = %s i32 %s, %s", t, map[string]string{And: "and", Or: "or"}[e.Operator], left, right)
+			return t
+
+		case LT, GT, LE, GE, EQ, NE:
+			predicate := map[string]string{LT: "slt", GT: "sgt", LE: "sle", GE: "sge", EQ: "eq", NE: "ne"}[e.Operator]
+			cond := ctx.temp()
+			ctx.emit("%s = icmp %s i32 %s, %s", cond, predicate, left, right)
+			t := ctx.temp()
+			ctx.emit("%s = zext i1 %s to i32", t, cond)
+			return t
+
+		default:
+			ctx.fail("Unknown operator %v", e.Operator)
+			return "0"
+		}
+
+	case *ArrayConstExpr:
+		array := ctx.malloc((len(e.Elems) + 1) * ctx.target.WordSize())
+		ctx.store(fmt.Sprintf("%d", len(e.Elems)), ctx.address(array))
+		for i, elem := range e.Elems {
+			v := ctx.value(elem)
+			ctx.store(v, ctx.address(ctx.offset(array, (i+1)*ctx.target.WordSize())))
+		}
+		return array
+
+	case *NewStructExpr:
+		object := ctx.malloc(len(e.Args) * ctx.target.WordSize())
+		for i, arg := range e.Args {
+			v := ctx.value(arg)
+			ctx.store(v, ctx.address(ctx.offset(object, i*ctx.target.WordSize())))
+		}
+		return object
+
+	case *NewPairExpr:
+		pair := ctx.malloc(2 * ctx.target.WordSize())
+		left := ctx.value(e.Left)
+		ctx.store(left, ctx.address(pair))
+		right := ctx.value(e.Right)
+		ctx.store(right, ctx.address(ctx.offset(pair, ctx.target.WordSize())))
+		return pair
+
+	case *CallExpr:
+		args := []string{}
+		for _, arg := range e.Args {
+			args = append(args, "i32 "+ctx.value(arg))
+		}
+		if len(e.Args) > ctx.callees[e.Label.Label] {
+			ctx.callees[e.Label.Label] = len(e.Args)
+		}
+		t := ctx.temp()
+		ctx.emit("%s = call i32 @%s(%s)", t, e.Label.Label, strings.Join(args, ", "))
+		return t
+
+	default:
+		ctx.fail("Unhandled expression %T", e)
+		return "0"
+	}
+}
+
+//
+// Instructions
+//
+func (ctx *llvmGeneratorContext) generateInstr(instr Instr) {
+	if _, ok := instr.(*LabelInstr); !ok && ctx.terminated {
+		// Code after a jump can only be reached through a label
+		ctx.startBlock(ctx.newLabel("dead"))
+	}
+
+	switch i := instr.(type) {
+	case *NoOpInstr, *UnwindScopesInstr:
+
+	case *LabelInstr:
+		ctx.startBlock(i.Label)
+
+	case *DeclareInstr:
+		ctx.declare(i.Var)
+
+	case *PushScopeInstr:
+		ctx.scope.push()
+
+	case *PopScopeInstr:
+		ctx.scope.pop()
+
+	case *EvalInstr:
+		ctx.value(i.Expr)
+
+	case *ReadInstr:
+		dst := ctx.lvalue(i.Dst)
+		t := ctx.temp()
+		if i.Type.Equals(frontend.BasicType{frontend.CHAR}) {
+			ctx.emit("%s = call i32 @_wacc_read_char()", t)
+		} else {
+			ctx.emit("%s = call i32 @_wacc_read_int()", t)
+		}
+		ctx.store(t, dst)
+
+	case *FreeInstr:
+		object := ctx.value(i.Object)
+		ctx.emit("call void @%s(i32 %s)", RuntimeCheckNullPointerLabel, object)
+		ctx.emit("call void @_wacc_free(i32 %s)", object)
+
+	case *ReturnInstr:
+		ctx.terminate("ret i32 %s", ctx.value(i.Expr))
+
+	case *ExitInstr:
+		ctx.emit("call void @exit(i32 %s)", ctx.value(i.Expr))
+		ctx.terminate("unreachable")
+
+	case *PrintInstr:
+		if v, ok := i.Expr.(*CharConstExpr); ok && v.Value == '\n' {
+			ctx.emit("call void @_wacc_print_nl()")
+			return
+		}
+
+		v := ctx.value(i.Expr)
+		t := i.Type
+		if t.Equals(frontend.BasicType{frontend.INT}) {
+			ctx.emit("call void @_wacc_print_int(i32 %s)", v)
+		} else if t.Equals(frontend.BasicType{frontend.FLOAT}) {
+			ctx.emit("call void @_wacc_print_float(i32 %s)", v)
+		} else if t.Equals(frontend.BasicType{frontend.BOOL}) {
+			ctx.emit("call void @_wacc_print_bool(i32 %s)", v)
+		} else if t.Equals(frontend.BasicType{frontend.CHAR}) {
+			ctx.emit("call void @_wacc_print_char(i32 %s)", v)
+		} else if t.Equals(frontend.BasicType{frontend.STRING}) ||
+			t.Equals(frontend.ArrayType{frontend.BasicType{frontend.CHAR}}) {
+			ctx.emit("call void @_wacc_print_wstr(i32 %s)", v)
+		} else {
+			ctx.emit("call void @_wacc_print_addr(i32 %s)", v)
+		}
+
+	case *MoveInstr:
+		v := ctx.value(i.Src)
+		ctx.store(v, ctx.lvalue(i.Dst))
+
+	case *JmpInstr:
+		ctx.terminate("br label %%%s", i.Dst.Instr.(*LabelInstr).Label)
+
+	case *JmpCondInstr:
+		cond := ctx.temp()
+		ctx.emit("%s = icmp ne i32 %s, 0", cond, ctx.value(i.Cond))
+		next := ctx.newLabel("next")
+		ctx.terminate("br i1 %s, label %%%s, label %%%s", cond, i.Dst.Instr.(*LabelInstr).Label, next)
+		ctx.startBlock(next)
+
+	case *LocaleInstr:
+		ctx.emit("call void @_wacc_init()")
+
+	case *PhiInstr:
+		ctx.fail("Phi instructions must be removed before code generation")
+
+	default:
+		ctx.fail("Unhandled instruction %T", instr)
+	}
+}
+
+// generateFunction returns the body of a function, leaving its parameters to
+// be declared once every call to it has been seen
+func (ctx *llvmGeneratorContext) generateFunction(n *InstrNode, isMain bool) string {
+	ctx.stage = "generating LLVM IR for " + n.Instr.(*LabelInstr).Label
+	ctx.text = ""
+	ctx.allocas = ""
+	ctx.temps = 0
+	ctx.terminated = false
+	ctx.scope = newVariableScopes()
+	ctx.registerParams = 0
+	ctx.stackParams = 0
+	ctx.errorBlocks = make(map[string]bool)
+
+	for node := n.Next; node != nil; node = node.Next {
+		ctx.generateInstr(node.Instr)
+	}
+	if !ctx.terminated {
+		if isMain {
+			ctx.terminate("ret i32 0")
+		} else {
+			ctx.terminate("unreachable")
+		}
+	}
+
+	errors := map[string]string{
+		"_wacc_overflow":       RuntimeOverflowLabel,
+		"_wacc_divide_by_zero": "_wacc_throw_divide_by_zero",
+	}
+	for _, block := range []string{"_wacc_overflow", "_wacc_divide_by_zero"} {
+		if ctx.errorBlocks[block] {
+			ctx.text += block + ":\n"
+			ctx.emit("call void @%s()", errors[block])
+			ctx.emit("unreachable")
+		}
+	}
+
+	return "entry:\n" + ctx.allocas + ctx.text
+}
+
+// Textual LLVM IR, generated before register allocation
+var LLVMTarget Target = llvmTarget{}
+
+type llvmTarget struct{}
+
+func (llvmTarget) Name() string                                  { return "llvm" }
+func (llvmTarget) Description() string                           { return "LLVM IR" }
+func (llvmTarget) WordSize() int                                 { return 4 }
+func (llvmTarget) ArgumentRegisters() int                        { return 4 }
+func (llvmTarget) Registers() *RegisterFile                      { return nil }
+func (llvmTarget) OutputExtension() string                       { return ".ll" }
+func (llvmTarget) GenerateCode(ifCtx *IFContext) (string, error) { return GenerateLLVMCode(ifCtx) }
+
+// GenerateLLVMCode generates LLVM IR for a program whose IF hasn't been
+// register allocated. As with GenerateCode, an error is a compiler bug.
+func GenerateLLVMCode(ifCtx *IFContext) (string, error) {
+	ctx := new(llvmGeneratorContext)
+	ctx.target = LLVMTarget
+	ctx.callees = make(map[string]int)
+	ctx.literals = make(map[string]int)
+	ctx.dataEnd = llvmDataStart
+
+	type function struct {
+		name           string
+		body           string
+		registerParams int
+		stackParams    int
+	}
+	functions := []function{}
+	defined := make(map[string]bool)
+	for _, branch := range ifCtx.Branches() {
+		name := branch.Instr.(*LabelInstr).Label
+		body := ctx.generateFunction(branch, branch == ifCtx.main)
+		functions = append(functions, function{name, body, ctx.registerParams, ctx.stackParams})
+		defined[name] = true
+	}
+	if ctx.err != nil {
+		return "", ctx.err
+	}
+
+	code := ""
+	for _, f := range functions {
+		if f.name == ifCtx.main.Instr.(*LabelInstr).Label {
+			code += "define i32 @main() {\n" + f.body + "}\n\n"
+			continue
+		}
+
+		// Parameters after the fourth are numbered from the last, as on the
+		// stack
+		params := f.registerParams
+		if f.stackParams > 0 {
+			params = ctx.target.ArgumentRegisters() + f.stackParams
+		}
+		if ctx.callees[f.name] > params {
+			params = ctx.callees[f.name]
+		}
+		names := []string{}
+		for k := 0; k < params; k++ {
+			if k < ctx.target.ArgumentRegisters() {
+				names = append(names, fmt.Sprintf("i32 %%arg%d", k))
+			} else {
+				names = append(names, fmt.Sprintf("i32 %%stackarg%d", params-1-k))
+			}
+		}
+		code += fmt.Sprintf("define i32 @%s(%s) {\n%s}\n\n", f.name, strings.Join(names, ", "), f.body)
+	}
+
+	// Functions defined elsewhere
+	declarations := ""
+	for name, args := range ctx.callees {
+		if !defined[name] {
+			params := strings.TrimSuffix(strings.Repeat("i32, ", args), ", ")
+			declarations += fmt.Sprintf("declare i32 @%s(%s)\n", name, params)
+		}
+	}
+
+	data := ctx.literalDefs
+	data += fmt.Sprintf("@_wacc_heap_top = internal global i32 %d\n", ctx.dataEnd)
+	data += "\ndefine internal void @_wacc_init_data() {\n" + ctx.literalInit + "\tret void\n}\n"
+
+	return data + "\n" + declarations + "\n" + code + llvmRuntime(), nil
+}
+
+//
+// Runtime
+//
+
+// llvmNarrowString defines a C string constant, returning its definition and
+// an i8* pointing to it
+func llvmNarrowString(name, s string) (string, string) {
+	escaped := ""
+	for _, b := range []byte(s + "\x00") {
+		if b < ' ' || b > '~' || b == '"' || b == '\\' {
+			escaped += fmt.Sprintf("\\%02X", b)
+		} else {
+			escaped += string(b)
+		}
+	}
+	array := fmt.Sprintf("[%d x i8]", len(s)+1)
+	return fmt.Sprintf("@%s = private unnamed_addr constant %s c\"%s\"\n", name, array, escaped),
+		fmt.Sprintf("i8* getelementptr inbounds (%s, %s* @%s, i32 0, i32 0)", array, array, name)
+}
+
+// llvmWideString defines a wide string constant, returning its definition and
+// an i32* pointing to it
+func llvmWideString(name, s string) (string, string) {
+	chars := []string{}
+	for _, r := range s + "\x00" {
+		chars = append(chars, fmt.Sprintf("i32 %d", r))
+	}
+	array := fmt.Sprintf("[%d x i32]", len(chars))
+	return fmt.Sprintf("@%s = private unnamed_addr constant %s [%s]\n", name, array, strings.Join(chars, ", ")),
+		fmt.Sprintf("i32* getelementptr inbounds (%s, %s* @%s, i32 0, i32 0)", array, array, name)
+}
+
+// llvmRuntime returns the runtime library. Strings are referred to in it as
+// $name.
+func llvmRuntime() string {
+	definitions := ""
+	replacements := []string{}
+	add := func(name, def, ref string) {
+		definitions += def
+		replacements = append(replacements, "$"+name, ref)
+	}
+	for _, s := range []struct{ name, value string }{
+		{"printf_fmt_int", "%d"},
+		{"scanf_fmt_int", "%d"},
+		{"printf_fmt_float", "%f"},
+		{"printf_fmt_char", "%lc"},
+		{"scanf_fmt_char", " %lc"},
+		{"printf_fmt_str", "%s"},
+		{"printf_fmt_wstr", "%.*ls"},
+		{"printf_fmt_addr", "%p"},
+	} {
+		def, ref := llvmWideString(s.name, s.value)
+		add(s.name, def, ref)
+	}
+	for _, s := range []struct{ name, value string }{
+		{"printf_true", "true"},
+		{"printf_false", "false"},
+		{"printf_nil", "(nil)"},
+		{"_wacc_overflow_error_msg", "OverflowError: the result is too small/large to store in a 4-byte signed-integer.\n"},
+		{"_wacc_divide_by_zero_msg", "DivideByZeroError: divide or modulo by zero\n"},
+		{"_wacc_array_index_negative_msg", "ArrayIndexOutOfBoundsError: negative index\n"},
+		{"_wacc_array_index_large_msg", "ArrayIndexOutOfBoundsError: index too large\n"},
+		{"_wacc_null_dereference_msg", "NullReferenceError: dereference a null reference\n"},
+		{"_wacc_out_of_memory_msg", "OutOfMemoryError: the heap is full\n"},
+		{"_wacc_null", ""},
+	} {
+		def, ref := llvmNarrowString(s.name, s.value)
+		add(s.name, def, ref)
+	}
+
+	memory := fmt.Sprintf("[%d x i8]", llvmMemorySize)
+	replacements = append(replacements, "$memory_size", fmt.Sprint(llvmMemorySize), "$memory", memory)
+
+	return definitions + strings.NewReplacer(replacements...).Replace(llvmRuntimeText)
+}
+
+const llvmRuntimeText = `
+@_wacc_memory = internal global $memory zeroinitializer, align 16
+@_wacc_free_list = internal global i32 0
+
+declare i32 @wprintf(i32*, ...)
+declare i32 @wscanf(i32*, ...)
+declare i32 @putwchar(i32)
+declare i32 @fflush(i8*)
+declare i8* @setlocale(i32, i8*)
+declare void @exit(i32) noreturn
+declare { i32, i1 } @llvm.sadd.with.overflow.i32(i32, i32)
+declare { i32, i1 } @llvm.ssub.with.overflow.i32(i32, i32)
+declare { i32, i1 } @llvm.smul.with.overflow.i32(i32, i32)
+
+define internal void @_wacc_init() {
+	%1 = call i8* @setlocale(i32 6, $_wacc_null)
+	call void @_wacc_init_data()
+	ret void
+}
+
+define internal i32* @_wacc_address(i32 %addr) alwaysinline {
+	%1 = getelementptr inbounds $memory, $memory* @_wacc_memory, i32 0, i32 %addr
+	%2 = bitcast i8* %1 to i32*
+	ret i32* %2
+}
+
+define internal void @_wacc_copy(i32 %dst, i32* %src, i32 %words) {
+entry:
+	br label %loop
+loop:
+	%i = phi i32 [ 0, %entry ], [ %next, %body ]
+	%done = icmp eq i32 %i, %words
+	br i1 %done, label %end, label %body
+body:
+	%from = getelementptr inbounds i32, i32* %src, i32 %i
+	%word = load i32, i32* %from, align 4
+	%offset = shl i32 %i, 2
+	%addr = add i32 %dst, %offset
+	%to = call i32* @_wacc_address(i32 %addr)
+	store i32 %word, i32* %to, align 4
+	%next = add i32 %i, 1
+	br label %loop
+end:
+	ret void
+}
+
+; Blocks are preceded by their size, and freed blocks are kept in a list
+; threaded through their first word. The first block in the list which is big
+; enough is reused, otherwise a new one is taken from the top of the heap.
+define internal i32 @_wacc_malloc(i32 %size) {
+entry:
+	%rounded = add i32 %size, 3
+	%wanted = and i32 %rounded, -4
+	br label %search
+search:
+	%link = phi i32* [ @_wacc_free_list, %entry ], [ %nextlink, %next ]
+	%block = load i32, i32* %link, align 4
+	%empty = icmp eq i32 %block, 0
+	br i1 %empty, label %fresh, label %check
+check:
+	%header = sub i32 %block, 4
+	%headerptr = call i32* @_wacc_address(i32 %header)
+	%blocksize = load i32, i32* %headerptr, align 4
+	%fits = icmp uge i32 %blocksize, %wanted
+	br i1 %fits, label %reuse, label %next
+next:
+	%nextlink = call i32* @_wacc_address(i32 %block)
+	br label %search
+reuse:
+	%blockptr = call i32* @_wacc_address(i32 %block)
+	%after = load i32, i32* %blockptr, align 4
+	store i32 %after, i32* %link, align 4
+	ret i32 %block
+fresh:
+	%top = load i32, i32* @_wacc_heap_top, align 4
+	%new = add i32 %top, 4
+	%newtop = add i32 %new, %wanted
+	%full = icmp ugt i32 %newtop, $memory_size
+	br i1 %full, label %oom, label %grow
+grow:
+	store i32 %newtop, i32* @_wacc_heap_top, align 4
+	%topptr = call i32* @_wacc_address(i32 %top)
+	store i32 %wanted, i32* %topptr, align 4
+	ret i32 %new
+oom:
+	call void @_wacc_throw_runtime_error($_wacc_out_of_memory_msg)
+	unreachable
+}
+
+define internal void @_wacc_free(i32 %block) {
+	%1 = load i32, i32* @_wacc_free_list, align 4
+	%2 = call i32* @_wacc_address(i32 %block)
+	store i32 %1, i32* %2, align 4
+	store i32 %block, i32* @_wacc_free_list, align 4
+	ret void
+}
+
+define internal void @_wacc_check_array_bounds(i32 %index, i32 %array) {
+entry:
+	call void @_wacc_check_null_pointer(i32 %array)
+	%negative = icmp slt i32 %index, 0
+	br i1 %negative, label %below, label %nonnegative
+nonnegative:
+	%lengthptr = call i32* @_wacc_address(i32 %array)
+	%length = load i32, i32* %lengthptr, align 4
+	%large = icmp sge i32 %index, %length
+	br i1 %large, label %above, label %ok
+ok:
+	ret void
+below:
+	call void @_wacc_throw_runtime_error($_wacc_array_index_negative_msg)
+	unreachable
+above:
+	call void @_wacc_throw_runtime_error($_wacc_array_index_large_msg)
+	unreachable
+}
+
+define internal void @_wacc_check_null_pointer(i32 %ptr) {
+entry:
+	%null = icmp eq i32 %ptr, 0
+	br i1 %null, label %error, label %ok
+ok:
+	ret void
+error:
+	call void @_wacc_throw_runtime_error($_wacc_null_dereference_msg)
+	unreachable
+}
+
+define internal void @_wacc_throw_overflow_error() noreturn {
+	call void @_wacc_throw_runtime_error($_wacc_overflow_error_msg)
+	unreachable
+}
+
+define internal void @_wacc_throw_divide_by_zero() noreturn {
+	call void @_wacc_throw_runtime_error($_wacc_divide_by_zero_msg)
+	unreachable
+}
+
+define internal void @_wacc_throw_runtime_error(i8* %msg) noreturn {
+	call void @_wacc_print_str(i8* %msg)
+	call void @exit(i32 -1)
+	unreachable
+}
+
+define internal i32 @_wacc_read(i32* %fmt) {
+	%1 = alloca i32, align 4
+	store i32 0, i32* %1, align 4
+	%2 = call i32 (i32*, ...) @wscanf(i32* %fmt, i32* %1)
+	%3 = load i32, i32* %1, align 4
+	ret i32 %3
+}
+
+define internal i32 @_wacc_read_int() {
+	%1 = call i32 @_wacc_read($scanf_fmt_int)
+	ret i32 %1
+}
+
+define internal i32 @_wacc_read_char() {
+	%1 = call i32 @_wacc_read($scanf_fmt_char)
+	ret i32 %1
+}
+
+define internal void @_wacc_print_int(i32 %n) {
+	%1 = call i32 (i32*, ...) @wprintf($printf_fmt_int, i32 %n)
+	%2 = call i32 @fflush(i8* null)
+	ret void
+}
+
+define internal void @_wacc_print_float(i32 %bits) {
+	%1 = bitcast i32 %bits to float
+	%2 = fpext float %1 to double
+	%3 = call i32 (i32*, ...) @wprintf($printf_fmt_float, double %2)
+	%4 = call i32 @fflush(i8* null)
+	ret void
+}
+
+define internal void @_wacc_print_bool(i32 %b) {
+	%1 = icmp ne i32 %b, 0
+	%2 = select i1 %1, $printf_true, $printf_false
+	call void @_wacc_print_str(i8* %2)
+	ret void
+}
+
+define internal void @_wacc_print_char(i32 %c) {
+	%1 = call i32 (i32*, ...) @wprintf($printf_fmt_char, i32 %c)
+	%2 = call i32 @fflush(i8* null)
+	ret void
+}
+
+define internal void @_wacc_print_str(i8* %s) {
+	%1 = call i32 (i32*, ...) @wprintf($printf_fmt_str, i8* %s)
+	%2 = call i32 @fflush(i8* null)
+	ret void
+}
+
+define internal void @_wacc_print_wstr(i32 %s) {
+	%1 = call i32* @_wacc_address(i32 %s)
+	%2 = load i32, i32* %1, align 4
+	%3 = getelementptr inbounds i32, i32* %1, i32 1
+	%4 = call i32 (i32*, ...) @wprintf($printf_fmt_wstr, i32 %2, i32* %3)
+	%5 = call i32 @fflush(i8* null)
+	ret void
+}
+
+define internal void @_wacc_print_addr(i32 %p) {
+entry:
+	%null = icmp eq i32 %p, 0
+	br i1 %null, label %nil, label %address
+nil:
+	call void @_wacc_print_str($printf_nil)
+	ret void
+address:
+	%wide = zext i32 %p to i64
+	%ptr = inttoptr i64 %wide to i8*
+	%printed = call i32 (i32*, ...) @wprintf($printf_fmt_addr, i8* %ptr)
+	%flushed = call i32 @fflush(i8* null)
+	ret void
+}
+
+define internal void @_wacc_print_nl() {
+	%1 = call i32 @putwchar(i32 10)
+	ret void
+}
+`
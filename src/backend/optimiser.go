@@ -14,6 +14,9 @@ type Optimizer interface {
 type fpWhileUnrollerContext struct {
 	ifCtx *IFContext
 
+	// Longest loop which will be unrolled
+	maxIterations int
+
 	loopVariable *VarExpr
 
 	lvStart     int
@@ -126,9 +129,47 @@ func (ctx *fpWhileUnrollerContext) checkLoopVariableIncrements(node *InstrNode)
 	return
 }
 
+// leavesEarly reports whether the body of a loop jumps to its start or end
+// other than by the jump back at the end, as break and continue do
+func (ctx *fpWhileUnrollerContext) leavesEarly(node *InstrNode, begin string) bool {
+	jumps := 0
+	for node = node.Next; node != nil; node = node.Next {
+		var dst *InstrNode
+		switch instr := node.Instr.(type) {
+		case *LabelInstr:
+			if instr.Label == ctx.loopEnd {
+				return jumps > 1
+			}
+		case *JmpInstr:
+			dst = instr.Dst
+		case *JmpCondInstr:
+			dst = instr.Dst
+		}
+
+		if dst != nil {
+			if label, ok := dst.Instr.(*LabelInstr); ok && (label.Label == begin || label.Label == ctx.loopEnd) {
+				jumps++
+			}
+		}
+	}
+	return true
+}
+
 func (ctx *fpWhileUnrollerContext) optimizeLoop(node *InstrNode, whileCond *JmpCondInstr, endPoint *LabelInstr) {
 	ctx.loopEnd = endPoint.Label
 
+	// Only a condition which is a single jump at the start of the loop can be
+	// removed. Conditions using && and || jump out of the loop more than once.
+	if _, ok := node.Prev.Instr.(*LabelInstr); !ok {
+		return
+	}
+	if _, ok := node.Next.Instr.(*PushScopeInstr); !ok {
+		return
+	}
+	if ctx.leavesEarly(node, node.Prev.Instr.(*LabelInstr).Label) {
+		return
+	}
+
 	var ok bool
 
 	// firstly, check to see whether the conditional is a "simple" conditional
@@ -147,7 +188,7 @@ func (ctx *fpWhileUnrollerContext) optimizeLoop(node *InstrNode, whileCond *JmpC
 
 	loopLength := (ctx.lvEnd - ctx.lvStart) / ctx.lvIncrement
 
-	if loopLength > OPTIMISER_LOOPUNROLL_MAX {
+	if loopLength > ctx.maxIterations {
 		return
 	}
 
@@ -171,21 +212,24 @@ func (ctx *fpWhileUnrollerContext) optimizeLoop(node *InstrNode, whileCond *JmpC
 		n = n.Next
 	}
 	instrList = instrList[1 : len(instrList)-2]
-	knownLabels := make(map[string]bool)
-	for _, x := range instrList {
-		if labelInstr, ok := x.(*LabelInstr); ok {
-			knownLabels[labelInstr.Label] = true
-		}
-	}
 
 	n = n.Prev
 	n.Prev.Next, n.Next.Prev = n.Next, n.Prev // omit the jump
 	n = n.Prev                                // n is the popscope
 
-	node.Next, n.Prev = n, node // remove all the instructions
+	ctx.copyIterations(node, n, instrList)
+}
 
-	loopStart := node
-	loopEnd := n
+// copyIterations replaces the instructions between loopStart and loopEnd with
+// a copy of instrList for each value of the loop variable, renaming the labels
+// inside the loop in each copy
+func (ctx *fpWhileUnrollerContext) copyIterations(loopStart, loopEnd *InstrNode, instrList []Instr) {
+	knownLabels := make(map[string]bool)
+	for _, x := range instrList {
+		if labelInstr, ok := x.(*LabelInstr); ok {
+			knownLabels[labelInstr.Label] = true
+		}
+	}
 
 	var lastNode *InstrNode
 	lastNode = loopStart
@@ -216,36 +260,137 @@ func (ctx *fpWhileUnrollerContext) optimizeLoop(node *InstrNode, whileCond *JmpC
 		}
 	}
 	lastNode.Next, loopEnd.Prev = loopEnd, lastNode
+}
+
+// stepIncrement returns how much a move adds to the loop variable, which must
+// be by adding a constant to itself
+func (ctx *fpWhileUnrollerContext) stepIncrement(instr Instr) (int, bool) {
+	move, ok := instr.(*MoveInstr)
+	if !ok {
+		return 0, false
+	}
+	if dst, ok := move.Dst.(*VarExpr); !ok || dst.Name != ctx.loopVariable.Name {
+		return 0, false
+	}
+	src, ok := move.Src.(*BinaryExpr)
+	if !ok || src.Operator != "+" {
+		return 0, false
+	}
 
+	variable, ok := src.Left.(*VarExpr)
+	increment, incOk := src.Right.(*IntConstExpr)
+	if !ok {
+		variable, ok = src.Right.(*VarExpr)
+		increment, incOk = src.Left.(*IntConstExpr)
+	}
+	if !ok || !incOk || variable.Name != ctx.loopVariable.Name {
+		return 0, false
+	}
+	return increment.Value, true
 }
 
-func (ctx *fpWhileUnrollerContext) optimizePath(initialInstr *InstrNode) {
-	node := initialInstr
-	for node != nil {
-		if instr, ok := node.Instr.(*JmpCondInstr); ok {
-			if endPoint, ok := instr.Dst.Instr.(*LabelInstr); ok {
-				ctx.optimizeLoop(node, instr, endPoint)
+// optimizeForLoop unrolls a for loop. The translator recorded where its loop
+// variable is set, tested and stepped, so nothing has to be searched for. The
+// body and the step are copied for each iteration, leaving out the condition
+// and the jump back.
+func (ctx *fpWhileUnrollerContext) optimizeForLoop(loop *loopInfo) {
+	ctx.loopEnd = loop.end.Instr.(*LabelInstr).Label
+
+	init, ok := loop.init.Instr.(*MoveInstr)
+	if !ok {
+		return
+	}
+	start, ok := init.Src.(*IntConstExpr)
+	if !ok {
+		return
+	}
+
+	// The condition must be a single jump out of the loop when the variable
+	// isn't below a constant
+	cond := loop.begin.Next
+	jmp, ok := cond.Instr.(*JmpCondInstr)
+	if !ok || jmp.Dst != loop.end {
+		return
+	}
+	if _, ok := cond.Next.Instr.(*PushScopeInstr); !ok {
+		return
+	}
+	not, ok := jmp.Cond.(*UnaryExpr)
+	if !ok || not.Operator != "!" {
+		return
+	}
+	if ctx.loopVariable, ctx.lvEnd, ok = ctx.conditionalIsSimple(not.Operand); !ok {
+		return
+	}
+	if ctx.loopVariable.Name != loop.variable {
+		return
+	}
+
+	// The step must be a single move adding to the variable
+	step := loop.step.Next
+	if _, ok := step.Next.Instr.(*JmpInstr); !ok {
+		return
+	}
+	if ctx.lvIncrement, ok = ctx.stepIncrement(step.Instr); !ok || ctx.lvIncrement <= 0 {
+		return
+	}
+	ctx.lvStart = start.Value
+
+	// The body mustn't change the variable, or leave other than by the end
+	var instrList []Instr
+	for n := cond.Next; n != step.Next; n = n.Next {
+		var dst Expr
+		switch instr := n.Instr.(type) {
+		case *MoveInstr:
+			dst = instr.Dst
+		case *ReadInstr:
+			dst = instr.Dst
+		case *JmpInstr:
+			if instr.Dst == loop.begin || instr.Dst == loop.step || instr.Dst == loop.end {
+				return
+			}
+		case *JmpCondInstr:
+			if instr.Dst == loop.begin || instr.Dst == loop.step || instr.Dst == loop.end {
+				return
 			}
 		}
-		node = node.Next
+		if v, ok := dst.(*VarExpr); ok && n != step && v.Name == loop.variable {
+			return
+		}
+		instrList = append(instrList, n.Instr)
+	}
+
+	if ctx.lvStart < ctx.lvEnd && (ctx.lvEnd-ctx.lvStart-1)/ctx.lvIncrement >= ctx.maxIterations {
+		return
 	}
+
+	// Replace everything from the condition to the jump back
+	ctx.copyIterations(loop.begin, step.Next.Next, instrList)
 }
 
+// Optimize unrolls the loops recorded by the translator, innermost first so
+// that unrolled inner loops are copied into their outer loop
 func (ctx *fpWhileUnrollerContext) Optimize(ifCtx *IFContext) {
 	ctx.ifCtx = ifCtx
 
-	for _, path := range ifCtx.functions {
-		ctx.optimizePath(path)
+	for i := len(ifCtx.loopList) - 1; i >= 0; i-- {
+		loop := ifCtx.loopList[i]
+		if loop.variable != "" {
+			ctx.optimizeForLoop(loop)
+			continue
+		}
+		if instr, ok := loop.begin.Next.Instr.(*JmpCondInstr); ok && instr.Dst == loop.end {
+			ctx.optimizeLoop(loop.begin.Next, instr, loop.end.Instr.(*LabelInstr))
+		}
 	}
-
-	ctx.optimizePath(ifCtx.main)
 }
 
 type fpInlinerContext struct {
 	ifCtx             *IFContext
+	maxInstrs         int
 	replacementCode   map[string][]Instr
 	functionLabels    map[string]map[string]bool
-	functionArguments []fpInlinerFuncArg
+	functionArguments map[string][]fpInlinerFuncArg
 	inlineCount       int
 }
 
@@ -276,7 +421,11 @@ func (ctx *fpInlinerContext) exprDoesCall(expr Expr) bool {
 		return doesCall
 	case *PairElemExpr:
 		return ctx.exprDoesCall(expr.Operand)
-	case *CharConstExpr, *StringConstExpr, *ArrayConstExpr, *IntConstExpr, *BoolConstExpr, *PointerConstExpr:
+	case *ArrayElemExpr:
+		return ctx.exprDoesCall(expr.Array) || ctx.exprDoesCall(expr.Index)
+	case *StructElemExpr:
+		return false
+	case *CharConstExpr, *StringConstExpr, *ArrayConstExpr, *IntConstExpr, *FloatConstExpr, *BoolConstExpr, *PointerConstExpr:
 		return false
 	case *RegisterExpr, *StackArgumentExpr, *StackLocationExpr:
 		return false
@@ -299,6 +448,7 @@ func (ctx *fpInlinerContext) checkInlinable(initNode *InstrNode) {
 	var firstNode *InstrNode
 	stillLookingForArguments := true
 	var buildingInstr *fpInlinerFuncArg
+	var arguments []fpInlinerFuncArg
 	var extraDeclarations []*DeclareInstr
 	for node != nil {
 		if stillLookingForArguments {
@@ -319,15 +469,18 @@ func (ctx *fpInlinerContext) checkInlinable(initNode *InstrNode) {
 				}
 
 				if registerExpr, ok := instr.Src.(*RegisterExpr); ok {
-					if registerExpr.Id < 4 {
-						ctx.functionArguments = append(ctx.functionArguments, *buildingInstr)
+					if registerExpr.Id < ctx.ifCtx.target.ArgumentRegisters() {
+						arguments = append(arguments, *buildingInstr)
 						buildingInstr = nil
 					} else {
 						firstNode = buildingInstr.Node
 						stillLookingForArguments = false
 					}
 				} else if _, ok := instr.Src.(*StackArgumentExpr); ok {
-
+					// arguments after the first ArgumentRegisters() are
+					// passed on the stack
+					arguments = append(arguments, *buildingInstr)
+					buildingInstr = nil
 				} else {
 					firstNode = buildingInstr.Node
 					stillLookingForArguments = false
@@ -350,9 +503,10 @@ func (ctx *fpInlinerContext) checkInlinable(initNode *InstrNode) {
 		node = node.Next
 	}
 
-	if nodeCount > OPTIMISER_INLINER_MAX {
+	if nodeCount > ctx.maxInstrs {
 		return
 	}
+	ctx.functionArguments[funcName] = arguments
 
 	instrList := make([]Instr, 0)
 	node = initNode
@@ -432,7 +586,7 @@ func (ctx *fpInlinerContext) fixLabels(funcName string, prefix string, instr Ins
 		instr.Expr = ctx.fixLabelsExpr(funcName, prefix, instr.Expr)
 	case *ReadInstr:
 		instr.Dst = ctx.fixLabelsExpr(funcName, prefix, instr.Dst)
-	case *PushScopeInstr, *PopScopeInstr, *NoOpInstr:
+	case *PushScopeInstr, *PopScopeInstr, *UnwindScopesInstr, *NoOpInstr:
 	case *FreeInstr:
 		instr.Object = ctx.fixLabelsExpr(funcName, prefix, instr.Object)
 	case *DeclareInstr:
@@ -510,17 +664,17 @@ func (ctx *fpInlinerContext) inlineInPath(node *InstrNode) {
 				backNode := node.Prev
 
 				// TODO: unbreak usage of stack...
-				pushScopeStack[len(pushScopeStack)-1].StackSize += 48 * regWidth
+				pushScopeStack[len(pushScopeStack)-1].StackSize += 48 * ctx.ifCtx.target.WordSize()
 
 				for argNum, argExpr := range callExpr.Args {
 					varExpr := &VarExpr{fmt.Sprintf("_%s_arg_%d", callExpr.Label.Label, argNum)}
 					newNode := &InstrNode{
 						Instr: &DeclareInstr{
 							Var:  varExpr,
-							Type: ctx.functionArguments[argNum].Type,
+							Type: ctx.functionArguments[callExpr.Label.Label][argNum].Type,
 						},
 					}
-					pushScopeStack[len(pushScopeStack)-1].StackSize += regWidth
+					pushScopeStack[len(pushScopeStack)-1].StackSize += ctx.ifCtx.target.WordSize()
 
 					backNode.Next, newNode.Prev = newNode, backNode
 					newNode.Next, node.Prev = node, newNode
@@ -569,6 +723,7 @@ func (ctx *fpInlinerContext) Optimize(ifCtx *IFContext) {
 	ctx.ifCtx = ifCtx
 	ctx.replacementCode = make(map[string][]Instr)
 	ctx.functionLabels = make(map[string]map[string]bool)
+	ctx.functionArguments = make(map[string][]fpInlinerFuncArg)
 
 	for _, path := range ifCtx.functions {
 		ctx.checkInlinable(path)
@@ -580,10 +735,16 @@ func (ctx *fpInlinerContext) Optimize(ifCtx *IFContext) {
 	ctx.inlineInPath(ifCtx.main)
 }
 
+// OptimiseFirstPassIF runs the passes at the default optimisation level which
+// work on the IF as it comes out of the translator
 func OptimiseFirstPassIF(ifCtx *IFContext) {
-	new(fpWhileUnrollerContext).Optimize(ifCtx)
-	new(fpInlinerContext).Optimize(ifCtx)
+	pm, _ := NewPassManager(DefaultOptimisationLevel)
+	pm.Run(ifCtx, FirstPass)
 }
 
+// OptimiseSecondPassIF runs the passes at the default optimisation level which
+// work on the IF in SSA form
 func OptimiseSecondPassIF(ifCtx *IFContext) {
+	pm, _ := NewPassManager(DefaultOptimisationLevel)
+	pm.Run(ifCtx, SecondPass)
 }
@@ -0,0 +1,85 @@
+package backend
+
+import (
+	"testing"
+)
+
+// argumentTarget is the ARM target with a different number of argument
+// registers
+type argumentTarget struct {
+	armTarget
+	arguments int
+}
+
+func (t argumentTarget) ArgumentRegisters() int { return t.arguments }
+
+func TestInlinerArgumentRegisters(t *testing.T) {
+	source := "begin\n  int f(int a, int b, int c, int d, int e) is\n    return a + e\n  end\n" +
+		"  int x = call f(1, 2, 3, 4, 5) ;\n  println x\nend\n"
+
+	tests := []struct {
+		name   string
+		target Target
+	}{
+		{"arm", ARMTarget},
+		{"two registers", argumentTarget{arguments: 2}},
+		{"six registers", argumentTarget{arguments: 6}},
+	}
+	for _, test := range tests {
+		ifCtx := translateFor(t, source, test.target)
+		(&fpInlinerContext{maxInstrs: OPTIMISER_INLINER_MAX}).Optimize(ifCtx)
+
+		for node := ifCtx.main; node != nil; node = node.Next {
+			move, ok := node.Instr.(*MoveInstr)
+			if !ok {
+				continue
+			}
+			switch src := move.Src.(type) {
+			case *CallExpr:
+				t.Errorf("%v: call to %v isn't inlined", test.name, src.Label.Label)
+			case *RegisterExpr, *StackArgumentExpr:
+				t.Errorf("%v: inlined code reads argument %v", test.name, src.Repr())
+			}
+		}
+	}
+}
+
+func TestLoopUnrolling(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		prints   int
+		unrolled bool
+	}{
+		{"while", "int i = 0 ;\n  while i < 3 do\n    print i ;\n    i = i + 1\n  done", 3, true},
+		{"for", "for int i = 0; i < 3; i = i + 1 do\n    print i\n  done", 3, true},
+		{"for with a larger step", "for int i = 0; i < 7; i = i + 3 do\n    print i\n  done", 3, true},
+		{"nested for", "for int i = 0; i < 2; i = i + 1 do\n    for int j = 0; j < 2; j = j + 1 do\n      print j\n    done\n  done", 4, true},
+		{"for too long", "for int i = 0; i < 1000; i = i + 1 do\n    print i\n  done", 1, false},
+		{"for assigning to its variable", "for int i = 0; i < 3; i = i + 1 do\n    i = i + 1 ;\n    print i\n  done", 1, false},
+		{"for with continue", "for int i = 0; i < 3; i = i + 1 do\n    if i == 1 then continue else skip fi ;\n    print i\n  done", 1, false},
+		{"for with break", "for int i = 0; i < 3; i = i + 1 do\n    if i == 1 then break else skip fi ;\n    print i\n  done", 1, false},
+		{"for-each", "int[] a = [1, 2, 3] ;\n  for int x in a do\n    print x\n  done", 1, false},
+		{"for counting down", "for int i = 3; i > 0; i = i - 1 do\n    print i\n  done", 1, false},
+	}
+	for _, test := range tests {
+		ifCtx := translate(t, "begin\n  "+test.body+"\nend\n")
+		(&fpWhileUnrollerContext{maxIterations: OPTIMISER_LOOPUNROLL_MAX}).Optimize(ifCtx)
+
+		prints, jumps := 0, 0
+		for node := ifCtx.main; node != nil; node = node.Next {
+			switch node.Instr.(type) {
+			case *PrintInstr:
+				prints++
+			case *JmpInstr:
+				jumps++
+			}
+		}
+		if prints != test.prints {
+			t.Errorf("%v: %v prints are left, want %v", test.name, prints, test.prints)
+		}
+		if unrolled := jumps == 0; unrolled != test.unrolled {
+			t.Errorf("%v: unrolled is %v, want %v", test.name, unrolled, test.unrolled)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// When a pass runs, relative to the conversion of the IF into SSA form
+type PassPhase int
+
+const (
+	// Run over the IF as it comes out of the translator
+	FirstPass PassPhase = iota
+
+	// Run over the IF in SSA form
+	SecondPass
+)
+
+// Optimisation levels, as selected by -O0 to -O3
+const (
+	MinOptimisationLevel     = 0
+	MaxOptimisationLevel     = 3
+	DefaultOptimisationLevel = 2
+)
+
+// A named optimisation pass which can be selected on the command line
+type PassInfo struct {
+	Name        string
+	Description string
+	Phase       PassPhase
+
+	// Tuning parameters and their default values
+	Params map[string]int
+
+	// Lowest optimisation level the pass runs at
+	Level int
+
+	create func(params map[string]int) Optimizer
+}
+
+var passRegistry = []*PassInfo{
+	{
+		Name:        "unroll",
+		Description: "Unroll while loops with a small constant number of iterations",
+		Phase:       FirstPass,
+		Params:      map[string]int{"max-iterations": OPTIMISER_LOOPUNROLL_MAX},
+		Level:       2,
+		create: func(params map[string]int) Optimizer {
+			return &fpWhileUnrollerContext{maxIterations: params["max-iterations"]}
+		},
+	},
+	{
+		Name:        "inline",
+		Description: "Inline calls to small functions",
+		Phase:       FirstPass,
+		Params:      map[string]int{"max-instrs": OPTIMISER_INLINER_MAX},
+		Level:       2,
+		create: func(params map[string]int) Optimizer {
+			return &fpInlinerContext{maxInstrs: params["max-instrs"]}
+		},
+	},
+	{
+		Name:        "constprop",
+		Description: "Propagate and fold constants, and fold constant branches",
+		Phase:       SecondPass,
+		Level:       1,
+		create: func(map[string]int) Optimizer {
+			return new(spConstantPropagationContext)
+		},
+	},
+	{
+		Name:        "dce",
+		Description: "Remove unreachable code, dead stores and unused variables",
+		Phase:       SecondPass,
+		Level:       1,
+		create: func(map[string]int) Optimizer {
+			return new(spDeadCodeContext)
+		},
+	},
+}
+
+// Parameters which are raised at -O3
+var aggressiveParams = map[string]int{
+	"unroll.max-iterations": 4 * OPTIMISER_LOOPUNROLL_MAX,
+	"inline.max-instrs":     4 * OPTIMISER_INLINER_MAX,
+}
+
+// Passes returns every pass which can be selected, in the order they run at
+// the highest optimisation level
+func Passes() []*PassInfo {
+	return passRegistry
+}
+
+func lookupPass(name string) (*PassInfo, bool) {
+	for _, p := range passRegistry {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// A PassManager runs a list of passes over the IF, each in its own phase
+type PassManager struct {
+	passes []*PassInfo
+
+	// Parameter values, by <pass>.<parameter>
+	params map[string]int
+
+	// Passes after which the IF is written to dump
+	dumpAfter map[string]bool
+	dump      io.Writer
+}
+
+func newPassManager() *PassManager {
+	pm := &PassManager{
+		params:    make(map[string]int),
+		dumpAfter: make(map[string]bool),
+	}
+	for _, p := range passRegistry {
+		for param, value := range p.Params {
+			pm.params[p.Name+"."+param] = value
+		}
+	}
+	return pm
+}
+
+// NewPassManager selects the passes which run at an optimisation level
+func NewPassManager(level int) (*PassManager, error) {
+	if level < MinOptimisationLevel || level > MaxOptimisationLevel {
+		return nil, fmt.Errorf("unknown optimisation level %d", level)
+	}
+
+	pm := newPassManager()
+	for _, p := range passRegistry {
+		if level >= p.Level {
+			pm.passes = append(pm.passes, p)
+		}
+	}
+	if level == MaxOptimisationLevel {
+		for param, value := range aggressiveParams {
+			pm.params[param] = value
+		}
+	}
+	return pm, nil
+}
+
+// NewPassManagerForPasses runs exactly the passes named in a comma separated
+// list. Passes run in the order given within each phase, and may be repeated.
+func NewPassManagerForPasses(list string) (*PassManager, error) {
+	pm := newPassManager()
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		p, ok := lookupPass(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown optimisation pass '%s'", name)
+		}
+		pm.passes = append(pm.passes, p)
+	}
+	return pm, nil
+}
+
+// SetParam changes a tuning parameter, given as <pass>.<parameter>=<value>
+func (pm *PassManager) SetParam(setting string) error {
+	eq := strings.Index(setting, "=")
+	if eq == -1 {
+		return fmt.Errorf("expected <pass>.<parameter>=<value>, got '%s'", setting)
+	}
+	name, value := setting[:eq], setting[eq+1:]
+
+	if _, ok := pm.params[name]; !ok {
+		return fmt.Errorf("unknown optimisation parameter '%s' (known parameters: %s)",
+			name, strings.Join(pm.paramNames(), ", "))
+	}
+	var n int
+	if _, err := fmt.Sscanf(value, "%d", &n); err != nil || n < 0 {
+		return fmt.Errorf("optimisation parameter '%s' must be a non-negative integer", name)
+	}
+	pm.params[name] = n
+	return nil
+}
+
+func (pm *PassManager) paramNames() []string {
+	names := []string{}
+	for name := range pm.params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DumpAfter writes the IF to w after each run of the named pass. The name
+// "all" dumps the IF after every pass.
+func (pm *PassManager) DumpAfter(name string, w io.Writer) error {
+	if _, ok := lookupPass(name); !ok && name != "all" {
+		return fmt.Errorf("unknown optimisation pass '%s'", name)
+	}
+	pm.dumpAfter[name] = true
+	pm.dump = w
+	return nil
+}
+
+// PassNames lists the passes which will run, in order
+func (pm *PassManager) PassNames() []string {
+	names := []string{}
+	for _, p := range pm.passes {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// Run runs the passes belonging to a phase over the IF
+func (pm *PassManager) Run(ifCtx *IFContext, phase PassPhase) {
+	for _, p := range pm.passes {
+		if p.Phase != phase {
+			continue
+		}
+
+		params := make(map[string]int)
+		for param := range p.Params {
+			params[param] = pm.params[p.Name+"."+param]
+		}
+		p.create(params).Optimize(ifCtx)
+
+		if pm.dumpAfter[p.Name] || pm.dumpAfter["all"] {
+			fmt.Fprintf(pm.dump, "Intermediate form after %s\n", p.Name)
+			DrawIFGraph(pm.dump, ifCtx)
+			fmt.Fprintln(pm.dump)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package backend
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestPassLevels(t *testing.T) {
+	tests := []struct {
+		level  int
+		passes string
+	}{
+		{0, ""},
+		{1, "constprop,dce"},
+		{2, "unroll,inline,constprop,dce"},
+		{3, "unroll,inline,constprop,dce"},
+	}
+	for _, test := range tests {
+		pm, err := NewPassManager(test.level)
+		if err != nil {
+			t.Errorf("-O%v: %v", test.level, err)
+			continue
+		}
+		if passes := strings.Join(pm.PassNames(), ","); passes != test.passes {
+			t.Errorf("-O%v runs %q, want %q", test.level, passes, test.passes)
+		}
+	}
+
+	pm, _ := NewPassManager(MaxOptimisationLevel)
+	if pm.params["unroll.max-iterations"] <= OPTIMISER_LOOPUNROLL_MAX {
+		t.Errorf("-O%v doesn't unroll longer loops", MaxOptimisationLevel)
+	}
+}
+
+func TestPassOptionErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		create func() (*PassManager, error)
+
+		// Part of the error, or empty if there shouldn't be one
+		err string
+	}{
+		{
+			"level too low",
+			func() (*PassManager, error) { return NewPassManager(-1) },
+			"unknown optimisation level -1",
+		},
+		{
+			"level too high",
+			func() (*PassManager, error) { return NewPassManager(4) },
+			"unknown optimisation level 4",
+		},
+		{
+			"passes",
+			func() (*PassManager, error) { return NewPassManagerForPasses("dce, constprop,,dce") },
+			"",
+		},
+		{
+			"unknown pass",
+			func() (*PassManager, error) { return NewPassManagerForPasses("constprop,gvn") },
+			"unknown optimisation pass 'gvn'",
+		},
+		{
+			"param",
+			func() (*PassManager, error) { return withParam("unroll.max-iterations=3") },
+			"",
+		},
+		{
+			"param without a value",
+			func() (*PassManager, error) { return withParam("unroll.max-iterations") },
+			"expected <pass>.<parameter>=<value>",
+		},
+		{
+			"unknown param",
+			func() (*PassManager, error) { return withParam("unroll.max=3") },
+			"unknown optimisation parameter 'unroll.max' (known parameters: inline.max-instrs, unroll.max-iterations)",
+		},
+		{
+			"param of a pass without any",
+			func() (*PassManager, error) { return withParam("dce.rounds=2") },
+			"unknown optimisation parameter 'dce.rounds'",
+		},
+		{
+			"negative param",
+			func() (*PassManager, error) { return withParam("inline.max-instrs=-1") },
+			"'inline.max-instrs' must be a non-negative integer",
+		},
+		{
+			"param not a number",
+			func() (*PassManager, error) { return withParam("inline.max-instrs=lots") },
+			"'inline.max-instrs' must be a non-negative integer",
+		},
+		{
+			"dump after unknown pass",
+			func() (*PassManager, error) {
+				pm, _ := NewPassManager(DefaultOptimisationLevel)
+				return pm, pm.DumpAfter("gvn", ioutil.Discard)
+			},
+			"unknown optimisation pass 'gvn'",
+		},
+		{
+			"dump after all",
+			func() (*PassManager, error) {
+				pm, _ := NewPassManager(DefaultOptimisationLevel)
+				return pm, pm.DumpAfter("all", ioutil.Discard)
+			},
+			"",
+		},
+	}
+	for _, test := range tests {
+		_, err := test.create()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%v: unexpected error %v", test.name, err)
+		case test.err != "" && err == nil:
+			t.Errorf("%v: no error, want %q", test.name, test.err)
+		case test.err != "" && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%v: got error %q, want %q", test.name, err, test.err)
+		}
+	}
+
+	pm, _ := NewPassManagerForPasses("dce, constprop,,dce")
+	if passes := strings.Join(pm.PassNames(), ","); passes != "dce,constprop,dce" {
+		t.Errorf("-passes runs %q, want dce,constprop,dce", passes)
+	}
+}
+
+// withParam sets a tuning parameter at the default optimisation level
+func withParam(setting string) (*PassManager, error) {
+	pm, _ := NewPassManager(DefaultOptimisationLevel)
+	return pm, pm.SetParam(setting)
+}
@@ -0,0 +1,569 @@
+package backend
+
+import (
+	"unicode/utf8"
+
+	"../frontend"
+)
+
+// Sparse conditional constant propagation, from "Constant Propagation with
+// Conditional Branches" by Wegman and Zadeck. It runs over the IF in SSA form,
+// so each variable has a single value which is found by following the edges of
+// the CFG which can actually be taken.
+//
+// Expressions are only folded when evaluating them at runtime can't fail, so
+// overflows and divisions by zero are left for the runtime checks to report.
+
+const (
+	latticeUndefined = iota
+	latticeConstant
+	latticeOverdefined
+)
+
+// What is known about the value of an expression
+type latticeValue struct {
+	state int
+	value Expr
+}
+
+var overdefined = latticeValue{state: latticeOverdefined}
+
+type cfgEdge struct {
+	from *BasicBlock
+	to   *BasicBlock
+}
+
+type spConstantPropagationContext struct {
+	ifCtx *IFContext
+	cfg   *CFG
+
+	values map[string]latticeValue
+	uses   map[string][]*InstrNode
+
+	executable map[cfgEdge]bool
+	visited    map[*BasicBlock]bool
+
+	flowWorklist []cfgEdge
+	ssaWorklist  []*InstrNode
+
+	// Edges into the block of each phi before any branches were folded
+	phiEdges map[*InstrNode][]*InstrNode
+}
+
+//
+// Folding constants
+//
+func isConstant(e Expr) bool {
+	switch e.(type) {
+	case *IntConstExpr, *BoolConstExpr, *CharConstExpr:
+		return true
+	default:
+		return false
+	}
+}
+
+// ordinal returns the value a constant has in a register
+func ordinal(e Expr) (int, bool) {
+	switch e := e.(type) {
+	case *IntConstExpr:
+		return e.Value, true
+	case *CharConstExpr:
+		return int(e.Value), true
+	case *BoolConstExpr:
+		if e.Value {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// foldUnary evaluates a unary operator applied to a constant
+func foldUnary(operator string, operand Expr) (Expr, bool) {
+	switch operator {
+	case Not:
+		if b, ok := operand.(*BoolConstExpr); ok {
+			return &BoolConstExpr{!b.Value}, true
+		}
+
+	case Neg:
+		if n, ok := operand.(*IntConstExpr); ok && n.Value != frontend.INT_MIN {
+			return &IntConstExpr{-n.Value}, true
+		}
+
+	case Ord:
+		if c, ok := operand.(*CharConstExpr); ok {
+			return &IntConstExpr{int(c.Value)}, true
+		}
+
+	case Chr:
+		if n, ok := operand.(*IntConstExpr); ok {
+			if size := utf8.RuneLen(rune(n.Value)); size > 0 {
+				return &CharConstExpr{rune(n.Value), size}, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// foldBinary evaluates a binary operator applied to two constants
+func foldBinary(operator string, left, right Expr) (Expr, bool) {
+	switch operator {
+	case Add, Sub, Mul, Div, Mod:
+		l, lOk := left.(*IntConstExpr)
+		r, rOk := right.(*IntConstExpr)
+		if !lOk || !rOk {
+			return nil, false
+		}
+		a, b := int64(l.Value), int64(r.Value)
+
+		var n int64
+		switch operator {
+		case Add:
+			n = a + b
+		case Sub:
+			n = a - b
+		case Mul:
+			n = a * b
+		case Div:
+			if b == 0 {
+				return nil, false
+			}
+			n = a / b
+		case Mod:
+			// Mod is worked out as a - (a / b) * b, which overflows when
+			// dividing the smallest int by -1
+			if b == 0 || (a == frontend.INT_MIN && b == -1) {
+				return nil, false
+			}
+			n = a % b
+		}
+
+		if n < frontend.INT_MIN || n > frontend.INT_MAX {
+			return nil, false
+		}
+		return &IntConstExpr{int(n)}, true
+
+	case And, Or:
+		l, lOk := left.(*BoolConstExpr)
+		r, rOk := right.(*BoolConstExpr)
+		if !lOk || !rOk {
+			return nil, false
+		}
+		if operator == And {
+			return &BoolConstExpr{l.Value && r.Value}, true
+		}
+		return &BoolConstExpr{l.Value || r.Value}, true
+
+	case LT, LE, GT, GE, EQ, NE:
+		a, lOk := ordinal(left)
+		b, rOk := ordinal(right)
+		if !lOk || !rOk {
+			return nil, false
+		}
+
+		var result bool
+		switch operator {
+		case LT:
+			result = a < b
+		case LE:
+			result = a <= b
+		case GT:
+			result = a > b
+		case GE:
+			result = a >= b
+		case EQ:
+			result = a == b
+		case NE:
+			result = a != b
+		}
+		return &BoolConstExpr{result}, true
+	}
+	return nil, false
+}
+
+// mayFail reports whether evaluating an expression could raise a runtime error
+func mayFail(e Expr) bool {
+	switch e := e.(type) {
+	case *UnaryExpr:
+		return e.Operator == Neg || e.Operator == Len || mayFail(e.Operand)
+
+	case *BinaryExpr:
+		switch e.Operator {
+		case Add, Sub, Mul, Div, Mod:
+			return true
+		}
+		return mayFail(e.Left) || mayFail(e.Right)
+
+	case *ArrayElemExpr, *PairElemExpr, *StructElemExpr:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// foldExpr folds every operator in an expression whose operands are constant
+func foldExpr(e Expr) Expr {
+	switch e := e.(type) {
+	case *UnaryExpr:
+		operand := foldExpr(e.Operand)
+		if isConstant(operand) {
+			if c, ok := foldUnary(e.Operator, operand); ok {
+				return c
+			}
+		}
+		return &UnaryExpr{e.Operator, operand, e.Type}
+
+	case *BinaryExpr:
+		left, right := foldExpr(e.Left), foldExpr(e.Right)
+		if isConstant(left) && isConstant(right) {
+			if c, ok := foldBinary(e.Operator, left, right); ok {
+				return c
+			}
+		}
+
+		// The heavier operand is evaluated first. If folding changes which
+		// one that is, and both could raise a runtime error, the error
+		// reported would change too.
+		if (left.Weight() > right.Weight()) != (e.Left.Weight() > e.Right.Weight()) &&
+			mayFail(left) && mayFail(right) {
+			return &BinaryExpr{e.Operator, e.Left, e.Right, e.Type}
+		}
+		return &BinaryExpr{e.Operator, left, right, e.Type}
+
+	default:
+		return e
+	}
+}
+
+func foldInstr(i Instr) {
+	switch i := i.(type) {
+	case *MoveInstr:
+		i.Src = foldExpr(i.Src)
+
+	case *EvalInstr:
+		i.Expr = foldExpr(i.Expr)
+
+	case *ReturnInstr:
+		i.Expr = foldExpr(i.Expr)
+
+	case *ExitInstr:
+		i.Expr = foldExpr(i.Expr)
+
+	case *PrintInstr:
+		i.Expr = foldExpr(i.Expr)
+
+	case *JmpCondInstr:
+		i.Cond = foldExpr(i.Cond)
+	}
+}
+
+//
+// Propagation
+//
+func meet(a, b latticeValue) latticeValue {
+	switch {
+	case a.state == latticeUndefined:
+		return b
+	case b.state == latticeUndefined:
+		return a
+	case a.state == latticeOverdefined || b.state == latticeOverdefined:
+		return overdefined
+	case a.value.Repr() != b.value.Repr():
+		return overdefined
+	default:
+		return a
+	}
+}
+
+func (ctx *spConstantPropagationContext) evaluate(e Expr) latticeValue {
+	switch e := e.(type) {
+	case *IntConstExpr, *BoolConstExpr, *CharConstExpr:
+		return latticeValue{latticeConstant, e}
+
+	case *VarExpr:
+		if v, ok := ctx.values[e.Name]; ok {
+			return v
+		}
+		return overdefined
+
+	case *UnaryExpr:
+		operand := ctx.evaluate(e.Operand)
+		if operand.state != latticeConstant {
+			return operand
+		}
+		if c, ok := foldUnary(e.Operator, operand.value); ok {
+			return latticeValue{latticeConstant, c}
+		}
+		return overdefined
+
+	case *BinaryExpr:
+		left, right := ctx.evaluate(e.Left), ctx.evaluate(e.Right)
+		if left.state == latticeOverdefined || right.state == latticeOverdefined {
+			return overdefined
+		}
+		if left.state == latticeUndefined || right.state == latticeUndefined {
+			return latticeValue{state: latticeUndefined}
+		}
+		if c, ok := foldBinary(e.Operator, left.value, right.value); ok {
+			return latticeValue{latticeConstant, c}
+		}
+		return overdefined
+
+	default:
+		// Calls, reads from memory and floating point values are never
+		// treated as constant
+		return overdefined
+	}
+}
+
+func (ctx *spConstantPropagationContext) setValue(v *VarExpr, value latticeValue) {
+	// Values only ever move down the lattice, so a change of state is the
+	// only change there can be
+	if ctx.values[v.Name].state == value.state {
+		return
+	}
+	ctx.values[v.Name] = value
+	ctx.ssaWorklist = append(ctx.ssaWorklist, ctx.uses[v.Name]...)
+}
+
+func (ctx *spConstantPropagationContext) markExecutable(from, to *BasicBlock) {
+	if !ctx.executable[cfgEdge{from, to}] {
+		ctx.flowWorklist = append(ctx.flowWorklist, cfgEdge{from, to})
+	}
+}
+
+// branchTargets returns the blocks a conditional jump at the end of b goes to
+// when its condition is true and when it is false
+func (ctx *spConstantPropagationContext) branchTargets(b *BasicBlock, jmp *JmpCondInstr) (*BasicBlock, *BasicBlock) {
+	var taken, notTaken *BasicBlock
+	label := jmp.Dst.Instr.(*LabelInstr).Label
+	for _, s := range b.Succs {
+		if l, ok := s.First().Instr.(*LabelInstr); ok && l.Label == label {
+			taken = s
+		}
+	}
+	if b.Id+1 < len(ctx.cfg.Blocks) {
+		notTaken = ctx.cfg.Blocks[b.Id+1]
+	}
+	return taken, notTaken
+}
+
+func (ctx *spConstantPropagationContext) visitInstr(node *InstrNode) {
+	b := ctx.cfg.BlockOf(node)
+
+	switch i := node.Instr.(type) {
+	case *PhiInstr:
+		value := latticeValue{state: latticeUndefined}
+		for k, p := range b.Preds {
+			if ctx.executable[cfgEdge{p, b}] {
+				value = meet(value, ctx.evaluate(i.Args[k]))
+			}
+		}
+		ctx.setValue(i.Dst, value)
+
+	case *MoveInstr:
+		if v, ok := i.Dst.(*VarExpr); ok {
+			ctx.setValue(v, ctx.evaluate(i.Src))
+		}
+
+	case *ReadInstr:
+		if v, ok := i.Dst.(*VarExpr); ok {
+			ctx.setValue(v, overdefined)
+		}
+
+	case *JmpCondInstr:
+		cond := ctx.evaluate(i.Cond)
+		if cond.state == latticeUndefined {
+			return
+		}
+
+		taken, notTaken := ctx.branchTargets(b, i)
+		if c, ok := cond.value.(*BoolConstExpr); ok && cond.state == latticeConstant {
+			if !c.Value {
+				taken = notTaken
+			}
+			if taken != nil {
+				ctx.markExecutable(b, taken)
+			}
+			return
+		}
+		for _, s := range b.Succs {
+			ctx.markExecutable(b, s)
+		}
+		return
+	}
+
+	if node == b.Last() {
+		for _, s := range b.Succs {
+			ctx.markExecutable(b, s)
+		}
+	}
+}
+
+func (ctx *spConstantPropagationContext) visitBlock(b *BasicBlock) {
+	for _, node := range b.Instrs {
+		ctx.visitInstr(node)
+	}
+}
+
+func (ctx *spConstantPropagationContext) propagate() {
+	ctx.visited[ctx.cfg.Entry] = true
+	ctx.visitBlock(ctx.cfg.Entry)
+
+	for len(ctx.flowWorklist) > 0 || len(ctx.ssaWorklist) > 0 {
+		for len(ctx.flowWorklist) > 0 {
+			e := ctx.flowWorklist[len(ctx.flowWorklist)-1]
+			ctx.flowWorklist = ctx.flowWorklist[:len(ctx.flowWorklist)-1]
+			if ctx.executable[e] {
+				continue
+			}
+			ctx.executable[e] = true
+
+			// The first time a block is reached everything in it is
+			// evaluated, afterwards only the phis can change
+			if !ctx.visited[e.to] {
+				ctx.visited[e.to] = true
+				ctx.visitBlock(e.to)
+				continue
+			}
+			for _, node := range e.to.Instrs {
+				if _, ok := node.Instr.(*PhiInstr); ok {
+					ctx.visitInstr(node)
+				}
+			}
+		}
+
+		for len(ctx.ssaWorklist) > 0 {
+			node := ctx.ssaWorklist[len(ctx.ssaWorklist)-1]
+			ctx.ssaWorklist = ctx.ssaWorklist[:len(ctx.ssaWorklist)-1]
+			if ctx.visited[ctx.cfg.BlockOf(node)] {
+				ctx.visitInstr(node)
+			}
+		}
+	}
+}
+
+//
+// Rewriting the branch
+//
+func (ctx *spConstantPropagationContext) findUses(branch *InstrNode) {
+	ctx.values = make(map[string]latticeValue)
+	ctx.uses = make(map[string][]*InstrNode)
+
+	for node := branch; node != nil; node = node.Next {
+		n := node
+		use := func(v *VarExpr) Expr {
+			ctx.uses[v.Name] = append(ctx.uses[v.Name], n)
+			return v
+		}
+
+		if phi, ok := node.Instr.(*PhiInstr); ok {
+			for _, arg := range phi.Args {
+				mapVars(arg, use)
+			}
+		} else {
+			rewriteUses(node.Instr, use)
+		}
+
+		if v := definedVar(node.Instr); v != nil {
+			ctx.values[v.Name] = latticeValue{state: latticeUndefined}
+		}
+	}
+}
+
+// replaceConstants substitutes the constant variables and folds what it can in
+// the blocks which can run. Conditional jumps which always go the same way
+// become plain jumps, or no-ops if they are never taken, so that the edges
+// they no longer take disappear from the CFG.
+func (ctx *spConstantPropagationContext) replaceConstants() []*InstrNode {
+	replace := func(v *VarExpr) Expr {
+		if value := ctx.values[v.Name]; value.state == latticeConstant {
+			return value.value.Copy()
+		}
+		return v
+	}
+
+	folded := []*InstrNode{}
+	for _, b := range ctx.cfg.Blocks {
+		if !ctx.visited[b] {
+			continue
+		}
+
+		for _, node := range b.Instrs {
+			if phi, ok := node.Instr.(*PhiInstr); ok {
+				if value := ctx.values[phi.Dst.Name]; value.state == latticeConstant {
+					node.Instr = &MoveInstr{Dst: phi.Dst, Src: value.value.Copy()}
+					continue
+				}
+				for k, arg := range phi.Args {
+					phi.Args[k] = mapVars(arg, replace)
+				}
+				continue
+			}
+
+			rewriteUses(node.Instr, replace)
+			foldInstr(node.Instr)
+
+			switch i := node.Instr.(type) {
+			case *MoveInstr:
+				if v, ok := i.Dst.(*VarExpr); ok {
+					if value := ctx.values[v.Name]; value.state == latticeConstant {
+						i.Src = value.value.Copy()
+					}
+				}
+
+			case *JmpCondInstr:
+				if c, ok := i.Cond.(*BoolConstExpr); ok {
+					if c.Value {
+						node.Instr = &JmpInstr{i.Dst}
+					} else {
+						node.Instr = &NoOpInstr{}
+					}
+					folded = append(folded, node)
+				}
+			}
+		}
+	}
+	return folded
+}
+
+// removeFoldedEdges drops the arguments of phis which came in along edges which
+// are no longer in the CFG
+func (ctx *spConstantPropagationContext) removeFoldedEdges(folded []*InstrNode) {
+	if len(folded) == 0 {
+		return
+	}
+	ctx.cfg.Rebuild()
+	remapPhis(ctx.cfg, ctx.phiEdges)
+
+	// Removing a block entirely would change the edges again
+	for _, node := range folded {
+		if _, ok := node.Instr.(*NoOpInstr); ok && len(ctx.cfg.BlockOf(node).Instrs) > 1 {
+			unlinkNode(node)
+		}
+	}
+}
+
+func (ctx *spConstantPropagationContext) optimizePath(branch *InstrNode) {
+	ctx.cfg = BuildCFG(branch)
+	ctx.executable = make(map[cfgEdge]bool)
+	ctx.visited = make(map[*BasicBlock]bool)
+	ctx.flowWorklist = nil
+	ctx.ssaWorklist = nil
+
+	ctx.findUses(branch)
+	ctx.phiEdges = phiEdges(ctx.cfg)
+	ctx.propagate()
+	ctx.removeFoldedEdges(ctx.replaceConstants())
+}
+
+func (ctx *spConstantPropagationContext) Optimize(ifCtx *IFContext) {
+	ctx.ifCtx = ifCtx
+
+	for _, branch := range ifCtx.Branches() {
+		ctx.optimizePath(branch)
+	}
+}
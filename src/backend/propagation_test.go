@@ -0,0 +1,229 @@
+package backend
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"../frontend"
+)
+
+func intConst(n int) Expr {
+	return &IntConstExpr{n}
+}
+
+func binary(operator string, left, right Expr) Expr {
+	return &BinaryExpr{operator, left, right, frontend.BasicType{frontend.INT}}
+}
+
+func TestFoldExpr(t *testing.T) {
+	tests := []struct {
+		expr Expr
+		want string
+	}{
+		{binary(Add, intConst(1), intConst(2)), "INT 3"},
+		{binary(Mul, binary(Sub, intConst(10), intConst(4)), intConst(7)), "INT 42"},
+		{binary(Div, intConst(-7), intConst(2)), "INT -3"},
+		{binary(Mod, intConst(-7), intConst(2)), "INT -1"},
+		{&BinaryExpr{LT, intConst(1), intConst(2), frontend.BasicType{frontend.BOOL}}, "BOOL true"},
+		{&BinaryExpr{And, &BoolConstExpr{true}, &BoolConstExpr{false}, frontend.BasicType{frontend.BOOL}}, "BOOL false"},
+		{&UnaryExpr{Ord, &CharConstExpr{'a', 1}, frontend.BasicType{frontend.INT}}, "INT 97"},
+
+		// Anything which fails at runtime is left for the runtime checks
+		{binary(Add, intConst(frontend.INT_MAX), intConst(1)), "BINARY int + (INT 2147483647) (INT 1)"},
+		{binary(Div, intConst(1), intConst(0)), "BINARY int / (INT 1) (INT 0)"},
+		{binary(Mod, intConst(frontend.INT_MIN), intConst(-1)), "BINARY int % (INT -2147483648) (INT -1)"},
+		{&UnaryExpr{Neg, intConst(frontend.INT_MIN), frontend.BasicType{frontend.INT}}, "UNARY int - (INT -2147483648)"},
+
+		// Only the part which can't fail is folded
+		{binary(Add, binary(Add, intConst(1), intConst(2)), binary(Div, intConst(1), intConst(0))),
+			"BINARY int + (INT 3) (BINARY int / (INT 1) (INT 0))"},
+	}
+	for _, test := range tests {
+		if got := foldExpr(test.expr).Repr(); got != test.want {
+			t.Errorf("foldExpr(%v) = %v, want %v", test.expr.Repr(), got, test.want)
+		}
+	}
+}
+
+// firstFault evaluates an integer expression in the order the generated code
+// does, and returns the runtime error it raises, if any
+func firstFault(e Expr) (int64, string) {
+	switch e := e.(type) {
+	case *IntConstExpr:
+		return int64(e.Value), ""
+
+	case *UnaryExpr:
+		n, fault := firstFault(e.Operand)
+		if fault != "" {
+			return 0, fault
+		}
+		if n == frontend.INT_MIN {
+			return 0, "overflow"
+		}
+		return -n, ""
+
+	case *BinaryExpr:
+		var a, b int64
+		var fault string
+		if e.Left.Weight() > e.Right.Weight() {
+			if a, fault = firstFault(e.Left); fault == "" {
+				b, fault = firstFault(e.Right)
+			}
+		} else {
+			if b, fault = firstFault(e.Right); fault == "" {
+				a, fault = firstFault(e.Left)
+			}
+		}
+		if fault != "" {
+			return 0, fault
+		}
+
+		var n int64
+		switch e.Operator {
+		case Add:
+			n = a + b
+		case Sub:
+			n = a - b
+		case Mul:
+			n = a * b
+		case Div, Mod:
+			if b == 0 {
+				return 0, "divide by zero"
+			}
+			if a == frontend.INT_MIN && b == -1 {
+				return 0, "overflow"
+			}
+			if e.Operator == Div {
+				n = a / b
+			} else {
+				n = a % b
+			}
+		}
+		if n < frontend.INT_MIN || n > frontend.INT_MAX {
+			return 0, "overflow"
+		}
+		return n, ""
+	}
+	panic(fmt.Sprintf("firstFault can't evaluate %v", e.Repr()))
+}
+
+// printedExpr returns the expression printed by the first println in main
+func printedExpr(ifCtx *IFContext) Expr {
+	for node := ifCtx.main; node != nil; node = node.Next {
+		if print, ok := node.Instr.(*PrintInstr); ok {
+			return print.Expr
+		}
+	}
+	return nil
+}
+
+// randomExpr builds an expression out of constants which are likely to
+// overflow or divide by zero
+func randomExpr(r *rand.Rand, depth int) string {
+	if depth == 0 || r.Intn(4) == 0 {
+		constants := []string{"0", "1", "2", "7", "100", "2147483647", "1073741824"}
+		return constants[r.Intn(len(constants))]
+	}
+	operators := []string{"+", "-", "*", "/", "%"}
+	return fmt.Sprintf("(%v %v %v)", randomExpr(r, depth-1), operators[r.Intn(len(operators))], randomExpr(r, depth-1))
+}
+
+func TestConstantPropagationFaultOrder(t *testing.T) {
+	exprs := []string{
+		"((7 + 100) + (2147483647 - 7)) % ((3 / 0) + 1)",
+		"(((2147483647 + 1) + 1) + 1) + ((((1 + 1) + (1 + 1)) / 0) + 1)",
+		"(7 + 2147483647) + ((3 / 0) + 1)",
+	}
+	r := rand.New(rand.NewSource(1))
+	for len(exprs) < 500 {
+		exprs = append(exprs, randomExpr(r, 5))
+	}
+
+	for _, expr := range exprs {
+		ifCtx := translate(t, fmt.Sprintf("begin\n  println %v\nend\n", expr))
+		_, want := firstFault(printedExpr(ifCtx).Copy())
+
+		if err := ConvertToSSA(ifCtx); err != nil {
+			t.Fatalf("ConvertToSSA returned %v", err)
+		}
+		OptimiseSecondPassIF(ifCtx)
+		folded := printedExpr(ifCtx)
+		if _, got := firstFault(folded); got != want {
+			t.Errorf("%v is folded to %v, which raises %q rather than %q", expr, folded.Repr(), got, want)
+		}
+	}
+}
+
+func TestConstantPropagation(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+
+		// The first value printed, and whether any conditional jumps are left
+		printed  string
+		branches bool
+	}{
+		{
+			"variables",
+			"begin\n  int x = 2 ;\n  int y = x * 3 ;\n  println y + 1\nend\n",
+			"INT 7", false,
+		},
+		{
+			"condition",
+			"begin\n  int x = 1 ;\n  int y = 0 ;\n  if x > 0 then y = 5 else y = 6 fi ;\n  println y\nend\n",
+			"INT 5", false,
+		},
+		{
+			"same value on both branches",
+			"begin\n  int x = 0 ;\n  read x ;\n  int y = 0 ;\n  if x > 0 then y = 5 else y = 5 fi ;\n  println y\nend\n",
+			"INT 5", true,
+		},
+		{
+			"different values on each branch",
+			"begin\n  int x = 0 ;\n  read x ;\n  int y = 0 ;\n  if x > 0 then y = 5 else y = 6 fi ;\n  println y\nend\n",
+			"VAR y.4", true,
+		},
+		{
+			"loop never entered",
+			"begin\n  int i = 10 ;\n  while i < 3 do\n    i = i + 1\n  done ;\n  println i\nend\n",
+			"INT 10", false,
+		},
+		{
+			"loop",
+			"begin\n  int i = 0 ;\n  while i < 3 do\n    i = i + 1\n  done ;\n  println i\nend\n",
+			"VAR i.2", true,
+		},
+		{
+			"overflow",
+			"begin\n  int x = 2147483647 ;\n  println x + 1\nend\n",
+			"BINARY int + (INT 2147483647) (INT 1)", false,
+		},
+	}
+	for _, test := range tests {
+		ifCtx := translate(t, test.source)
+		if err := ConvertToSSA(ifCtx); err != nil {
+			t.Fatalf("%v: ConvertToSSA returned %v", test.name, err)
+		}
+		OptimiseSecondPassIF(ifCtx)
+
+		var printed string
+		branches := false
+		for node := ifCtx.main; node != nil; node = node.Next {
+			switch i := node.Instr.(type) {
+			case *PrintInstr:
+				if printed == "" {
+					printed = i.Expr.Repr()
+				}
+			case *JmpCondInstr:
+				branches = true
+			}
+		}
+		if printed != test.printed {
+			t.Errorf("%v: prints %v, want %v", test.name, printed, test.printed)
+		}
+		if branches != test.branches {
+			t.Errorf("%v: conditional jumps left is %v, want %v", test.name, branches, test.branches)
+		}
+	}
+}
@@ -6,8 +6,23 @@ import (
 	"../frontend"
 )
 
+// Strategies for deciding where variables live
+type RegisterAllocator int
+
+const (
+	// Keep every variable on the stack, and use all of the target's
+	// temporary registers (r4-r11 on ARM) for temporaries
+	SimpleAllocator RegisterAllocator = iota
+
+	// Use liveness analysis to keep variables in the target's variable
+	// registers (r8-r11 on ARM) where possible, and use the rest (r4-r7) for
+	// temporaries
+	LinearScanAllocator
+)
+
 type Variable struct {
 	stack       int
+	reg         *RegisterExpr // nil if the variable lives on the stack
 	typeInfo    frontend.Type
 	initialised bool
 }
@@ -15,6 +30,20 @@ type Variable struct {
 type VariableScope struct {
 	variableMap map[string]*Variable
 	next        int
+
+	// First stack slot belonging to this scope, and one past the last slot
+	// used for spilling
+	base   int
+	extent int
+
+	// Instruction which reserves stack space for this scope, if any
+	push *PushScopeInstr
+}
+
+// A register whose previous value has been moved to the stack
+type spilledRegister struct {
+	slot int
+	age  int
 }
 
 type RegisterAllocatorContext struct {
@@ -22,8 +51,33 @@ type RegisterAllocatorContext struct {
 	scope []VariableScope
 	depth int
 
+	// Target being allocated for, and its registers
+	target    Target
+	registers *RegisterFile
+
 	// Registers in use
-	registerUseList [12]bool
+	registerUseList []bool
+
+	// Registers which can be used for temporaries
+	firstTemporary int
+	lastTemporary  int
+
+	// Registers given to variables in the current branch
+	assignments map[*DeclareInstr]*RegisterExpr
+
+	// Order in which the registers in use were allocated, used to decide
+	// which one to spill
+	registerAge []int
+	allocations int
+
+	// Allocation frames, innermost last. A frame covers the evaluation of a
+	// single instruction or expression, and holds the registers it is
+	// actively using, which can't be spilled.
+	frames [][]int
+
+	// Values spilled from each register, most recent last
+	spills     [][]spilledRegister
+	spillSlots map[int]bool
 
 	// Current location in the list
 	currentNode *InstrNode
@@ -31,30 +85,145 @@ type RegisterAllocatorContext struct {
 	// String data store
 	dataStore      map[string]*StringConstExpr
 	dataStoreIndex int
+
+	stageErrors
+}
+
+//
+// Register allocation and spilling
+//
+func (ctx *RegisterAllocatorContext) pushFrame(pinned ...*RegisterExpr) {
+	frame := []int{}
+	for _, r := range pinned {
+		frame = append(frame, r.Id)
+	}
+	ctx.frames = append(ctx.frames, frame)
+}
+
+func (ctx *RegisterAllocatorContext) popFrame() {
+	ctx.frames = ctx.frames[:len(ctx.frames)-1]
+}
+
+func (ctx *RegisterAllocatorContext) pin(r *RegisterExpr) {
+	if len(ctx.frames) > 0 {
+		top := len(ctx.frames) - 1
+		ctx.frames[top] = append(ctx.frames[top], r.Id)
+	}
+}
+
+func (ctx *RegisterAllocatorContext) unpin(r *RegisterExpr) {
+	if len(ctx.frames) > 0 {
+		top := len(ctx.frames) - 1
+		for i, id := range ctx.frames[top] {
+			if id == r.Id {
+				ctx.frames[top] = append(ctx.frames[top][:i], ctx.frames[top][i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (ctx *RegisterAllocatorContext) isPinned(id int) bool {
+	if len(ctx.frames) == 0 {
+		return false
+	}
+	for _, pinned := range ctx.frames[len(ctx.frames)-1] {
+		if pinned == id {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate allocates registers for an expression which leaves its result in
+// dst
+func (ctx *RegisterAllocatorContext) evaluate(e Expr, dst *RegisterExpr) {
+	ctx.pushFrame(dst)
+	e.allocateRegisters(ctx, dst)
+	ctx.popFrame()
 }
 
 func (ctx *RegisterAllocatorContext) allocateRegister() *RegisterExpr {
 	var reg *RegisterExpr
-	for k, inUse := range ctx.registerUseList {
-		if k < 4 {
-			continue
-		}
-		if !inUse {
+	for k := ctx.firstTemporary; k <= ctx.lastTemporary; k++ {
+		if !ctx.registerUseList[k] {
 			reg = &RegisterExpr{k}
 			break
 		}
 	}
 
 	if reg == nil {
-		panic("Ran out of registers - need to spill")
+		reg = ctx.spillRegister()
 	}
 	ctx.registerUseList[reg.Id] = true
+	ctx.registerAge[reg.Id] = ctx.allocations
+	ctx.allocations++
+	ctx.pin(reg)
+	return reg
+}
+
+// spillRegister frees up a register by saving its value to the stack. The
+// register chosen is the oldest one not in use by the current frame, as it
+// belongs to the outermost expression and won't be needed for the longest
+// time. Its value is reloaded when the register is freed again.
+func (ctx *RegisterAllocatorContext) spillRegister() *RegisterExpr {
+	victim := -1
+	for k := ctx.firstTemporary; k <= ctx.lastTemporary; k++ {
+		if ctx.isPinned(k) {
+			continue
+		}
+		if victim == -1 || ctx.registerAge[k] < ctx.registerAge[victim] {
+			victim = k
+		}
+	}
+
+	if victim == -1 {
+		ctx.fail("Ran out of registers - no register can be spilled")
+		return &RegisterExpr{4}
+	}
+
+	slot := ctx.allocateSpillSlot()
+	reg := &RegisterExpr{victim}
+	ctx.pushInstr(&MoveInstr{Dst: &StackLocationExpr{slot}, Src: reg})
+	ctx.spills[victim] = append(ctx.spills[victim], spilledRegister{slot, ctx.registerAge[victim]})
 	return reg
 }
 
+// allocateSpillSlot finds a free stack slot in the innermost scope. Spills
+// never outlive the instruction they occur in, so any slot after the last
+// variable declared so far can be used.
+func (ctx *RegisterAllocatorContext) allocateSpillSlot() int {
+	scope := &ctx.scope[ctx.depth-1]
+	if scope.push == nil {
+		ctx.fail("Cannot spill a register outside of a scope")
+		return 0
+	}
+
+	slot := scope.next
+	for ctx.spillSlots[slot] {
+		slot++
+	}
+	ctx.spillSlots[slot] = true
+	if slot >= scope.extent {
+		scope.extent = slot + 1
+	}
+	return slot
+}
+
 func (ctx *RegisterAllocatorContext) freeRegister(r *RegisterExpr) {
 	if !ctx.registerUseList[r.Id] {
-		panic("Freeing register not in use")
+		ctx.fail("Freeing register not in use")
+	}
+	ctx.unpin(r)
+
+	// Give the register back to its previous owner
+	if n := len(ctx.spills[r.Id]); n > 0 {
+		spill := ctx.spills[r.Id][n-1]
+		ctx.spills[r.Id] = ctx.spills[r.Id][:n-1]
+		ctx.pushInstr(&MoveInstr{Dst: &RegisterExpr{r.Id}, Src: &StackLocationExpr{spill.slot}})
+		ctx.registerAge[r.Id] = spill.age
+		delete(ctx.spillSlots, spill.slot)
+		return
 	}
 	ctx.registerUseList[r.Id] = false
 }
@@ -83,14 +252,18 @@ func (ctx *RegisterAllocatorContext) initialiseVariable(v *VarExpr) {
 	}
 
 	// Give up
-	panic(fmt.Sprintf("Trying to initialise non-existent variable '%s'", v.Name))
+	ctx.fail("Trying to initialise non-existent variable '%s'", v.Name)
 }
 
-func (ctx *RegisterAllocatorContext) lookupVariable(v *VarExpr) *StackLocationExpr {
+func (ctx *RegisterAllocatorContext) lookupVariable(v *VarExpr) Expr {
 	if innerVar, ok := ctx.innerLookupVariable(v); ok {
+		if innerVar.reg != nil {
+			return &RegisterExpr{innerVar.reg.Id}
+		}
 		return &StackLocationExpr{innerVar.stack}
 	} else {
-		panic(fmt.Sprintf("Trying to access non-existent variable '%s'", v.Name))
+		ctx.fail("Trying to access non-existent variable '%s'", v.Name)
+		return &StackLocationExpr{0}
 	}
 }
 
@@ -98,13 +271,19 @@ func (ctx *RegisterAllocatorContext) lookupType(v *VarExpr) frontend.Type {
 	if innerVar, ok := ctx.innerLookupVariable(v); ok {
 		return innerVar.typeInfo
 	} else {
-		panic(fmt.Sprintf("Trying to get type of non-existent variable '%s'", v.Name))
+		ctx.fail("Trying to get type of non-existent variable '%s'", v.Name)
+		return nil
 	}
 }
 
-func (ctx *RegisterAllocatorContext) createVariable(d *DeclareInstr) *StackLocationExpr {
+func (ctx *RegisterAllocatorContext) createVariable(d *DeclareInstr) Expr {
+	if reg, ok := ctx.assignments[d]; ok {
+		ctx.scope[ctx.depth-1].variableMap[d.Var.Name] = &Variable{0, reg, d.Type, false}
+		return reg
+	}
+
 	n := ctx.scope[ctx.depth-1].next
-	ctx.scope[ctx.depth-1].variableMap[d.Var.Name] = &Variable{n, d.Type, false}
+	ctx.scope[ctx.depth-1].variableMap[d.Var.Name] = &Variable{n, nil, d.Type, false}
 	ctx.scope[ctx.depth-1].next++
 	return &StackLocationExpr{n}
 }
@@ -116,23 +295,26 @@ func (ctx *RegisterAllocatorContext) pushInstr(i Instr) {
 }
 
 func (ctx *RegisterAllocatorContext) allocateRegistersForBranch(n *InstrNode) {
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println("Recovered inside allocateRegistersForBranch:", n.Instr.(*LabelInstr).Label)
-			panic(r)
-		}
-	}()
-	ctx.pushScope()
+	ctx.stage = "allocating registers for " + n.Instr.(*LabelInstr).Label
+	ctx.pushScope(nil)
 	ctx.currentNode = n
 	for {
+		ctx.pushFrame()
 		ctx.currentNode.Instr.allocateRegisters(ctx)
+		ctx.popFrame()
 		ctx.currentNode = ctx.currentNode.Next
 		if ctx.currentNode.Next == nil {
 			break
 		}
 	}
+
+	// The last node closes the outermost scope. It isn't processed above so
+	// that instructions can still be inserted before it.
+	if pop, ok := ctx.currentNode.Instr.(*PopScopeInstr); ok {
+		ctx.popScope(pop)
+	}
 	n.stackSpace = ctx.scope[0].next
-	ctx.popScope()
+	ctx.popScope(nil)
 }
 
 func (ctx *RegisterAllocatorContext) pushDataStore(e *StringConstExpr) string {
@@ -142,37 +324,88 @@ func (ctx *RegisterAllocatorContext) pushDataStore(e *StringConstExpr) string {
 	return label
 }
 
-func (ctx *RegisterAllocatorContext) pushScope() {
+func (ctx *RegisterAllocatorContext) pushScope(push *PushScopeInstr) {
 	// Create a new scope and start at the next available stack address of the
 	// parent scope
-	newScope := VariableScope{variableMap: make(map[string]*Variable)}
+	newScope := VariableScope{variableMap: make(map[string]*Variable), push: push}
 	if ctx.depth > 0 {
 		newScope.next = ctx.scope[ctx.depth-1].next
 	}
+	newScope.base = newScope.next
+	newScope.extent = newScope.next
 
 	// Add to the top of the scope stack
 	ctx.scope = append(ctx.scope, newScope)
 	ctx.depth++
 }
 
-func (ctx *RegisterAllocatorContext) popScope() {
+func (ctx *RegisterAllocatorContext) popScope(pop *PopScopeInstr) {
+	// Make sure the scope reserves enough stack for its variables and for any
+	// registers spilled while it was innermost
+	scope := ctx.scope[ctx.depth-1]
+	if scope.push != nil {
+		used := scope.next
+		if scope.extent > used {
+			used = scope.extent
+		}
+		stackSize := (used - scope.base) * ctx.target.WordSize()
+
+		// Ensure stack is double-word aligned (5.2.1.2)
+		if (stackSize % 8) != 0 {
+			stackSize += 8 - (stackSize % 8)
+		}
+
+		if stackSize > scope.push.StackSize {
+			scope.push.StackSize = stackSize
+		}
+		if pop != nil {
+			pop.StackSize = scope.push.StackSize
+		}
+	}
+
 	ctx.scope = ctx.scope[:ctx.depth-1]
 	ctx.depth--
 }
 
-func AllocateRegisters(ifCtx *IFContext) {
+// AllocateRegisters rewrites the IF to use the registers and stack slots of
+// target instead of variables. The target must have a register file. An error
+// means the IF was malformed, which is a compiler bug.
+func AllocateRegisters(ifCtx *IFContext, target Target, allocator RegisterAllocator) error {
+	registers := target.Registers()
+	if registers == nil {
+		return &InternalError{"allocating registers", fmt.Sprintf("target %v does not use register allocation", target.Name())}
+	}
+
 	ctx := new(RegisterAllocatorContext)
 	ctx.dataStore = make(map[string]*StringConstExpr)
 	ctx.dataStoreIndex = 0
+	ctx.spillSlots = make(map[int]bool)
+	ctx.target = target
+	ctx.registers = registers
+	ctx.registerUseList = make([]bool, registers.Count)
+	ctx.registerAge = make([]int, registers.Count)
+	ctx.spills = make([][]spilledRegister, registers.Count)
+	ctx.firstTemporary = registers.FirstTemporary
+	ctx.lastTemporary = registers.LastTemporary
+	if allocator == LinearScanAllocator {
+		ctx.lastTemporary = registers.FirstVariable - 1
+	}
 
 	// Iterate through nodes in the IF
 	for _, f := range ifCtx.functions {
+		if allocator == LinearScanAllocator {
+			ctx.assignments = allocateVariableRegisters(f, registers)
+		}
 		ctx.allocateRegistersForBranch(f)
 	}
+	if allocator == LinearScanAllocator {
+		ctx.assignments = allocateVariableRegisters(ifCtx.main, registers)
+	}
 	ctx.allocateRegistersForBranch(ifCtx.main)
 	ctx.pushInstr(&MoveInstr{&RegisterExpr{0}, &IntConstExpr{0}})
 
 	ifCtx.dataStore = ctx.dataStore
+	return ctx.err
 }
 
 //
@@ -188,18 +421,20 @@ func (ctx *RegisterAllocatorContext) translateLValue(e Expr, r *RegisterExpr) Ex
 		arrayPtr := r
 		index := ctx.allocateRegister()
 
-		expr.Array.allocateRegisters(ctx, arrayPtr)
-		expr.Index.allocateRegisters(ctx, index)
+		ctx.evaluate(expr.Array, arrayPtr)
+		ctx.evaluate(expr.Index, index)
 
 		// Runtime safety check
-		ctx.pushInstr(&PushInstr{&RegisterExpr{0}})
-		ctx.pushInstr(&PushInstr{&RegisterExpr{1}})
-		ctx.pushInstr(&MoveInstr{Dst: &RegisterExpr{1}, Src: arrayPtr})
-		ctx.pushInstr(&MoveInstr{Dst: &RegisterExpr{0}, Src: index})
-		ctx.pushInstr(&CallInstr{Label: &LocationExpr{RuntimeCheckArrayBoundsLabel}})
-		ctx.pushInstr(&CheckNullDereferenceInstr{arrayPtr})
-		ctx.pushInstr(&PopInstr{&RegisterExpr{1}})
-		ctx.pushInstr(&PopInstr{&RegisterExpr{0}})
+		if !expr.InBounds {
+			ctx.pushInstr(&PushInstr{&RegisterExpr{0}})
+			ctx.pushInstr(&PushInstr{&RegisterExpr{1}})
+			ctx.pushInstr(&MoveInstr{Dst: &RegisterExpr{1}, Src: arrayPtr})
+			ctx.pushInstr(&MoveInstr{Dst: &RegisterExpr{0}, Src: index})
+			ctx.pushInstr(&CallInstr{Label: &LocationExpr{RuntimeCheckArrayBoundsLabel}})
+			ctx.pushInstr(&CheckNullDereferenceInstr{arrayPtr})
+			ctx.pushInstr(&PopInstr{&RegisterExpr{1}})
+			ctx.pushInstr(&PopInstr{&RegisterExpr{0}})
+		}
 
 		ctx.pushInstr(&AddInstr{
 			Dst:      arrayPtr,
@@ -216,12 +451,14 @@ func (ctx *RegisterAllocatorContext) translateLValue(e Expr, r *RegisterExpr) Ex
 		if expr.Fst {
 			offset = 0
 		} else {
-			offset = regWidth
+			offset = ctx.target.WordSize()
 		}
 
 		v := ctx.lookupVariable(expr.Operand)
 		ctx.pushInstr(&MoveInstr{r, v})
-		ctx.pushInstr(&CheckNullDereferenceInstr{r})
+		if !expr.NotNull {
+			ctx.pushInstr(&CheckNullDereferenceInstr{r})
+		}
 		return &MemExpr{r, offset}
 
 	case *StructElemExpr:
@@ -230,14 +467,17 @@ func (ctx *RegisterAllocatorContext) translateLValue(e Expr, r *RegisterExpr) Ex
 
 		v := ctx.lookupVariable(expr.StructIdent)
 		ctx.pushInstr(&MoveInstr{r, v})
-		ctx.pushInstr(&CheckNullDereferenceInstr{r})
+		if !expr.NotNull {
+			ctx.pushInstr(&CheckNullDereferenceInstr{r})
+		}
 		return &MemExpr{r, offset}
 
 	case *StackArgumentExpr, *StackLocationExpr, *MemExpr:
 		return e
 
 	default:
-		panic(fmt.Sprintf("Unhandled lvalue %T", expr))
+		ctx.fail("Unhandled lvalue %T", expr)
+		return e
 	}
 }
 
@@ -275,15 +515,15 @@ func (e *ArrayConstExpr) allocateRegisters(ctx *RegisterAllocatorContext, dst *R
 
 	// Allocate space on the heap
 	length := len(e.Elems)
-	ctx.pushInstr(&HeapAllocInstr{dst, (length + 1) * regWidth})
+	ctx.pushInstr(&HeapAllocInstr{dst, (length + 1) * ctx.target.WordSize()})
 	ctx.pushInstr(&MoveInstr{helperReg, &IntConstExpr{length}})
 	ctx.pushInstr(&MoveInstr{Dst: &MemExpr{dst, 0}, Src: helperReg})
 
 	// Copy each element into the array
 	for i, e := range e.Elems {
-		e.allocateRegisters(ctx, helperReg)
+		ctx.evaluate(e, helperReg)
 		ctx.pushInstr(&MoveInstr{
-			Dst: &MemExpr{dst, (i + 1) * regWidth},
+			Dst: &MemExpr{dst, (i + 1) * ctx.target.WordSize()},
 			Src: helperReg})
 	}
 
@@ -331,7 +571,7 @@ func (e *StructElemExpr) allocateRegisters(ctx *RegisterAllocatorContext, dst *R
 }
 
 func (e *UnaryExpr) allocateRegisters(ctx *RegisterAllocatorContext, dst *RegisterExpr) {
-	e.Operand.allocateRegisters(ctx, dst)
+	ctx.evaluate(e.Operand, dst)
 
 	// Allocate registers depending on operator
 	switch e.Operator {
@@ -355,7 +595,7 @@ func (e *UnaryExpr) allocateRegisters(ctx *RegisterAllocatorContext, dst *Regist
 		ctx.pushInstr(&MoveInstr{dst, &MemExpr{dst, 0}})
 
 	default:
-		panic("Unhandled unary operator")
+		ctx.fail("Unhandled unary operator %v", e.Operator)
 	}
 }
 
@@ -363,16 +603,16 @@ func (e *BinaryExpr) allocateRegisters(ctx *RegisterAllocatorContext, dst *Regis
 	// Decide which side to translate first depending on weight
 	var op1, op2, helperReg *RegisterExpr
 	if e.Left.Weight() > e.Right.Weight() {
-		e.Left.allocateRegisters(ctx, dst)
+		ctx.evaluate(e.Left, dst)
 		helperReg = ctx.allocateRegister()
-		e.Right.allocateRegisters(ctx, helperReg)
+		ctx.evaluate(e.Right, helperReg)
 
 		op1 = dst
 		op2 = helperReg
 	} else {
-		e.Right.allocateRegisters(ctx, dst)
+		ctx.evaluate(e.Right, dst)
 		helperReg = ctx.allocateRegister()
-		e.Left.allocateRegisters(ctx, helperReg)
+		ctx.evaluate(e.Left, helperReg)
 
 		op1 = helperReg
 		op2 = dst
@@ -409,7 +649,7 @@ func (e *BinaryExpr) allocateRegisters(ctx *RegisterAllocatorContext, dst *Regis
 		ctx.pushInstr(&CmpInstr{Dst: dst, Left: op1, Right: op2, Operator: e.Operator})
 
 	default:
-		panic(fmt.Sprintf("Unknown operator %v", e.Operator))
+		ctx.fail("Unknown operator %v", e.Operator)
 	}
 
 	ctx.freeRegister(helperReg)
@@ -420,12 +660,12 @@ func (e *NewStructExpr) allocateRegisters(ctx *RegisterAllocatorContext, dst *Re
 
 	// Allocate struct on the heap
 	numArgs := len(e.Args)
-	ctx.pushInstr(&HeapAllocInstr{dst, numArgs * regWidth})
+	ctx.pushInstr(&HeapAllocInstr{dst, numArgs * ctx.target.WordSize()})
 
 	// Fill structure
 	for n, arg := range e.Args {
-		arg.allocateRegisters(ctx, helperReg)
-		ctx.pushInstr(&MoveInstr{&MemExpr{dst, n * regWidth}, helperReg})
+		ctx.evaluate(arg, helperReg)
+		ctx.pushInstr(&MoveInstr{&MemExpr{dst, n * ctx.target.WordSize()}, helperReg})
 	}
 
 	ctx.freeRegister(helperReg)
@@ -435,26 +675,27 @@ func (e *NewPairExpr) allocateRegisters(ctx *RegisterAllocatorContext, dst *Regi
 	helperReg := ctx.allocateRegister()
 
 	// Allocate pair on the heap
-	ctx.pushInstr(&HeapAllocInstr{dst, 2 * regWidth})
+	ctx.pushInstr(&HeapAllocInstr{dst, 2 * ctx.target.WordSize()})
 
 	// Fill pair structure
-	e.Left.allocateRegisters(ctx, helperReg)
+	ctx.evaluate(e.Left, helperReg)
 	ctx.pushInstr(&MoveInstr{&MemExpr{dst, 0}, helperReg})
-	e.Right.allocateRegisters(ctx, helperReg)
-	ctx.pushInstr(&MoveInstr{&MemExpr{dst, regWidth}, helperReg})
+	ctx.evaluate(e.Right, helperReg)
+	ctx.pushInstr(&MoveInstr{&MemExpr{dst, ctx.target.WordSize()}, helperReg})
 
 	ctx.freeRegister(helperReg)
 }
 
 func (e *CallExpr) allocateRegisters(ctx *RegisterAllocatorContext, dst *RegisterExpr) {
-	// Move arguments into r0-r4
+	// Move the first arguments into registers and push the rest
+	argumentRegisters := ctx.target.ArgumentRegisters()
 	for n, arg := range e.Args {
 		//arg := e.Args[n]
-		if n < 4 {
-			arg.allocateRegisters(ctx, &RegisterExpr{n})
+		if n < argumentRegisters {
+			ctx.evaluate(arg, &RegisterExpr{n})
 		} else {
 			freeReg := ctx.allocateRegister()
-			arg.allocateRegisters(ctx, freeReg)
+			ctx.evaluate(arg, freeReg)
 			ctx.pushInstr(&PushInstr{
 				Op: freeReg,
 			})
@@ -469,9 +710,9 @@ func (e *CallExpr) allocateRegisters(ctx *RegisterAllocatorContext, dst *Registe
 	ctx.pushInstr(&MoveInstr{Dst: dst, Src: &RegisterExpr{0}})
 
 	// Get rid of arguments
-	if len(e.Args) > 4 {
+	if len(e.Args) > argumentRegisters {
 		freeReg := ctx.allocateRegister()
-		for n := len(e.Args) - 1; n >= 4; n-- {
+		for n := len(e.Args) - 1; n >= argumentRegisters; n-- {
 			ctx.pushInstr(&PopInstr{Op: freeReg})
 		}
 		ctx.freeRegister(freeReg)
@@ -486,16 +727,17 @@ func (i *NoOpInstr) allocateRegisters(ctx *RegisterAllocatorContext) {}
 func (i *LabelInstr) allocateRegisters(ctx *RegisterAllocatorContext) {}
 
 func (i *EvalInstr) allocateRegisters(ctx *RegisterAllocatorContext) {
-	// Allocate registers and throw away the result
+	// Allocate registers and throw away the result. Expressions without side
+	// effects are removed beforehand by dead code elimination, if it runs.
 	dst := ctx.allocateRegister()
-	i.Expr.allocateRegisters(ctx, dst)
-	// TODO: Remove this instruction
+	ctx.evaluate(i.Expr, dst)
 	ctx.freeRegister(dst)
 }
 
 func (i *ReadInstr) allocateRegisters(ctx *RegisterAllocatorContext) {
 	switch expr := i.Dst.(type) {
 	case *VarExpr:
+		ctx.initialiseVariable(expr)
 		i.Dst = ctx.lookupVariable(expr)
 
 	case *ArrayElemExpr:
@@ -514,27 +756,27 @@ func (i *ReadInstr) allocateRegisters(ctx *RegisterAllocatorContext) {
 		ctx.freeRegister(dst)
 
 	default:
-		panic(fmt.Sprintf("Cannot read into %v", i.Dst.Repr()))
+		ctx.fail("Cannot read into %v", i.Dst.Repr())
 	}
 }
 
 func (i *FreeInstr) allocateRegisters(ctx *RegisterAllocatorContext) {
 	dst := ctx.allocateRegister()
-	i.Object.allocateRegisters(ctx, dst)
+	ctx.evaluate(i.Object, dst)
 	i.Object = dst
 	ctx.freeRegister(dst)
 }
 
 func (i *ReturnInstr) allocateRegisters(ctx *RegisterAllocatorContext) {
 	dst := ctx.allocateRegister()
-	i.Expr.allocateRegisters(ctx, dst)
+	ctx.evaluate(i.Expr, dst)
 	i.Expr = dst
 	ctx.freeRegister(dst)
 }
 
 func (i *ExitInstr) allocateRegisters(ctx *RegisterAllocatorContext) {
 	dst := ctx.allocateRegister()
-	i.Expr.allocateRegisters(ctx, dst)
+	ctx.evaluate(i.Expr, dst)
 	i.Expr = dst
 	ctx.freeRegister(dst)
 }
@@ -553,12 +795,12 @@ func (i *PrintInstr) allocateRegisters(ctx *RegisterAllocatorContext) {
 
 	// Generate instructions to store result of expression in dst
 	dst := ctx.allocateRegister()
-	i.Expr.allocateRegisters(ctx, dst)
+	ctx.evaluate(i.Expr, dst)
 	i.Expr = dst
 
 	// If the type is nil, we have an issue
 	if i.Type == nil {
-		panic(fmt.Sprintf("Type not defined for %T", i))
+		ctx.fail("Type not defined for %T", i)
 	}
 
 	ctx.freeRegister(dst)
@@ -567,7 +809,7 @@ func (i *PrintInstr) allocateRegisters(ctx *RegisterAllocatorContext) {
 func (i *MoveInstr) allocateRegisters(ctx *RegisterAllocatorContext) {
 	src := ctx.allocateRegister()
 	dst := ctx.allocateRegister()
-	i.Src.allocateRegisters(ctx, src)
+	ctx.evaluate(i.Src, src)
 	i.Src = src
 	i.Dst = ctx.translateLValue(i.Dst, dst)
 	ctx.freeRegister(dst)
@@ -578,7 +820,7 @@ func (i *JmpInstr) allocateRegisters(ctx *RegisterAllocatorContext) {}
 
 func (i *JmpCondInstr) allocateRegisters(ctx *RegisterAllocatorContext) {
 	cond := ctx.allocateRegister()
-	i.Cond.allocateRegisters(ctx, cond)
+	ctx.evaluate(i.Cond, cond)
 	i.Cond = cond
 	ctx.freeRegister(cond)
 }
@@ -587,12 +829,18 @@ func (i *DeclareInstr) allocateRegisters(ctx *RegisterAllocatorContext) {
 	ctx.createVariable(i)
 }
 
-func (*PushScopeInstr) allocateRegisters(ctx *RegisterAllocatorContext) {
-	ctx.pushScope()
+func (i *PushScopeInstr) allocateRegisters(ctx *RegisterAllocatorContext) {
+	ctx.pushScope(i)
 }
 
-func (*PopScopeInstr) allocateRegisters(ctx *RegisterAllocatorContext) {
-	ctx.popScope()
+func (i *PopScopeInstr) allocateRegisters(ctx *RegisterAllocatorContext) {
+	ctx.popScope(i)
+}
+
+func (i *UnwindScopesInstr) allocateRegisters(ctx *RegisterAllocatorContext) {}
+
+func (i *PhiInstr) allocateRegisters(ctx *RegisterAllocatorContext) {
+	ctx.fail("Phi instructions must be removed before register allocation")
 }
 
 // Second stage IF instructions should never do anything
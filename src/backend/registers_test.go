@@ -0,0 +1,118 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"../frontend"
+)
+
+// translate checks a program and translates it to IF for ARM
+func translate(t *testing.T, source string) *IFContext {
+	return translateFor(t, source, ARMTarget)
+}
+
+// translateFor checks a program and translates it to IF for a target
+func translateFor(t *testing.T, source string, target Target) *IFContext {
+	sources := frontend.NewSourceManager()
+	diags := frontend.NewDiagnostics(sources)
+	ast, ok := frontend.GenerateAST("", "test.wacc", strings.NewReader(source), sources, diags)
+	if !ok || !frontend.VerifyProgram(ast, diags) {
+		t.Fatalf("%q doesn't compile: %v", source, diags.List())
+	}
+	ifCtx, err := TranslateToIF(ast, target)
+	if err != nil {
+		t.Fatalf("TranslateToIF returned %v for %q", err, source)
+	}
+	return ifCtx
+}
+
+// balancedSum is a sum of depth levels over x, which needs depth + 1 registers
+// to evaluate
+func balancedSum(depth int) string {
+	if depth == 0 {
+		return "x"
+	}
+	sum := balancedSum(depth - 1)
+	return fmt.Sprintf("(%v + %v)", sum, sum)
+}
+
+type spillScope struct {
+	push *PushScopeInstr
+	base int
+}
+
+// checkSpills walks a register allocated branch and checks that every spill
+// uses a slot past the variables in scope, which the innermost scope reserves
+// space for, and is reloaded before the scope ends. It returns the number of
+// spills.
+func checkSpills(t *testing.T, name string, n *InstrNode) int {
+	scopes := []spillScope{}
+	next := 0
+	live := map[int]int{}
+	spills := 0
+	for ; n != nil; n = n.Next {
+		switch instr := n.Instr.(type) {
+		case *PushScopeInstr:
+			scopes = append(scopes, spillScope{instr, next})
+
+		case *PopScopeInstr:
+			if len(live) != 0 {
+				t.Errorf("%v: slots %v are never reloaded", name, live)
+			}
+			next = scopes[len(scopes)-1].base
+			scopes = scopes[:len(scopes)-1]
+
+		case *DeclareInstr:
+			next++
+
+		case *MoveInstr:
+			if slot, ok := instr.Dst.(*StackLocationExpr); ok && slot.Id >= next {
+				if _, ok := instr.Src.(*RegisterExpr); !ok {
+					t.Errorf("%v: stack slot %v is written to by %v", name, slot.Id, instr.Src)
+				}
+				if _, ok := live[slot.Id]; ok {
+					t.Errorf("%v: stack slot %v is spilled to twice", name, slot.Id)
+				}
+				scope := scopes[len(scopes)-1]
+				if (slot.Id-scope.base+1)*ARMTarget.WordSize() > scope.push.StackSize {
+					t.Errorf("%v: stack slot %v is outside its scope of %v bytes", name, slot.Id, scope.push.StackSize)
+				}
+				live[slot.Id] = instr.Src.(*RegisterExpr).Id
+				spills++
+			}
+			if slot, ok := instr.Src.(*StackLocationExpr); ok && slot.Id >= next {
+				if r, ok := instr.Dst.(*RegisterExpr); !ok || live[slot.Id] != r.Id {
+					t.Errorf("%v: stack slot %v is reloaded into %v", name, slot.Id, instr.Dst)
+				}
+				delete(live, slot.Id)
+			}
+		}
+	}
+	return spills
+}
+
+func TestSpillSlots(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		spills bool
+	}{
+		{"no spills", fmt.Sprintf("begin\n  int x = 1 ;\n  println %v\nend\n", balancedSum(7)), false},
+		{"one spill", fmt.Sprintf("begin\n  int x = 1 ;\n  int y = 2 ;\n  println %v\nend\n", balancedSum(8)), true},
+		{"several spills", fmt.Sprintf("begin\n  int x = 1 ;\n  println %v\nend\n", balancedSum(11)), true},
+		{"inner scope", fmt.Sprintf("begin\n  int x = 1 ;\n  begin\n    int y = 2 ;\n    int z = 3 ;\n    println %v\n  end ;\n  int y = 4 ;\n  println y\nend\n", balancedSum(10)), true},
+		{"loop", fmt.Sprintf("begin\n  int x = 1 ;\n  while x < 3 do\n    int y = %v ;\n    x = x + 1\n  done\nend\n", balancedSum(9)), true},
+	}
+	for _, test := range tests {
+		ifCtx := translate(t, test.source)
+		if err := AllocateRegisters(ifCtx, ARMTarget, SimpleAllocator); err != nil {
+			t.Errorf("%v: AllocateRegisters returned %v", test.name, err)
+			continue
+		}
+		if spills := checkSpills(t, test.name, ifCtx.main); (spills > 0) != test.spills {
+			t.Errorf("%v: got %v spills, want spills to be %v", test.name, spills, test.spills)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package backend
+
+// The variables in scope in the function being generated, innermost scope
+// last, for the targets which are generated from the IF before register
+// allocation. Each variable is held wherever the target keeps it, such as a
+// C or WebAssembly local or an LLVM alloca.
+//
+// As in the register allocator, a variable only hides one in an outer scope
+// once it has been assigned to, so that it can be initialised from the outer
+// one.
+type variableScopes []map[string]*scopedLocation
+
+type scopedLocation struct {
+	location    interface{}
+	initialised bool
+}
+
+func newVariableScopes() variableScopes {
+	return variableScopes{make(map[string]*scopedLocation)}
+}
+
+func (s *variableScopes) push() {
+	*s = append(*s, make(map[string]*scopedLocation))
+}
+
+func (s *variableScopes) pop() {
+	*s = (*s)[:len(*s)-1]
+}
+
+func (s variableScopes) declare(v *VarExpr, location interface{}) {
+	s[len(s)-1][v.Name] = &scopedLocation{location, false}
+}
+
+// lookup finds the variable an expression reads. It returns false if there is
+// no such variable, which the translator should have ruled out.
+func (s variableScopes) lookup(v *VarExpr) (interface{}, bool) {
+	for i := len(s) - 1; i >= 0; i-- {
+		if variable, ok := s[i][v.Name]; ok && variable.initialised {
+			return variable.location, true
+		}
+	}
+	return nil, false
+}
+
+// initialise finds the variable an expression assigns to, which hides any
+// variable of the same name in an outer scope from then on
+func (s variableScopes) initialise(v *VarExpr) (interface{}, bool) {
+	for i := len(s) - 1; i >= 0; i-- {
+		if variable, ok := s[i][v.Name]; ok {
+			variable.initialised = true
+			return variable.location, true
+		}
+	}
+	return nil, false
+}
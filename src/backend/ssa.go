@@ -0,0 +1,814 @@
+package backend
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"../frontend"
+)
+
+// In SSA form every variable in a branch is assigned exactly once. Each
+// assignment to a variable in the original IF creates a new version of it,
+// named <variable>.<version>, and phi instructions merge versions where
+// control flow joins. Variables shadowed by a declaration in an inner scope
+// are renamed to <variable>#<n> first, so that every name refers to a single
+// variable. All versions are declared at the top of the branch.
+
+type ssaVariable struct {
+	name     string
+	typeInfo frontend.Type
+
+	// Number of versions created so far, and the versions visible at the
+	// current point of the renaming walk, innermost last
+	versions int
+	stack    []*VarExpr
+}
+
+type ssaContext struct {
+	ifCtx  *IFContext
+	branch *InstrNode
+	cfg    *CFG
+
+	variables map[string]*ssaVariable
+
+	// Declarations of each version, in the order they were created
+	decls    []*DeclareInstr
+	declNode *InstrNode
+
+	stageErrors
+}
+
+// A copy making up part of a phi instruction
+type ssaCopy struct {
+	dst *VarExpr
+	src Expr
+}
+
+//
+// Variable uses and definitions
+//
+// mapVars rebuilds an expression with each variable it reads replaced by the
+// result of f
+func mapVars(e Expr, f func(*VarExpr) Expr) Expr {
+	// Pair and struct elements can only refer to variables
+	mapVar := func(v *VarExpr) *VarExpr {
+		if r, ok := f(v).(*VarExpr); ok {
+			return r
+		}
+		return v
+	}
+
+	switch e := e.(type) {
+	case *VarExpr:
+		return f(e)
+
+	case *ArrayElemExpr:
+		return &ArrayElemExpr{mapVars(e.Array, f), mapVars(e.Index, f), e.InBounds}
+
+	case *PairElemExpr:
+		return &PairElemExpr{e.Fst, mapVar(e.Operand), e.NotNull}
+
+	case *StructElemExpr:
+		return &StructElemExpr{
+			StructIdent: mapVar(e.StructIdent),
+			ElemIdent:   e.ElemIdent,
+			ElemOffset:  e.ElemOffset,
+			NotNull:     e.NotNull,
+		}
+
+	case *UnaryExpr:
+		return &UnaryExpr{e.Operator, mapVars(e.Operand, f), e.Type}
+
+	case *BinaryExpr:
+		return &BinaryExpr{e.Operator, mapVars(e.Left, f), mapVars(e.Right, f), e.Type}
+
+	case *ArrayConstExpr:
+		elems := make([]Expr, len(e.Elems))
+		for i, elem := range e.Elems {
+			elems[i] = mapVars(elem, f)
+		}
+		return &ArrayConstExpr{e.Type, elems}
+
+	case *NewStructExpr:
+		args := make([]Expr, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = mapVars(arg, f)
+		}
+		return &NewStructExpr{e.Label, args}
+
+	case *NewPairExpr:
+		return &NewPairExpr{mapVars(e.Left, f), mapVars(e.Right, f)}
+
+	case *CallExpr:
+		args := make([]Expr, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = mapVars(arg, f)
+		}
+		return &CallExpr{e.Label, args}
+
+	default:
+		return e
+	}
+}
+
+// rewriteUses replaces each variable read by an instruction with the result
+// of f. The arguments of phi instructions are left alone, as they are read on
+// the edges into the block rather than by the instruction itself.
+func rewriteUses(i Instr, f func(*VarExpr) Expr) {
+	switch i := i.(type) {
+	case *MoveInstr:
+		i.Src = mapVars(i.Src, f)
+		if _, ok := i.Dst.(*VarExpr); !ok {
+			i.Dst = mapVars(i.Dst, f)
+		}
+
+	case *ReadInstr:
+		if _, ok := i.Dst.(*VarExpr); !ok {
+			i.Dst = mapVars(i.Dst, f)
+		}
+
+	case *EvalInstr:
+		i.Expr = mapVars(i.Expr, f)
+
+	case *FreeInstr:
+		i.Object = mapVars(i.Object, f)
+
+	case *ReturnInstr:
+		i.Expr = mapVars(i.Expr, f)
+
+	case *ExitInstr:
+		i.Expr = mapVars(i.Expr, f)
+
+	case *PrintInstr:
+		i.Expr = mapVars(i.Expr, f)
+
+	case *JmpCondInstr:
+		i.Cond = mapVars(i.Cond, f)
+	}
+}
+
+// definedVar returns the variable an instruction assigns to, if any
+func definedVar(i Instr) *VarExpr {
+	switch i := i.(type) {
+	case *MoveInstr:
+		if v, ok := i.Dst.(*VarExpr); ok {
+			return v
+		}
+
+	case *ReadInstr:
+		if v, ok := i.Dst.(*VarExpr); ok {
+			return v
+		}
+
+	case *PhiInstr:
+		return i.Dst
+	}
+	return nil
+}
+
+func setDefinedVar(i Instr, v *VarExpr) {
+	switch i := i.(type) {
+	case *MoveInstr:
+		i.Dst = v
+
+	case *ReadInstr:
+		i.Dst = v
+
+	case *PhiInstr:
+		i.Dst = v
+	}
+}
+
+func versionOf(name string) (string, int) {
+	dot := strings.LastIndex(name, ".")
+	if dot == -1 {
+		return name, 0
+	}
+	version, err := strconv.Atoi(name[dot+1:])
+	if err != nil {
+		return name, 0
+	}
+	return name[:dot], version
+}
+
+func endsInJump(i Instr) bool {
+	switch i.(type) {
+	case *JmpInstr, *JmpCondInstr:
+		return true
+	default:
+		return false
+	}
+}
+
+func fallsThrough(i Instr) bool {
+	switch i.(type) {
+	case *JmpInstr, *ReturnInstr, *ExitInstr:
+		return false
+	default:
+		return true
+	}
+}
+
+//
+// Keeping phis in step with the CFG
+//
+// phiEdges records the edges into the block of every phi, so that the
+// arguments can be matched up with the edges again once a pass has changed
+// the branch. Each edge is identified by the last instruction of the
+// predecessor, or nil if the predecessor can't be reached.
+func phiEdges(cfg *CFG) map[*InstrNode][]*InstrNode {
+	edges := make(map[*InstrNode][]*InstrNode)
+	for _, b := range cfg.Blocks {
+		for _, node := range b.Instrs {
+			if _, ok := node.Instr.(*PhiInstr); !ok {
+				continue
+			}
+			for _, p := range b.Preds {
+				var last *InstrNode
+				if p.Reachable() {
+					last = p.Last()
+				}
+				edges[node] = append(edges[node], last)
+			}
+		}
+	}
+	return edges
+}
+
+// remapPhis puts the arguments of each phi back in the order of the
+// predecessors in the rebuilt CFG. An edge is matched with the block which
+// now holds the instruction that led along it, or if that has been removed,
+// the closest instruction before it which is still in the branch. Passes never
+// empty a block which can be reached, so each reachable predecessor still holds
+// an instruction of its own and is matched with exactly one of the recorded
+// edges. Edges which have gone lose their argument, and edges from unreachable
+// code take the result of the phi, as they are never followed. A phi left with
+// a single argument becomes a copy.
+func remapPhis(cfg *CFG, edges map[*InstrNode][]*InstrNode) {
+	for node, preds := range edges {
+		phi, ok := node.Instr.(*PhiInstr)
+		b := cfg.BlockOf(node)
+		if !ok || b == nil {
+			continue
+		}
+
+		// Removed nodes still point at what came before them
+		from := make(map[*BasicBlock]int)
+		for k, n := range preds {
+			for n != nil && cfg.BlockOf(n) == nil {
+				n = n.Prev
+			}
+			if n != nil {
+				from[cfg.BlockOf(n)] = k
+			}
+		}
+
+		args := make([]Expr, len(b.Preds))
+		for n, p := range b.Preds {
+			args[n] = phi.Dst.Copy()
+			if k, ok := from[p]; ok && p.Reachable() {
+				args[n] = phi.Args[k]
+			}
+		}
+
+		if len(args) == 1 {
+			node.Instr = &MoveInstr{Dst: phi.Dst, Src: args[0]}
+		} else {
+			phi.Args = args
+		}
+	}
+}
+
+//
+// Conversion to SSA form
+//
+// resolveVariables gives every variable declared in the branch a unique name,
+// following the same scoping rules as the register allocator
+func (ctx *ssaContext) resolveVariables() {
+	type scopedName struct {
+		name        string
+		initialised bool
+	}
+	scope := []map[string]*scopedName{make(map[string]*scopedName)}
+	declared := make(map[string]int)
+
+	lookup := func(v *VarExpr) Expr {
+		for i := len(scope) - 1; i >= 0; i-- {
+			if s, ok := scope[i][v.Name]; ok && s.initialised {
+				return &VarExpr{s.name}
+			}
+		}
+		ctx.fail("Trying to access non-existent variable '%s'", v.Name)
+		return v
+	}
+
+	initialise := func(v *VarExpr) *VarExpr {
+		for i := len(scope) - 1; i >= 0; i-- {
+			if s, ok := scope[i][v.Name]; ok {
+				s.initialised = true
+				return &VarExpr{s.name}
+			}
+		}
+		ctx.fail("Trying to initialise non-existent variable '%s'", v.Name)
+		return v
+	}
+
+	for node := ctx.branch; node != nil; node = node.Next {
+		switch i := node.Instr.(type) {
+		case *PushScopeInstr:
+			scope = append(scope, make(map[string]*scopedName))
+
+		case *PopScopeInstr:
+			scope = scope[:len(scope)-1]
+
+		case *DeclareInstr:
+			name := i.Var.Name
+			if n := declared[i.Var.Name]; n > 0 {
+				name = fmt.Sprintf("%s#%d", i.Var.Name, n)
+			}
+			declared[i.Var.Name]++
+
+			scope[len(scope)-1][i.Var.Name] = &scopedName{name, false}
+			ctx.variables[name] = &ssaVariable{name: name, typeInfo: i.Type}
+			node.Instr = &DeclareInstr{&VarExpr{name}, i.Type}
+
+		default:
+			rewriteUses(i, lookup)
+			if v := definedVar(i); v != nil {
+				setDefinedVar(i, initialise(v))
+			}
+		}
+	}
+}
+
+// removeUnreachable deletes code which can never run, as there is no version
+// of a variable for it to refer to. Labels and scope changes are kept, as the
+// code generator tracks the stack through them.
+func (ctx *ssaContext) removeUnreachable() {
+	for _, b := range ctx.cfg.Blocks {
+		if b.Reachable() {
+			continue
+		}
+		for _, node := range b.Instrs {
+			switch node.Instr.(type) {
+			case *LabelInstr, *PushScopeInstr, *PopScopeInstr:
+			default:
+				unlinkNode(node)
+			}
+		}
+	}
+	ctx.cfg.Rebuild()
+}
+
+// placePhis inserts a phi instruction wherever two definitions of a variable
+// meet, as long as the variable is still live there
+func (ctx *ssaContext) placePhis() {
+	live, liveIn := analyseLiveness(ctx.branch)
+	index := make(map[*InstrNode]int)
+	for n, node := range live.instrs {
+		index[node] = n
+	}
+
+	defBlocks := make([][]*BasicBlock, len(live.variables))
+	for n, defs := range live.defs {
+		for _, v := range defs {
+			defBlocks[v.id] = append(defBlocks[v.id], ctx.cfg.BlockOf(live.instrs[n]))
+		}
+	}
+
+	for _, v := range live.variables {
+		hasPhi := make(map[*BasicBlock]bool)
+		worklist := defBlocks[v.id]
+		for len(worklist) > 0 {
+			b := worklist[len(worklist)-1]
+			worklist = worklist[:len(worklist)-1]
+
+			for _, f := range b.Frontier {
+				if hasPhi[f] || !liveIn[index[f.First()]].contains(v.id) {
+					continue
+				}
+				hasPhi[f] = true
+
+				args := make([]Expr, len(f.Preds))
+				for k := range args {
+					args[k] = &VarExpr{v.decl.Var.Name}
+				}
+				phi := &PhiInstr{&VarExpr{v.decl.Var.Name}, args}
+
+				// Phis come after the label, so that jumps to the block reach them
+				if _, ok := f.First().Instr.(*LabelInstr); ok {
+					insertAfter(f.First(), phi)
+				} else {
+					insertBefore(f.First(), phi)
+				}
+				worklist = append(worklist, f)
+			}
+		}
+	}
+	ctx.cfg.Rebuild()
+}
+
+func (ctx *ssaContext) newVersion(v *ssaVariable) *VarExpr {
+	v.versions++
+	version := &VarExpr{fmt.Sprintf("%s.%d", v.name, v.versions)}
+	ctx.decls = append(ctx.decls, &DeclareInstr{version, v.typeInfo})
+	return version
+}
+
+func (ctx *ssaContext) currentVersion(v *VarExpr) Expr {
+	variable, ok := ctx.variables[v.Name]
+	if !ok {
+		ctx.fail("Trying to access non-existent variable '%s'", v.Name)
+		return v
+	}
+	if len(variable.stack) == 0 {
+		ctx.fail("Variable '%s' is used before it is assigned", v.Name)
+		return v
+	}
+	return variable.stack[len(variable.stack)-1].Copy()
+}
+
+// rename walks the dominator tree, giving each definition a new version and
+// pointing each use at the version which reaches it
+func (ctx *ssaContext) rename(b *BasicBlock) {
+	defined := []*ssaVariable{}
+	for _, node := range b.Instrs {
+		if _, ok := node.Instr.(*PhiInstr); !ok {
+			rewriteUses(node.Instr, ctx.currentVersion)
+		}
+		if v := definedVar(node.Instr); v != nil {
+			variable := ctx.variables[v.Name]
+			version := ctx.newVersion(variable)
+			variable.stack = append(variable.stack, version)
+			setDefinedVar(node.Instr, version)
+			defined = append(defined, variable)
+		}
+	}
+
+	for _, s := range b.Succs {
+		pred := 0
+		for s.Preds[pred] != b {
+			pred++
+		}
+		for _, node := range s.Instrs {
+			if phi, ok := node.Instr.(*PhiInstr); ok {
+				phi.Args[pred] = ctx.currentVersion(phi.Args[pred].(*VarExpr))
+			}
+		}
+	}
+
+	for _, child := range b.Children {
+		ctx.rename(child)
+	}
+
+	for _, v := range defined {
+		v.stack = v.stack[:len(v.stack)-1]
+	}
+}
+
+// declareVersions replaces the original declarations with one for each
+// version at the top of the branch. Scopes no longer hold any variables, and
+// the register allocator works out how much stack each needs.
+func (ctx *ssaContext) declareVersions() {
+	var top *InstrNode
+	for node := ctx.branch; node != nil; node = node.Next {
+		switch i := node.Instr.(type) {
+		case *DeclareInstr:
+			unlinkNode(node)
+
+		case *PushScopeInstr:
+			if top == nil {
+				top = node
+			}
+			i.StackSize = 0
+
+		case *PopScopeInstr:
+			i.StackSize = 0
+		}
+	}
+
+	ctx.declNode = top
+	for _, decl := range ctx.decls {
+		ctx.declNode = insertAfter(ctx.declNode, decl)
+	}
+}
+
+func (ctx *ssaContext) toSSA() {
+	ctx.variables = make(map[string]*ssaVariable)
+	ctx.resolveVariables()
+
+	ctx.cfg = BuildCFG(ctx.branch)
+	ctx.removeUnreachable()
+	ctx.placePhis()
+	ctx.rename(ctx.cfg.Entry)
+	ctx.declareVersions()
+}
+
+//
+// Conversion out of SSA form
+//
+// findDeclarations collects the declarations at the top of a branch in SSA
+// form, and the latest version of each variable
+func (ctx *ssaContext) findDeclarations() {
+	ctx.variables = make(map[string]*ssaVariable)
+	for node := ctx.branch; node != nil; node = node.Next {
+		decl, ok := node.Instr.(*DeclareInstr)
+		if !ok {
+			continue
+		}
+		ctx.declNode = node
+
+		name, version := versionOf(decl.Var.Name)
+		v, ok := ctx.variables[name]
+		if !ok {
+			v = &ssaVariable{name: name, typeInfo: decl.Type}
+			ctx.variables[name] = v
+		}
+		if version > v.versions {
+			v.versions = version
+		}
+	}
+}
+
+// edgeInsertionPoint returns the node before which code should be placed to
+// run only when control passes from p to s. Edges from a block with several
+// successors to one with several predecessors are split with a new block
+// placed just before s.
+func (ctx *ssaContext) edgeInsertionPoint(p, s *BasicBlock) *InstrNode {
+	last := p.Last()
+	if len(p.Succs) == 1 {
+		if endsInJump(last.Instr) {
+			return last
+		}
+		return last.Next
+	}
+
+	jmp := last.Instr.(*JmpCondInstr)
+	label, ok := s.First().Instr.(*LabelInstr)
+	if !ok || label.Label != jmp.Dst.Instr.(*LabelInstr).Label {
+		// Only the fall through edge reaches the code after the jump
+		return last.Next
+	}
+
+	if fallsThrough(s.First().Prev.Instr) {
+		insertBefore(s.First(), &JmpInstr{s.First()})
+	}
+	n := ctx.ifCtx.currentCounter
+	ctx.ifCtx.currentCounter++
+	jmp.Dst = insertBefore(s.First(), &LabelInstr{fmt.Sprintf("_edge_split%d", n)})
+	return s.First()
+}
+
+// insertCopies places the copies making up the phis on one edge before a
+// node. The copies happen at once, so they are ordered such that no variable
+// is overwritten before it has been read, using a temporary to break cycles.
+func (ctx *ssaContext) insertCopies(at *InstrNode, copies []ssaCopy) {
+	pending := []ssaCopy{}
+	for _, c := range copies {
+		if src, ok := c.src.(*VarExpr); !ok || src.Name != c.dst.Name {
+			pending = append(pending, c)
+		}
+	}
+
+	isRead := func(v *VarExpr) bool {
+		for _, c := range pending {
+			if src, ok := c.src.(*VarExpr); ok && src.Name == v.Name {
+				return true
+			}
+		}
+		return false
+	}
+
+	for len(pending) > 0 {
+		ready := -1
+		for k, c := range pending {
+			if !isRead(c.dst) {
+				ready = k
+				break
+			}
+		}
+
+		if ready == -1 {
+			// Every copy is part of a cycle, so save one destination first
+			dst := pending[0].dst
+			name, _ := versionOf(dst.Name)
+			v := ctx.variables[name]
+			tmp := ctx.newVersion(v)
+			ctx.declNode = insertAfter(ctx.declNode, ctx.decls[len(ctx.decls)-1])
+			insertBefore(at, &MoveInstr{Dst: tmp, Src: dst.Copy()})
+
+			for k, c := range pending {
+				if src, ok := c.src.(*VarExpr); ok && src.Name == dst.Name {
+					pending[k].src = tmp.Copy()
+				}
+			}
+			continue
+		}
+
+		c := pending[ready]
+		insertBefore(at, &MoveInstr{Dst: c.dst.Copy(), Src: c.src.Copy()})
+		pending = append(pending[:ready], pending[ready+1:]...)
+	}
+}
+
+// removePhis replaces each phi with copies on the edges into its block
+func (ctx *ssaContext) removePhis() {
+	cfg := BuildCFG(ctx.branch)
+	for _, s := range cfg.Blocks {
+		phis := []*InstrNode{}
+		for _, node := range s.Instrs {
+			if _, ok := node.Instr.(*PhiInstr); ok {
+				phis = append(phis, node)
+			}
+		}
+		if len(phis) == 0 {
+			continue
+		}
+
+		for pred, p := range s.Preds {
+			copies := []ssaCopy{}
+			for _, node := range phis {
+				phi := node.Instr.(*PhiInstr)
+				copies = append(copies, ssaCopy{phi.Dst, phi.Args[pred]})
+			}
+			ctx.insertCopies(ctx.edgeInsertionPoint(p, s), copies)
+		}
+
+		for _, node := range phis {
+			unlinkNode(node)
+		}
+	}
+}
+
+// coalesce merges versions of the same variable whenever their lifetimes
+// don't overlap, which also removes the copies between them. Without any
+// optimisations in between, this restores the variables of the original IF.
+func (ctx *ssaContext) coalesce() {
+	live, liveIn := analyseLiveness(ctx.branch)
+	numVars := len(live.variables)
+
+	// Two variables interfere if one is assigned while the other is live,
+	// unless it's being assigned a copy of the other
+	interference := make([]variableSet, numVars)
+	for k := range interference {
+		interference[k] = newVariableSet(numVars)
+	}
+	for n, node := range live.instrs {
+		if len(live.defs[n]) == 0 {
+			continue
+		}
+		liveOut := live.liveOut(liveIn, n)
+
+		var copied *liveVariable
+		if move, ok := node.Instr.(*MoveInstr); ok {
+			if _, ok := move.Src.(*VarExpr); ok && len(live.uses[n]) == 1 {
+				copied = live.uses[n][0]
+			}
+		}
+
+		for _, d := range live.defs[n] {
+			for _, v := range live.variables {
+				if v != d && v != copied && liveOut.contains(v.id) {
+					interference[d.id].add(v.id)
+					interference[v.id].add(d.id)
+				}
+			}
+		}
+	}
+
+	// Merge classes of variables, each of which is represented by the member
+	// declared first
+	class := make([]int, numVars)
+	members := make([][]int, numVars)
+	for k := range class {
+		class[k] = k
+		members[k] = []int{k}
+	}
+	interferes := func(a, b int) bool {
+		for _, m := range members[b] {
+			for _, n := range members[a] {
+				if interference[n].contains(m) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	merge := func(x, y *liveVariable) {
+		xName, _ := versionOf(x.decl.Var.Name)
+		yName, _ := versionOf(y.decl.Var.Name)
+		a, b := class[x.id], class[y.id]
+		if xName != yName || a == b || interferes(a, b) {
+			return
+		}
+
+		if b < a {
+			a, b = b, a
+		}
+		for _, m := range members[b] {
+			class[m] = a
+		}
+		members[a] = append(members[a], members[b]...)
+		members[b] = nil
+	}
+
+	// Copies are merged first, then any other versions which can share a
+	// variable
+	for n, node := range live.instrs {
+		move, ok := node.Instr.(*MoveInstr)
+		if !ok || len(live.defs[n]) != 1 || len(live.uses[n]) != 1 {
+			continue
+		}
+		if _, ok := move.Src.(*VarExpr); ok {
+			merge(live.defs[n][0], live.uses[n][0])
+		}
+	}
+	for _, x := range live.variables {
+		for _, y := range live.variables[x.id+1:] {
+			merge(x, y)
+		}
+	}
+
+	// The first class of each variable takes its original name
+	names := make([]string, numVars)
+	taken := make(map[string]bool)
+	for k, v := range live.variables {
+		if class[k] != k {
+			continue
+		}
+		name, _ := versionOf(v.decl.Var.Name)
+		if taken[name] {
+			name = v.decl.Var.Name
+		}
+		taken[name] = true
+		names[k] = name
+	}
+
+	byName := make(map[string]int)
+	for k, v := range live.variables {
+		byName[v.decl.Var.Name] = k
+	}
+	rename := func(v *VarExpr) Expr {
+		if k, ok := byName[v.Name]; ok {
+			return &VarExpr{names[class[k]]}
+		}
+		return v
+	}
+
+	for node := ctx.branch; node != nil; node = node.Next {
+		if decl, ok := node.Instr.(*DeclareInstr); ok {
+			k := byName[decl.Var.Name]
+			if class[k] != k {
+				unlinkNode(node)
+			} else {
+				decl.Var = &VarExpr{names[k]}
+			}
+			continue
+		}
+
+		rewriteUses(node.Instr, rename)
+		if v := definedVar(node.Instr); v != nil {
+			setDefinedVar(node.Instr, rename(v).(*VarExpr))
+		}
+
+		// Drop copies which have become redundant
+		if move, ok := node.Instr.(*MoveInstr); ok {
+			dst, dstOk := move.Dst.(*VarExpr)
+			src, srcOk := move.Src.(*VarExpr)
+			if dstOk && srcOk && dst.Name == src.Name {
+				unlinkNode(node)
+			}
+		}
+	}
+}
+
+func (ctx *ssaContext) fromSSA() {
+	ctx.findDeclarations()
+	ctx.removePhis()
+	ctx.coalesce()
+}
+
+// ConvertToSSA rewrites every branch of the IF into SSA form. An error means
+// the IF was malformed, which is a compiler bug.
+func ConvertToSSA(ifCtx *IFContext) error {
+	for _, branch := range ifCtx.Branches() {
+		ctx := &ssaContext{ifCtx: ifCtx, branch: branch}
+		ctx.stage = "converting " + branch.Instr.(*LabelInstr).Label + " to SSA form"
+		ctx.toSSA()
+		if ctx.err != nil {
+			return ctx.err
+		}
+	}
+	return nil
+}
+
+// ConvertFromSSA removes the phi instructions from every branch of the IF,
+// which must happen before registers are allocated
+func ConvertFromSSA(ifCtx *IFContext) {
+	for _, branch := range ifCtx.Branches() {
+		ctx := &ssaContext{ifCtx: ifCtx, branch: branch}
+		ctx.fromSSA()
+	}
+}
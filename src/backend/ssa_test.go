@@ -0,0 +1,193 @@
+package backend
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"../frontend"
+)
+
+// declaredVars lists the variables declared in a branch, sorted
+func declaredVars(branch *InstrNode) []string {
+	names := []string{}
+	for node := branch; node != nil; node = node.Next {
+		if decl, ok := node.Instr.(*DeclareInstr); ok {
+			names = append(names, decl.Var.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkSSA checks that every variable in a branch is assigned exactly once,
+// and returns the number of phis
+func checkSSA(t *testing.T, name string, branch *InstrNode) int {
+	declared := make(map[string]bool)
+	for _, v := range declaredVars(branch) {
+		declared[v] = true
+	}
+
+	assigned := make(map[string]bool)
+	phis := 0
+	for node := branch; node != nil; node = node.Next {
+		if phi, ok := node.Instr.(*PhiInstr); ok {
+			phis++
+			for _, arg := range phi.Args {
+				if v, ok := arg.(*VarExpr); ok && !declared[v.Name] {
+					t.Errorf("%v: phi reads undeclared %v", name, v.Name)
+				}
+			}
+		}
+		rewriteUses(node.Instr, func(v *VarExpr) Expr {
+			if !declared[v.Name] {
+				t.Errorf("%v: %v reads undeclared %v", name, node.Instr.Repr(), v.Name)
+			}
+			return v
+		})
+
+		if v := definedVar(node.Instr); v != nil {
+			if assigned[v.Name] {
+				t.Errorf("%v: %v is assigned more than once", name, v.Name)
+			}
+			if !declared[v.Name] {
+				t.Errorf("%v: undeclared %v is assigned", name, v.Name)
+			}
+			assigned[v.Name] = true
+		}
+	}
+	return phis
+}
+
+func TestSSARoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		phis   int
+
+		// Variables declared once out of SSA form
+		vars string
+	}{
+		{
+			"straight line",
+			"begin\n  int x = 1 ;\n  x = x + 1 ;\n  println x\nend\n",
+			0,
+			"x",
+		},
+		{
+			"if",
+			"begin\n  int x = 1 ;\n  int y = 0 ;\n  if x > 0 then y = 2 else y = 3 fi ;\n  println y\nend\n",
+			1,
+			"x y",
+		},
+		{
+			"while",
+			"begin\n  int x = 1 ;\n  int y = 2 ;\n  while x < 10 do\n    x = x + y\n  done ;\n  println x\nend\n",
+			1,
+			"x y",
+		},
+		{
+			"shadowed",
+			"begin\n  int x = 1 ;\n  begin\n    int x = 5 ;\n    x = x + 1 ;\n    println x\n  end ;\n  println x\nend\n",
+			0,
+			"x x#1",
+		},
+		{
+			"nested loops",
+			"begin\n  int i = 0 ;\n  int s = 0 ;\n  while i < 3 do\n    int j = 0 ;\n    while j < 3 do\n      s = s + j ;\n      j = j + 1\n    done ;\n    i = i + 1\n  done ;\n  println s\nend\n",
+			4,
+			"i j s",
+		},
+		{
+			"read",
+			"begin\n  int x = 1 ;\n  if x > 0 then read x else skip fi ;\n  println x\nend\n",
+			1,
+			"x",
+		},
+	}
+	for _, test := range tests {
+		ifCtx := translate(t, test.source)
+		if err := ConvertToSSA(ifCtx); err != nil {
+			t.Errorf("%v: ConvertToSSA returned %v", test.name, err)
+			continue
+		}
+		if phis := checkSSA(t, test.name, ifCtx.main); phis != test.phis {
+			t.Errorf("%v: got %v phis, want %v", test.name, phis, test.phis)
+		}
+
+		ConvertFromSSA(ifCtx)
+		for node := ifCtx.main; node != nil; node = node.Next {
+			if _, ok := node.Instr.(*PhiInstr); ok {
+				t.Errorf("%v: %v is left after converting out of SSA form", test.name, node.Instr.Repr())
+			}
+		}
+		if vars := strings.Join(declaredVars(ifCtx.main), " "); vars != test.vars {
+			t.Errorf("%v: got variables %q, want %q", test.name, vars, test.vars)
+		}
+
+		if err := AllocateRegisters(ifCtx, ARMTarget, SimpleAllocator); err != nil {
+			t.Errorf("%v: AllocateRegisters returned %v", test.name, err)
+		}
+	}
+}
+
+func TestSSAParallelCopies(t *testing.T) {
+	tests := []struct {
+		name   string
+		copies [][2]string
+	}{
+		{"chain", [][2]string{{"a.1", "b.1"}, {"b.1", "c.1"}}},
+		{"swap", [][2]string{{"a.1", "b.1"}, {"b.1", "a.1"}}},
+		{"rotate", [][2]string{{"a.1", "b.1"}, {"b.1", "c.1"}, {"c.1", "a.1"}}},
+		{"swap and copy", [][2]string{{"a.1", "b.1"}, {"b.1", "a.1"}, {"c.1", "a.1"}}},
+		{"self", [][2]string{{"a.1", "a.1"}, {"b.1", "c.1"}}},
+	}
+	for _, test := range tests {
+		branch := newBranch(
+			label("main"),
+			&DeclareInstr{&VarExpr{"a.1"}, frontend.BasicType{frontend.INT}},
+			&DeclareInstr{&VarExpr{"b.1"}, frontend.BasicType{frontend.INT}},
+			&DeclareInstr{&VarExpr{"c.1"}, frontend.BasicType{frontend.INT}},
+			label("edge"),
+			ret())
+		ctx := &ssaContext{ifCtx: &IFContext{}, branch: branch}
+		ctx.findDeclarations()
+
+		copies := []ssaCopy{}
+		for _, c := range test.copies {
+			copies = append(copies, ssaCopy{&VarExpr{c[0]}, &VarExpr{c[1]}})
+		}
+		at := branch
+		for at.Next.Next != nil {
+			at = at.Next
+		}
+		ctx.insertCopies(at, copies)
+
+		// Run the copies one at a time, and check they have the effect of
+		// running all at once
+		values := make(map[string]string)
+		for node := branch; node != at; node = node.Next {
+			switch i := node.Instr.(type) {
+			case *DeclareInstr:
+				values[i.Var.Name] = i.Var.Name
+			case *MoveInstr:
+				values[i.Dst.(*VarExpr).Name] = values[i.Src.(*VarExpr).Name]
+			}
+		}
+		for _, c := range test.copies {
+			if values[c[0]] != c[1] {
+				t.Errorf("%v: %v ends up as %v, want %v", test.name, c[0], values[c[0]], c[1])
+			}
+		}
+	}
+}
+
+func TestSSAMalformedIF(t *testing.T) {
+	ifCtx := &IFContext{
+		main: newBranch(label("main"), &PrintInstr{&VarExpr{"x"}, frontend.BasicType{frontend.INT}}, ret()),
+	}
+	err := ConvertToSSA(ifCtx)
+	if err == nil || !strings.Contains(err.Error(), "non-existent variable 'x'") {
+		t.Errorf("ConvertToSSA returned %v, want an error about x", err)
+	}
+}
@@ -0,0 +1,70 @@
+package backend
+
+// The registers seen by the register allocator. The IF numbers registers from
+// 0, and each target maps the numbers onto its own machine registers. Function
+// arguments are passed in the first ArgumentRegisters() registers of the
+// target and results are returned in register 0, so every register file must
+// have at least that many registers reserved below FirstTemporary.
+type RegisterFile struct {
+	// Number of registers. Every register id is below this.
+	Count int
+
+	// Registers which the allocator can use for temporaries
+	FirstTemporary int
+	LastTemporary  int
+
+	// Registers handed out to variables by the linear scan allocator. These
+	// are taken from the top of the temporaries, and the rest are left for
+	// temporaries.
+	FirstVariable int
+	LastVariable  int
+}
+
+// A machine or language which code can be generated for
+type Target interface {
+	// Name used to select the target with -target
+	Name() string
+	Description() string
+
+	// Size in bytes of a stack slot holding a variable or a spilled
+	// register, and of each field of an array, pair or struct on the heap
+	WordSize() int
+
+	// Number of arguments passed in registers, starting from register 0.
+	// The rest are passed on the stack.
+	ArgumentRegisters() int
+
+	// Registers available to the register allocator, or nil if the target
+	// is generated from the IF before register allocation and leaves it to
+	// another compiler
+	Registers() *RegisterFile
+
+	// Extension given to the generated code by default
+	OutputExtension() string
+
+	GenerateCode(ifCtx *IFContext) (string, error)
+}
+
+var targetRegistry = []Target{
+	ARMTarget,
+	AArch64Target,
+	X86_64Target,
+	LLVMTarget,
+	CTarget,
+	WasmTarget,
+	BytecodeTarget,
+}
+
+// Targets returns every target, in the order they are listed in -help
+func Targets() []Target {
+	return targetRegistry
+}
+
+func LookupTarget(name string) (Target, bool) {
+	for _, t := range targetRegistry {
+		if t.Name() == name {
+			return t, true
+		}
+	}
+	return nil, false
+}
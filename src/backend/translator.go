@@ -2,6 +2,7 @@ package backend
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"unicode/utf8"
 
@@ -9,6 +10,10 @@ import (
 )
 
 type IFContext struct {
+	// Target the IF is translated for, which decides the size of stack
+	// slots and heap fields and how arguments are passed
+	target Target
+
 	// Variable scoping
 	scope          []map[string]frontend.Type
 	scopePushInstr []*PushScopeInstr
@@ -17,6 +22,13 @@ type IFContext struct {
 	// Labels
 	labels map[string]Instr
 
+	// Loops around the current statement, innermost last
+	loops []loopLabels
+
+	// Every loop translated, outermost first, so that the unroller doesn't
+	// have to search for them
+	loopList []*loopInfo
+
 	// Functions
 	main      *InstrNode
 	functions map[string]*InstrNode
@@ -25,13 +37,60 @@ type IFContext struct {
 	// Data Store
 	dataStore      map[string]*StringConstExpr
 	currentCounter int
+
+	stageErrors
+}
+
+// Where break and continue statements inside a loop jump to, and the scope
+// depth outside of the loop. Continue jumps to begin, which is the step of a
+// for loop.
+type loopLabels struct {
+	begin *InstrNode
+	end   *InstrNode
+	depth int
+}
+
+// A loop as it was translated
+type loopInfo struct {
+	begin *InstrNode // Label before the condition
+	end   *InstrNode // Label after the loop
+
+	// Only set for for and for-each loops: the loop variable, the move
+	// initialising it, and the label before the step
+	variable string
+	init     *InstrNode
+	step     *InstrNode
 }
 
-func TranslateToIF(program *frontend.Program) *IFContext {
+// TranslateToIF translates a checked program into the IF. An error means the
+// AST contained something the translator can't handle, which is a compiler
+// bug.
+func TranslateToIF(program *frontend.Program, target Target) (*IFContext, error) {
 	ctx := new(IFContext)
+	ctx.stage = "translating to IF"
+	ctx.target = target
 	ctx.functions = make(map[string]*InstrNode)
 	ctx.translate(program)
-	return ctx
+	if ctx.err != nil {
+		return nil, ctx.err
+	}
+	return ctx, nil
+}
+
+// Branches returns the first node of each function, ordered by name,
+// followed by main
+func (ctx *IFContext) Branches() []*InstrNode {
+	names := []string{}
+	for name := range ctx.functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	branches := []*InstrNode{}
+	for _, name := range names {
+		branches = append(branches, ctx.functions[name])
+	}
+	return append(branches, ctx.main)
 }
 
 func (ctx *IFContext) makeNode(i Instr) *InstrNode {
@@ -80,7 +139,7 @@ func (ctx *IFContext) pushScope() {
 
 func (ctx *IFContext) popScope() {
 	// Determine stack size
-	stackSize := len(ctx.scope[ctx.depth-1]) * regWidth
+	stackSize := len(ctx.scope[ctx.depth-1]) * ctx.target.WordSize()
 
 	// Ensure stack is double-word aligned (5.2.1.2)
 	if (stackSize % 8) != 0 {
@@ -94,6 +153,20 @@ func (ctx *IFContext) popScope() {
 	ctx.depth--
 }
 
+// jumpOutOfLoop jumps to the start or end of the innermost loop, freeing the
+// stack of the scopes inside the loop first
+func (ctx *IFContext) jumpOutOfLoop(toEnd bool) {
+	loop := ctx.loops[len(ctx.loops)-1]
+	if ctx.depth > loop.depth {
+		ctx.addInstr(&UnwindScopesInstr{ctx.depth - loop.depth})
+	}
+	if toEnd {
+		ctx.addInstr(&JmpInstr{loop.end})
+	} else {
+		ctx.addInstr(&JmpInstr{loop.begin})
+	}
+}
+
 func (ctx *IFContext) getType(expr Expr) frontend.Type {
 	switch expr := expr.(type) {
 	case *IntConstExpr:
@@ -129,7 +202,8 @@ func (ctx *IFContext) getType(expr Expr) frontend.Type {
 		}
 
 		// Cant find the variable, this should never happen
-		panic(fmt.Sprintf("Cannot find variable %s", expr.Name))
+		ctx.fail("Cannot find variable %s", expr.Name)
+		return nil
 
 	default:
 		return nil
@@ -170,24 +244,27 @@ func (ctx *IFContext) translateExpr(expr frontend.Expr) Expr {
 			return &PointerConstExpr{0}
 		}
 
-		panic(fmt.Sprintf("Unhandled BasicLit %s", expr.Type.Repr()))
+		ctx.fail("Unhandled BasicLit %s", expr.Type.Repr())
+		return &IntConstExpr{0}
 
 	case *frontend.IdentExpr:
 		return &VarExpr{expr.Name}
 
 	case *frontend.ArrayElemExpr:
-		return &ArrayElemExpr{ctx.translateExpr(expr.Volume), ctx.translateExpr(expr.Index)}
+		return &ArrayElemExpr{ctx.translateExpr(expr.Volume), ctx.translateExpr(expr.Index), false}
 
 	case *frontend.PairElemExpr:
 		return &PairElemExpr{
 			expr.SelectorType == frontend.FST,
-			&VarExpr{expr.Operand.Name}}
+			&VarExpr{expr.Operand.Name},
+			false}
 
 	case *frontend.StructElemExpr:
 		return &StructElemExpr{
 			&VarExpr{expr.StructIdent.Name},
 			&VarExpr{expr.ElemIdent.Name},
-			expr.ElemNum * regWidth,
+			expr.ElemNum * ctx.target.WordSize(),
+			false,
 		}
 
 	case *frontend.UnaryExpr:
@@ -211,6 +288,10 @@ func (ctx *IFContext) translateExpr(expr frontend.Expr) Expr {
 			Type:     expr.Type}
 
 	case *frontend.BinaryExpr:
+		if expr.Operator == And || expr.Operator == Or {
+			return ctx.translateLogical(expr)
+		}
+
 		return &BinaryExpr{
 			Operator: expr.Operator,
 			Left:     ctx.translateExpr(expr.Left),
@@ -247,7 +328,124 @@ func (ctx *IFContext) translateExpr(expr frontend.Expr) Expr {
 		return &CallExpr{Label: &LocationExpr{expr.Ident.Name}, Args: translatedArgs}
 
 	default:
-		panic(fmt.Sprintf("Unhandled expression %T", expr))
+		ctx.fail("Unhandled expression %T", expr)
+		return &IntConstExpr{0}
+	}
+}
+
+// translateLogical evaluates && or || into a new variable, jumping over the
+// right operand when the left one decides the result. Expressions have no
+// side effects other than runtime errors, so computing the value before the
+// rest of the expression which contains it only changes which error is
+// reported when there are several.
+func (ctx *IFContext) translateLogical(expr *frontend.BinaryExpr) Expr {
+	n := ctx.currentCounter
+	result := &VarExpr{fmt.Sprintf("_logical_%d", n)}
+	end := ctx.makeNode(&LabelInstr{fmt.Sprintf("_logical_end%d", n)})
+	ctx.currentCounter += 1
+
+	ctx.addType(result.Name, frontend.BasicType{frontend.BOOL})
+	ctx.addInstr(&DeclareInstr{result, frontend.BasicType{frontend.BOOL}})
+	ctx.addInstr(&MoveInstr{Dst: result, Src: &BoolConstExpr{false}})
+	ctx.translateCond(expr, end, false)
+	ctx.addInstr(&MoveInstr{Dst: result, Src: &BoolConstExpr{true}})
+	ctx.appendNode(end)
+
+	return result
+}
+
+// translateCond adds jumps to dst which are taken when cond evaluates to
+// jumpIf. && and || become a jump for each operand, so that the right operand
+// is only evaluated when the left one doesn't decide the result.
+func (ctx *IFContext) translateCond(cond frontend.Expr, dst *InstrNode, jumpIf bool) {
+	switch cond := cond.(type) {
+	case *frontend.UnaryExpr:
+		if cond.Operator == Not {
+			ctx.translateCond(cond.Operand, dst, !jumpIf)
+			return
+		}
+
+	case *frontend.BinaryExpr:
+		if cond.Operator == And || cond.Operator == Or {
+			// The left operand decides the result of && when it is false,
+			// and of || when it is true
+			decides := cond.Operator == Or
+			if decides == jumpIf {
+				ctx.translateCond(cond.Left, dst, jumpIf)
+				ctx.translateCond(cond.Right, dst, jumpIf)
+				return
+			}
+
+			n := ctx.currentCounter
+			skip := ctx.makeNode(&LabelInstr{fmt.Sprintf("_cond_skip%d", n)})
+			ctx.currentCounter += 1
+
+			ctx.translateCond(cond.Left, skip, decides)
+			ctx.translateCond(cond.Right, dst, jumpIf)
+			ctx.appendNode(skip)
+			return
+		}
+	}
+
+	trexpr := ctx.translateExpr(cond)
+	if !jumpIf {
+		trexpr = &UnaryExpr{
+			Operator: Not,
+			Operand:  trexpr,
+			Type:     frontend.BasicType{frontend.BOOL}}
+	}
+	ctx.addInstr(&JmpCondInstr{dst, trexpr})
+}
+
+// translateUpdate translates an lvalue of type t which is read and then
+// written. An array index which could change is moved into a temporary first,
+// so that it is only evaluated once. The read does the runtime checks, so the
+// lvalue written to doesn't repeat them.
+func (ctx *IFContext) translateUpdate(lhs frontend.LValueExpr, t frontend.Type) (dst Expr, src Expr) {
+	switch lhs := lhs.(type) {
+	case *frontend.ArrayElemExpr:
+		n := ctx.currentCounter
+		ctx.currentCounter += 1
+
+		array := ctx.translateExpr(lhs.Volume)
+		if _, ok := array.(*VarExpr); !ok {
+			v := &VarExpr{fmt.Sprintf("_update_array%d", n)}
+			ctx.addType(v.Name, frontend.ArrayType{t})
+			ctx.addInstr(&DeclareInstr{v, frontend.ArrayType{t}})
+			ctx.addInstr(&MoveInstr{Dst: v, Src: array})
+			array = v
+		}
+
+		// Variables can't be changed by evaluating the right hand side, as
+		// calls can only change what is on the heap
+		index := ctx.translateExpr(lhs.Index)
+		switch index.(type) {
+		case *VarExpr, *IntConstExpr:
+		default:
+			v := &VarExpr{fmt.Sprintf("_update_index%d", n)}
+			ctx.addType(v.Name, frontend.BasicType{frontend.INT})
+			ctx.addInstr(&DeclareInstr{v, frontend.BasicType{frontend.INT}})
+			ctx.addInstr(&MoveInstr{Dst: v, Src: index})
+			index = v
+		}
+
+		return &ArrayElemExpr{array, index, true}, &ArrayElemExpr{array.Copy(), index.Copy(), false}
+
+	case *frontend.PairElemExpr:
+		src := ctx.translateExpr(lhs).(*PairElemExpr)
+		dst := src.Copy().(*PairElemExpr)
+		dst.NotNull = true
+		return dst, src
+
+	case *frontend.StructElemExpr:
+		src := ctx.translateExpr(lhs).(*StructElemExpr)
+		dst := src.Copy().(*StructElemExpr)
+		dst.NotNull = true
+		return dst, src
+
+	default:
+		src := ctx.translateExpr(lhs)
+		return src.Copy(), src
 	}
 }
 
@@ -260,8 +458,9 @@ func (ctx *IFContext) translate(node frontend.Stmt) {
 				ctx.beginFunction(f.Ident.Name)
 				ctx.pushScope()
 
+				argumentRegisters := ctx.target.ArgumentRegisters()
 				for regNum, p := range f.Params {
-					if regNum < 4 {
+					if regNum < argumentRegisters {
 						ctx.addType(p.Ident.Name, p.Type)
 						ctx.addInstr(&DeclareInstr{&VarExpr{p.Ident.Name}, p.Type})
 						ctx.addInstr(&MoveInstr{Dst: &VarExpr{p.Ident.Name}, Src: &RegisterExpr{regNum}})
@@ -270,7 +469,7 @@ func (ctx *IFContext) translate(node frontend.Stmt) {
 						ctx.addInstr(&DeclareInstr{&VarExpr{p.Ident.Name}, p.Type})
 						ctx.addInstr(&MoveInstr{
 							Dst: &VarExpr{p.Ident.Name},
-							Src: &StackArgumentExpr{(len(f.Params) - 5) - (regNum - 4)},
+							Src: &StackArgumentExpr{(len(f.Params) - argumentRegisters - 1) - (regNum - argumentRegisters)},
 						})
 					}
 				}
@@ -309,6 +508,28 @@ func (ctx *IFContext) translate(node frontend.Stmt) {
 				Dst: ctx.translateExpr(node.Left),
 				Src: ctx.translateExpr(node.Right)})
 
+	case *frontend.CompoundAssignStmt:
+		n := ctx.currentCounter
+		ctx.currentCounter += 1
+
+		// The current value is read before the right hand side is evaluated
+		dst, src := ctx.translateUpdate(node.Left, node.Type)
+		if _, ok := src.(*VarExpr); !ok {
+			v := &VarExpr{fmt.Sprintf("_update_value%d", n)}
+			ctx.addType(v.Name, node.Type)
+			ctx.addInstr(&DeclareInstr{v, node.Type})
+			ctx.addInstr(&MoveInstr{Dst: v, Src: src})
+			src = v
+		}
+		ctx.addInstr(
+			&MoveInstr{
+				Dst: dst,
+				Src: &BinaryExpr{
+					Operator: node.Operator,
+					Left:     src,
+					Right:    ctx.translateExpr(node.Right),
+					Type:     node.Type}})
+
 	case *frontend.ReadStmt:
 		ctx.addInstr(&ReadInstr{ctx.translateExpr(node.Dst), node.Type})
 
@@ -336,11 +557,7 @@ func (ctx *IFContext) translate(node frontend.Stmt) {
 		endIfElse := ctx.makeNode(&LabelInstr{fmt.Sprintf("_ifelse_end%d", n)})
 		ctx.currentCounter += 1
 
-		trexpr := ctx.translateExpr(node.Cond)
-		ctx.addInstr(&JmpCondInstr{startElse, &UnaryExpr{
-			Operator: Not,
-			Operand:  trexpr,
-			Type:     frontend.BasicType{frontend.BOOL}}})
+		ctx.translateCond(node.Cond, startElse, false)
 
 		// Build main branch
 		ctx.pushScope()
@@ -369,25 +586,132 @@ func (ctx *IFContext) translate(node frontend.Stmt) {
 		ctx.currentCounter += 1
 
 		// Build condition
+		ctx.loopList = append(ctx.loopList, &loopInfo{begin: beginWhile, end: endWhile})
 		ctx.appendNode(beginWhile)
 
-		trexpr := ctx.translateExpr(node.Cond)
-		ctx.addInstr(&JmpCondInstr{endWhile, &UnaryExpr{
-			Operator: Not,
-			Operand:  trexpr,
-			Type:     frontend.BasicType{frontend.BOOL}}})
+		ctx.translateCond(node.Cond, endWhile, false)
 
 		// Build body
+		ctx.loops = append(ctx.loops, loopLabels{beginWhile, endWhile, ctx.depth})
 		ctx.pushScope()
 		for _, n := range node.Body {
 			ctx.translate(n)
 		}
 		ctx.popScope()
+		ctx.loops = ctx.loops[:len(ctx.loops)-1]
 
 		// Build end
 		ctx.addInstr(&JmpInstr{beginWhile})
 		ctx.appendNode(endWhile)
 
+	case *frontend.ForStmt:
+		n := ctx.currentCounter
+		beginFor := ctx.makeNode(&LabelInstr{fmt.Sprintf("_for_begin%d", n)})
+		stepFor := ctx.makeNode(&LabelInstr{fmt.Sprintf("_for_step%d", n)})
+		endFor := ctx.makeNode(&LabelInstr{fmt.Sprintf("_for_end%d", n)})
+		ctx.currentCounter += 1
+
+		// The loop variable is in a scope around the whole loop
+		ctx.pushScope()
+		ctx.translate(node.Init)
+		ctx.loopList = append(ctx.loopList, &loopInfo{
+			begin:    beginFor,
+			end:      endFor,
+			variable: node.Init.Ident.Name,
+			init:     ctx.current,
+			step:     stepFor,
+		})
+
+		// Build condition
+		ctx.appendNode(beginFor)
+
+		ctx.translateCond(node.Cond, endFor, false)
+
+		// Build body
+		ctx.loops = append(ctx.loops, loopLabels{stepFor, endFor, ctx.depth})
+		ctx.pushScope()
+		for _, n := range node.Body {
+			ctx.translate(n)
+		}
+		ctx.popScope()
+		ctx.loops = ctx.loops[:len(ctx.loops)-1]
+
+		// Build step
+		ctx.appendNode(stepFor)
+		ctx.translate(node.Step)
+
+		// Build end
+		ctx.addInstr(&JmpInstr{beginFor})
+		ctx.appendNode(endFor)
+		ctx.popScope()
+
+	case *frontend.ForEachStmt:
+		n := ctx.currentCounter
+		beginFor := ctx.makeNode(&LabelInstr{fmt.Sprintf("_foreach_begin%d", n)})
+		stepFor := ctx.makeNode(&LabelInstr{fmt.Sprintf("_foreach_step%d", n)})
+		endFor := ctx.makeNode(&LabelInstr{fmt.Sprintf("_foreach_end%d", n)})
+		ctx.currentCounter += 1
+
+		intType := frontend.BasicType{frontend.INT}
+		collection := &VarExpr{fmt.Sprintf("_foreach_collection%d", n)}
+		length := &VarExpr{fmt.Sprintf("_foreach_len%d", n)}
+		index := &VarExpr{fmt.Sprintf("_foreach_index%d", n)}
+		elem := &VarExpr{node.Ident.Name}
+
+		// The collection and its length are evaluated once, into variables
+		// in a scope around the loop with the element
+		ctx.pushScope()
+		ctx.addType(collection.Name, frontend.ArrayType{node.Type})
+		ctx.addInstr(&DeclareInstr{collection, frontend.ArrayType{node.Type}})
+		ctx.addInstr(&MoveInstr{Dst: collection, Src: ctx.translateExpr(node.Collection)})
+		ctx.addType(length.Name, intType)
+		ctx.addInstr(&DeclareInstr{length, intType})
+		ctx.addInstr(&MoveInstr{Dst: length, Src: &UnaryExpr{Operator: Len, Operand: collection, Type: intType}})
+		ctx.addType(elem.Name, node.Type)
+		ctx.addInstr(&DeclareInstr{elem, node.Type})
+		ctx.addType(index.Name, intType)
+		ctx.addInstr(&DeclareInstr{index, intType})
+		ctx.loopList = append(ctx.loopList, &loopInfo{
+			begin:    beginFor,
+			end:      endFor,
+			variable: index.Name,
+			init:     ctx.addInstr(&MoveInstr{Dst: index, Src: &IntConstExpr{0}}),
+			step:     stepFor,
+		})
+
+		// Build condition. The index is always below the length afterwards,
+		// so the element doesn't need to be bounds checked.
+		ctx.appendNode(beginFor)
+		ctx.addInstr(&JmpCondInstr{endFor, &UnaryExpr{
+			Operator: Not,
+			Operand:  &BinaryExpr{Operator: LT, Left: index, Right: length, Type: frontend.BasicType{frontend.BOOL}},
+			Type:     frontend.BasicType{frontend.BOOL}}})
+		ctx.addInstr(&MoveInstr{Dst: elem, Src: &ArrayElemExpr{collection, index, true}})
+
+		// Build body
+		ctx.loops = append(ctx.loops, loopLabels{stepFor, endFor, ctx.depth})
+		ctx.pushScope()
+		for _, n := range node.Body {
+			ctx.translate(n)
+		}
+		ctx.popScope()
+		ctx.loops = ctx.loops[:len(ctx.loops)-1]
+
+		// Build step
+		ctx.appendNode(stepFor)
+		ctx.addInstr(&MoveInstr{Dst: index, Src: &BinaryExpr{Operator: Add, Left: index, Right: &IntConstExpr{1}, Type: intType}})
+
+		// Build end
+		ctx.addInstr(&JmpInstr{beginFor})
+		ctx.appendNode(endFor)
+		ctx.popScope()
+
+	case *frontend.BreakStmt:
+		ctx.jumpOutOfLoop(true)
+
+	case *frontend.ContinueStmt:
+		ctx.jumpOutOfLoop(false)
+
 	// Scope
 	case *frontend.ScopeStmt:
 		ctx.pushScope()
@@ -397,6 +721,6 @@ func (ctx *IFContext) translate(node frontend.Stmt) {
 		ctx.popScope()
 
 	default:
-		panic(fmt.Sprintf("Unhandled statement %T", node))
+		ctx.fail("Unhandled statement %T", node)
 	}
 }
@@ -0,0 +1,935 @@
+package backend
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"../frontend"
+)
+
+// Generation of a WebAssembly text format module from the IF, before register
+// allocation. WACC values are i32s and pointers are addresses in the linear
+// memory, which holds the string literals followed by the heap, laid out as
+// on ARM. Output and input go through functions imported from the host, so
+// the module runs wherever a few lines of glue can be written.
+//
+// WebAssembly only has structured control flow, so the labels of a function
+// split it into segments, and a jump sets the segment to run next and
+// branches back to a loop which dispatches to it.
+
+// Size of a page of linear memory
+const wasmPageSize = 1 << 16
+
+// Start of the string literals. The word at address 0 holds the list of
+// freed blocks, so null is never a valid address.
+const wasmDataStart = 8
+
+type wasmGeneratorContext struct {
+	target Target
+
+	// Function being generated
+	text   string
+	locals []string
+	temps  int
+	scope  variableScopes
+
+	// Segment started by each label which is jumped to
+	segments map[string]int
+
+	// Parameters read by the function, by register or stack argument
+	registerParams int
+	stackParams    int
+
+	// Number of arguments passed to each function called
+	callees map[string]int
+
+	// String literals, and the addresses they are stored at
+	literals    map[string]int
+	literalDefs string
+	dataEnd     int
+
+	stageErrors
+}
+
+func (ctx *wasmGeneratorContext) emit(s string, a ...interface{}) {
+	ctx.text += "\t\t" + fmt.Sprintf(s, a...) + "\n"
+}
+
+// temp stores the value left on the stack by the instructions emitted since
+// the last value was taken
+func (ctx *wasmGeneratorContext) temp() string {
+	ctx.temps++
+	t := fmt.Sprintf("$t%d", ctx.temps)
+	ctx.locals = append(ctx.locals, t)
+	ctx.emit("local.set %s", t)
+	return "local.get " + t
+}
+
+func (ctx *wasmGeneratorContext) literal(s string) int {
+	if address, ok := ctx.literals[s]; ok {
+		return address
+	}
+
+	words := []rune{rune(len([]rune(s)))}
+	words = append(words, []rune(s)...)
+	bytes := ""
+	for _, w := range words {
+		for i := uint(0); i < 32; i += 8 {
+			bytes += fmt.Sprintf("\\%02x", uint32(w)>>i&0xff)
+		}
+	}
+	ctx.literalDefs += fmt.Sprintf("\t(data (i32.const %d) \"%s\")\n", ctx.dataEnd, bytes)
+
+	address := ctx.dataEnd
+	ctx.literals[s] = address
+	ctx.dataEnd += len(words) * ctx.target.WordSize()
+	return address
+}
+
+// jump continues execution at a label
+func (ctx *wasmGeneratorContext) jump(label string) {
+	ctx.emit("i32.const %d", ctx.segments[label])
+	ctx.emit("local.set $pc")
+	ctx.emit("br $dispatch")
+}
+
+//
+// Variables
+//
+func (ctx *wasmGeneratorContext) declare(v *VarExpr) {
+	// Names of versions and inlined variables contain characters which
+	// aren't allowed in identifiers
+	name := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+		return '_'
+	}, v.Name)
+	name = fmt.Sprintf("$v_%s_%d", name, len(ctx.locals))
+
+	ctx.locals = append(ctx.locals, name)
+	ctx.scope.declare(v, name)
+}
+
+// lookup finds the local of the variable an expression reads
+func (ctx *wasmGeneratorContext) lookup(v *VarExpr) string {
+	name, ok := ctx.scope.lookup(v)
+	if !ok {
+		ctx.fail("Trying to access non-existent variable '%s'", v.Name)
+		return "$pc"
+	}
+	return name.(string)
+}
+
+// initialise finds the local of the variable an expression assigns to
+func (ctx *wasmGeneratorContext) initialise(v *VarExpr) string {
+	name, ok := ctx.scope.initialise(v)
+	if !ok {
+		ctx.fail("Trying to initialise non-existent variable '%s'", v.Name)
+		return "$pc"
+	}
+	return name.(string)
+}
+
+//
+// Expressions
+//
+
+// address evaluates the address of a heap location an expression refers to
+func (ctx *wasmGeneratorContext) address(e Expr) string {
+	switch e := e.(type) {
+	case *ArrayElemExpr:
+		array := ctx.value(e.Array)
+		index := ctx.value(e.Index)
+		if !e.InBounds {
+			ctx.emit(index)
+			ctx.emit(array)
+			ctx.emit("call $%s", RuntimeCheckArrayBoundsLabel)
+		}
+		ctx.emit(array)
+		ctx.emit(index)
+		ctx.emit("i32.const %d", ctx.target.WordSize())
+		ctx.emit("i32.mul")
+		ctx.emit("i32.add")
+		ctx.emit("i32.const %d", ctx.target.WordSize())
+		ctx.emit("i32.add")
+		return ctx.temp()
+
+	case *PairElemExpr:
+		offset := 0
+		if !e.Fst {
+			offset = ctx.target.WordSize()
+		}
+		pair := ctx.value(e.Operand)
+		if !e.NotNull {
+			ctx.emit(pair)
+			ctx.emit("call $%s", RuntimeCheckNullPointerLabel)
+		}
+		ctx.emit(pair)
+		ctx.emit("i32.const %d", offset)
+		ctx.emit("i32.add")
+		return ctx.temp()
+
+	case *StructElemExpr:
+		object := ctx.value(e.StructIdent)
+		if !e.NotNull {
+			ctx.emit(object)
+			ctx.emit("call $%s", RuntimeCheckNullPointerLabel)
+		}
+		ctx.emit(object)
+		ctx.emit("i32.const %d", e.ElemOffset)
+		ctx.emit("i32.add")
+		return ctx.temp()
+
+	default:
+		ctx.fail("Unhandled lvalue %T", e)
+		return "i32.const 0"
+	}
+}
+
+// store assigns the value of an operand to the location an expression
+// refers to
+func (ctx *wasmGeneratorContext) store(e Expr, v string) {
+	if e, ok := e.(*VarExpr); ok {
+		ctx.emit(v)
+		ctx.emit("local.set %s", ctx.initialise(e))
+		return
+	}
+
+	address := ctx.address(e)
+	ctx.emit(address)
+	ctx.emit(v)
+	ctx.emit("i32.store")
+}
+
+// value evaluates an expression, returning a single instruction which pushes
+// its value and has no side effects
+func (ctx *wasmGeneratorContext) value(e Expr) string {
+	switch e := e.(type) {
+	case *IntConstExpr:
+		return fmt.Sprintf("i32.const %d", e.Value)
+
+	case *FloatConstExpr:
+		return fmt.Sprintf("i32.const %d", int32(math.Float32bits(e.Value)))
+
+	case *BoolConstExpr:
+		if e.Value {
+			return "i32.const 1"
+		}
+		return "i32.const 0"
+
+	case *CharConstExpr:
+		return fmt.Sprintf("i32.const %d", e.Value)
+
+	case *PointerConstExpr:
+		return fmt.Sprintf("i32.const %d", e.Value)
+
+	case *StringConstExpr:
+		return fmt.Sprintf("i32.const %d", ctx.literal(e.Value))
+
+	case *RegisterExpr:
+		// Only parameters are read from registers before allocation
+		if e.Id >= ctx.registerParams {
+			ctx.registerParams = e.Id + 1
+		}
+		return fmt.Sprintf("local.get $arg%d", e.Id)
+
+	case *StackArgumentExpr:
+		if e.Id >= ctx.stackParams {
+			ctx.stackParams = e.Id + 1
+		}
+		return fmt.Sprintf("local.get $stackarg%d", e.Id)
+
+	case *VarExpr:
+		return "local.get " + ctx.lookup(e)
+
+	case *ArrayElemExpr, *PairElemExpr, *StructElemExpr:
+		ctx.emit(ctx.address(e))
+		ctx.emit("i32.load")
+		return ctx.temp()
+
+	case *UnaryExpr:
+		operand := ctx.value(e.Operand)
+		switch e.Operator {
+		case Not:
+			ctx.emit(operand)
+			ctx.emit("i32.eqz")
+
+		case Ord, Chr:
+			return operand
+
+		case Neg:
+			ctx.emit("i32.const 0")
+			ctx.emit(operand)
+			if e.Type.Equals(frontend.BasicType{frontend.FLOAT}) {
+				ctx.emit("call $_wacc_fsub")
+			} else {
+				ctx.emit("call $_wacc_sub")
+			}
+
+		case Len:
+			ctx.emit(operand)
+			ctx.emit("i32.load")
+
+		default:
+			ctx.fail("Unhandled unary operator %v", e.Operator)
+		}
+		return ctx.temp()
+
+	case *BinaryExpr:
+		// Evaluate the operands in the same order as the register allocator
+		var left, right string
+		if e.Left.Weight() > e.Right.Weight() {
+			left = ctx.value(e.Left)
+			right = ctx.value(e.Right)
+		} else {
+			right = ctx.value(e.Right)
+			left = ctx.value(e.Left)
+		}
+		ctx.emit(left)
+		ctx.emit(right)
+
+		switch e.Operator {
+		case Add, Sub, Mul, Div, Mod:
+			function := map[string]string{Add: "add", Sub: "sub", Mul: "mul", Div: "div", Mod: "mod"}[e.Operator]
+			if e.Type.Equals(frontend.BasicType{frontend.FLOAT}) {
+				function = "f" + function
+			}
+			ctx.emit("call $_wacc_%s", function)
+
+		case And:
+			ctx.emit("i32.and")
+
+		case Or:
+			ctx.emit("i32.or")
+
+		case LT, GT, LE, GE, EQ, NE:
+			instr := map[string]string{LT: "lt_s", GT: "gt_s", LE: "le_s", GE: "ge_s", EQ: "eq", NE: "ne"}[e.Operator]
+			ctx.emit("i32.%s", instr)
+
+		default:
+			ctx.fail("Unknown operator %v", e.Operator)
+		}
+		return ctx.temp()
+
+	case *ArrayConstExpr:
+		ctx.emit("i32.const %d", (len(e.Elems)+1)*ctx.target.WordSize())
+		ctx.emit("call $_wacc_malloc")
+		array := ctx.temp()
+		ctx.emit(array)
+		ctx.emit("i32.const %d", len(e.Elems))
+		ctx.emit("i32.store")
+		for i, elem := range e.Elems {
+			v := ctx.value(elem)
+			ctx.emit(array)
+			ctx.emit(v)
+			ctx.emit("i32.store offset=%d", (i+1)*ctx.target.WordSize())
+		}
+		return array
+
+	case *NewStructExpr:
+		ctx.emit("i32.const %d", len(e.Args)*ctx.target.WordSize())
+		ctx.emit("call $_wacc_malloc")
+		object := ctx.temp()
+		for i, arg := range e.Args {
+			v := ctx.value(arg)
+			ctx.emit(object)
+			ctx.emit(v)
+			ctx.emit("i32.store offset=%d", i*ctx.target.WordSize())
+		}
+		return object
+
+	case *NewPairExpr:
+		ctx.emit("i32.const %d", 2*ctx.target.WordSize())
+		ctx.emit("call $_wacc_malloc")
+		pair := ctx.temp()
+		left := ctx.value(e.Left)
+		ctx.emit(pair)
+		ctx.emit(left)
+		ctx.emit("i32.store")
+		right := ctx.value(e.Right)
+		ctx.emit(pair)
+		ctx.emit(right)
+		ctx.emit("i32.store offset=%d", ctx.target.WordSize())
+		return pair
+
+	case *CallExpr:
+		args := []string{}
+		for _, arg := range e.Args {
+			args = append(args, ctx.value(arg))
+		}
+		for _, arg := range args {
+			ctx.emit(arg)
+		}
+		if len(e.Args) > ctx.callees[e.Label.Label] {
+			ctx.callees[e.Label.Label] = len(e.Args)
+		}
+		ctx.emit("call $%s", e.Label.Label)
+		return ctx.temp()
+
+	default:
+		ctx.fail("Unhandled expression %T", e)
+		return "i32.const 0"
+	}
+}
+
+//
+// Instructions
+//
+func (ctx *wasmGeneratorContext) generateInstr(instr Instr) {
+	switch i := instr.(type) {
+	case *NoOpInstr, *UnwindScopesInstr:
+
+	case *LabelInstr:
+		// Close the block which is branched out of to reach the segment
+		if segment, ok := ctx.segments[i.Label]; ok {
+			ctx.text += fmt.Sprintf("\t\tend ;; %s, segment %d\n", i.Label, segment)
+		}
+
+	case *DeclareInstr:
+		ctx.declare(i.Var)
+
+	case *PushScopeInstr:
+		ctx.scope.push()
+
+	case *PopScopeInstr:
+		ctx.scope.pop()
+
+	case *EvalInstr:
+		ctx.value(i.Expr)
+
+	case *ReadInstr:
+		if i.Type.Equals(frontend.BasicType{frontend.CHAR}) {
+			ctx.emit("call $_wacc_read_char")
+		} else {
+			ctx.emit("call $_wacc_read_int")
+		}
+		ctx.store(i.Dst, ctx.temp())
+
+	case *FreeInstr:
+		object := ctx.value(i.Object)
+		ctx.emit(object)
+		ctx.emit("call $%s", RuntimeCheckNullPointerLabel)
+		ctx.emit(object)
+		ctx.emit("call $_wacc_free")
+
+	case *ReturnInstr:
+		ctx.emit(ctx.value(i.Expr))
+		ctx.emit("return")
+
+	case *ExitInstr:
+		ctx.emit(ctx.value(i.Expr))
+		ctx.emit("call $_wacc_exit")
+		ctx.emit("unreachable")
+
+	case *PrintInstr:
+		v := ctx.value(i.Expr)
+		ctx.emit(v)
+		t := i.Type
+		if t.Equals(frontend.BasicType{frontend.INT}) {
+			ctx.emit("call $_wacc_print_int")
+		} else if t.Equals(frontend.BasicType{frontend.FLOAT}) {
+			ctx.emit("f32.reinterpret_i32")
+			ctx.emit("call $_wacc_print_float")
+		} else if t.Equals(frontend.BasicType{frontend.BOOL}) {
+			ctx.emit("call $_wacc_print_bool")
+		} else if t.Equals(frontend.BasicType{frontend.CHAR}) {
+			ctx.emit("call $_wacc_print_char")
+		} else if t.Equals(frontend.BasicType{frontend.STRING}) ||
+			t.Equals(frontend.ArrayType{frontend.BasicType{frontend.CHAR}}) {
+			ctx.emit("call $_wacc_print_wstr")
+		} else {
+			ctx.emit("call $_wacc_print_addr")
+		}
+
+	case *MoveInstr:
+		ctx.store(i.Dst, ctx.value(i.Src))
+
+	case *JmpInstr:
+		ctx.jump(i.Dst.Instr.(*LabelInstr).Label)
+
+	case *JmpCondInstr:
+		ctx.emit(ctx.value(i.Cond))
+		ctx.emit("if")
+		ctx.jump(i.Dst.Instr.(*LabelInstr).Label)
+		ctx.emit("end")
+
+	case *LocaleInstr:
+		// The literals are in place before the module starts, and the host
+		// decides how characters are encoded
+
+	case *PhiInstr:
+		ctx.fail("Phi instructions must be removed before code generation")
+
+	default:
+		ctx.fail("Unhandled instruction %T", instr)
+	}
+}
+
+// generateFunction returns the body of a function, leaving its parameters to
+// be declared once every call to it has been seen
+func (ctx *wasmGeneratorContext) generateFunction(n *InstrNode, isMain bool) string {
+	ctx.stage = "generating WebAssembly for " + n.Instr.(*LabelInstr).Label
+	ctx.text = ""
+	ctx.locals = nil
+	ctx.temps = 0
+	ctx.scope = newVariableScopes()
+	ctx.registerParams = 0
+	ctx.stackParams = 0
+
+	// Segment 0 is the start of the function, and each label which is jumped
+	// to starts another
+	targets := make(map[string]bool)
+	for node := n.Next; node != nil; node = node.Next {
+		switch i := node.Instr.(type) {
+		case *JmpInstr:
+			targets[i.Dst.Instr.(*LabelInstr).Label] = true
+		case *JmpCondInstr:
+			targets[i.Dst.Instr.(*LabelInstr).Label] = true
+		}
+	}
+	ctx.segments = make(map[string]int)
+	for node := n.Next; node != nil; node = node.Next {
+		if l, ok := node.Instr.(*LabelInstr); ok && targets[l.Label] {
+			ctx.segments[l.Label] = len(ctx.segments) + 1
+		}
+	}
+
+	for node := n.Next; node != nil; node = node.Next {
+		ctx.generateInstr(node.Instr)
+	}
+
+	body := ""
+	for _, local := range ctx.locals {
+		body += fmt.Sprintf("\t\t(local %s i32)\n", local)
+	}
+	if len(ctx.segments) > 0 {
+		// Segment k follows the end of the k-th innermost block, so the
+		// br_table leaves k blocks to reach it
+		body += "\t\t(local $pc i32)\n"
+		body += "\t\tloop $dispatch\n"
+		body += strings.Repeat("\t\tblock\n", len(ctx.segments)+1)
+		body += "\t\tlocal.get $pc\n"
+		body += "\t\tbr_table"
+		for k := 0; k <= len(ctx.segments); k++ {
+			body += fmt.Sprintf(" %d", k)
+		}
+		body += "\n\t\tend ;; segment 0\n"
+		ctx.text += "\t\tend ;; dispatch\n"
+	}
+	body += ctx.text
+
+	if isMain {
+		body += "\t\ti32.const 0\n"
+	} else {
+		body += "\t\tunreachable\n"
+	}
+	return body
+}
+
+// WebAssembly text format, generated before register allocation
+var WasmTarget Target = wasmTarget{}
+
+type wasmTarget struct{}
+
+func (wasmTarget) Name() string                                  { return "wasm" }
+func (wasmTarget) Description() string                           { return "WebAssembly text format" }
+func (wasmTarget) WordSize() int                                 { return 4 }
+func (wasmTarget) ArgumentRegisters() int                        { return 4 }
+func (wasmTarget) Registers() *RegisterFile                      { return nil }
+func (wasmTarget) OutputExtension() string                       { return ".wat" }
+func (wasmTarget) GenerateCode(ifCtx *IFContext) (string, error) { return GenerateWasmCode(ifCtx) }
+
+// GenerateWasmCode generates a WebAssembly text format module for a program
+// whose IF hasn't been register allocated. As with GenerateCode, an error is a
+// compiler bug.
+func GenerateWasmCode(ifCtx *IFContext) (string, error) {
+	ctx := new(wasmGeneratorContext)
+	ctx.target = WasmTarget
+	ctx.callees = make(map[string]int)
+	ctx.literals = make(map[string]int)
+	ctx.dataEnd = wasmDataStart
+
+	// Messages used by the runtime
+	messages := []string{}
+	for _, m := range wasmRuntimeMessages {
+		messages = append(messages, "{"+m[0]+"}", fmt.Sprint(ctx.literal(m[1])))
+	}
+	runtime := strings.NewReplacer(messages...).Replace(wasmRuntime)
+
+	type function struct {
+		name           string
+		body           string
+		registerParams int
+		stackParams    int
+	}
+	functions := []function{}
+	defined := make(map[string]bool)
+	for _, branch := range ifCtx.Branches() {
+		name := branch.Instr.(*LabelInstr).Label
+		body := ctx.generateFunction(branch, branch == ifCtx.main)
+		functions = append(functions, function{name, body, ctx.registerParams, ctx.stackParams})
+		defined[name] = true
+	}
+	if ctx.err != nil {
+		return "", ctx.err
+	}
+
+	code := ""
+	for _, f := range functions {
+		// Parameters after the fourth are numbered from the last, as on the
+		// stack
+		params := f.registerParams
+		if f.stackParams > 0 {
+			params = ctx.target.ArgumentRegisters() + f.stackParams
+		}
+		if ctx.callees[f.name] > params {
+			params = ctx.callees[f.name]
+		}
+		signature := "\t(func $" + f.name
+		if f.name == ifCtx.main.Instr.(*LabelInstr).Label {
+			signature += " (export \"main\")"
+		}
+		for k := 0; k < params; k++ {
+			if k < ctx.target.ArgumentRegisters() {
+				signature += fmt.Sprintf(" (param $arg%d i32)", k)
+			} else {
+				signature += fmt.Sprintf(" (param $stackarg%d i32)", params-1-k)
+			}
+		}
+		code += signature + " (result i32)\n" + f.body + "\t)\n\n"
+	}
+
+	// Functions defined elsewhere are imported from the environment
+	imports := ""
+	external := []string{}
+	for name := range ctx.callees {
+		if !defined[name] {
+			external = append(external, name)
+		}
+	}
+	sort.Strings(external)
+	for _, name := range external {
+		params := strings.Repeat(" i32", ctx.callees[name])
+		if params != "" {
+			params = " (param" + params + ")"
+		}
+		imports += fmt.Sprintf("\t(import \"env\" \"%s\" (func $%s%s (result i32)))\n", name, name, params)
+	}
+
+	pages := (ctx.dataEnd + wasmPageSize - 1) / wasmPageSize
+	data := fmt.Sprintf("\t(memory (export \"memory\") %d)\n", pages)
+	data += ctx.literalDefs
+	data += fmt.Sprintf("\t(global $_wacc_heap_top (mut i32) (i32.const %d))\n", ctx.dataEnd)
+
+	return "(module\n" + wasmHostImports + imports + "\n" + data + "\n" + runtime + "\n" + code + ")\n", nil
+}
+
+//
+// Runtime
+//
+
+// Messages printed by the runtime, and the names the runtime refers to them by
+var wasmRuntimeMessages = [][2]string{
+	{"true", "true"},
+	{"false", "false"},
+	{"out_of_memory", "OutOfMemoryError: the heap is full\n"},
+	{"overflow", "OverflowError: the result is too small/large to store in a 4-byte signed-integer.\n"},
+	{"null_reference", "NullReferenceError: dereference a null reference\n"},
+	{"negative_index", "ArrayIndexOutOfBoundsError: negative index\n"},
+	{"index_too_large", "ArrayIndexOutOfBoundsError: index too large\n"},
+	{"divide_by_zero", "DivideByZeroError: divide or modulo by zero\n"},
+}
+
+// Functions the host provides. Characters are Unicode code points, exit must
+// not return, and print_addr prints 0 as (nil).
+const wasmHostImports = `	(import "wacc" "print_int" (func $_wacc_print_int (param i32)))
+	(import "wacc" "print_float" (func $_wacc_print_float (param f32)))
+	(import "wacc" "print_char" (func $_wacc_print_char (param i32)))
+	(import "wacc" "print_addr" (func $_wacc_print_addr (param i32)))
+	(import "wacc" "read_int" (func $_wacc_read_int (result i32)))
+	(import "wacc" "read_char" (func $_wacc_read_char (result i32)))
+	(import "wacc" "exit" (func $_wacc_exit (param i32)))
+`
+
+const wasmRuntime = `	(func $_wacc_print_wstr (param $s i32)
+		(local $end i32)
+		local.get $s
+		local.get $s
+		i32.load
+		i32.const 4
+		i32.mul
+		i32.add
+		local.set $end
+		block $done
+		loop $next
+		local.get $s
+		local.get $end
+		i32.ge_u
+		br_if $done
+		local.get $s
+		i32.const 4
+		i32.add
+		local.tee $s
+		i32.load
+		call $_wacc_print_char
+		br $next
+		end
+		end
+	)
+
+	(func $_wacc_print_bool (param $b i32)
+		i32.const {true}
+		i32.const {false}
+		local.get $b
+		select
+		call $_wacc_print_wstr
+	)
+
+	(func $_wacc_throw_runtime_error (param $msg i32)
+		local.get $msg
+		call $_wacc_print_wstr
+		i32.const -1
+		call $_wacc_exit
+		unreachable
+	)
+
+	;; Blocks are preceded by their size, and freed blocks are kept in a list
+	;; threaded through their first word, starting at address 0. The first
+	;; block in the list which is big enough is reused, otherwise a new one
+	;; is taken from the top of the heap, growing the memory if needed.
+	(func $_wacc_malloc (param $size i32) (result i32)
+		(local $link i32)
+		(local $block i32)
+		local.get $size
+		i32.const 3
+		i32.add
+		i32.const -4
+		i32.and
+		local.set $size
+
+		block $new
+		loop $search
+		local.get $link
+		i32.load
+		local.tee $block
+		i32.eqz
+		br_if $new
+		local.get $block
+		i32.const 4
+		i32.sub
+		i32.load
+		local.get $size
+		i32.ge_u
+		if
+		local.get $link
+		local.get $block
+		i32.load
+		i32.store
+		local.get $block
+		return
+		end
+		local.get $block
+		local.set $link
+		br $search
+		end
+		end
+
+		global.get $_wacc_heap_top
+		i32.const 4
+		i32.add
+		local.get $size
+		i32.add
+		memory.size
+		i32.const 16
+		i32.shl
+		i32.gt_u
+		if
+		local.get $size
+		i32.const 4
+		i32.add
+		i32.const 16
+		i32.shr_u
+		i32.const 1
+		i32.add
+		memory.grow
+		i32.const -1
+		i32.eq
+		if
+		i32.const {out_of_memory}
+		call $_wacc_throw_runtime_error
+		end
+		end
+
+		global.get $_wacc_heap_top
+		local.get $size
+		i32.store
+		global.get $_wacc_heap_top
+		i32.const 4
+		i32.add
+		local.tee $block
+		local.get $size
+		i32.add
+		global.set $_wacc_heap_top
+		local.get $block
+	)
+
+	(func $_wacc_free (param $block i32)
+		local.get $block
+		i32.const 0
+		i32.load
+		i32.store
+		i32.const 0
+		local.get $block
+		i32.store
+	)
+
+	(func $_wacc_check_null_pointer (param $ptr i32)
+		local.get $ptr
+		i32.eqz
+		if
+		i32.const {null_reference}
+		call $_wacc_throw_runtime_error
+		end
+	)
+
+	(func $_wacc_check_array_bounds (param $index i32) (param $array i32)
+		local.get $array
+		call $_wacc_check_null_pointer
+		local.get $index
+		i32.const 0
+		i32.lt_s
+		if
+		i32.const {negative_index}
+		call $_wacc_throw_runtime_error
+		end
+		local.get $index
+		local.get $array
+		i32.load
+		i32.ge_s
+		if
+		i32.const {index_too_large}
+		call $_wacc_throw_runtime_error
+		end
+	)
+
+	(func $_wacc_check_divide_by_zero (param $divisor i32)
+		local.get $divisor
+		i32.eqz
+		if
+		i32.const {divide_by_zero}
+		call $_wacc_throw_runtime_error
+		end
+	)
+
+	;; Integer arithmetic, raising an error when the result doesn't fit
+	(func $_wacc_checked (param $result i64) (result i32)
+		local.get $result
+		local.get $result
+		i32.wrap_i64
+		i64.extend_i32_s
+		i64.ne
+		if
+		i32.const {overflow}
+		call $_wacc_throw_runtime_error
+		end
+		local.get $result
+		i32.wrap_i64
+	)
+
+	(func $_wacc_add (param $a i32) (param $b i32) (result i32)
+		local.get $a
+		i64.extend_i32_s
+		local.get $b
+		i64.extend_i32_s
+		i64.add
+		call $_wacc_checked
+	)
+
+	(func $_wacc_sub (param $a i32) (param $b i32) (result i32)
+		local.get $a
+		i64.extend_i32_s
+		local.get $b
+		i64.extend_i32_s
+		i64.sub
+		call $_wacc_checked
+	)
+
+	(func $_wacc_mul (param $a i32) (param $b i32) (result i32)
+		local.get $a
+		i64.extend_i32_s
+		local.get $b
+		i64.extend_i32_s
+		i64.mul
+		call $_wacc_checked
+	)
+
+	;; As __aeabi_idiv, dividing the smallest integer by -1 gives itself,
+	;; where i32.div_s would trap
+	(func $_wacc_div (param $a i32) (param $b i32) (result i32)
+		local.get $b
+		call $_wacc_check_divide_by_zero
+		local.get $b
+		i32.const -1
+		i32.eq
+		if
+		i32.const 0
+		local.get $a
+		i32.sub
+		return
+		end
+		local.get $a
+		local.get $b
+		i32.div_s
+	)
+
+	(func $_wacc_mod (param $a i32) (param $b i32) (result i32)
+		local.get $a
+		local.get $a
+		local.get $b
+		call $_wacc_div
+		local.get $b
+		call $_wacc_mul
+		call $_wacc_sub
+	)
+
+	;; Floats are kept as their bits
+	(func $_wacc_fadd (param $a i32) (param $b i32) (result i32)
+		local.get $a
+		f32.reinterpret_i32
+		local.get $b
+		f32.reinterpret_i32
+		f32.add
+		i32.reinterpret_f32
+	)
+
+	(func $_wacc_fsub (param $a i32) (param $b i32) (result i32)
+		local.get $a
+		f32.reinterpret_i32
+		local.get $b
+		f32.reinterpret_i32
+		f32.sub
+		i32.reinterpret_f32
+	)
+
+	(func $_wacc_fmul (param $a i32) (param $b i32) (result i32)
+		local.get $a
+		f32.reinterpret_i32
+		local.get $b
+		f32.reinterpret_i32
+		f32.mul
+		i32.reinterpret_f32
+	)
+
+	(func $_wacc_fdiv (param $a i32) (param $b i32) (result i32)
+		local.get $a
+		f32.reinterpret_i32
+		local.get $b
+		f32.reinterpret_i32
+		f32.div
+		i32.reinterpret_f32
+	)
+`
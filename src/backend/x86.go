@@ -0,0 +1,597 @@
+package backend
+
+import (
+	"fmt"
+	"math"
+
+	"../frontend"
+)
+
+// Code generation for x86-64 Linux, from the same register allocated IF as
+// the ARM generator.
+//
+// WACC values stay 32 bits wide, so everything is computed with the 32-bit
+// forms of the instructions, and the heap and data are laid out exactly as on
+// ARM. Pointers are therefore 32 bits too: programs must be linked with
+// -no-pie, and the runtime stops malloc from using mmap, which keeps every
+// address below 4GB.
+//
+// The registers of the IF map onto x86-64 registers as follows. r0-r3 are the
+// first four System V argument registers, so calls into WACC functions follow
+// the C calling convention for up to four arguments. Further arguments are
+// pushed in the same order as on ARM, one quadword each. Results come back in
+// eax, and are moved into r0 after each call. r4-r11 are saved by every WACC
+// function, as on ARM, and the runtime saves r8-r10 across calls into C.
+// rax and r11 are scratch registers.
+var x86Registers = [...]struct{ quad, long string }{
+	{"rdi", "edi"},
+	{"rsi", "esi"},
+	{"rdx", "edx"},
+	{"rcx", "ecx"},
+	{"rbx", "ebx"},
+	{"r12", "r12d"},
+	{"r13", "r13d"},
+	{"r14", "r14d"},
+	{"r15", "r15d"},
+	{"r8", "r8d"},
+	{"r9", "r9d"},
+	{"r10", "r10d"},
+}
+
+// Registers saved in the prologue of every function, in the order they are
+// pushed
+var x86SavedRegisters = []int{4, 5, 6, 7, 8, 9, 10, 11}
+
+type x86GeneratorContext struct {
+	target        Target
+	data          string
+	text          string
+	stackDistance int
+
+	// Stack reserved by each scope, innermost last
+	scopeSizes []int
+
+	currentFunction string
+
+	stageErrors
+}
+
+func (ctx *x86GeneratorContext) pushLabel(label string) {
+	ctx.text += fmt.Sprintf("%v:\n", label)
+}
+
+func (ctx *x86GeneratorContext) pushCode(s string, a ...interface{}) {
+	ctx.text += "\t" + fmt.Sprintf(s, a...) + "\n"
+}
+
+func x86Register(r *RegisterExpr) string {
+	return "%" + x86Registers[r.Id].long
+}
+
+// operand formats an expression as an AT&T operand holding a 32-bit value
+func (ctx *x86GeneratorContext) operand(e Expr) string {
+	switch e := e.(type) {
+	case *RegisterExpr:
+		return x86Register(e)
+
+	case *IntConstExpr:
+		return fmt.Sprintf("$%v", e.Value)
+
+	case *FloatConstExpr:
+		return fmt.Sprintf("$%v", math.Float32bits(e.Value))
+
+	case *BoolConstExpr:
+		if e.Value {
+			return "$1"
+		}
+		return "$0"
+
+	case *CharConstExpr:
+		return fmt.Sprintf("$%v", int(e.Value))
+
+	case *PointerConstExpr:
+		return fmt.Sprintf("$%v", e.Value)
+
+	case *LocationExpr:
+		return "$" + e.Label
+
+	case *MemExpr:
+		if e.Offset == 0 {
+			return fmt.Sprintf("(%%%v)", x86Registers[e.Address.Id].quad)
+		}
+		return fmt.Sprintf("%v(%%%v)", e.Offset, x86Registers[e.Address.Id].quad)
+
+	case *StackLocationExpr:
+		// Slots are counted down from the top of the stack space of the
+		// function, so the first one ends where that space ends
+		return fmt.Sprintf("%v(%%rsp)", ctx.stackDistance-ctx.target.WordSize()*(e.Id+1))
+
+	case *StackArgumentExpr:
+		// Skip the saved registers and the return address
+		saved := len(x86SavedRegisters) + 1
+		return fmt.Sprintf("%v(%%rsp)", ctx.stackDistance+(e.Id+saved)*8)
+
+	default:
+		ctx.fail("Unhandled operand type %T", e)
+		return "$0"
+	}
+}
+
+//
+// Instructions
+//
+func (ctx *x86GeneratorContext) generateInstr(instr Instr) {
+	switch i := instr.(type) {
+	case *NoOpInstr, *EvalInstr, *DeclareInstr:
+
+	case *LabelInstr:
+		ctx.pushLabel(i.Label)
+
+	case *ReadInstr:
+		if i.Type.Equals(frontend.BasicType{frontend.CHAR}) {
+			ctx.pushCode("call _wacc_read_char")
+		} else {
+			ctx.pushCode("call _wacc_read_int")
+		}
+		ctx.pushCode("movl %%eax, %v", ctx.operand(i.Dst))
+
+	case *FreeInstr:
+		ctx.pushCode("movl %v, %%edi", ctx.operand(i.Object))
+		ctx.pushCode("call " + RuntimeCheckNullPointerLabel)
+		ctx.pushCode("ccall free")
+
+	case *ReturnInstr:
+		ctx.pushCode("movl %v, %%edi", ctx.operand(i.Expr))
+		ctx.pushCode("addq $%v, %%rsp", ctx.stackDistance)
+		ctx.pushCode("jmp _" + ctx.currentFunction + "_end")
+
+	case *ExitInstr:
+		ctx.pushCode("movl %v, %%edi", ctx.operand(i.Expr))
+		ctx.pushCode("ccall exit")
+
+	case *PrintInstr:
+		ctx.generatePrint(i)
+
+	case *MoveInstr:
+		switch i.Dst.(type) {
+		case *MemExpr, *StackLocationExpr:
+			ctx.pushCode("movl %v, %v", x86Register(i.Src.(*RegisterExpr)), ctx.operand(i.Dst))
+
+		case *RegisterExpr:
+			ctx.pushCode("movl %v, %v", ctx.operand(i.Src), ctx.operand(i.Dst))
+
+		default:
+			ctx.fail("Unhandled dst type of mov %T", i.Dst)
+		}
+
+	case *NotInstr:
+		ctx.pushCode("movl %v, %%eax", ctx.operand(i.Src))
+		ctx.pushCode("notl %%eax")
+		ctx.pushCode("movl %%eax, %v", ctx.operand(i.Dst))
+
+	case *NegInstr:
+		ctx.pushCode("negl %v", ctx.operand(i.Expr))
+		ctx.pushCode("jo " + RuntimeOverflowLabel)
+
+	case *CmpInstr:
+		cc := map[string]string{EQ: "e", NE: "ne", LT: "l", GT: "g", LE: "le", GE: "ge"}[i.Operator]
+		ctx.pushCode("xorl %%eax, %%eax")
+		ctx.pushCode("cmpl %v, %v", ctx.operand(i.Right), ctx.operand(i.Left))
+		ctx.pushCode("set%s %%al", cc)
+		ctx.pushCode("movl %%eax, %v", ctx.operand(i.Dst))
+
+	case *JmpInstr:
+		ctx.pushCode("jmp %v", i.Dst.Instr.(*LabelInstr).Label)
+
+	case *JmpCondInstr:
+		if _, ok := i.Cond.(*RegisterExpr); !ok {
+			ctx.fail("condition is not a register, abort")
+			break
+		}
+		ctx.pushCode("cmpl $0, %v", ctx.operand(i.Cond))
+		ctx.pushCode("jne %v", i.Dst.Instr.(*LabelInstr).Label)
+
+	case *AddInstr:
+		ctx.generateArithmetic("add", i.Dst, i.Op1, i.Op2, i.Op2Shift, i.Type)
+
+	case *SubInstr:
+		ctx.generateArithmetic("sub", i.Dst, i.Op1, i.Op2, i.Op2Shift, i.Type)
+
+	case *MulInstr:
+		ctx.generateArithmetic("mul", i.Dst, i.Op1, i.Op2, nil, i.Type)
+
+	case *DivInstr:
+		if i.Type.Equals(frontend.BasicType{frontend.FLOAT}) {
+			ctx.generateArithmetic("div", i.Dst, i.Op1, i.Op2, nil, i.Type)
+		} else {
+			ctx.pushCode("movl %v, %%edi", ctx.operand(i.Op1))
+			ctx.pushCode("movl %v, %%esi", ctx.operand(i.Op2))
+			ctx.pushCode("call " + RuntimeCheckDivZeroLabel)
+			ctx.pushCode("call _wacc_idiv")
+			ctx.pushCode("movl %%eax, %v", ctx.operand(i.Dst))
+		}
+
+	case *AndInstr:
+		ctx.pushCode("movl %v, %%eax", ctx.operand(i.Op1))
+		ctx.pushCode("andl %v, %%eax", ctx.operand(i.Op2))
+		ctx.pushCode("movl %%eax, %v", ctx.operand(i.Dst))
+
+	case *OrInstr:
+		ctx.pushCode("movl %v, %%eax", ctx.operand(i.Op1))
+		ctx.pushCode("orl %v, %%eax", ctx.operand(i.Op2))
+		ctx.pushCode("movl %%eax, %v", ctx.operand(i.Dst))
+
+	case *PhiInstr:
+		ctx.fail("Phi instructions must be removed before code generation")
+
+	case *PushScopeInstr:
+		if i.StackSize > 0 {
+			ctx.pushCode("subq $%v, %%rsp", i.StackSize)
+		}
+		ctx.stackDistance += i.StackSize
+		ctx.scopeSizes = append(ctx.scopeSizes, i.StackSize)
+
+	case *PopScopeInstr:
+		ctx.stackDistance -= i.StackSize
+		ctx.scopeSizes = ctx.scopeSizes[:len(ctx.scopeSizes)-1]
+		if i.StackSize > 0 {
+			ctx.pushCode("addq $%v, %%rsp", i.StackSize)
+		}
+
+	case *UnwindScopesInstr:
+		size := 0
+		for _, s := range ctx.scopeSizes[len(ctx.scopeSizes)-i.Scopes:] {
+			size += s
+		}
+		if size > 0 {
+			ctx.pushCode("addq $%v, %%rsp", size)
+		}
+
+	case *CheckNullDereferenceInstr:
+		ctx.pushCode("pushq %%rdi")
+		ctx.pushCode("movl %v, %%edi", ctx.operand(i.Ptr))
+		ctx.pushCode("call " + RuntimeCheckNullPointerLabel)
+		ctx.pushCode("popq %%rdi")
+
+	case *CallInstr:
+		ctx.pushCode("call %v", i.Label.Label)
+		ctx.pushCode("movl %%eax, %%edi")
+
+	case *HeapAllocInstr:
+		ctx.pushCode("movl $%v, %%edi", i.Size)
+		ctx.pushCode("ccall malloc")
+		ctx.pushCode("movl %%eax, %v", ctx.operand(i.Dst))
+
+	case *PushInstr:
+		ctx.pushCode("pushq %%%v", x86Registers[i.Op.Id].quad)
+		ctx.stackDistance += 8
+
+	case *PopInstr:
+		ctx.stackDistance -= 8
+		ctx.pushCode("popq %%%v", x86Registers[i.Op.Id].quad)
+
+	case *LocaleInstr:
+		ctx.pushCode("call _wacc_init")
+
+	default:
+		ctx.fail("Unhandled instruction %T", instr)
+	}
+}
+
+// generateArithmetic computes dst = op1 <op> op2 in eax, so that dst may be
+// either operand. Integer operations raise an overflow error; float ones are
+// done in SSE registers.
+func (ctx *x86GeneratorContext) generateArithmetic(op string, dst, op1 *RegisterExpr, op2 Expr, shift Shift, t frontend.Type) {
+	if t.Equals(frontend.BasicType{frontend.FLOAT}) {
+		ctx.pushCode("movd %v, %%xmm0", ctx.operand(op1))
+		ctx.pushCode("movd %v, %%xmm1", ctx.operand(op2))
+		ctx.pushCode("%sss %%xmm1, %%xmm0", op)
+		ctx.pushCode("movd %%xmm0, %v", ctx.operand(dst))
+		return
+	}
+
+	instr := map[string]string{"add": "addl", "sub": "subl", "mul": "imull"}[op]
+	if shift != nil {
+		ctx.pushCode("movl %v, %%r11d", ctx.operand(op2))
+		ctx.pushCode("shll $%v, %%r11d", shift.(*LSL).Value)
+		op2 = nil
+	}
+	ctx.pushCode("movl %v, %%eax", ctx.operand(op1))
+	if op2 == nil {
+		ctx.pushCode("%s %%r11d, %%eax", instr)
+	} else {
+		ctx.pushCode("%s %v, %%eax", instr, ctx.operand(op2))
+	}
+	ctx.pushCode("jo " + RuntimeOverflowLabel)
+	ctx.pushCode("movl %%eax, %v", ctx.operand(dst))
+}
+
+func (ctx *x86GeneratorContext) generatePrint(i *PrintInstr) {
+	if v, ok := i.Expr.(*CharConstExpr); ok && v.Value == '\n' {
+		ctx.pushCode("call _wacc_print_nl")
+		return
+	}
+
+	switch obj := i.Expr.(type) {
+	case *IntConstExpr, *BoolConstExpr, *CharConstExpr, *LocationExpr, *RegisterExpr:
+		ctx.pushCode("movl %v, %%esi", ctx.operand(obj))
+
+	default:
+		ctx.fail("Cannot print an object of type %T", obj)
+	}
+
+	derivedType := i.Type
+	if derivedType.Equals(frontend.BasicType{frontend.INT}) {
+		ctx.pushCode("call _wacc_print_int")
+	} else if derivedType.Equals(frontend.BasicType{frontend.FLOAT}) {
+		ctx.pushCode("call _wacc_print_float")
+	} else if derivedType.Equals(frontend.BasicType{frontend.BOOL}) {
+		ctx.pushCode("call _wacc_print_bool")
+	} else if derivedType.Equals(frontend.BasicType{frontend.CHAR}) {
+		ctx.pushCode("call _wacc_print_char")
+	} else if derivedType.Equals(frontend.BasicType{frontend.STRING}) {
+		ctx.pushCode("call _wacc_print_wstr")
+	} else if derivedType.Equals(frontend.ArrayType{frontend.BasicType{frontend.CHAR}}) {
+		ctx.pushCode("call _wacc_print_wstr")
+	} else {
+		ctx.pushCode("call _wacc_print_addr")
+	}
+}
+
+func (ctx *x86GeneratorContext) generateData(ifCtx *IFContext) {
+	encodeRuneToUTF32 := func(r rune) string {
+		return fmt.Sprintf("\\%03o\\%03o\\%03o\\000", r%0x100, (r>>8)%0x100, (r>>16)%0x100)
+	}
+
+	for k, v := range ifCtx.dataStore {
+		wideString := ""
+		length := 0
+		for _, r := range v.Value {
+			wideString += encodeRuneToUTF32(r)
+			length += 1
+		}
+		ctx.data += fmt.Sprintf("%s:\n\t.long %v\n\t.ascii \"%s\"\n", k, length, wideString)
+	}
+}
+
+func (ctx *x86GeneratorContext) generateFunction(n *InstrNode) {
+	ctx.currentFunction = n.Instr.(*LabelInstr).Label
+	ctx.stage = "generating x86-64 code for " + ctx.currentFunction
+
+	ctx.generateInstr(n.Instr)
+	for _, r := range x86SavedRegisters {
+		ctx.pushCode("pushq %%%v", x86Registers[r].quad)
+	}
+
+	for node := n.Next; node != nil; node = node.Next {
+		ctx.generateInstr(node.Instr)
+	}
+
+	ctx.pushLabel("_" + ctx.currentFunction + "_end")
+	for k := len(x86SavedRegisters) - 1; k >= 0; k-- {
+		ctx.pushCode("popq %%%v", x86Registers[x86SavedRegisters[k]].quad)
+	}
+	ctx.pushCode("movl %%edi, %%eax")
+	ctx.pushCode("ret")
+}
+
+// The same numbering as on ARM, mapped by x86Registers: r0-r3 are the first
+// four argument registers, and temporaries and variables use rbx, r12-r15 and
+// r8-r10
+var x86RegisterFile = &RegisterFile{
+	Count:          len(x86Registers),
+	FirstTemporary: 4,
+	LastTemporary:  11,
+	FirstVariable:  8,
+	LastVariable:   11,
+}
+
+// x86-64 Linux, using the System V ABI
+var X86_64Target Target = x86Target{}
+
+type x86Target struct{}
+
+func (x86Target) Name() string                                  { return "x86_64-linux" }
+func (x86Target) Description() string                           { return "x86-64 Linux" }
+func (x86Target) WordSize() int                                 { return 4 }
+func (x86Target) ArgumentRegisters() int                        { return 4 }
+func (x86Target) Registers() *RegisterFile                      { return x86RegisterFile }
+func (x86Target) OutputExtension() string                       { return ".s" }
+func (x86Target) GenerateCode(ifCtx *IFContext) (string, error) { return GenerateX86Code(ifCtx) }
+
+// GenerateX86Code generates GNU assembler source for x86-64 Linux. As with
+// GenerateCode, an error is a compiler bug.
+func GenerateX86Code(ifCtx *IFContext) (string, error) {
+	ctx := new(x86GeneratorContext)
+	ctx.target = X86_64Target
+
+	ctx.data += x86RuntimeData
+	ctx.generateData(ifCtx)
+
+	for _, f := range ifCtx.functions {
+		ctx.text += fmt.Sprintf(".global %v\n", f.Instr.(*LabelInstr).Label)
+	}
+	ctx.text += ".global main\n"
+
+	for _, f := range ifCtx.functions {
+		ctx.generateFunction(f)
+	}
+	ctx.generateFunction(ifCtx.main)
+
+	if ctx.err != nil {
+		return "", ctx.err
+	}
+	return x86RuntimeMacros + ".data\n" + ctx.data + ".text\n" + ctx.text + x86RuntimeText +
+		"\t.section .note.GNU-stack,\"\",@progbits\n", nil
+}
+
+//
+// Runtime
+//
+
+// ccall calls a C function with the stack aligned to 16 bytes, keeping the
+// registers which WACC code expects to survive a call
+const x86RuntimeMacros = `.macro ccall function
+	pushq %r8
+	pushq %r9
+	pushq %r10
+	pushq %rbp
+	movq %rsp, %rbp
+	andq $-16, %rsp
+	call \function
+	movq %rbp, %rsp
+	popq %rbp
+	popq %r10
+	popq %r9
+	popq %r8
+.endm
+`
+
+const x86RuntimeData = `
+printf_fmt_int:
+	.ascii "%\000\000\000d\000\000\000\000\000\000\000"
+scanf_fmt_int:
+	.ascii "%\000\000\000d\000\000\000\000\000\000\000"
+printf_fmt_float:
+	.ascii "%\000\000\000f\000\000\000\000\000\000\000"
+printf_fmt_char:
+	.ascii "%\000\000\000l\000\000\000c\000\000\000\000\000\000\000"
+scanf_fmt_char:
+	.ascii " \000\000\000%\000\000\000l\000\000\000c\000\000\000\000\000\000\000"
+printf_fmt_str:
+	.ascii "%\000\000\000s\000\000\000\000\000\000\000"
+printf_fmt_wstr:
+	.ascii "%\000\000\000.\000\000\000*\000\000\000l\000\000\000s\000\000\000\000\000\000\000"
+printf_fmt_addr:
+	.ascii "%\000\000\000p\000\000\000\000\000\000\000"
+printf_true:
+	.asciz "true"
+printf_false:
+	.asciz "false"
+printf_nil:
+	.asciz "(nil)"
+_wacc_overflow_error_msg:
+	.asciz "OverflowError: the result is too small/large to store in a 4-byte signed-integer.\n"
+_wacc_divide_by_zero_msg:
+	.asciz "DivideByZeroError: divide or modulo by zero\n"
+_wacc_array_index_negative_msg:
+	.asciz "ArrayIndexOutOfBoundsError: negative index\n"
+_wacc_array_index_large_msg:
+	.asciz "ArrayIndexOutOfBoundsError: index too large\n"
+_wacc_null_dereference_msg:
+	.asciz "NullReferenceError: dereference a null reference\n"
+_wacc_null:
+	.ascii "\000"
+	.align 4
+_wacc_read_buffer:
+	.long 0
+`
+
+const x86RuntimeText = `
+_wacc_init:
+	movl $6, %edi
+	movl $_wacc_null, %esi
+	ccall setlocale
+	movl $-4, %edi
+	xorl %esi, %esi
+	ccall mallopt
+	ret
+` + RuntimeCheckArrayBoundsLabel + `:
+	testl %esi, %esi
+	jz _wacc_throw_null_dereference
+	movl (%rsi), %eax
+	cmpl $0, %edi
+	movl $_wacc_array_index_negative_msg, %esi
+	jl _wacc_throw_runtime_error
+	cmpl %eax, %edi
+	movl $_wacc_array_index_large_msg, %esi
+	jge _wacc_throw_runtime_error
+	ret
+` + RuntimeCheckDivZeroLabel + `:
+	cmpl $0, %esi
+	je _wacc_throw_divide_by_zero
+	ret
+_wacc_idiv:
+	movl %edi, %eax
+	cmpl $-1, %esi
+	je _wacc_idiv_negate
+	cltd
+	idivl %esi
+	ret
+_wacc_idiv_negate:
+	negl %eax
+	ret
+` + RuntimeOverflowLabel + `:
+	movl $_wacc_overflow_error_msg, %esi
+	jmp _wacc_throw_runtime_error
+_wacc_throw_divide_by_zero:
+	movl $_wacc_divide_by_zero_msg, %esi
+	jmp _wacc_throw_runtime_error
+` + RuntimeCheckNullPointerLabel + `:
+	testl %edi, %edi
+	jz _wacc_throw_null_dereference
+	ret
+_wacc_throw_null_dereference:
+	movl $_wacc_null_dereference_msg, %esi
+_wacc_throw_runtime_error:
+	call _wacc_print_str
+	movl $-1, %edi
+	ccall exit
+_wacc_read_int:
+	movl $scanf_fmt_int, %edi
+	jmp _wacc_read
+_wacc_read_char:
+	movl $scanf_fmt_char, %edi
+_wacc_read:
+	movl $0, _wacc_read_buffer
+	movl $_wacc_read_buffer, %esi
+	xorl %eax, %eax
+	ccall wscanf
+	movl _wacc_read_buffer, %eax
+	ret
+_wacc_print_bool:
+	testl %esi, %esi
+	movl $printf_true, %esi
+	jnz _wacc_print_str
+	movl $printf_false, %esi
+_wacc_print_str:
+	movl $printf_fmt_str, %edi
+	jmp _wacc_print
+_wacc_print_int:
+	movl $printf_fmt_int, %edi
+	jmp _wacc_print
+_wacc_print_char:
+	movl $printf_fmt_char, %edi
+	jmp _wacc_print
+_wacc_print_wstr:
+	movl %esi, %eax
+	leaq 4(%rax), %rdx
+	movl (%rax), %esi
+	movl $printf_fmt_wstr, %edi
+	jmp _wacc_print
+_wacc_print_addr:
+	movl $printf_fmt_addr, %edi
+	testl %esi, %esi
+	jnz _wacc_print
+	movl $printf_fmt_str, %edi
+	movl $printf_nil, %esi
+_wacc_print:
+	xorl %eax, %eax
+	ccall wprintf
+	xorl %edi, %edi
+	ccall fflush
+	ret
+_wacc_print_float:
+	movd %esi, %xmm0
+	cvtss2sd %xmm0, %xmm0
+	movl $printf_fmt_float, %edi
+	movl $1, %eax
+	ccall wprintf
+	xorl %edi, %edi
+	ccall fflush
+	ret
+_wacc_print_nl:
+	movl $10, %edi
+	ccall putwchar
+	ret
+`
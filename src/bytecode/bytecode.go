@@ -0,0 +1,417 @@
+// Package bytecode defines a compact register based bytecode for WACC
+// programs, its on-disk encoding, and a virtual machine which executes it.
+// Programs are compiled to bytecode by the backend from the IF, and the
+// machine behaves as the code produced by the ARM backend does: it prints the
+// same runtime errors and exits with the same codes.
+package bytecode
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+type Opcode uint8
+
+// Operands of an instruction are registers of the current frame (R), or
+// immediate values (I). Every value is a 32-bit word, and memory is addressed
+// in bytes, with words aligned to 4 bytes. Floats are kept as their bits.
+const (
+	OpNop Opcode = iota
+
+	OpConst // R[A] = B
+	OpMove  // R[A] = R[B]
+	OpParam // R[A] = argument B passed on the stack, numbered from the last
+	OpLoad  // R[A] = memory[R[B] + C]
+	OpStore // memory[R[A] + C] = R[B]
+	OpAlloc // R[A] = address of a new block of B bytes
+	OpFree  // Free the block at R[A]
+
+	// R[A] = R[B] op R[C]. Integer arithmetic raises an OverflowError if the
+	// result doesn't fit in 32 bits, and division by zero a
+	// DivideByZeroError.
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpMod
+	OpFAdd
+	OpFSub
+	OpFMul
+	OpFDiv
+	OpAnd
+	OpOr
+	OpEq
+	OpNe
+	OpLt
+	OpLe
+	OpGt
+	OpGe
+
+	OpNot // R[A] = R[B] ^ 1
+
+	OpCheckNull   // Raise a NullReferenceError if R[A] is null
+	OpCheckBounds // Check that R[B] is a valid index into the array R[A]
+
+	OpJmp   // Continue at instruction A
+	OpJmpIf // Continue at instruction B if R[A] is not zero
+
+	OpArg    // Pass R[A] as the next argument of a call
+	OpCall   // R[A] = result of calling function B with the arguments passed
+	OpReturn // Return R[A] to the caller
+	OpExit   // Exit with status R[A]
+
+	OpRead  // Read a value of kind B into R[A]
+	OpPrint // Print R[A] as kind B
+
+	opCount
+)
+
+// Kinds of value which can be read and printed
+const (
+	KindInt int32 = iota
+	KindFloat
+	KindBool
+	KindChar
+	KindString
+	KindAddress
+)
+
+type operandKind int
+
+const (
+	none operandKind = iota
+	register
+	immediate
+)
+
+type opcodeInfo struct {
+	name     string
+	operands [3]operandKind
+}
+
+var opcodes = [opcodeCount]opcodeInfo{
+	OpNop:         {"nop", [3]operandKind{}},
+	OpConst:       {"const", [3]operandKind{register, immediate}},
+	OpMove:        {"move", [3]operandKind{register, register}},
+	OpParam:       {"param", [3]operandKind{register, immediate}},
+	OpLoad:        {"load", [3]operandKind{register, register, immediate}},
+	OpStore:       {"store", [3]operandKind{register, register, immediate}},
+	OpAlloc:       {"alloc", [3]operandKind{register, immediate}},
+	OpFree:        {"free", [3]operandKind{register}},
+	OpAdd:         {"add", [3]operandKind{register, register, register}},
+	OpSub:         {"sub", [3]operandKind{register, register, register}},
+	OpMul:         {"mul", [3]operandKind{register, register, register}},
+	OpDiv:         {"div", [3]operandKind{register, register, register}},
+	OpMod:         {"mod", [3]operandKind{register, register, register}},
+	OpFAdd:        {"fadd", [3]operandKind{register, register, register}},
+	OpFSub:        {"fsub", [3]operandKind{register, register, register}},
+	OpFMul:        {"fmul", [3]operandKind{register, register, register}},
+	OpFDiv:        {"fdiv", [3]operandKind{register, register, register}},
+	OpAnd:         {"and", [3]operandKind{register, register, register}},
+	OpOr:          {"or", [3]operandKind{register, register, register}},
+	OpEq:          {"eq", [3]operandKind{register, register, register}},
+	OpNe:          {"ne", [3]operandKind{register, register, register}},
+	OpLt:          {"lt", [3]operandKind{register, register, register}},
+	OpLe:          {"le", [3]operandKind{register, register, register}},
+	OpGt:          {"gt", [3]operandKind{register, register, register}},
+	OpGe:          {"ge", [3]operandKind{register, register, register}},
+	OpNot:         {"not", [3]operandKind{register, register}},
+	OpCheckNull:   {"checknull", [3]operandKind{register}},
+	OpCheckBounds: {"checkbounds", [3]operandKind{register, register}},
+	OpJmp:         {"jmp", [3]operandKind{immediate}},
+	OpJmpIf:       {"jmpif", [3]operandKind{register, immediate}},
+	OpArg:         {"arg", [3]operandKind{register}},
+	OpCall:        {"call", [3]operandKind{register, immediate}},
+	OpReturn:      {"return", [3]operandKind{register}},
+	OpExit:        {"exit", [3]operandKind{register}},
+	OpRead:        {"read", [3]operandKind{register, immediate}},
+	OpPrint:       {"print", [3]operandKind{register, immediate}},
+}
+
+const opcodeCount = int(opCount)
+
+func (op Opcode) String() string {
+	if int(op) < opcodeCount {
+		return opcodes[op].name
+	}
+	return fmt.Sprintf("op%d", op)
+}
+
+type Instr struct {
+	Op      Opcode
+	A, B, C int32
+}
+
+// Operands of the instruction which are registers
+func (i *Instr) Registers() []*int32 {
+	regs := []*int32{}
+	operands := []*int32{&i.A, &i.B, &i.C}
+	for k, kind := range opcodes[i.Op].operands {
+		if kind == register {
+			regs = append(regs, operands[k])
+		}
+	}
+	return regs
+}
+
+func (i Instr) String() string {
+	s := i.Op.String()
+	for k, v := range []int32{i.A, i.B, i.C} {
+		switch opcodes[i.Op].operands[k] {
+		case register:
+			s += fmt.Sprintf(" r%d", v)
+		case immediate:
+			s += fmt.Sprintf(" %d", v)
+		}
+	}
+	return s
+}
+
+type Function struct {
+	Name string
+
+	// Size of the function's frame. The first four arguments are passed in
+	// r0-r3, and the rest on the stack.
+	Registers int
+
+	Code []Instr
+}
+
+type Program struct {
+	Functions []*Function
+
+	// Index of the function run first
+	Main int
+
+	// Initial contents of memory from DataStart, holding the string literals.
+	// The heap starts after them.
+	Data []int32
+}
+
+// Start of the string literals. Addresses below this are never allocated, so
+// that null is never a valid address.
+const DataStart = 8
+
+// Number of arguments a call passes in the first registers of the callee. The
+// rest are on its stack, where the caller pushed them.
+const ArgumentRegisters = 4
+
+// Disassembly of the program, for debugging
+func (p *Program) String() string {
+	s := fmt.Sprintf("data %v\n", p.Data)
+	for n, f := range p.Functions {
+		s += fmt.Sprintf("\nfunction %d %s (%d registers)\n", n, f.Name, f.Registers)
+		for pc, i := range f.Code {
+			s += fmt.Sprintf("%5d  %v\n", pc, i)
+		}
+	}
+	return s
+}
+
+//
+// Encoding
+//
+// A program is encoded as the magic number and version, followed by its
+// fields in order. Integers are encoded as varints, and strings and slices are
+// preceded by their length.
+//
+const (
+	magic   = "WACCBC"
+	version = 1
+)
+
+var ErrFormat = errors.New("bytecode: not a WACC bytecode file")
+
+type encoder struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (e *encoder) int(n int64) {
+	e.w.Write(e.buf[:binary.PutVarint(e.buf[:], n)])
+}
+
+func (e *encoder) string(s string) {
+	e.int(int64(len(s)))
+	e.w.WriteString(s)
+}
+
+// Encode writes the program to w
+func (p *Program) Encode(w io.Writer) error {
+	e := &encoder{w: bufio.NewWriter(w)}
+	e.w.WriteString(magic)
+	e.w.WriteByte(version)
+
+	e.int(int64(p.Main))
+	e.int(int64(len(p.Data)))
+	for _, word := range p.Data {
+		e.int(int64(word))
+	}
+
+	e.int(int64(len(p.Functions)))
+	for _, f := range p.Functions {
+		e.string(f.Name)
+		e.int(int64(f.Registers))
+		e.int(int64(len(f.Code)))
+		for _, i := range f.Code {
+			e.w.WriteByte(byte(i.Op))
+			for k, v := range []int32{i.A, i.B, i.C} {
+				if opcodes[i.Op].operands[k] != none {
+					e.int(int64(v))
+				}
+			}
+		}
+	}
+	return e.w.Flush()
+}
+
+type decoder struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (d *decoder) int() int64 {
+	if d.err != nil {
+		return 0
+	}
+	n, err := binary.ReadVarint(d.r)
+	if err != nil {
+		d.err = err
+	}
+	return n
+}
+
+// length reads the length of a string or slice. Each element takes at least a
+// byte, so the length can't be larger than what is left of the input.
+func (d *decoder) length() int {
+	n := d.int()
+	if d.err == nil && (n < 0 || n > int64(d.r.Len())) {
+		d.err = ErrFormat
+	}
+	if d.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) word() int32 {
+	n := d.int()
+	if d.err == nil && int64(int32(n)) != n {
+		d.err = ErrFormat
+	}
+	return int32(n)
+}
+
+func (d *decoder) string() string {
+	b := make([]byte, d.length())
+	if d.err == nil {
+		_, d.err = io.ReadFull(d.r, b)
+	}
+	return string(b)
+}
+
+// Decode reads a program written by Encode
+func Decode(r io.Reader) (*Program, error) {
+	input, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	d := &decoder{r: bytes.NewReader(input)}
+	header := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(d.r, header); err != nil || string(header[:len(magic)]) != magic {
+		return nil, ErrFormat
+	}
+	if header[len(magic)] != version {
+		return nil, fmt.Errorf("bytecode: unsupported version %d", header[len(magic)])
+	}
+
+	p := new(Program)
+	p.Main = int(d.word())
+	p.Data = make([]int32, d.length())
+	for k := range p.Data {
+		p.Data[k] = d.word()
+	}
+
+	p.Functions = make([]*Function, d.length())
+	for k := range p.Functions {
+		f := new(Function)
+		f.Name = d.string()
+		f.Registers = int(d.word())
+		f.Code = make([]Instr, d.length())
+		for pc := range f.Code {
+			op, err := d.r.ReadByte()
+			if err != nil && d.err == nil {
+				d.err = err
+			}
+			if int(op) >= opcodeCount && d.err == nil {
+				d.err = ErrFormat
+			}
+			if d.err != nil {
+				break
+			}
+
+			i := Instr{Op: Opcode(op)}
+			operands := []*int32{&i.A, &i.B, &i.C}
+			for n, kind := range opcodes[i.Op].operands {
+				if kind != none {
+					*operands[n] = d.word()
+				}
+			}
+			f.Code[pc] = i
+		}
+		p.Functions[k] = f
+	}
+
+	if d.err == io.EOF || d.err == io.ErrUnexpectedEOF {
+		return nil, ErrFormat
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if err := p.verify(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// verify checks that every register, jump and call in the program is in
+// range, so that the machine doesn't need to
+func (p *Program) verify() error {
+	if p.Main < 0 || p.Main >= len(p.Functions) {
+		return fmt.Errorf("bytecode: main function %d out of range", p.Main)
+	}
+	for _, f := range p.Functions {
+		if f.Registers < 4 {
+			return fmt.Errorf("bytecode: function %s has too few registers", f.Name)
+		}
+		for pc := range f.Code {
+			i := &f.Code[pc]
+			for _, r := range i.Registers() {
+				if *r < 0 || int(*r) >= f.Registers {
+					return fmt.Errorf("bytecode: register out of range in %s at %d: %v", f.Name, pc, *i)
+				}
+			}
+
+			switch i.Op {
+			case OpJmp:
+				if i.A < 0 || int(i.A) >= len(f.Code) {
+					return fmt.Errorf("bytecode: jump out of range in %s at %d", f.Name, pc)
+				}
+			case OpJmpIf:
+				if i.B < 0 || int(i.B) >= len(f.Code) {
+					return fmt.Errorf("bytecode: jump out of range in %s at %d", f.Name, pc)
+				}
+			case OpCall:
+				if i.B < 0 || int(i.B) >= len(p.Functions) {
+					return fmt.Errorf("bytecode: call out of range in %s at %d", f.Name, pc)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package bytecode
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Calls a function adding its two arguments and prints the result
+func testProgram() *Program {
+	return &Program{
+		Main: 1,
+		Data: []int32{3, 'a', -1, 1<<31 - 1, -1 << 31},
+		Functions: []*Function{
+			{
+				Name:      "f_add",
+				Registers: 4,
+				Code: []Instr{
+					{Op: OpAdd, A: 0, B: 0, C: 1},
+					{Op: OpReturn, A: 0},
+				},
+			},
+			{
+				Name:      "main",
+				Registers: 6,
+				Code: []Instr{
+					{Op: OpConst, A: 4, B: 40},
+					{Op: OpConst, A: 5, B: -38},
+					{Op: OpJmpIf, A: 5, B: 4},
+					{Op: OpNop},
+					{Op: OpArg, A: 4},
+					{Op: OpArg, A: 5},
+					{Op: OpCall, A: 0, B: 0},
+					{Op: OpPrint, A: 0, B: KindInt},
+					{Op: OpExit, A: 0},
+				},
+			},
+		},
+	}
+}
+
+func encode(t *testing.T, p *Program) []byte {
+	var buf bytes.Buffer
+	if err := p.Encode(&buf); err != nil {
+		t.Fatalf("Encode returned %v", err)
+	}
+	return buf.Bytes()
+}
+
+// Encodes a file field by field, for files Encode can't produce
+func encodeRaw(fields func(e *encoder)) []byte {
+	var buf bytes.Buffer
+	e := &encoder{w: bufio.NewWriter(&buf)}
+	e.w.WriteString(magic)
+	e.w.WriteByte(version)
+	fields(e)
+	e.w.Flush()
+	return buf.Bytes()
+}
+
+func TestEncodeDecode(t *testing.T) {
+	p := testProgram()
+	decoded, err := Decode(bytes.NewReader(encode(t, p)))
+	if err != nil {
+		t.Fatalf("Decode returned %v", err)
+	}
+	if !reflect.DeepEqual(decoded, p) {
+		t.Errorf("Decode returned\n%v\nwant\n%v", decoded, p)
+	}
+
+	var stdout bytes.Buffer
+	code, err := Run(decoded, strings.NewReader(""), &stdout)
+	if err != nil {
+		t.Fatalf("Run returned %v", err)
+	}
+	if code != 2 || stdout.String() != "2" {
+		t.Errorf("Run printed %q and exited with %v, want \"2\" and 2", stdout.String(), code)
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	encoded := encode(t, testProgram())
+	for n := 0; n < len(encoded); n++ {
+		if _, err := Decode(bytes.NewReader(encoded[:n])); err != ErrFormat {
+			t.Errorf("Decode of the first %d of %d bytes returned %v, want ErrFormat", n, len(encoded), err)
+		}
+	}
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	badMagic := encode(t, testProgram())
+	badMagic[0] = 'X'
+
+	badVersion := encode(t, testProgram())
+	badVersion[len(magic)] = version + 1
+
+	outOfRange := func(modify func(p *Program)) []byte {
+		p := testProgram()
+		modify(p)
+		return encode(t, p)
+	}
+	function := func(code ...Instr) func(e *encoder) {
+		return func(e *encoder) {
+			e.int(0)
+			e.int(0)
+			e.int(1)
+			e.string("main")
+			e.int(4)
+			e.int(int64(len(code)))
+			for _, i := range code {
+				e.w.WriteByte(byte(i.Op))
+				e.int(int64(i.A))
+			}
+		}
+	}
+
+	tests := []struct {
+		name    string
+		encoded []byte
+		err     string
+	}{
+		{"empty file", nil, ErrFormat.Error()},
+		{"bad magic number", badMagic, ErrFormat.Error()},
+		{"unsupported version", badVersion, "unsupported version"},
+		{"unknown opcode", encodeRaw(function(Instr{Op: opCount})), ErrFormat.Error()},
+		{"data longer than the file", encodeRaw(func(e *encoder) {
+			e.int(0)
+			e.int(1 << 40)
+		}), ErrFormat.Error()},
+		{"name longer than the file", encodeRaw(func(e *encoder) {
+			e.int(0)
+			e.int(0)
+			e.int(1)
+			e.int(1000)
+		}), ErrFormat.Error()},
+		{"negative length", encodeRaw(func(e *encoder) {
+			e.int(0)
+			e.int(-1)
+		}), ErrFormat.Error()},
+		{"word out of range", encodeRaw(func(e *encoder) {
+			e.int(0)
+			e.int(1)
+			e.int(1 << 32)
+		}), ErrFormat.Error()},
+		{"main out of range", outOfRange(func(p *Program) { p.Main = 2 }), "main function 2 out of range"},
+		{"too few registers", outOfRange(func(p *Program) { p.Functions[0].Registers = 3 }), "too few registers"},
+		{"register out of range", outOfRange(func(p *Program) {
+			p.Functions[1].Code[0].A = 6
+		}), "register out of range"},
+		{"jump out of range", outOfRange(func(p *Program) {
+			p.Functions[1].Code[2].B = 9
+		}), "jump out of range"},
+		{"call out of range", outOfRange(func(p *Program) {
+			p.Functions[1].Code[6].B = -1
+		}), "call out of range"},
+	}
+
+	for _, test := range tests {
+		p, err := Decode(bytes.NewReader(test.encoded))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: Decode returned %v, want an error containing %q", test.name, err, test.err)
+		}
+		if p != nil {
+			t.Errorf("%s: Decode returned a program", test.name)
+		}
+	}
+}
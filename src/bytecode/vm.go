@@ -0,0 +1,432 @@
+package bytecode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Messages printed by the runtime before exiting, as in the ARM runtime
+const (
+	OVERFLOW_MSG       = "OverflowError: the result is too small/large to store in a 4-byte signed-integer.\n"
+	DIVIDE_BY_ZERO_MSG = "DivideByZeroError: divide or modulo by zero\n"
+	NEGATIVE_INDEX_MSG = "ArrayIndexOutOfBoundsError: negative index\n"
+	LARGE_INDEX_MSG    = "ArrayIndexOutOfBoundsError: index too large\n"
+	NULL_REFERENCE_MSG = "NullReferenceError: dereference a null reference\n"
+	OUT_OF_MEMORY_MSG  = "OutOfMemoryError: the heap is full\n"
+)
+
+// The runtime library calls exit(-1) on a runtime error
+const RUNTIME_ERROR = 255
+
+// Largest amount of memory a program can use
+const MemorySize = 1 << 26
+
+// Used to unwind the machine when the program terminates
+type exitStatus struct {
+	code int
+}
+
+type machine struct {
+	program *Program
+
+	// Memory, as words. Blocks on the heap are preceded by their size, and
+	// freed blocks are kept in a list threaded through their first word.
+	memory   []int32
+	freeList int32
+
+	// Arguments passed for the next call
+	args []int32
+
+	stdin  *bufio.Reader
+	stdout *bufio.Writer
+}
+
+// Run executes a program, reading from stdin and writing to stdout. It returns
+// the program's exit code. An error is only returned if the program is
+// malformed, for example because it accesses memory it never allocated.
+func Run(program *Program, stdin io.Reader, stdout io.Writer) (code int, err error) {
+	if err := program.verify(); err != nil {
+		return 0, err
+	}
+
+	m := &machine{
+		program: program,
+		memory:  make([]int32, DataStart/4, DataStart/4+len(program.Data)),
+		stdin:   bufio.NewReader(stdin),
+		stdout:  bufio.NewWriter(stdout),
+	}
+	m.memory = append(m.memory, program.Data...)
+
+	defer func() {
+		m.stdout.Flush()
+		if r := recover(); r != nil {
+			switch r := r.(type) {
+			case exitStatus:
+				code = r.code
+			case error:
+				code, err = 0, r
+			default:
+				panic(r)
+			}
+		}
+	}()
+
+	m.call(program.Functions[program.Main], nil)
+	return 0, nil
+}
+
+// throw prints a runtime error and terminates the program
+func (m *machine) throw(msg string) {
+	fmt.Fprint(m.stdout, msg)
+	panic(exitStatus{RUNTIME_ERROR})
+}
+
+//
+// Memory
+//
+func (m *machine) word(address, offset int32) *int32 {
+	a := int64(address) + int64(offset)
+	if a < DataStart || a%4 != 0 || a/4 >= int64(len(m.memory)) {
+		panic(fmt.Errorf("bytecode: invalid memory access at 0x%x", a))
+	}
+	return &m.memory[a/4]
+}
+
+func (m *machine) alloc(size int32) int32 {
+	size = (size + 3) &^ 3
+
+	// Reuse the first freed block which is big enough
+	link := &m.freeList
+	for block := *link; block != 0; block = *link {
+		if *m.word(block, -4) >= size {
+			*link = *m.word(block, 0)
+			return block
+		}
+		link = m.word(block, 0)
+	}
+
+	if int64(len(m.memory))*4+4+int64(size) > MemorySize {
+		m.throw(OUT_OF_MEMORY_MSG)
+	}
+	block := int32(len(m.memory)*4 + 4)
+	m.memory = append(m.memory, size)
+	m.memory = append(m.memory, make([]int32, size/4)...)
+	return block
+}
+
+func (m *machine) free(block int32) {
+	*m.word(block, 0) = m.freeList
+	m.freeList = block
+}
+
+//
+// Arithmetic, raising an error when the result doesn't fit
+//
+func (m *machine) checked(result int64) int32 {
+	if result < math.MinInt32 || result > math.MaxInt32 {
+		m.throw(OVERFLOW_MSG)
+	}
+	return int32(result)
+}
+
+// As __aeabi_idiv, dividing the smallest integer by -1 gives itself
+func (m *machine) div(a, b int32) int32 {
+	if b == 0 {
+		m.throw(DIVIDE_BY_ZERO_MSG)
+	}
+	if b == -1 {
+		return -a
+	}
+	return a / b
+}
+
+func float(bits int32) float32 {
+	return math.Float32frombits(uint32(bits))
+}
+
+func bits(f float32) int32 {
+	return int32(math.Float32bits(f))
+}
+
+func boolean(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+//
+// Execution
+//
+func (m *machine) call(f *Function, args []int32) int32 {
+	r := make([]int32, f.Registers)
+	var stackArgs []int32
+	if len(args) > ArgumentRegisters {
+		copy(r, args[:ArgumentRegisters])
+		stackArgs = args[ArgumentRegisters:]
+	} else {
+		copy(r, args)
+	}
+
+	code := f.Code
+	pc := 0
+	for pc < len(code) {
+		i := &code[pc]
+		pc++
+
+		switch i.Op {
+		case OpNop:
+
+		case OpConst:
+			r[i.A] = i.B
+
+		case OpMove:
+			r[i.A] = r[i.B]
+
+		case OpParam:
+			// Stack arguments are numbered from the last, as pushed
+			n := len(stackArgs) - 1 - int(i.B)
+			if n < 0 || n >= len(stackArgs) {
+				panic(fmt.Errorf("bytecode: %s reads missing argument %d", f.Name, i.B))
+			}
+			r[i.A] = stackArgs[n]
+
+		case OpLoad:
+			r[i.A] = *m.word(r[i.B], i.C)
+
+		case OpStore:
+			*m.word(r[i.A], i.C) = r[i.B]
+
+		case OpAlloc:
+			r[i.A] = m.alloc(i.B)
+
+		case OpFree:
+			if r[i.A] == 0 {
+				m.throw(NULL_REFERENCE_MSG)
+			}
+			m.free(r[i.A])
+
+		case OpAdd:
+			r[i.A] = m.checked(int64(r[i.B]) + int64(r[i.C]))
+
+		case OpSub:
+			r[i.A] = m.checked(int64(r[i.B]) - int64(r[i.C]))
+
+		case OpMul:
+			r[i.A] = m.checked(int64(r[i.B]) * int64(r[i.C]))
+
+		case OpDiv:
+			r[i.A] = m.div(r[i.B], r[i.C])
+
+		case OpMod:
+			a, b := r[i.B], r[i.C]
+			r[i.A] = m.checked(int64(a) - int64(m.checked(int64(m.div(a, b))*int64(b))))
+
+		case OpFAdd:
+			r[i.A] = bits(float(r[i.B]) + float(r[i.C]))
+
+		case OpFSub:
+			r[i.A] = bits(float(r[i.B]) - float(r[i.C]))
+
+		case OpFMul:
+			r[i.A] = bits(float(r[i.B]) * float(r[i.C]))
+
+		case OpFDiv:
+			r[i.A] = bits(float(r[i.B]) / float(r[i.C]))
+
+		case OpAnd:
+			r[i.A] = r[i.B] & r[i.C]
+
+		case OpOr:
+			r[i.A] = r[i.B] | r[i.C]
+
+		case OpEq:
+			r[i.A] = boolean(r[i.B] == r[i.C])
+
+		case OpNe:
+			r[i.A] = boolean(r[i.B] != r[i.C])
+
+		case OpLt:
+			r[i.A] = boolean(r[i.B] < r[i.C])
+
+		case OpLe:
+			r[i.A] = boolean(r[i.B] <= r[i.C])
+
+		case OpGt:
+			r[i.A] = boolean(r[i.B] > r[i.C])
+
+		case OpGe:
+			r[i.A] = boolean(r[i.B] >= r[i.C])
+
+		case OpNot:
+			r[i.A] = r[i.B] ^ 1
+
+		case OpCheckNull:
+			if r[i.A] == 0 {
+				m.throw(NULL_REFERENCE_MSG)
+			}
+
+		case OpCheckBounds:
+			if r[i.A] == 0 {
+				m.throw(NULL_REFERENCE_MSG)
+			}
+			if r[i.B] < 0 {
+				m.throw(NEGATIVE_INDEX_MSG)
+			}
+			if r[i.B] >= *m.word(r[i.A], 0) {
+				m.throw(LARGE_INDEX_MSG)
+			}
+
+		case OpJmp:
+			pc = int(i.A)
+
+		case OpJmpIf:
+			if r[i.A] != 0 {
+				pc = int(i.B)
+			}
+
+		case OpArg:
+			m.args = append(m.args, r[i.A])
+
+		case OpCall:
+			callee := m.program.Functions[i.B]
+			args := m.args
+			m.args = nil
+			r[i.A] = m.call(callee, args)
+
+		case OpReturn:
+			return r[i.A]
+
+		case OpExit:
+			panic(exitStatus{int(uint8(r[i.A]))})
+
+		case OpRead:
+			switch i.B {
+			case KindInt:
+				r[i.A] = m.readInt()
+			case KindChar:
+				r[i.A] = m.readChar()
+			default:
+				panic(fmt.Errorf("bytecode: cannot read values of kind %d", i.B))
+			}
+
+		case OpPrint:
+			m.print(r[i.A], i.B)
+		}
+	}
+
+	if f != m.program.Functions[m.program.Main] {
+		panic(fmt.Errorf("bytecode: %s ended without returning", f.Name))
+	}
+	return 0
+}
+
+//
+// Output, formatted as the runtime library formats it
+//
+func (m *machine) print(v int32, kind int32) {
+	switch kind {
+	case KindInt:
+		fmt.Fprintf(m.stdout, "%d", v)
+
+	case KindFloat:
+		fmt.Fprintf(m.stdout, "%f", float64(float(v)))
+
+	case KindBool:
+		fmt.Fprintf(m.stdout, "%v", v != 0)
+
+	case KindChar:
+		m.stdout.WriteRune(rune(v))
+
+	case KindString:
+		if v == 0 {
+			m.throw(NULL_REFERENCE_MSG)
+		}
+		length := *m.word(v, 0)
+		for k := int32(1); k <= length; k++ {
+			// %ls stops at the terminating null character
+			c := *m.word(v, 4*k)
+			if c == 0 {
+				break
+			}
+			m.stdout.WriteRune(rune(c))
+		}
+
+	case KindAddress:
+		if v == 0 {
+			fmt.Fprint(m.stdout, "(nil)")
+		} else {
+			fmt.Fprintf(m.stdout, "0x%x", uint32(v))
+		}
+
+	default:
+		panic(fmt.Errorf("bytecode: cannot print values of kind %d", kind))
+	}
+}
+
+//
+// Input, parsed as wscanf parses it. On failure the destination is set to
+// zero, as the generated code does.
+//
+func (m *machine) skipSpace() {
+	for {
+		r, _, err := m.stdin.ReadRune()
+		if err != nil {
+			return
+		}
+		if r != ' ' && r != '\t' && r != '\n' && r != '\r' && r != '\v' && r != '\f' {
+			m.stdin.UnreadRune()
+			return
+		}
+	}
+}
+
+func (m *machine) readInt() int32 {
+	m.skipSpace()
+
+	digits := ""
+	if r, _, err := m.stdin.ReadRune(); err == nil {
+		if r == '-' || r == '+' || (r >= '0' && r <= '9') {
+			digits += string(r)
+		} else {
+			m.stdin.UnreadRune()
+		}
+	}
+	for {
+		r, _, err := m.stdin.ReadRune()
+		if err != nil {
+			break
+		}
+		if r < '0' || r > '9' {
+			m.stdin.UnreadRune()
+			break
+		}
+		digits += string(r)
+	}
+
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		if numErr, ok := err.(*strconv.NumError); !ok || numErr.Err != strconv.ErrRange {
+			return 0
+		}
+	}
+	if n > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	if n < math.MinInt32 {
+		return math.MinInt32
+	}
+	return int32(n)
+}
+
+func (m *machine) readChar() int32 {
+	m.skipSpace()
+	r, _, err := m.stdin.ReadRune()
+	if err != nil {
+		return 0
+	}
+	return int32(r)
+}
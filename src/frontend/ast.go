@@ -129,6 +129,15 @@ type AssignStmt struct {
 	Right Expr
 }
 
+// Left Operator= Right, which works out the location of Left only once
+type CompoundAssignStmt struct {
+	Left        LValueExpr
+	OperatorPos *Position
+	Operator    string // The arithmetic operator, without the '='
+	Right       Expr
+	Type        Type
+}
+
 type ReadStmt struct {
 	Read *Position
 	Dst  LValueExpr
@@ -172,6 +181,35 @@ type WhileStmt struct {
 	Done  *Position
 }
 
+// The variable declared by Init is only in scope inside the loop
+type ForStmt struct {
+	For  *Position
+	Init *DeclStmt
+	Cond Expr
+	Step Stmt
+	Body []Stmt
+	Done *Position
+}
+
+// Runs the body once for each element of an array or character of a string,
+// declared in the loop's scope as Ident
+type ForEachStmt struct {
+	For        *Position
+	Type       Type
+	Ident      *IdentExpr
+	Collection Expr
+	Body       []Stmt
+	Done       *Position
+}
+
+type BreakStmt struct {
+	Break *Position // position of "break" keyword
+}
+
+type ContinueStmt struct {
+	Continue *Position // position of "continue" keyword
+}
+
 type ScopeStmt struct {
 	BeginPos *Position
 	Body     []Stmt
@@ -511,6 +549,14 @@ func (s AssignStmt) Repr() string {
 	return fmt.Sprintf("Assign(%v, %v)", s.Left.Repr(), s.Right.Repr())
 }
 
+// Compound Assign Statement
+func (CompoundAssignStmt) stmtNode()        {}
+func (s CompoundAssignStmt) Pos() *Position { return s.Left.Pos() }
+func (s CompoundAssignStmt) End() *Position { return s.Right.Pos().End() }
+func (s CompoundAssignStmt) Repr() string {
+	return fmt.Sprintf("CompoundAssign(%v, %v=, %v)", s.Left.Repr(), s.Operator, s.Right.Repr())
+}
+
 // Read Statement
 func (ReadStmt) stmtNode()        {}
 func (s ReadStmt) Pos() *Position { return s.Read }
@@ -586,6 +632,42 @@ func (s WhileStmt) Repr() string {
 	return fmt.Sprintf("While(%v)Do(%v)", s.Cond.Repr(), ReprNodes(s.Body))
 }
 
+// For Statement
+func (ForStmt) stmtNode()        {}
+func (s ForStmt) Pos() *Position { return s.For }
+func (s ForStmt) End() *Position {
+	return s.Done.End()
+}
+func (s ForStmt) Repr() string {
+	return fmt.Sprintf("For(%v; %v; %v)Do(%v)", s.Init.Repr(), s.Cond.Repr(), s.Step.Repr(), ReprNodes(s.Body))
+}
+
+// For Each Statement
+func (ForEachStmt) stmtNode()        {}
+func (s ForEachStmt) Pos() *Position { return s.For }
+func (s ForEachStmt) End() *Position {
+	return s.Done.End()
+}
+func (s ForEachStmt) Repr() string {
+	return fmt.Sprintf("ForEach(%v %v In %v)Do(%v)", s.Type.Repr(), s.Ident.Repr(), s.Collection.Repr(), ReprNodes(s.Body))
+}
+
+// Break Statement
+func (BreakStmt) stmtNode()        {}
+func (s BreakStmt) Pos() *Position { return s.Break }
+func (s BreakStmt) End() *Position {
+	return s.Break.End()
+}
+func (s BreakStmt) Repr() string { return "Break" }
+
+// Continue Statement
+func (ContinueStmt) stmtNode()        {}
+func (s ContinueStmt) Pos() *Position { return s.Continue }
+func (s ContinueStmt) End() *Position {
+	return s.Continue.End()
+}
+func (s ContinueStmt) Repr() string { return "Continue" }
+
 // Scope Statement
 func (ScopeStmt) stmtNode()        {}
 func (s ScopeStmt) Pos() *Position { return s.BeginPos }
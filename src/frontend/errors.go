@@ -16,6 +16,7 @@ const POINTER_LINE_CHAR = '~'
 const POINTER_POINTER_CHAR = '^'
 
 var ERROR_COLOUR = ansi.ColorCode("red+h")
+var WARNING_COLOUR = ansi.ColorCode("magenta+h")
 var LINE_COLOUR = ansi.ColorCode("reset")
 var BAD_LINE_COLOUR = ansi.ColorCode("yellow")
 var POINTER_COLOUR = ansi.ColorCode("reset")
@@ -23,42 +24,93 @@ var RESET = ansi.ColorCode("reset")
 
 const CONTEXT_TO_PRINT = 2
 
-func SyntaxError(position *Position, s string, a ...interface{}) {
-	errorStr := fmt.Sprintf(s, a...)
-	fmt.Print(ERROR_COLOUR)
-	fmt.Printf("%v:%v:%v: syntax error: %v\n", position.Name(), position.Line(), position.Column(), errorStr)
-	dumpLineData(position)
-	fmt.Print(RESET)
-}
+const (
+	SEVERITY_ERROR = iota
+	SEVERITY_WARNING
+)
 
-func SemanticError(position *Position, s string, a ...interface{}) {
-	errorStr := fmt.Sprintf(s, a...)
-	fmt.Print(ERROR_COLOUR)
-	fmt.Printf("%v:%v:%v: semantic error: %v\n", position.Name(), position.Line(), position.Column(), errorStr)
-	dumpLineData(position)
-	fmt.Print(RESET)
+//
+// Diagnostics
+//
+type Diagnostic struct {
+	Position *Position
+	Severity int
+	Kind     string // e.g. "syntax error"
+	Message  string
+
+	// File containing the position, if it is known
+	source *SourceFile
 }
 
-var errBuffer []string
+func (d *Diagnostic) Error() string {
+	return fmt.Sprintf("%v:%v:%v: %v: %v",
+		d.Position.Name(), d.Position.Line(), d.Position.Column(), d.Kind, d.Message)
+}
 
-func SetUpErrorOutput(r io.Reader) io.Reader {
-	// we need to read the entire set of lines into a buffer so we can do
-	// pretty error output
+// Pretty renders the diagnostic in colour, followed by the lines of source
+// surrounding it
+func (d *Diagnostic) Pretty() string {
 	buf := new(bytes.Buffer)
-	if _, err := buf.ReadFrom(r); err != nil {
-		panic(err)
+	if d.Severity == SEVERITY_WARNING {
+		fmt.Fprint(buf, WARNING_COLOUR)
+	} else {
+		fmt.Fprint(buf, ERROR_COLOUR)
 	}
+	fmt.Fprintln(buf, d.Error())
+	if d.source != nil {
+		dumpLineData(buf, d.source.Lines(), d.Position)
+	}
+	fmt.Fprint(buf, RESET)
+	return buf.String()
+}
 
-	strdata := string(buf.Bytes())
-	errBuffer = strings.Split(strings.Replace(strdata, "\t", " ", -1), "\n")
+type Diagnostics struct {
+	sources  *SourceManager
+	list     []*Diagnostic
+	errCount int
+}
+
+func NewDiagnostics(sources *SourceManager) *Diagnostics {
+	return &Diagnostics{sources: sources}
+}
+
+func (d *Diagnostics) add(position *Position, severity int, kind string, s string, a ...interface{}) {
+	d.list = append(d.list, &Diagnostic{
+		Position: position,
+		Severity: severity,
+		Kind:     kind,
+		Message:  fmt.Sprintf(s, a...),
+		source:   d.sources.File(position.File()),
+	})
+	if severity == SEVERITY_ERROR {
+		d.errCount++
+	}
+}
+
+func (d *Diagnostics) SyntaxError(position *Position, s string, a ...interface{}) {
+	d.add(position, SEVERITY_ERROR, "syntax error", s, a...)
+}
+
+func (d *Diagnostics) SemanticError(position *Position, s string, a ...interface{}) {
+	d.add(position, SEVERITY_ERROR, "semantic error", s, a...)
+}
+
+func (d *Diagnostics) Warning(position *Position, s string, a ...interface{}) {
+	d.add(position, SEVERITY_WARNING, "warning", s, a...)
+}
+
+func (d *Diagnostics) List() []*Diagnostic {
+	return d.list
+}
 
-	return buf
+func (d *Diagnostics) HasErrors() bool {
+	return d.errCount > 0
 }
 
-func dumpLineData(position *Position) {
+func dumpLineData(w io.Writer, lines []string, position *Position) {
 	lineToPrint := position.Line() - 1
 
-	if lineToPrint < 0 || len(errBuffer) <= lineToPrint {
+	if lineToPrint < 0 || len(lines) <= lineToPrint {
 		return
 	}
 
@@ -66,21 +118,21 @@ func dumpLineData(position *Position) {
 		if currentLine < 0 {
 			continue
 		}
-		fmt.Println(LINE_COLOUR + errBuffer[currentLine])
+		fmt.Fprintln(w, LINE_COLOUR+lines[currentLine])
 	}
 
-	fmt.Println(BAD_LINE_COLOUR + errBuffer[lineToPrint])
+	fmt.Fprintln(w, BAD_LINE_COLOUR+lines[lineToPrint])
 
 	dashes := strings.Repeat(string(POINTER_LINE_CHAR), position.Column()-1)
 	caret := string(POINTER_POINTER_CHAR)
-	fmt.Println(POINTER_COLOUR + dashes + caret)
+	fmt.Fprintln(w, POINTER_COLOUR+dashes+caret)
 
 	for currentLine := lineToPrint + 1; currentLine <= lineToPrint+CONTEXT_TO_PRINT; currentLine += 1 {
-		if currentLine >= len(errBuffer) {
+		if currentLine >= len(lines) {
 			continue
 		}
-		fmt.Println(LINE_COLOUR + errBuffer[currentLine])
+		fmt.Fprintln(w, LINE_COLOUR+lines[currentLine])
 	}
 
-	fmt.Print(RESET)
+	fmt.Fprint(w, RESET)
 }
@@ -15,14 +15,14 @@ func (l *Lexer) Error(s string) {
 	pos := NewPositionFromLexer(l)
 	if len(l.stack) > 0 {
 		unexpectedToken := l.Text()
-		SyntaxError(pos, "unexpected '%s'", unexpectedToken)
+		l.diags.SyntaxError(pos, "unexpected '%s'", unexpectedToken)
 	} else {
-		SyntaxError(pos, "unexpected '<EOF>'")
+		l.diags.SyntaxError(pos, "unexpected '<EOF>'")
 	}
 	l.err = true
 }
 
-func tryOpenModule(modulePath string, module string) (io.Reader, bool) {
+func tryOpenModule(modulePath string, module string) (*os.File, bool) {
 	file, err := os.Open(fmt.Sprintf("%v/%v.wacc", modulePath, module))
 	if err != nil {
 		return nil, false
@@ -30,34 +30,39 @@ func tryOpenModule(modulePath string, module string) (io.Reader, bool) {
 	return file, true
 }
 
-func GenerateAST(modulePath string, input io.Reader) (*Program, bool) {
+// Parses input, and any modules it imports, into a single program. Each file
+// read is registered with sources under its path, and problems are recorded
+// in diags
+func GenerateAST(modulePath string, filename string, input io.Reader, sources *SourceManager, diags *Diagnostics) (*Program, bool) {
 	// Generate AST
-	generateAST := func(input io.Reader) (*Program, bool) {
-		lexer := NewLexer(SetUpErrorOutput(input))
-		yyParse(lexer)
-		if lexer.err {
-			return nil, false
-		}
-		return lexer.program, true
+	file, buffered, err := sources.Load(filename, input)
+	if err != nil {
+		diags.SyntaxError(&Position{name: filename}, "unable to read input: %v", err)
+		return nil, false
 	}
-	program, ok := generateAST(input)
-	if !ok {
+	lexer := NewLexer(buffered)
+	lexer.file = file
+	lexer.diags = diags
+	yyParse(lexer)
+	if lexer.err {
 		return nil, false
 	}
+	program := lexer.program
 
 	// Recursively import modules
 	moduleStructs := []*Struct{}
 	moduleFunctions := []*Function{}
 	for _, i := range program.Imports {
 		// Load the module file
-		file, ok := tryOpenModule(modulePath, i.Module.Name)
+		moduleFile, ok := tryOpenModule(modulePath, i.Module.Name)
 		if !ok {
-			SyntaxError(i.Pos(), "Unable to import module %v, module does not exist in the modulepath", i.Module.Name)
+			diags.SyntaxError(i.Pos(), "Unable to import module %v, module does not exist in the modulepath", i.Module.Name)
 			return nil, false
 		}
 
 		// Generate AST for this module
-		ast, astOk := GenerateAST(modulePath, file)
+		ast, astOk := GenerateAST(modulePath, moduleFile.Name(), moduleFile, sources, diags)
+		moduleFile.Close()
 		if !astOk {
 			return nil, false
 		}
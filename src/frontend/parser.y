@@ -39,9 +39,10 @@
 %token INT FLOAT BOOL CHAR STRING PAIR VOID
 %token IMPORT IS EXTERNAL STRUCT
 %token IF THEN ELSE FI
-%token WHILE DO DONE
+%token WHILE FOR IN DO DONE BREAK CONTINUE
 %token LEN ORD CHR FST SND
 %token LE GE EQ NE AND OR
+%token ADD_ASSIGN SUB_ASSIGN MUL_ASSIGN DIV_ASSIGN MOD_ASSIGN
 %%
 
 top
@@ -111,7 +112,7 @@ struct_member
 /* Functions */
 function
     : type identifier '(' optional_param_list ')' IS statement_list END {
-        if !VerifyFunctionReturns($7.Stmts) {
+        if !VerifyFunctionReturns(yylex.(*Lexer).diags, $7.Stmts) {
           yylex.(*Lexer).err = true
         }
         $$.Func = &Function{$1.Position, $1.Type, $2.Expr.(*IdentExpr), $4.Params, $7.Stmts, false}
@@ -151,7 +152,7 @@ statement_list
 statement
     : SKIP                            { $$.Stmt = &SkipStmt{$1.Position} }
     | type identifier '=' assign_rhs  { $$.Stmt = &DeclStmt{$1.Position, $1.Type, $2.Expr.(*IdentExpr), $4.Expr} }
-    | assign_lhs '=' assign_rhs       { $$.Stmt = &AssignStmt{$1.Expr.(LValueExpr), $3.Expr} }
+    | assignment                      { $$.Stmt = $1.Stmt }
     | READ assign_lhs                 { $$.Stmt = &ReadStmt{$1.Position, $2.Expr.(LValueExpr), nil} }
     | FREE expression                 { $$.Stmt = &FreeStmt{$1.Position, $2.Expr} }
     | RETURN expression               { $$.Stmt = &ReturnStmt{$1.Position, $2.Expr} }
@@ -166,6 +167,30 @@ statement
     | WHILE expression DO statement_list DONE {
         $$.Stmt = &WhileStmt{ $1.Position, $2.Expr, $4.Stmts , $5.Position }
       }
+    | FOR type identifier '=' assign_rhs ';' expression ';' assignment DO statement_list DONE {
+        init := &DeclStmt{$2.Position, $2.Type, $3.Expr.(*IdentExpr), $5.Expr}
+        $$.Stmt = &ForStmt{$1.Position, init, $7.Expr, $9.Stmt, $11.Stmts, $12.Position}
+      }
+    | FOR type identifier IN expression DO statement_list DONE {
+        $$.Stmt = &ForEachStmt{$1.Position, $2.Type, $3.Expr.(*IdentExpr), $5.Expr, $7.Stmts, $8.Position}
+      }
+    | BREAK                           { $$.Stmt = &BreakStmt{$1.Position} }
+    | CONTINUE                        { $$.Stmt = &ContinueStmt{$1.Position} }
+    ;
+
+assignment
+    : assign_lhs '=' assign_rhs { $$.Stmt = &AssignStmt{$1.Expr.(LValueExpr), $3.Expr} }
+    | assign_lhs compound_assign expression {
+        $$.Stmt = &CompoundAssignStmt{$1.Expr.(LValueExpr), $2.Position, $2.Value, $3.Expr, nil}
+      }
+    ;
+
+compound_assign
+    : ADD_ASSIGN { $$.Position = $1.Position; $$.Value = "+" }
+    | SUB_ASSIGN { $$.Position = $1.Position; $$.Value = "-" }
+    | MUL_ASSIGN { $$.Position = $1.Position; $$.Value = "*" }
+    | DIV_ASSIGN { $$.Position = $1.Position; $$.Value = "/" }
+    | MOD_ASSIGN { $$.Position = $1.Position; $$.Value = "%" }
     ;
 
 assign_lhs
@@ -293,7 +318,7 @@ unary_expression
 
 multiplicative_expression
     : unary_expression {
-        if !VerifyNoOverflows($1.Expr) {
+        if !VerifyNoOverflows(yylex.(*Lexer).diags, $1.Expr) {
           yylex.(*Lexer).err = true
         }
         $$.Expr = $1.Expr
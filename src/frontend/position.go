@@ -1,12 +1,17 @@
 package frontend
 
 type Position struct {
+	file   int
 	name   string
 	line   int
 	column int
 	length int
 }
 
+// Id of the SourceFile containing this position
+func (p *Position) File() int {
+	return p.file
+}
 func (p *Position) Name() string {
 	return p.name
 }
@@ -24,6 +29,7 @@ func (p *Position) End() *Position {
 }
 func (p *Position) Add(x int) *Position {
 	return &Position{
+		file:   p.file,
 		name:   p.name,
 		line:   p.line,
 		column: p.column + x,
@@ -54,13 +60,15 @@ type Pos *Position
 func NewPositionFromLexer(l *Lexer) *Position {
 	if len(l.stack) > 0 {
 		return &Position{
-			name:   "<unknown>",
+			file:   l.file.Id(),
+			name:   l.file.Name(),
 			line:   l.Line() + 1,
 			column: l.Column() + 1,
 			length: len(l.Text())}
 	} else {
 		return &Position{
-			name:   "<unknown>",
+			file:   l.file.Id(),
+			name:   l.file.Name(),
 			line:   0,
 			column: 0,
 			length: 0}
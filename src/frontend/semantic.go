@@ -12,7 +12,9 @@ type Context struct {
 	currentFunction *Function
 	types           []map[string]Type
 	depth           int
+	loops           int // Number of loops around the current statement
 	err             bool
+	diags           *Diagnostics
 }
 
 //
@@ -67,8 +69,8 @@ func (ctx *Context) genTypeSignature(ident string, types []Type) string {
 //
 // Semantic Checking
 //
-func VerifyProgram(program *Program) bool {
-	ctx := &Context{make(map[string]*Struct), make(map[string]*Function), nil, nil, 0, false}
+func VerifyProgram(program *Program, diags *Diagnostics) bool {
+	ctx := &Context{make(map[string]*Struct), make(map[string]*Function), nil, nil, 0, 0, false, diags}
 
 	// Add structs to the context to ensureeeach struct has a unique identifier
 	// and so we can lookup structs later
@@ -114,7 +116,7 @@ func (ctx *Context) LookupStruct(name string) (*Struct, bool) {
 func (ctx *Context) AddStruct(s *Struct) {
 	name := s.Ident.Name
 	if _, ok := ctx.LookupStruct(name); ok {
-		SemanticError(s.Pos(), "struct '%v' already exists in this program", name)
+		ctx.diags.SemanticError(s.Pos(), "struct '%v' already exists in this program", name)
 		ctx.err = true
 	} else {
 		ctx.structs[name] = s
@@ -145,7 +147,7 @@ func (ctx *Context) AddFunction(f *Function) {
 	}
 
 	if ok {
-		SemanticError(f.Pos(), "function '%v' already exists in this program", ctx.genTypeSignature(originalName, types))
+		ctx.diags.SemanticError(f.Pos(), "function '%v' already exists in this program", ctx.genTypeSignature(originalName, types))
 		ctx.err = true
 	} else {
 		ctx.functions[f.Ident.Name] = f
@@ -190,7 +192,7 @@ func (ctx *Context) LookupVariable(ident *IdentExpr) (Type, bool) {
 
 func (ctx *Context) AddVariable(t Type, ident *IdentExpr) {
 	if _, ok := ctx.types[ctx.depth-1][ident.Name]; ok {
-		SemanticError(ident.Pos(), "variable '%v' already exists in this scope", ident.Name)
+		ctx.diags.SemanticError(ident.Pos(), "variable '%v' already exists in this scope", ident.Name)
 		ctx.err = true
 	} else {
 		ctx.types[ctx.depth-1][ident.Name] = t
@@ -209,7 +211,7 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 	switch expr := expr.(type) {
 	case *IdentExpr:
 		if t, ok := ctx.LookupVariable(expr); !ok {
-			SemanticError(expr.Pos(), "use of undeclared variable '%v'", expr.Name)
+			ctx.diags.SemanticError(expr.Pos(), "use of undeclared variable '%v'", expr.Name)
 			ctx.err = true
 			return ErrorType{}
 		} else {
@@ -218,13 +220,17 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 
 	case *ArrayElemExpr:
 		t := ctx.DeriveType(expr.Volume) // given a[i] - find a
+		if index := ctx.DeriveType(expr.Index); !index.Equals(BasicType{INT}) {
+			ctx.diags.SemanticError(expr.Index.Pos(), "incorrect type of array index (expected: int; actual: %v)", index.Repr())
+			ctx.err = true
+		}
 		if t.Equals(BasicType{STRING}) {
 			return BasicType{CHAR}
 		}
 		if array, ok := t.(ArrayType); ok {
 			return array.BaseType
 		} else {
-			SemanticError(expr.Pos(), "cannot index a value which isn't an array (actual: %v)", t.Repr())
+			ctx.diags.SemanticError(expr.Pos(), "cannot index a value which isn't an array (actual: %v)", t.Repr())
 			ctx.err = true
 			return ErrorType{}
 		}
@@ -241,7 +247,7 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 				panic("expr.SelectorType must be either FST or SND")
 			}
 		} else {
-			SemanticError(expr.Pos(), "operand of pair selector must be a pair type (actual: %v)", t.Repr())
+			ctx.diags.SemanticError(expr.Pos(), "operand of pair selector must be a pair type (actual: %v)", t.Repr())
 			ctx.err = true
 			return ErrorType{}
 		}
@@ -263,18 +269,18 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 						return m.Type
 					}
 				}
-				SemanticError(expr.ElemIdent.Pos(), "the struct %v does not contain member %v",
+				ctx.diags.SemanticError(expr.ElemIdent.Pos(), "the struct %v does not contain member %v",
 					expr.Repr(), expr.ElemIdent.Repr())
 				ctx.err = true
 				return ErrorType{}
 
 			} else {
-				SemanticError(expr.Pos(), "no such struct exists: %v", expr.Repr())
+				ctx.diags.SemanticError(expr.Pos(), "no such struct exists: %v", expr.Repr())
 				ctx.err = true
 				return ErrorType{}
 			}
 		} else {
-			SemanticError(expr.Pos(), "can only access members from struct type (actual: %v)", t.Repr())
+			ctx.diags.SemanticError(expr.Pos(), "can only access members from struct type (actual: %v)", t.Repr())
 			ctx.err = true
 			return ErrorType{}
 		}
@@ -297,7 +303,7 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 		t := ctx.DeriveType(expr.Values[0])
 		for i := 1; i < len(expr.Values); i++ {
 			if !t.Equals(ctx.DeriveType(expr.Values[i])) {
-				SemanticError(expr.Pos(), "all expressions in the array literal must have the same type")
+				ctx.diags.SemanticError(expr.Pos(), "all expressions in the array literal must have the same type")
 				ctx.err = true
 				return ErrorType{}
 			}
@@ -313,7 +319,7 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 		case "!":
 			expected := BasicType{BOOL}
 			if !t.Equals(expected) {
-				SemanticError(expr.Pos(), "unexpected operand type (expected: %v; actual: %v)", expected.Repr(), t.Repr())
+				ctx.diags.SemanticError(expr.Pos(), "unexpected operand type (expected: %v; actual: %v)", expected.Repr(), t.Repr())
 				ctx.err = true
 				return ErrorType{}
 			}
@@ -322,7 +328,7 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 
 		case "-":
 			if !t.Equals(BasicType{INT}) && !t.Equals(BasicType{FLOAT}) {
-				SemanticError(expr.Pos(), "unexpected operand type (expected: int, float; actual: %v)", t.Repr())
+				ctx.diags.SemanticError(expr.Pos(), "unexpected operand type (expected: int, float; actual: %v)", t.Repr())
 				ctx.err = true
 				return ErrorType{}
 			}
@@ -332,7 +338,7 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 		case "len":
 			expected := ArrayType{AnyType{}}
 			if !t.Equals(expected) {
-				SemanticError(expr.Pos(), "unexpected operand type (expected: %v; actual: %v)", expected.Repr(), t.Repr())
+				ctx.diags.SemanticError(expr.Pos(), "unexpected operand type (expected: %v; actual: %v)", expected.Repr(), t.Repr())
 				ctx.err = true
 				return ErrorType{}
 			}
@@ -342,7 +348,7 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 		case "ord":
 			expected := BasicType{CHAR}
 			if !t.Equals(expected) {
-				SemanticError(expr.Pos(), "unexpected operand type (expected: %v; actual: %v)", expected.Repr(), t.Repr())
+				ctx.diags.SemanticError(expr.Pos(), "unexpected operand type (expected: %v; actual: %v)", expected.Repr(), t.Repr())
 				ctx.err = true
 				return ErrorType{}
 			}
@@ -352,7 +358,7 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 		case "chr":
 			expected := BasicType{INT}
 			if !t.Equals(expected) {
-				SemanticError(expr.Pos(), "unexpected operand type (expected: %v; actual: %v)", expected.Repr(), t.Repr())
+				ctx.diags.SemanticError(expr.Pos(), "unexpected operand type (expected: %v; actual: %v)", expected.Repr(), t.Repr())
 				ctx.err = true
 				return ErrorType{}
 			}
@@ -360,7 +366,7 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 			return expr.Type
 
 		default:
-			SemanticError(expr.Pos(), "IMPLEMENT_ME - operator '%v' unhandled", expr.Operator)
+			ctx.diags.SemanticError(expr.Pos(), "IMPLEMENT_ME - operator '%v' unhandled", expr.Operator)
 			ctx.err = true
 			return ErrorType{}
 		}
@@ -371,12 +377,12 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 		switch expr.Operator {
 		case "*", "/", "%", "+", "-":
 			if !t1.Equals(BasicType{INT}) && !t1.Equals(BasicType{FLOAT}) {
-				SemanticError(expr.Pos(), "invalid type on left of operator '%v' (expected: int, float; actual: %v)", expr.Operator, t1.Repr())
+				ctx.diags.SemanticError(expr.Pos(), "invalid type on left of operator '%v' (expected: int, float; actual: %v)", expr.Operator, t1.Repr())
 				ctx.err = true
 				return ErrorType{}
 			}
 			if !t2.Equals(t1) {
-				SemanticError(expr.Pos(), "invalid type on right of operator '%v' (expected: %v; actual: %v)", expr.Operator, t1.Repr(), t2.Repr())
+				ctx.diags.SemanticError(expr.Pos(), "invalid type on right of operator '%v' (expected: %v; actual: %v)", expr.Operator, t1.Repr(), t2.Repr())
 				ctx.err = true
 				return ErrorType{}
 			}
@@ -385,12 +391,12 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 
 		case ">", ">=", "<", "<=":
 			if !t1.Equals(BasicType{INT}) && !t1.Equals(BasicType{FLOAT}) && !t1.Equals(BasicType{CHAR}) {
-				SemanticError(expr.Pos(), "invalid type on left of operator '%v' (expected: int, float, char; actual: %v)", expr.Operator, t1.Repr())
+				ctx.diags.SemanticError(expr.Pos(), "invalid type on left of operator '%v' (expected: int, float, char; actual: %v)", expr.Operator, t1.Repr())
 				ctx.err = true
 				return ErrorType{}
 			}
 			if !t2.Equals(t1) {
-				SemanticError(expr.Pos(), "invalid type on right of operator '%v' (expected: %v; actual: %v)", expr.Operator, t1.Repr(), t2.Repr())
+				ctx.diags.SemanticError(expr.Pos(), "invalid type on right of operator '%v' (expected: %v; actual: %v)", expr.Operator, t1.Repr(), t2.Repr())
 				ctx.err = true
 				return ErrorType{}
 			}
@@ -399,7 +405,7 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 
 		case "==", "!=":
 			if !t1.Equals(t2) {
-				SemanticError(expr.Pos(), "operand types for '%v' do not match (%v does not match %v)", expr.Operator, t1.Repr(), t2.Repr())
+				ctx.diags.SemanticError(expr.Pos(), "operand types for '%v' do not match (%v does not match %v)", expr.Operator, t1.Repr(), t2.Repr())
 				ctx.err = true
 				return ErrorType{}
 			}
@@ -408,12 +414,12 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 
 		case "&&", "||":
 			if !t1.Equals(BasicType{BOOL}) {
-				SemanticError(expr.Pos(), "invalid type on left of operator '%v' (expected: bool; actual: %v)", expr.Operator, t1.Repr())
+				ctx.diags.SemanticError(expr.Pos(), "invalid type on left of operator '%v' (expected: bool; actual: %v)", expr.Operator, t1.Repr())
 				ctx.err = true
 				return ErrorType{}
 			}
 			if !t2.Equals(BasicType{BOOL}) {
-				SemanticError(expr.Pos(), "invalid type on right of operator '%v' (expected: bool; actual: %v)", expr.Operator, t2.Repr())
+				ctx.diags.SemanticError(expr.Pos(), "invalid type on right of operator '%v' (expected: bool; actual: %v)", expr.Operator, t2.Repr())
 				ctx.err = true
 				return ErrorType{}
 			}
@@ -421,7 +427,7 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 			return expr.Type
 
 		default:
-			SemanticError(expr.Pos(), "IMPLEMENT_ME - operator '%v' unhandled", expr.Operator)
+			ctx.diags.SemanticError(expr.Pos(), "IMPLEMENT_ME - operator '%v' unhandled", expr.Operator)
 			ctx.err = true
 			return ErrorType{}
 		}
@@ -458,7 +464,7 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 			// Verify number of arguments
 			argsLen, paramLen := len(expr.Args), len(f.Params)
 			if argsLen != paramLen {
-				SemanticError(expr.Pos(), "wrong number of arguments to '%v' specified (expected: %v; actual: %v)", originalName, argsLen, paramLen)
+				ctx.diags.SemanticError(expr.Pos(), "wrong number of arguments to '%v' specified (expected: %v; actual: %v)", originalName, argsLen, paramLen)
 				ctx.err = true
 				return ErrorType{}
 			}
@@ -467,7 +473,7 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 			for i := 0; i < argsLen; i++ {
 				argType, paramType := paramTypes[i], f.Params[i].Type
 				if !argType.Equals(paramType) {
-					SemanticError(expr.Pos(), "parameter type mismatch (expected: %v; actual: %v)", paramType.Repr(), argType.Repr())
+					ctx.diags.SemanticError(expr.Pos(), "parameter type mismatch (expected: %v; actual: %v)", paramType.Repr(), argType.Repr())
 					ctx.err = true
 					return ErrorType{}
 				}
@@ -476,13 +482,13 @@ func (ctx *Context) DeriveType(expr Expr) Type {
 			// Return function type
 			return f.Type
 		} else {
-			SemanticError(expr.Pos(), "use of undefined function '%v'", ctx.genTypeSignature(originalName, paramTypes))
+			ctx.diags.SemanticError(expr.Pos(), "use of undefined function '%v'", ctx.genTypeSignature(originalName, paramTypes))
 			ctx.err = true
 			return ErrorType{}
 		}
 
 	default:
-		SemanticError(expr.Pos(), "IMPLEMENT_ME: unhandled type in DeriveType - type: %T", expr)
+		ctx.diags.SemanticError(expr.Pos(), "IMPLEMENT_ME: unhandled type in DeriveType - type: %T", expr)
 		ctx.err = true
 		return ErrorType{}
 	}
@@ -509,7 +515,7 @@ func (ctx *Context) VerifyStatement(statement Stmt) {
 	case *DeclStmt:
 		t1, t2 := statement.Type, ctx.DeriveType(statement.Right)
 		if !t1.Equals(t2) {
-			SemanticError(statement.Pos(), "value being used to initialise '%v' does not match its declared type (%v does not match %v)",
+			ctx.diags.SemanticError(statement.Pos(), "value being used to initialise '%v' does not match its declared type (%v does not match %v)",
 				statement.Ident.Name, t1.Repr(), t2.Repr())
 			ctx.err = true
 		} else {
@@ -519,14 +525,19 @@ func (ctx *Context) VerifyStatement(statement Stmt) {
 	case *AssignStmt:
 		t1, t2 := ctx.DeriveType(statement.Left), ctx.DeriveType(statement.Right)
 		if !t1.Equals(t2) {
-			SemanticError(statement.Pos(), "cannot assign rvalue to lvalue with a different type (%v does not match %v)", t1.Repr(), t2.Repr())
+			ctx.diags.SemanticError(statement.Pos(), "cannot assign rvalue to lvalue with a different type (%v does not match %v)", t1.Repr(), t2.Repr())
 			ctx.err = true
 		}
 
+	case *CompoundAssignStmt:
+		// The types are checked as for Left Operator Right
+		value := &BinaryExpr{statement.Left, statement.OperatorPos, statement.Operator, statement.Right, nil}
+		statement.Type = ctx.DeriveType(value)
+
 	case *ReadStmt:
 		t := ctx.DeriveType(statement.Dst)
 		if !t.Equals(BasicType{INT}) && !t.Equals(BasicType{CHAR}) {
-			SemanticError(statement.Dst.Pos(), "destination of read has incorrect type (expected: int or char; actual: %v)", t.Repr())
+			ctx.diags.SemanticError(statement.Dst.Pos(), "destination of read has incorrect type (expected: int or char; actual: %v)", t.Repr())
 			ctx.err = true
 		}
 		statement.Type = t
@@ -534,27 +545,27 @@ func (ctx *Context) VerifyStatement(statement Stmt) {
 	case *FreeStmt:
 		t := ctx.DeriveType(statement.Object)
 		if !t.Equals(PairType{AnyType{}, AnyType{}}) && !t.Equals(ArrayType{AnyType{}}) {
-			SemanticError(statement.Object.Pos(), "object being freed must be either a pair or an array (actual: %v)", t.Repr())
+			ctx.diags.SemanticError(statement.Object.Pos(), "object being freed must be either a pair or an array (actual: %v)", t.Repr())
 			ctx.err = true
 		}
 
 	case *ExitStmt:
 		t := ctx.DeriveType(statement.Result)
 		if !t.Equals(BasicType{INT}) {
-			SemanticError(statement.Result.Pos(), "incorrect type in exit statement (expected: int; actual: %v)", t.Repr())
+			ctx.diags.SemanticError(statement.Result.Pos(), "incorrect type in exit statement (expected: int; actual: %v)", t.Repr())
 			ctx.err = true
 		}
 
 	case *ReturnStmt:
 		// Check if we're in a function
 		if ctx.currentFunction == nil {
-			SemanticError(statement.Pos(), "cannot call return in the program body")
+			ctx.diags.SemanticError(statement.Pos(), "cannot call return in the program body")
 			ctx.err = true
 		} else {
 			// Check if the type of the operand matches the return type
 			t := ctx.DeriveType(statement.Result)
 			if !t.Equals(ctx.currentFunction.Type) {
-				SemanticError(statement.Result.Pos(), "type in return statement must match the return type of the function (expected: %v; actual: %v)",
+				ctx.diags.SemanticError(statement.Result.Pos(), "type in return statement must match the return type of the function (expected: %v; actual: %v)",
 					ctx.currentFunction.Type.Repr(), t.Repr())
 				ctx.err = true
 			}
@@ -568,7 +579,7 @@ func (ctx *Context) VerifyStatement(statement Stmt) {
 		// Check the condition
 		t := ctx.DeriveType(statement.Cond)
 		if !t.Equals(BasicType{BOOL}) {
-			SemanticError(statement.Cond.Pos(), "condition type is incorrect (expected: bool; actual: %v)", t.Repr())
+			ctx.diags.SemanticError(statement.Cond.Pos(), "condition type is incorrect (expected: bool; actual: %v)", t.Repr())
 			ctx.err = true
 		}
 
@@ -586,14 +597,77 @@ func (ctx *Context) VerifyStatement(statement Stmt) {
 		// Check the condition
 		t := ctx.DeriveType(statement.Cond)
 		if !t.Equals(BasicType{BOOL}) {
-			SemanticError(statement.Cond.Pos(), "condition type is incorrect (expected: bool; actual: %v)", t.Repr())
+			ctx.diags.SemanticError(statement.Cond.Pos(), "condition type is incorrect (expected: bool; actual: %v)", t.Repr())
 			ctx.err = true
 		}
 
 		// Verfy body
+		ctx.loops++
+		ctx.PushScope()
+		ctx.VerifyStatementList(statement.Body)
+		ctx.PopScope()
+		ctx.loops--
+
+	case *ForStmt:
+		// The loop variable is in a scope of its own, around the body
+		ctx.PushScope()
+		ctx.VerifyStatement(statement.Init)
+		t := ctx.DeriveType(statement.Cond)
+		if !t.Equals(BasicType{BOOL}) {
+			ctx.diags.SemanticError(statement.Cond.Pos(), "condition type is incorrect (expected: bool; actual: %v)", t.Repr())
+			ctx.err = true
+		}
+
+		ctx.loops++
 		ctx.PushScope()
 		ctx.VerifyStatementList(statement.Body)
 		ctx.PopScope()
+		ctx.loops--
+
+		ctx.VerifyStatement(statement.Step)
+		ctx.PopScope()
+
+	case *ForEachStmt:
+		// Strings are iterated over as arrays of characters
+		var elem Type
+		switch t := ctx.DeriveType(statement.Collection).(type) {
+		case ErrorType:
+		case ArrayType:
+			elem = t.BaseType
+		default:
+			if t.Equals(BasicType{STRING}) {
+				elem = BasicType{CHAR}
+			} else {
+				ctx.diags.SemanticError(statement.Collection.Pos(), "cannot iterate over a value which isn't an array or string (actual: %v)", t.Repr())
+				ctx.err = true
+			}
+		}
+		if elem != nil && !elem.Equals(statement.Type) {
+			ctx.diags.SemanticError(statement.Ident.Pos(), "loop variable type is incorrect (expected: %v; actual: %v)", elem.Repr(), statement.Type.Repr())
+			ctx.err = true
+		}
+
+		// The loop variable is in a scope of its own, around the body
+		ctx.PushScope()
+		ctx.AddVariable(statement.Type, statement.Ident)
+		ctx.loops++
+		ctx.PushScope()
+		ctx.VerifyStatementList(statement.Body)
+		ctx.PopScope()
+		ctx.loops--
+		ctx.PopScope()
+
+	case *BreakStmt:
+		if ctx.loops == 0 {
+			ctx.diags.SemanticError(statement.Pos(), "break statement outside of a loop")
+			ctx.err = true
+		}
+
+	case *ContinueStmt:
+		if ctx.loops == 0 {
+			ctx.diags.SemanticError(statement.Pos(), "continue statement outside of a loop")
+			ctx.err = true
+		}
 
 	case *ScopeStmt:
 		ctx.PushScope()
@@ -0,0 +1,70 @@
+package frontend
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// A file of source code loaded by the compiler. Ids start from 1, so that the
+// zero value of a Position does not refer to any file.
+type SourceFile struct {
+	id    int
+	name  string
+	lines []string
+}
+
+func (f *SourceFile) Id() int {
+	return f.id
+}
+
+func (f *SourceFile) Name() string {
+	return f.name
+}
+
+// Lines returns the contents of the file split into lines, with tabs expanded
+// to single spaces so columns line up in error output
+func (f *SourceFile) Lines() []string {
+	return f.lines
+}
+
+type SourceManager struct {
+	files []*SourceFile
+}
+
+func NewSourceManager() *SourceManager {
+	return &SourceManager{}
+}
+
+// Load reads the entirety of r and registers it under name. The returned
+// reader yields the same contents, for use by the lexer.
+func (m *SourceManager) Load(name string, r io.Reader) (*SourceFile, io.Reader, error) {
+	// we need to read the entire set of lines into a buffer so we can do
+	// pretty error output
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, nil, err
+	}
+
+	strdata := string(buf.Bytes())
+	file := &SourceFile{
+		id:    len(m.files) + 1,
+		name:  name,
+		lines: strings.Split(strings.Replace(strdata, "\t", " ", -1), "\n"),
+	}
+	m.files = append(m.files, file)
+
+	return file, buf, nil
+}
+
+// File returns the file with the given id, or nil if there isn't one
+func (m *SourceManager) File(id int) *SourceFile {
+	if m == nil || id < 1 || id > len(m.files) {
+		return nil
+	}
+	return m.files[id-1]
+}
+
+func (m *SourceManager) Files() []*SourceFile {
+	return m.files
+}
@@ -75,9 +75,9 @@ func StaticExprOverflows(expr Expr) bool {
 	}
 }
 
-func VerifyNoOverflows(expr Expr) bool {
+func VerifyNoOverflows(diags *Diagnostics, expr Expr) bool {
 	if StaticExprOverflows(expr) {
-		SyntaxError(expr.Pos(), "integer literal does not fit in an int variable")
+		diags.SyntaxError(expr.Pos(), "integer literal does not fit in an int variable")
 		return false
 	}
 	return true
@@ -86,9 +86,9 @@ func VerifyNoOverflows(expr Expr) bool {
 // Iterate in reverse through body. If any of the top level statements return,
 // it returns on all code paths. If none of the top level statements return,
 // error.
-func VerifyFunctionReturns(stmtList []Stmt) bool {
+func VerifyFunctionReturns(diags *Diagnostics, stmtList []Stmt) bool {
 	if !VerifyAnyStatementsReturn(stmtList) {
-		SyntaxError(stmtList[0].Pos(), "function does not have a return or exit statement on every control path")
+		diags.SyntaxError(stmtList[0].Pos(), "function does not have a return or exit statement on every control path")
 		return false
 	}
 	return true
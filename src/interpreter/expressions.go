@@ -0,0 +1,399 @@
+package interpreter
+
+import (
+	"fmt"
+	"math"
+
+	"../frontend"
+)
+
+func (ctx *Context) eval(expr frontend.Expr) interface{} {
+	if !isLogical(expr) {
+		ctx.evalLogicals(expr)
+	}
+
+	switch expr := expr.(type) {
+	case *frontend.BasicLit:
+		if expr.Type.Equals(frontend.BasicType{frontend.STRING}) {
+			return ctx.stringLiteral(expr)
+		}
+		return literalValue(expr)
+
+	case *frontend.IdentExpr:
+		return ctx.lookup(expr.Name)
+
+	case *frontend.ArrayElemExpr:
+		array, index := ctx.element(expr)
+		return array.elems[index]
+
+	case *frontend.PairElemExpr:
+		pair := ctx.pair(expr)
+		if expr.SelectorType == frontend.FST {
+			return pair.fst
+		}
+		return pair.snd
+
+	case *frontend.StructElemExpr:
+		return ctx.structure(expr).fields[expr.ElemNum]
+
+	case *frontend.ArrayLit:
+		elems := make([]interface{}, len(expr.Values))
+		for i, e := range expr.Values {
+			elems[i] = ctx.eval(e)
+		}
+		return ctx.newArray(elems)
+
+	case *frontend.NewPairCmd:
+		fst := ctx.eval(expr.Left)
+		snd := ctx.eval(expr.Right)
+		return ctx.newPair(fst, snd)
+
+	case *frontend.NewStructCmd:
+		fields := make([]interface{}, len(expr.Args))
+		for i, arg := range expr.Args {
+			fields[i] = ctx.eval(arg)
+		}
+		return ctx.newStruct(fields)
+
+	case *frontend.CallCmd:
+		return ctx.call(expr)
+
+	case *frontend.UnaryExpr:
+		return ctx.evalUnary(expr)
+
+	case *frontend.BinaryExpr:
+		return ctx.evalBinary(expr)
+
+	default:
+		panic(fmt.Sprintf("Unhandled expression %T", expr))
+	}
+}
+
+//
+// L-values
+//
+func (ctx *Context) store(lhs frontend.LValueExpr, v interface{}) {
+	switch lhs := lhs.(type) {
+	case *frontend.IdentExpr:
+		ctx.assign(lhs.Name, v)
+
+	case *frontend.ArrayElemExpr:
+		array, index := ctx.element(lhs)
+		array.elems[index] = v
+
+	case *frontend.PairElemExpr:
+		pair := ctx.pair(lhs)
+		if lhs.SelectorType == frontend.FST {
+			pair.fst = v
+		} else {
+			pair.snd = v
+		}
+
+	case *frontend.StructElemExpr:
+		ctx.structure(lhs).fields[lhs.ElemNum] = v
+
+	default:
+		panic(fmt.Sprintf("Unhandled lvalue %T", lhs))
+	}
+}
+
+// update replaces the value at a location with f of its current value, only
+// working out the location once
+func (ctx *Context) update(lhs frontend.LValueExpr, f func(interface{}) interface{}) {
+	switch lhs := lhs.(type) {
+	case *frontend.IdentExpr:
+		ctx.assign(lhs.Name, f(ctx.lookup(lhs.Name)))
+
+	case *frontend.ArrayElemExpr:
+		array, index := ctx.element(lhs)
+		array.elems[index] = f(array.elems[index])
+
+	case *frontend.PairElemExpr:
+		pair := ctx.pair(lhs)
+		if lhs.SelectorType == frontend.FST {
+			pair.fst = f(pair.fst)
+		} else {
+			pair.snd = f(pair.snd)
+		}
+
+	case *frontend.StructElemExpr:
+		s := ctx.structure(lhs)
+		s.fields[lhs.ElemNum] = f(s.fields[lhs.ElemNum])
+
+	default:
+		panic(fmt.Sprintf("Unhandled lvalue %T", lhs))
+	}
+}
+
+// element evaluates the array and index of an array access, checking the
+// index is within bounds
+func (ctx *Context) element(expr *frontend.ArrayElemExpr) (*arrayValue, int32) {
+	v := ctx.eval(expr.Volume)
+	index := ctx.eval(expr.Index).(int32)
+	if v == nil {
+		ctx.throw(NULL_REFERENCE_MSG)
+	}
+	array := v.(*arrayValue)
+
+	if index < 0 {
+		ctx.throw(NEGATIVE_INDEX_MSG)
+	}
+	if int(index) >= len(array.elems) {
+		ctx.throw(LARGE_INDEX_MSG)
+	}
+	return array, index
+}
+
+func (ctx *Context) pair(expr *frontend.PairElemExpr) *pairValue {
+	v := ctx.lookup(expr.Operand.Name)
+	if v == nil {
+		ctx.throw(NULL_REFERENCE_MSG)
+	}
+	return v.(*pairValue)
+}
+
+func (ctx *Context) structure(expr *frontend.StructElemExpr) *structValue {
+	v := ctx.lookup(expr.StructIdent.Name)
+	if v == nil {
+		ctx.throw(NULL_REFERENCE_MSG)
+	}
+	return v.(*structValue)
+}
+
+//
+// Operators
+//
+
+// checkOverflow narrows the result of an integer operation performed in 64
+// bits, raising an OverflowError if it doesn't fit
+func (ctx *Context) checkOverflow(n int64) int32 {
+	if n > math.MaxInt32 || n < math.MinInt32 {
+		ctx.throw(OVERFLOW_MSG)
+	}
+	return int32(n)
+}
+
+func (ctx *Context) evalUnary(expr *frontend.UnaryExpr) interface{} {
+	v := ctx.eval(expr.Operand)
+
+	switch expr.Operator {
+	case "!":
+		return !v.(bool)
+
+	case "-":
+		if f, ok := v.(float32); ok {
+			return -f
+		}
+		return ctx.checkOverflow(-int64(v.(int32)))
+
+	case "+":
+		return v
+
+	case "len":
+		if v == nil {
+			ctx.throw(NULL_REFERENCE_MSG)
+		}
+		return int32(len(v.(*arrayValue).elems))
+
+	case "ord":
+		return int32(v.(charValue))
+
+	case "chr":
+		return charValue(v.(int32))
+
+	default:
+		panic(fmt.Sprintf("Unhandled unary operator %v", expr.Operator))
+	}
+}
+
+// weight is the weight in the backend of the IF an operand is translated to.
+// The generated code evaluates the heavier operand of a binary operator first,
+// and the right one when they weigh the same, which decides the runtime error
+// reported when both of them would raise one.
+func weight(expr frontend.Expr) int {
+	switch expr := expr.(type) {
+	case *frontend.UnaryExpr:
+		// Negated literals are translated to a single constant
+		if lit, ok := expr.Operand.(*frontend.BasicLit); ok && expr.Operator == "-" {
+			if lit.Type.Equals(frontend.BasicType{frontend.INT}) || lit.Type.Equals(frontend.BasicType{frontend.FLOAT}) {
+				return 1
+			}
+		}
+		return weight(expr.Operand) + 1
+
+	case *frontend.BinaryExpr:
+		// && and || are computed into a variable beforehand
+		if isLogical(expr) {
+			return 1
+		}
+		return weight(expr.Left) + weight(expr.Right) + 1
+
+	default:
+		// Literals, variables and the elements of arrays, pairs and structs
+		return 1
+	}
+}
+
+func isLogical(expr frontend.Expr) bool {
+	binary, ok := expr.(*frontend.BinaryExpr)
+	return ok && (binary.Operator == "&&" || binary.Operator == "||")
+}
+
+// evalLogical evaluates && or ||, only evaluating the right side if it decides
+// the result
+func (ctx *Context) evalLogical(expr *frontend.BinaryExpr) bool {
+	l := ctx.eval(expr.Left).(bool)
+	if l == (expr.Operator == "||") {
+		return l
+	}
+	return ctx.eval(expr.Right).(bool)
+}
+
+// evalLogicals evaluates the && and || expressions inside an expression, in
+// the order the backend translates them, and keeps their values until they
+// are reached. The generated code computes each of them into a variable
+// before the rest of the expression, which can change the runtime error
+// reported when there are several.
+func (ctx *Context) evalLogicals(expr frontend.Expr) {
+	switch expr := expr.(type) {
+	case *frontend.BinaryExpr:
+		if !isLogical(expr) {
+			ctx.evalLogicals(expr.Left)
+			ctx.evalLogicals(expr.Right)
+		} else if _, ok := ctx.logicals[expr]; !ok {
+			ctx.logicals[expr] = ctx.evalLogical(expr)
+		}
+
+	case *frontend.UnaryExpr:
+		ctx.evalLogicals(expr.Operand)
+
+	case *frontend.ArrayLit:
+		for _, e := range expr.Values {
+			ctx.evalLogicals(e)
+		}
+
+	case *frontend.NewPairCmd:
+		ctx.evalLogicals(expr.Left)
+		ctx.evalLogicals(expr.Right)
+
+	case *frontend.NewStructCmd:
+		for _, arg := range expr.Args {
+			ctx.evalLogicals(arg)
+		}
+
+	case *frontend.CallCmd:
+		for _, arg := range expr.Args {
+			ctx.evalLogicals(arg)
+		}
+	}
+}
+
+func (ctx *Context) evalBinary(expr *frontend.BinaryExpr) interface{} {
+	if isLogical(expr) {
+		if v, ok := ctx.logicals[expr]; ok {
+			delete(ctx.logicals, expr)
+			return v
+		}
+		return ctx.evalLogical(expr)
+	}
+
+	// Both sides are always evaluated, as they are in the generated code, and
+	// in the same order
+	var l, r interface{}
+	if weight(expr.Left) > weight(expr.Right) {
+		l = ctx.eval(expr.Left)
+		r = ctx.eval(expr.Right)
+	} else {
+		r = ctx.eval(expr.Right)
+		l = ctx.eval(expr.Left)
+	}
+	return ctx.binary(expr.Operator, l, r)
+}
+
+// binary applies an operator other than && and || to its evaluated operands
+func (ctx *Context) binary(op string, l, r interface{}) interface{} {
+	switch op {
+	case "==":
+		return l == r
+
+	case "!=":
+		return l != r
+	}
+
+	if lf, ok := l.(float32); ok {
+		return evalFloat(op, lf, r.(float32))
+	}
+	if lc, ok := l.(charValue); ok {
+		return evalCompare(op, int64(lc), int64(r.(charValue)))
+	}
+
+	a, b := int64(l.(int32)), int64(r.(int32))
+	switch op {
+	case "+":
+		return ctx.checkOverflow(a + b)
+
+	case "-":
+		return ctx.checkOverflow(a - b)
+
+	case "*":
+		return ctx.checkOverflow(a * b)
+
+	case "/":
+		if b == 0 {
+			ctx.throw(DIVIDE_BY_ZERO_MSG)
+		}
+		return int32(l.(int32) / r.(int32))
+
+	case "%":
+		// The generated code computes a - (a / b) * b
+		if b == 0 {
+			ctx.throw(DIVIDE_BY_ZERO_MSG)
+		}
+		q := int64(l.(int32) / r.(int32))
+		m := ctx.checkOverflow(q * b)
+		return ctx.checkOverflow(a - int64(m))
+
+	default:
+		return evalCompare(op, a, b)
+	}
+}
+
+func evalCompare(op string, a, b int64) bool {
+	switch op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	default:
+		panic(fmt.Sprintf("Unhandled binary operator %v", op))
+	}
+}
+
+func evalFloat(op string, a, b float32) interface{} {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/":
+		return a / b
+	case "%":
+		return a - (a/b)*b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	default:
+		panic(fmt.Sprintf("Unhandled binary operator %v", op))
+	}
+}
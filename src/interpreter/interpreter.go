@@ -0,0 +1,302 @@
+// Package interpreter executes a semantically checked AST directly, without
+// going through the backend. Its observable behaviour (output, runtime errors
+// and exit codes) matches that of the code produced by the ARM backend, so it
+// can be used to run programs quickly or to cross-check the code generator.
+package interpreter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"../frontend"
+)
+
+// Messages printed by the runtime library before exiting
+const (
+	OVERFLOW_MSG       = "OverflowError: the result is too small/large to store in a 4-byte signed-integer.\n"
+	DIVIDE_BY_ZERO_MSG = "DivideByZeroError: divide or modulo by zero\n"
+	NEGATIVE_INDEX_MSG = "ArrayIndexOutOfBoundsError: negative index\n"
+	LARGE_INDEX_MSG    = "ArrayIndexOutOfBoundsError: index too large\n"
+	NULL_REFERENCE_MSG = "NullReferenceError: dereference a null reference\n"
+)
+
+// The runtime library calls exit(-1) on a runtime error
+const RUNTIME_ERROR = 255
+
+// Literals are placed in the data section, well below the heap
+const DATA_START = 0x10f00
+
+// Used to unwind the interpreter when the program terminates early
+type exitStatus struct {
+	code int
+}
+
+type Context struct {
+	functions map[string]*frontend.Function
+
+	// Variables visible in the current function, innermost scope last
+	scopes []map[string]interface{}
+
+	// Values of the && and || expressions in the current function which are
+	// evaluated ahead of the expressions containing them
+	logicals map[*frontend.BinaryExpr]bool
+
+	stdin  *bufio.Reader
+	stdout *bufio.Writer
+
+	stringLits  map[*frontend.BasicLit]*arrayValue
+	nextLiteral int
+	nextAddress int
+}
+
+// Run interprets a program which has passed semantic checks, reading from
+// stdin and writing to stdout. It returns the program's exit code. An error
+// is only returned if the program could not be interpreted at all, for
+// example because it calls an external function.
+func Run(program *frontend.Program, stdin io.Reader, stdout io.Writer) (code int, err error) {
+	ctx := &Context{
+		functions:   make(map[string]*frontend.Function),
+		stdin:       bufio.NewReader(stdin),
+		stdout:      bufio.NewWriter(stdout),
+		logicals:    make(map[*frontend.BinaryExpr]bool),
+		stringLits:  make(map[*frontend.BasicLit]*arrayValue),
+		nextLiteral: DATA_START,
+		nextAddress: HEAP_START,
+	}
+	for _, f := range program.Funcs {
+		ctx.functions[f.Ident.Name] = f
+	}
+
+	defer func() {
+		ctx.stdout.Flush()
+		if r := recover(); r != nil {
+			switch r := r.(type) {
+			case exitStatus:
+				code = r.code
+			case error:
+				code, err = 0, r
+			default:
+				panic(r)
+			}
+		}
+	}()
+
+	ctx.pushScope()
+	ctx.execStmts(program.Body)
+	ctx.popScope()
+	return 0, nil
+}
+
+// throw prints a runtime error and terminates the program
+func (ctx *Context) throw(msg string) {
+	fmt.Fprint(ctx.stdout, msg)
+	panic(exitStatus{RUNTIME_ERROR})
+}
+
+//
+// Scopes
+//
+func (ctx *Context) pushScope() {
+	ctx.scopes = append(ctx.scopes, make(map[string]interface{}))
+}
+
+func (ctx *Context) popScope() {
+	ctx.scopes = ctx.scopes[:len(ctx.scopes)-1]
+}
+
+func (ctx *Context) declare(name string, v interface{}) {
+	ctx.scopes[len(ctx.scopes)-1][name] = v
+}
+
+func (ctx *Context) lookup(name string) interface{} {
+	for i := len(ctx.scopes) - 1; i >= 0; i-- {
+		if v, ok := ctx.scopes[i][name]; ok {
+			return v
+		}
+	}
+	panic(fmt.Sprintf("Cannot find variable %s", name))
+}
+
+func (ctx *Context) assign(name string, v interface{}) {
+	for i := len(ctx.scopes) - 1; i >= 0; i-- {
+		if _, ok := ctx.scopes[i][name]; ok {
+			ctx.scopes[i][name] = v
+			return
+		}
+	}
+	panic(fmt.Sprintf("Cannot find variable %s", name))
+}
+
+//
+// Statements
+//
+
+// How a statement finished, if it didn't go on to the next one
+type completion int
+
+const (
+	completed completion = iota
+	returned
+	broken
+	continued
+)
+
+// execStmts runs a list of statements in order, stopping early if one of them
+// returns from the current function or leaves the current loop
+func (ctx *Context) execStmts(stmts []frontend.Stmt) (interface{}, completion) {
+	for _, stmt := range stmts {
+		if v, how := ctx.exec(stmt); how != completed {
+			return v, how
+		}
+	}
+	return nil, completed
+}
+
+func (ctx *Context) execScope(stmts []frontend.Stmt) (interface{}, completion) {
+	ctx.pushScope()
+	defer ctx.popScope()
+	return ctx.execStmts(stmts)
+}
+
+func (ctx *Context) exec(stmt frontend.Stmt) (interface{}, completion) {
+	switch stmt := stmt.(type) {
+	case *frontend.SkipStmt:
+
+	case *frontend.EvalStmt:
+		ctx.eval(stmt.Expr)
+
+	case *frontend.DeclStmt:
+		// The right hand side can refer to a variable being shadowed
+		v := ctx.eval(stmt.Right)
+		ctx.declare(stmt.Ident.Name, v)
+
+	case *frontend.AssignStmt:
+		v := ctx.eval(stmt.Right)
+		ctx.store(stmt.Left, v)
+
+	case *frontend.CompoundAssignStmt:
+		ctx.update(stmt.Left, func(v interface{}) interface{} {
+			return ctx.binary(stmt.Operator, v, ctx.eval(stmt.Right))
+		})
+
+	case *frontend.ReadStmt:
+		if stmt.Type.Equals(frontend.BasicType{frontend.CHAR}) {
+			ctx.store(stmt.Dst, ctx.readChar())
+		} else {
+			ctx.store(stmt.Dst, ctx.readInt())
+		}
+
+	case *frontend.FreeStmt:
+		if ctx.eval(stmt.Object) == nil {
+			ctx.throw(NULL_REFERENCE_MSG)
+		}
+
+	case *frontend.ReturnStmt:
+		return ctx.eval(stmt.Result), returned
+
+	case *frontend.ExitStmt:
+		code := ctx.eval(stmt.Result).(int32)
+		panic(exitStatus{int(uint8(code))})
+
+	case *frontend.PrintStmt:
+		ctx.print(ctx.eval(stmt.Right), stmt.Type)
+		if stmt.NewLine {
+			ctx.stdout.WriteRune('\n')
+		}
+
+	case *frontend.IfStmt:
+		if ctx.eval(stmt.Cond).(bool) {
+			return ctx.execScope(stmt.Body)
+		}
+		return ctx.execScope(stmt.Else)
+
+	case *frontend.WhileStmt:
+		for ctx.eval(stmt.Cond).(bool) {
+			v, how := ctx.execScope(stmt.Body)
+			if how == returned {
+				return v, returned
+			}
+			if how == broken {
+				break
+			}
+		}
+
+	case *frontend.ForStmt:
+		// The loop variable is in a scope of its own around the body
+		ctx.pushScope()
+		defer ctx.popScope()
+		ctx.exec(stmt.Init)
+		for ctx.eval(stmt.Cond).(bool) {
+			v, how := ctx.execScope(stmt.Body)
+			if how == returned {
+				return v, returned
+			}
+			if how == broken {
+				break
+			}
+			ctx.exec(stmt.Step)
+		}
+
+	case *frontend.ForEachStmt:
+		// The collection is evaluated once, but its elements are read as the
+		// loop reaches them
+		v := ctx.eval(stmt.Collection)
+		if v == nil {
+			ctx.throw(NULL_REFERENCE_MSG)
+		}
+		array := v.(*arrayValue)
+
+		ctx.pushScope()
+		defer ctx.popScope()
+		for i := range array.elems {
+			ctx.declare(stmt.Ident.Name, array.elems[i])
+			v, how := ctx.execScope(stmt.Body)
+			if how == returned {
+				return v, returned
+			}
+			if how == broken {
+				break
+			}
+		}
+
+	case *frontend.BreakStmt:
+		return nil, broken
+
+	case *frontend.ContinueStmt:
+		return nil, continued
+
+	case *frontend.ScopeStmt:
+		return ctx.execScope(stmt.Body)
+
+	default:
+		panic(fmt.Sprintf("Unhandled statement %T", stmt))
+	}
+	return nil, completed
+}
+
+func (ctx *Context) call(expr *frontend.CallCmd) interface{} {
+	f, ok := ctx.functions[expr.Ident.Name]
+	if !ok {
+		panic(fmt.Sprintf("Cannot find function %s", expr.Ident.Name))
+	}
+	if f.External {
+		panic(fmt.Errorf("interpreter: cannot call external function %v", expr.Ident.Name))
+	}
+
+	args := make([]interface{}, len(expr.Args))
+	for i, arg := range expr.Args {
+		args[i] = ctx.eval(arg)
+	}
+
+	callerScopes, callerLogicals := ctx.scopes, ctx.logicals
+	ctx.scopes, ctx.logicals = nil, make(map[*frontend.BinaryExpr]bool)
+	defer func() { ctx.scopes, ctx.logicals = callerScopes, callerLogicals }()
+
+	ctx.pushScope()
+	for i, p := range f.Params {
+		ctx.declare(p.Ident.Name, args[i])
+	}
+	v, _ := ctx.execStmts(f.Body)
+	return v
+}
@@ -0,0 +1,89 @@
+package interpreter
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"../wacc"
+)
+
+func interpret(t *testing.T, source string, stdin string) (string, int) {
+	result, _, err := wacc.Compile(wacc.Options{
+		Filename:  "test.wacc",
+		Input:     strings.NewReader(source),
+		StopAfter: wacc.StageAST,
+	})
+	if err != nil {
+		t.Fatalf("Compile returned %v for %q, want no error", err, source)
+	}
+	stdout := new(bytes.Buffer)
+	code, err := Run(result.AST, strings.NewReader(stdin), stdout)
+	if err != nil {
+		t.Fatalf("Run returned %v, want no error", err)
+	}
+	return stdout.String(), code
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		stdin  string
+		output string
+		code   int
+	}{
+		{"print", "begin\n  int x = 1 ;\n  println x + 2\nend\n", "", "3\n", 0},
+		{"read", "begin\n  int x = 0 ;\n  read x ;\n  println x * 2\nend\n", "21\n", "42\n", 0},
+		{"call", "begin\n  int f(int n) is\n    if n == 0 then return 1 else int r = call f(n - 1) ; return n * r fi\n  end\n  int x = call f(5) ;\n  println x\nend\n", "", "120\n", 0},
+		{"exit", "begin\n  println 1 ;\n  exit 7\nend\n", "", "1\n", 7},
+		{"exit wraps", "begin\n  exit 300\nend\n", "", "", 44},
+		{"negative exit", "begin\n  exit -1\nend\n", "", "", 255},
+		{"break", "begin\n  int i = 0 ;\n  while true do\n    i = i + 1 ;\n    if i == 3 then break else skip fi\n  done ;\n  println i\nend\n", "", "3\n", 0},
+		{"continue", "begin\n  int i = 0 ;\n  int n = 0 ;\n  while i < 5 do\n    i = i + 1 ;\n    if i % 2 == 0 then continue else skip fi ;\n    n = n + i\n  done ;\n  println n\nend\n", "", "9\n", 0},
+		{"for", "begin\n  int i = 10 ;\n  for int i = 0; i < 3; i = i + 1 do\n    if i == 1 then continue else skip fi ;\n    print i\n  done ;\n  println i\nend\n", "", "0210\n", 0},
+		{"for-each", "begin\n  int[] a = [1, 2, 3] ;\n  for int x in a do\n    x = x * 2 ;\n    print x\n  done ;\n  for char c in \"ab\" do\n    print c\n  done ;\n  println a[0]\nend\n", "", "246ab1\n", 0},
+		{"compound assignment", "begin\n  int[] a = [1, 2, 3] ;\n  int i = 0 ;\n  a[i + 1] += 5 ;\n  a[a[0]] *= 3 ;\n  i -= 4 ;\n  println a[1] ;\n  println i\nend\n", "", "21\n-4\n", 0},
+		{"short circuit", "begin\n  int x = 0 ;\n  if x == 0 || 1 / x == 0 then println true else skip fi ;\n  println x != 0 && 1 / x == 0\nend\n", "", "true\nfalse\n", 0},
+	}
+	for _, test := range tests {
+		output, code := interpret(t, test.source, test.stdin)
+		if output != test.output || code != test.code {
+			t.Errorf("%v: got %q and exit code %v, want %q and %v", test.name, output, code, test.output, test.code)
+		}
+	}
+}
+
+func TestRunRuntimeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		output string
+	}{
+		{"overflow", "begin\n  int x = 2147483647 ;\n  println x + 1\nend\n", OVERFLOW_MSG},
+		{"negation overflow", "begin\n  int x = -2147483648 ;\n  println -x\nend\n", OVERFLOW_MSG},
+		{"divide by zero", "begin\n  int x = 0 ;\n  println 1 / x\nend\n", DIVIDE_BY_ZERO_MSG},
+		{"modulo by zero", "begin\n  int x = 0 ;\n  println 1 % x\nend\n", DIVIDE_BY_ZERO_MSG},
+		{"negative index", "begin\n  int[] a = [1, 2] ;\n  println a[-1]\nend\n", NEGATIVE_INDEX_MSG},
+		{"large index", "begin\n  int[] a = [1, 2] ;\n  a[2] = 3\nend\n", LARGE_INDEX_MSG},
+		{"fst of null", "begin\n  pair(int, int) p = null ;\n  int x = fst p\nend\n", NULL_REFERENCE_MSG},
+		{"free null", "begin\n  pair(int, int) p = null ;\n  free p\nend\n", NULL_REFERENCE_MSG},
+		{"compound overflow", "begin\n  int x = 2147483647 ;\n  x += 1\nend\n", OVERFLOW_MSG},
+		{"compound index checked first", "begin\n  int[] a = [1] ;\n  int x = 0 ;\n  a[1] += 1 / x\nend\n", LARGE_INDEX_MSG},
+		{"output before error", "begin\n  println 1 ;\n  println 1 / 0\nend\n", "1\n" + DIVIDE_BY_ZERO_MSG},
+
+		// The heavier operand is evaluated first, as in the generated code
+		{"heavier right operand", "begin\n  println (7 + 2147483647) + ((3 / 0) + 1)\nend\n", DIVIDE_BY_ZERO_MSG},
+		{"heavier left operand", "begin\n  println ((7 + 2147483647) + 1) + (3 / 0)\nend\n", OVERFLOW_MSG},
+		{"equal weights", "begin\n  println (7 + 2147483647) + (3 / 0)\nend\n", DIVIDE_BY_ZERO_MSG},
+
+		// && and || are evaluated before the expression containing them
+		{"logical first", "begin\n  int x = 2147483647 ;\n  bool b = ((x + 1) + 1 == 0) == (true && (1 / 0 == 0))\nend\n", DIVIDE_BY_ZERO_MSG},
+	}
+	for _, test := range tests {
+		output, code := interpret(t, test.source, "")
+		if output != test.output || code != RUNTIME_ERROR {
+			t.Errorf("%v: got %q and exit code %v, want %q and %v", test.name, output, code, test.output, RUNTIME_ERROR)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package interpreter
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"unicode/utf8"
+
+	"../frontend"
+)
+
+// Values are represented as follows:
+//   int           int32
+//   float         float32
+//   bool          bool
+//   char          charValue
+//   string, T[]   *arrayValue
+//   pair(T1, T2)  *pairValue
+//   struct S      *structValue
+//   null          nil
+//
+// Heap objects are given a fake address when allocated so that they can be
+// printed in the same way as the generated code prints pointers.
+type charValue rune
+
+type arrayValue struct {
+	address int
+	elems   []interface{}
+}
+
+type pairValue struct {
+	address int
+	fst     interface{}
+	snd     interface{}
+}
+
+type structValue struct {
+	address int
+	fields  []interface{}
+}
+
+// Heap addresses start where glibc's malloc starts handing them out under qemu
+const HEAP_START = 0x21008
+
+func (ctx *Context) allocate(words int) int {
+	address := ctx.nextAddress
+
+	// malloc prefixes each chunk with its size, and keeps them double-word
+	// aligned
+	size := words*4 + 4
+	if size%8 != 0 {
+		size += 8 - size%8
+	}
+	ctx.nextAddress += size
+	return address
+}
+
+func (ctx *Context) newArray(elems []interface{}) *arrayValue {
+	return &arrayValue{ctx.allocate(len(elems) + 1), elems}
+}
+
+func (ctx *Context) newPair(fst, snd interface{}) *pairValue {
+	return &pairValue{ctx.allocate(2), fst, snd}
+}
+
+func (ctx *Context) newStruct(fields []interface{}) *structValue {
+	return &structValue{ctx.allocate(len(fields)), fields}
+}
+
+// String literals live in the data section, so evaluating the same literal
+// twice yields the same array
+func (ctx *Context) stringLiteral(lit *frontend.BasicLit) *arrayValue {
+	if a, ok := ctx.stringLits[lit]; ok {
+		return a
+	}
+	elems := []interface{}{}
+	for _, r := range lit.Value {
+		elems = append(elems, charValue(r))
+	}
+	a := &arrayValue{ctx.nextLiteral, elems}
+	ctx.nextLiteral += 4 + 4*len(elems)
+	ctx.stringLits[lit] = a
+	return a
+}
+
+func literalValue(lit *frontend.BasicLit) interface{} {
+	switch lit.Type.(frontend.BasicType).TypeId {
+	case frontend.INT:
+		n, _ := strconv.ParseInt(lit.Value, 10, 64)
+		return int32(n)
+
+	case frontend.FLOAT:
+		f, _ := strconv.ParseFloat(lit.Value, 32)
+		return float32(f)
+
+	case frontend.BOOL:
+		return lit.Value == "true"
+
+	case frontend.CHAR:
+		r, _ := utf8.DecodeRuneInString(lit.Value)
+		return charValue(r)
+
+	case frontend.PAIR:
+		return nil
+
+	default:
+		panic(fmt.Sprintf("Unhandled literal type %v", lit.Type.Repr()))
+	}
+}
+
+func address(v interface{}) int {
+	switch v := v.(type) {
+	case *arrayValue:
+		return v.address
+	case *pairValue:
+		return v.address
+	case *structValue:
+		return v.address
+	default:
+		return 0
+	}
+}
+
+//
+// Output, formatted as the runtime library formats it
+//
+func (ctx *Context) print(v interface{}, t frontend.Type) {
+	switch {
+	case t.Equals(frontend.BasicType{frontend.INT}):
+		fmt.Fprintf(ctx.stdout, "%d", v.(int32))
+
+	case t.Equals(frontend.BasicType{frontend.FLOAT}):
+		fmt.Fprintf(ctx.stdout, "%f", float64(v.(float32)))
+
+	case t.Equals(frontend.BasicType{frontend.BOOL}):
+		fmt.Fprintf(ctx.stdout, "%v", v.(bool))
+
+	case t.Equals(frontend.BasicType{frontend.CHAR}):
+		ctx.stdout.WriteRune(rune(v.(charValue)))
+
+	case t.Equals(frontend.BasicType{frontend.STRING}),
+		t.Equals(frontend.ArrayType{frontend.BasicType{frontend.CHAR}}):
+		if v == nil {
+			ctx.throw(NULL_REFERENCE_MSG)
+		}
+		for _, r := range v.(*arrayValue).elems {
+			// %ls stops at the terminating null character
+			if r.(charValue) == 0 {
+				break
+			}
+			ctx.stdout.WriteRune(rune(r.(charValue)))
+		}
+
+	default:
+		if v == nil {
+			fmt.Fprint(ctx.stdout, "(nil)")
+		} else {
+			fmt.Fprintf(ctx.stdout, "0x%x", address(v))
+		}
+	}
+}
+
+//
+// Input, parsed as wscanf parses it. On failure the destination is set to
+// zero, as the generated code does.
+//
+func (ctx *Context) skipSpace() {
+	for {
+		r, _, err := ctx.stdin.ReadRune()
+		if err != nil {
+			return
+		}
+		if r != ' ' && r != '\t' && r != '\n' && r != '\r' && r != '\v' && r != '\f' {
+			ctx.stdin.UnreadRune()
+			return
+		}
+	}
+}
+
+func (ctx *Context) readInt() int32 {
+	ctx.skipSpace()
+
+	digits := ""
+	if r, _, err := ctx.stdin.ReadRune(); err == nil {
+		if r == '-' || r == '+' || (r >= '0' && r <= '9') {
+			digits += string(r)
+		} else {
+			ctx.stdin.UnreadRune()
+		}
+	}
+	for {
+		r, _, err := ctx.stdin.ReadRune()
+		if err != nil {
+			break
+		}
+		if r < '0' || r > '9' {
+			ctx.stdin.UnreadRune()
+			break
+		}
+		digits += string(r)
+	}
+
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		if numErr, ok := err.(*strconv.NumError); !ok || numErr.Err != strconv.ErrRange {
+			return 0
+		}
+	}
+	if n > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	if n < math.MinInt32 {
+		return math.MinInt32
+	}
+	return int32(n)
+}
+
+func (ctx *Context) readChar() charValue {
+	ctx.skipSpace()
+	r, _, err := ctx.stdin.ReadRune()
+	if err != nil {
+		return charValue(0)
+	}
+	return charValue(r)
+}
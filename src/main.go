@@ -5,75 +5,91 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
+	"./arm"
 	"./backend"
+	"./bytecode"
 	"./frontend"
+	"./interpreter"
+	"./wacc"
 )
 
-const INTERRUPT_CODE = 0
-const OK_CODE = 1
+// A flag which can be given more than once
+type stringList []string
 
-func compilerFactory(verbose bool, astonly bool, ifonly bool, checkSemantics bool) func(string, *os.File) (string, int) {
-	compiler := func(modulePath string, input *os.File) (string, int) {
-		// Generate AST for input file
-		ast, astOk := frontend.GenerateAST(modulePath, input)
-		if !astOk {
-			return "", frontend.SYNTAX_ERROR
-		}
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
 
-		// Perform semantic checks
-		if checkSemantics {
-			semanticOk := frontend.VerifyProgram(ast)
-			if !semanticOk {
-				return "", frontend.SEMANTIC_ERROR
-			}
-		}
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
 
-		// Print the current AST
-		if verbose {
-			fmt.Println("Abstract Syntax Tree:")
-			fmt.Println(ast.Repr())
-			fmt.Println()
-		}
+func listPasses() {
+	for _, p := range backend.Passes() {
+		fmt.Printf("%-10s (-O%d) %s\n", p.Name, p.Level, p.Description)
 
-		if astonly {
-			return "", INTERRUPT_CODE
+		params := []string{}
+		for param := range p.Params {
+			params = append(params, param)
 		}
-
-		// Translate to intermediate form
-		intermediateForm := backend.TranslateToIF(ast)
-		if verbose {
-			fmt.Println("First pass intermediate form")
-			backend.DrawIFGraph(intermediateForm)
-			fmt.Println()
+		sort.Strings(params)
+		for _, param := range params {
+			fmt.Printf("%-10s %s.%s=%d\n", "", p.Name, param, p.Params[param])
 		}
+	}
+}
 
-		// Perform optimisation and register-allocation passes over IF
-		backend.OptimiseFirstPassIF(intermediateForm)
-		backend.AllocateRegisters(intermediateForm)
-		backend.OptimiseSecondPassIF(intermediateForm)
+// runBytecode runs a program in the virtual machine and exits with its exit
+// code
+func runBytecode(program *bytecode.Program, err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	code, err := bytecode.Run(program, os.Stdin, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(code)
+}
 
-		if verbose {
-			fmt.Println("Second pass intermediate form")
-			backend.DrawIFGraph(intermediateForm)
-			fmt.Println()
-		}
+func listTargets() {
+	for _, t := range backend.Targets() {
+		fmt.Printf("%-14s %s\n", t.Name(), t.Description())
+	}
+}
 
-		if ifonly {
-			return "", INTERRUPT_CODE
-		}
+// configurePasses builds the pass manager described by the optimisation flags
+func configurePasses(level int, passes string, params []string, dumpAfter string) (*backend.PassManager, error) {
+	var pm *backend.PassManager
+	var err error
+	if passes != "" {
+		pm, err = backend.NewPassManagerForPasses(passes)
+	} else {
+		pm, err = backend.NewPassManager(level)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		// Generate final assembly code
-		asm := backend.GenerateCode(intermediateForm)
-		if verbose {
-			fmt.Println("Assembly")
-			fmt.Println(asm)
+	for _, param := range params {
+		if err := pm.SetParam(param); err != nil {
+			return nil, err
 		}
-
-		return asm, OK_CODE
 	}
-
-	return compiler
+	if dumpAfter != "" {
+		for _, name := range strings.Split(dumpAfter, ",") {
+			if err := pm.DumpAfter(strings.TrimSpace(name), os.Stdout); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return pm, nil
 }
 
 func main() {
@@ -82,50 +98,210 @@ func main() {
 	astonlyFlag := flag.Bool("ast", false, "Stop the compile process once the AST has been generated")
 	ifonlyFlag := flag.Bool("if", false, "Stop the compile process once the IF representation has been generated")
 	disableSemanticFlag := flag.Bool("i-know-what-im-doing", false, "Disable semantic checking")
-	outFile := flag.String("o", "out.s", "File to write asm to")
+	outFile := flag.String("o", "", "File to write to. Without -S or -c, an object file is written if it ends in .o, and an executable if it doesn't end in the target's extension")
 	modulePathFlag := flag.String("mp", "", "Module path")
+	interpretFlag := flag.Bool("interpret", false, "Interpret the program instead of compiling it")
+	assemblyFlag := flag.Bool("S", false, "Write the assembly, or whatever else the target generates (the default)")
+	objectFlag := flag.Bool("c", false, "Write an object file, assembling ARM code with the integrated assembler")
+	runFlag := flag.Bool("run", false, "Build an executable and run it, in an emulator if it is for another architecture")
+	ccFlag := flag.String("cc", "", "C compiler used to assemble and link, instead of $"+ccEnv+" or the target's default")
+	emulatorFlag := flag.String("emulator", "", "Emulator used by -run, instead of $"+emulatorEnv+" or the target's default")
+	simFlag := flag.Bool("sim", false, "Compile the program to ARM and run it in the built-in simulator")
+	vmFlag := flag.Bool("vm", false, "Compile the program to bytecode and run it in the virtual machine, or run a .wbc file")
+	regallocFlag := flag.String("regalloc", "simple", "Register allocator to use (simple, linear-scan)")
+	targetNames := []string{}
+	for _, t := range backend.Targets() {
+		targetNames = append(targetNames, t.Name())
+	}
+	targetFlag := flag.String("target", backend.ARMTarget.Name(), "Architecture to generate code for ("+strings.Join(targetNames, ", ")+", or list to describe them)")
+	var levelFlags [backend.MaxOptimisationLevel + 1]*bool
+	for level := range levelFlags {
+		levelFlags[level] = flag.Bool(fmt.Sprintf("O%d", level), false, fmt.Sprintf("Optimise at level %d", level))
+	}
+	passesFlag := flag.String("passes", "", "Comma separated optimisation passes to run, overriding -O (list to show them)")
+	var paramFlags stringList
+	flag.Var(&paramFlags, "param", "Set a tuning parameter of an optimisation pass, as <pass>.<parameter>=<value>")
+	dumpAfterFlag := flag.String("dump-after", "", "Comma separated optimisation passes to print the IF after, or all")
 	flag.Parse()
 
-	// Open file specified in the remaining argument
+	if *passesFlag == "list" {
+		listPasses()
+		return
+	}
+	if *targetFlag == "list" {
+		listTargets()
+		return
+	}
+
+	// Read from the file specified in the remaining argument
 	filename := flag.Arg(0)
-	input := os.Stdin
-	useStdin := true
-	if filename != "-" {
+	if *vmFlag && filepath.Ext(filename) == backend.BytecodeTarget.OutputExtension() {
 		f, err := os.Open(filename)
 		if err != nil {
-			panic(err)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		program, err := bytecode.Decode(f)
+		f.Close()
+		runBytecode(program, err)
+	}
+	opts := wacc.Options{
+		Filename:           filename,
+		ModulePath:         *modulePathFlag,
+		SkipSemanticChecks: *disableSemanticFlag,
+	}
+	useStdin := filename == "-"
+	if useStdin {
+		opts.Input = os.Stdin
+	}
+	if *verboseFlag {
+		opts.Trace = os.Stdout
+	}
+	switch *regallocFlag {
+	case "simple":
+		opts.RegisterAllocator = backend.SimpleAllocator
+	case "linear-scan":
+		opts.RegisterAllocator = backend.LinearScanAllocator
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown register allocator:", *regallocFlag)
+		os.Exit(1)
+	}
+	target, ok := backend.LookupTarget(*targetFlag)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Unknown target:", *targetFlag)
+		os.Exit(1)
+	}
+	opts.Target = target
+	if *simFlag && target != backend.ARMTarget {
+		fmt.Fprintln(os.Stderr, "Only ARM code can be simulated")
+		os.Exit(1)
+	}
+	outputFlags := 0
+	for _, set := range []bool{*assemblyFlag, *objectFlag, *runFlag} {
+		if set {
+			outputFlags++
 		}
-		input = f
-		useStdin = false
+	}
+	if outputFlags > 1 {
+		fmt.Fprintln(os.Stderr, "Only one of -S, -c and -run can be given")
+		os.Exit(1)
+	}
+	if *vmFlag {
+		// -vm always compiles to bytecode, so a target would be ignored
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "target" {
+				fmt.Fprintln(os.Stderr, "-target can't be given with -vm, which always compiles to bytecode")
+				os.Exit(1)
+			}
+		})
+		opts.Target = backend.BytecodeTarget
 	}
 
-	// This is our nod to Java, but with a Golang twist
-	// Create a compile function with the flags we like
-	compile := compilerFactory(*verboseFlag, *astonlyFlag, *ifonlyFlag, !*disableSemanticFlag)
+	// The highest level given wins
+	level := backend.DefaultOptimisationLevel
+	for l, set := range levelFlags {
+		if *set {
+			level = l
+		}
+	}
+	passes, err := configurePasses(level, *passesFlag, paramFlags, *dumpAfterFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	opts.Passes = passes
+
+	if *astonlyFlag || *interpretFlag {
+		opts.StopAfter = wacc.StageAST
+	} else if *ifonlyFlag {
+		opts.StopAfter = wacc.StageIF
+	}
 
 	// Compile the source code
-	modulePath := *modulePathFlag
-	if modulePath == "" && useStdin == false {
-		modulePath, _ = filepath.Abs(filepath.Dir(filename))
+	result, diagnostics, err := wacc.Compile(opts)
+	for _, d := range diagnostics {
+		fmt.Print(d.Pretty())
 	}
-	asm, compileCode := compile(modulePath, input)
-	if compileCode != OK_CODE {
-		os.Exit(compileCode)
+	switch err {
+	case nil:
+	case wacc.ErrSyntax:
+		os.Exit(frontend.SYNTAX_ERROR)
+	case wacc.ErrSemantic:
+		os.Exit(frontend.SEMANTIC_ERROR)
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *interpretFlag {
+		code, err := interpreter.Run(result.AST, os.Stdin, os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(code)
+	}
+	if *vmFlag {
+		runBytecode(bytecode.Decode(strings.NewReader(result.Assembly)))
+	}
+	if *simFlag {
+		code, err := arm.RunAssembly(result.Assembly, os.Stdin, os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(code)
+	}
+	if opts.StopAfter != wacc.StageAssembly {
+		return
+	}
+
+	b := &builder{target: target, assembly: result.Assembly, cc: *ccFlag, emulator: *emulatorFlag}
+	if *runFlag {
+		code, err := b.run()
+		b.cleanup()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(code)
 	}
 
-	// Grab the assembled code from the source name.
-	if useStdin == false && *outFile == "out.s" {
-		// Extract source code name from file
-		basename := filepath.Base(filename)
-		*outFile = basename[:len(basename)-len(filepath.Ext(filename))] + ".s"
+	// The kind of output is chosen by its name if it isn't given, for
+	// targets which can be built into executables
+	kind := outputAssembly
+	_, buildable := toolchains[target]
+	switch {
+	case *assemblyFlag:
+	case *objectFlag:
+		kind = outputObject
+	case *outFile != "" && buildable:
+		switch filepath.Ext(*outFile) {
+		case target.OutputExtension():
+		case ".o":
+			kind = outputObject
+		default:
+			kind = outputExecutable
+		}
 	}
 
-	// Save assembly to file
-	f, err := os.Create(*outFile)
-	if err != nil {
-		panic("Unable to open output file")
+	// Name the output after the source file
+	if *outFile == "" {
+		name := "out"
+		if !useStdin {
+			basename := filepath.Base(filename)
+			name = basename[:len(basename)-len(filepath.Ext(filename))]
+		}
+		if kind == outputObject {
+			*outFile = name + ".o"
+		} else {
+			*outFile = name + target.OutputExtension()
+		}
 	}
 
-	f.WriteString(asm)
-	f.Close()
+	err = b.build(kind, *outFile)
+	b.cleanup()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"./arm"
+	"./backend"
+)
+
+// What the compiler produces from a program
+type outputKind int
+
+const (
+	outputAssembly   outputKind = iota // The target's output, as it is generated
+	outputObject                       // A relocatable object file
+	outputExecutable                   // A program linked against the C library
+)
+
+// The commands used to build and run the output of a target. The C compiler
+// driver assembles and links, and the emulator runs what it produces on
+// another architecture. Either can be overridden by a flag or an environment
+// variable.
+type toolchain struct {
+	cc       []string
+	emulator []string
+}
+
+const (
+	ccEnv       = "WACC_CC"
+	emulatorEnv = "WACC_EMULATOR"
+)
+
+// Targets which can't be built into executables have no toolchain
+var toolchains = map[backend.Target]toolchain{
+	backend.ARMTarget: {
+		cc:       []string{"arm-linux-gnueabi-gcc", "-mcpu=arm1176jzf-s", "-mtune=arm1176jzf-s"},
+		emulator: []string{"qemu-arm", "-L", "/usr/arm-linux-gnueabi"},
+	},
+	backend.AArch64Target: {
+		cc:       []string{"aarch64-linux-gnu-gcc", "-no-pie"},
+		emulator: []string{"qemu-aarch64", "-L", "/usr/aarch64-linux-gnu"},
+	},
+	backend.X86_64Target: {
+		cc: []string{"gcc", "-no-pie"},
+	},
+	backend.LLVMTarget: {
+		cc: []string{"clang"},
+	},
+	backend.CTarget: {
+		cc: []string{"cc", "-std=c99"},
+	},
+}
+
+// findTool chooses the command for a tool from its flag, its environment
+// variable or the default, in that order, and checks that it is installed
+func findTool(what, flagName, flagValue, env string, fallback []string) ([]string, error) {
+	command := fallback
+	if value := os.Getenv(env); value != "" {
+		command = strings.Fields(value)
+	}
+	if flagValue != "" {
+		command = strings.Fields(flagValue)
+	}
+	if len(command) == 0 {
+		return nil, nil
+	}
+
+	if _, err := exec.LookPath(command[0]); err != nil {
+		return nil, &toolNotFoundError{what, command[0], flagName, env}
+	}
+	return command, nil
+}
+
+type toolNotFoundError struct {
+	what, command, flagName, env string
+}
+
+func (e *toolNotFoundError) Error() string {
+	return fmt.Sprintf("%s %s not found: install it, or choose another with -%s or %s",
+		e.what, e.command, e.flagName, e.env)
+}
+
+// A build of the compiler's output into an object file or executable
+type builder struct {
+	target   backend.Target
+	assembly string
+
+	// Flags overriding the toolchain
+	cc, emulator string
+
+	// Directory for intermediate files, removed by cleanup
+	dir string
+}
+
+func (b *builder) toolchain() (toolchain, error) {
+	t, ok := toolchains[b.target]
+	if !ok {
+		return t, fmt.Errorf("code for %s can't be built into an executable, use -S", b.target.Name())
+	}
+	return t, nil
+}
+
+func (b *builder) tempFile(name string) (string, error) {
+	if b.dir == "" {
+		dir, err := ioutil.TempDir("", "wacc")
+		if err != nil {
+			return "", err
+		}
+		b.dir = dir
+	}
+	return filepath.Join(b.dir, name), nil
+}
+
+func (b *builder) cleanup() {
+	if b.dir != "" {
+		os.RemoveAll(b.dir)
+	}
+}
+
+// compile runs the C compiler driver on the output of the target, written to
+// a temporary file, with the extra arguments given
+func (b *builder) compile(output string, args ...string) error {
+	t, err := b.toolchain()
+	if err != nil {
+		return err
+	}
+	cc, err := findTool(b.target.Name()+" assembler and linker", "cc", b.cc, ccEnv, t.cc)
+	if err != nil {
+		return err
+	}
+
+	// ARM code is assembled by the integrated assembler, so that only the
+	// linker is needed
+	var source string
+	if b.target == backend.ARMTarget {
+		source, err = b.tempFile("program.o")
+		if err == nil {
+			err = b.writeObject(source)
+		}
+	} else {
+		source, err = b.tempFile("program" + b.target.OutputExtension())
+		if err == nil {
+			err = ioutil.WriteFile(source, []byte(b.assembly), 0644)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	args = append(append(cc[1:len(cc):len(cc)], args...), "-o", output, source)
+	cmd := exec.Command(cc[0], args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v", cc[0], err)
+	}
+	return nil
+}
+
+func (b *builder) writeObject(output string) error {
+	obj, err := arm.Assemble(b.assembly)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	err = obj.WriteELF(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(output)
+	}
+	return err
+}
+
+// build writes the output of the compiler to a file of the kind asked for
+func (b *builder) build(kind outputKind, output string) error {
+	switch kind {
+	case outputObject:
+		if b.target == backend.ARMTarget {
+			return b.writeObject(output)
+		}
+		return b.compile(output, "-c")
+
+	case outputExecutable:
+		return b.compile(output)
+
+	default:
+		return ioutil.WriteFile(output, []byte(b.assembly), 0644)
+	}
+}
+
+// run builds an executable and runs it, under the emulator if there is one,
+// returning its exit code
+func (b *builder) run() (int, error) {
+	t, err := b.toolchain()
+	if err != nil {
+		return 0, err
+	}
+	emulator, err := findTool(b.target.Name()+" emulator", "emulator", b.emulator, emulatorEnv, t.emulator)
+	if err != nil {
+		return 0, b.runWithoutTools(err)
+	}
+
+	executable, err := b.tempFile("program")
+	if err == nil {
+		err = b.compile(executable)
+	}
+	if err != nil {
+		return 0, b.runWithoutTools(err)
+	}
+
+	command := append(emulator[:len(emulator):len(emulator)], executable)
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Exited() {
+			return status.ExitStatus(), nil
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s failed: %v", command[0], err)
+	}
+	return 0, nil
+}
+
+// runWithoutTools points at the ways of running a program which need no
+// tools, when a tool -run needs is missing
+func (b *builder) runWithoutTools(err error) error {
+	if _, ok := err.(*toolNotFoundError); !ok {
+		return err
+	}
+	if b.target == backend.ARMTarget {
+		return fmt.Errorf("%v\nuse -sim to run the program in the built-in simulator, or -interpret to interpret it", err)
+	}
+	return fmt.Errorf("%v\nuse -interpret to interpret the program instead", err)
+}
@@ -0,0 +1,72 @@
+package wacc
+
+import (
+	"fmt"
+
+	"../frontend"
+)
+
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+}
+
+// A problem found in the program being compiled. Line and Column are 1-based,
+// and are zero if the problem has no position (e.g. an unexpected end of
+// file).
+type Diagnostic struct {
+	File     string
+	Line     int
+	Column   int
+	Severity Severity
+	Kind     string // e.g. "syntax error", "semantic error"
+	Message  string
+
+	pretty string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%v:%v:%v: %v: %v", d.File, d.Line, d.Column, d.Kind, d.Message)
+}
+
+// Pretty returns the diagnostic as printed by the compile command, in colour
+// and with the surrounding lines of source code
+func (d Diagnostic) Pretty() string {
+	if d.pretty == "" {
+		return d.String() + "\n"
+	}
+	return d.pretty
+}
+
+func convertDiagnostics(diags *frontend.Diagnostics) []Diagnostic {
+	out := []Diagnostic{}
+	for _, d := range diags.List() {
+		severity := SeverityError
+		if d.Severity == frontend.SEVERITY_WARNING {
+			severity = SeverityWarning
+		}
+		out = append(out, Diagnostic{
+			File:     d.Position.Name(),
+			Line:     d.Position.Line(),
+			Column:   d.Position.Column(),
+			Severity: severity,
+			Kind:     d.Kind,
+			Message:  d.Message,
+			pretty:   d.Pretty(),
+		})
+	}
+	return out
+}
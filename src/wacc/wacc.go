@@ -0,0 +1,206 @@
+// Package wacc drives the compiler pipeline in-process. Nothing in this
+// package writes to the terminal or exits; problems in the program are
+// returned as diagnostics, and everything else as an error.
+package wacc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"../backend"
+	"../frontend"
+)
+
+var (
+	ErrSyntax   = errors.New("wacc: program contains syntax errors")
+	ErrSemantic = errors.New("wacc: program contains semantic errors")
+)
+
+// The last stage of the pipeline to run
+type Stage int
+
+const (
+	StageAssembly Stage = iota // Run the whole pipeline
+	StageAST                   // Stop once the AST has been checked
+	StageIF                    // Stop once the IF is ready for code generation
+)
+
+type Options struct {
+	// Name of the source file. If Input is nil, the source is read from
+	// this file.
+	Filename string
+	Input    io.Reader
+
+	// Directory searched for imported modules. Defaults to the directory
+	// containing Filename.
+	ModulePath string
+
+	StopAfter          Stage
+	SkipSemanticChecks bool
+
+	// How variables are assigned to registers. Defaults to keeping them all
+	// on the stack.
+	RegisterAllocator backend.RegisterAllocator
+
+	// Architecture to generate code for. Defaults to backend.ARMTarget.
+	Target backend.Target
+
+	// Optimisation passes to run over the IF. Defaults to the passes at
+	// backend.DefaultOptimisationLevel.
+	Passes *backend.PassManager
+
+	// If set, each intermediate representation is written here as it is
+	// produced
+	Trace io.Writer
+}
+
+type Result struct {
+	AST      *frontend.Program
+	IF       *backend.IFContext
+	Assembly string
+}
+
+func (opts *Options) modulePath() string {
+	if opts.ModulePath != "" || opts.Filename == "" || opts.Filename == "-" {
+		return opts.ModulePath
+	}
+	modulePath, err := filepath.Abs(filepath.Dir(opts.Filename))
+	if err != nil {
+		return filepath.Dir(opts.Filename)
+	}
+	return modulePath
+}
+
+func (opts *Options) sourceName() string {
+	if opts.Filename == "" || opts.Filename == "-" {
+		return "<stdin>"
+	}
+	return opts.Filename
+}
+
+func (opts *Options) trace(s string, a ...interface{}) {
+	if opts.Trace != nil {
+		fmt.Fprintf(opts.Trace, s, a...)
+	}
+}
+
+func internalError(err interface{}) error {
+	return fmt.Errorf("wacc: internal compiler error: %v", err)
+}
+
+// Compile runs the pipeline described by opts. If the program is invalid, the
+// returned error is ErrSyntax or ErrSemantic and the diagnostics describe why.
+func Compile(opts Options) (result *Result, diagnostics []Diagnostic, err error) {
+	sources := frontend.NewSourceManager()
+	diags := frontend.NewDiagnostics(sources)
+	defer func() {
+		// The stages return the compiler bugs they know how to detect. Any
+		// other crash is turned into an error too, rather than bringing down
+		// the program embedding the compiler.
+		if r := recover(); r != nil {
+			result = nil
+			err = internalError(r)
+		}
+		diagnostics = convertDiagnostics(diags)
+	}()
+
+	input := opts.Input
+	if input == nil {
+		f, err := os.Open(opts.Filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		input = f
+	}
+
+	// Generate AST for input file
+	ast, astOk := frontend.GenerateAST(opts.modulePath(), opts.sourceName(), input, sources, diags)
+	if !astOk {
+		return nil, nil, ErrSyntax
+	}
+
+	// Perform semantic checks
+	if !opts.SkipSemanticChecks {
+		if !frontend.VerifyProgram(ast, diags) {
+			return nil, nil, ErrSemantic
+		}
+	}
+	result = &Result{AST: ast}
+
+	opts.trace("Abstract Syntax Tree:\n%v\n\n", ast.Repr())
+	if opts.StopAfter == StageAST {
+		return result, nil, nil
+	}
+
+	// Translate to intermediate form
+	target := opts.Target
+	if target == nil {
+		target = backend.ARMTarget
+	}
+	result.IF, err = backend.TranslateToIF(ast, target)
+	if err != nil {
+		return nil, nil, internalError(err)
+	}
+	if opts.Trace != nil {
+		opts.trace("First pass intermediate form\n")
+		backend.DrawIFGraph(opts.Trace, result.IF)
+		opts.trace("\n")
+
+		opts.trace("Control flow graphs\n")
+		for _, branch := range result.IF.Branches() {
+			opts.trace("%v\n", branch.Instr.Repr())
+			backend.DrawCFG(opts.Trace, backend.BuildCFG(branch))
+		}
+		opts.trace("\n")
+	}
+
+	// Perform optimisation and register-allocation passes over IF
+	passes := opts.Passes
+	if passes == nil {
+		passes, _ = backend.NewPassManager(backend.DefaultOptimisationLevel)
+	}
+	opts.trace("Optimisation passes: %v\n\n", strings.Join(passes.PassNames(), ", "))
+
+	passes.Run(result.IF, backend.FirstPass)
+	if err := backend.ConvertToSSA(result.IF); err != nil {
+		return nil, nil, internalError(err)
+	}
+	if opts.Trace != nil {
+		opts.trace("SSA form\n")
+		backend.DrawIFGraph(opts.Trace, result.IF)
+		opts.trace("\n")
+	}
+	passes.Run(result.IF, backend.SecondPass)
+	backend.ConvertFromSSA(result.IF)
+
+	// Targets such as LLVM, C and WebAssembly leave register allocation to
+	// the compiler or engine consuming the output
+	if target.Registers() != nil {
+		if err := backend.AllocateRegisters(result.IF, target, opts.RegisterAllocator); err != nil {
+			return nil, nil, internalError(err)
+		}
+	}
+
+	if opts.Trace != nil {
+		opts.trace("Second pass intermediate form\n")
+		backend.DrawIFGraph(opts.Trace, result.IF)
+		opts.trace("\n")
+	}
+	if opts.StopAfter == StageIF {
+		return result, nil, nil
+	}
+
+	// Generate final assembly code
+	result.Assembly, err = target.GenerateCode(result.IF)
+	if err != nil {
+		return nil, nil, internalError(err)
+	}
+	opts.trace("Assembly\n%v\n", result.Assembly)
+
+	return result, nil, nil
+}
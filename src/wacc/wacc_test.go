@@ -0,0 +1,161 @@
+package wacc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"../arm"
+)
+
+func compileString(source string, opts Options) (*Result, []Diagnostic, error) {
+	opts.Filename = "test.wacc"
+	opts.Input = strings.NewReader(source)
+	return Compile(opts)
+}
+
+func TestCompileValidProgram(t *testing.T) {
+	result, diagnostics, err := compileString("begin\n  int x = 1 ;\n  println x + 2\nend\n", Options{})
+	if err != nil {
+		t.Fatalf("Compile returned %v, want no error", err)
+	}
+	if len(diagnostics) != 0 {
+		t.Errorf("Compile returned diagnostics %v, want none", diagnostics)
+	}
+	if result.AST == nil || result.IF == nil {
+		t.Errorf("Compile didn't return the AST and IF")
+	}
+	if !strings.Contains(result.Assembly, "main:") {
+		t.Errorf("Assembly has no main label:\n%v", result.Assembly)
+	}
+}
+
+func TestCompileStopAfter(t *testing.T) {
+	source := "begin\n  println 1\nend\n"
+
+	result, _, err := compileString(source, Options{StopAfter: StageAST})
+	if err != nil {
+		t.Fatalf("Compile returned %v, want no error", err)
+	}
+	if result.AST == nil || result.IF != nil || result.Assembly != "" {
+		t.Errorf("StageAST result = %+v, want only the AST", result)
+	}
+
+	result, _, err = compileString(source, Options{StopAfter: StageIF})
+	if err != nil {
+		t.Fatalf("Compile returned %v, want no error", err)
+	}
+	if result.IF == nil || result.Assembly != "" {
+		t.Errorf("StageIF result = %+v, want the IF and no assembly", result)
+	}
+}
+
+func TestCompileDiagnostics(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		err    error
+		kind   string
+		line   int
+	}{
+		{
+			name:   "syntax error",
+			source: "begin\n  int x = 1 ;\n  x = \nend\n",
+			err:    ErrSyntax,
+			kind:   "syntax error",
+			line:   4,
+		},
+		{
+			name:   "semantic error",
+			source: "begin\n  int x = 1 ;\n  bool b = x\nend\n",
+			err:    ErrSemantic,
+			kind:   "semantic error",
+			line:   3,
+		},
+	}
+
+	for _, test := range tests {
+		result, diagnostics, err := compileString(test.source, Options{})
+		if err != test.err {
+			t.Errorf("%s: Compile returned %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if result != nil {
+			t.Errorf("%s: Compile returned a result for an invalid program", test.name)
+		}
+		if len(diagnostics) == 0 {
+			t.Errorf("%s: Compile returned no diagnostics", test.name)
+			continue
+		}
+
+		d := diagnostics[0]
+		if d.File != "test.wacc" || d.Line != test.line || d.Column == 0 {
+			t.Errorf("%s: diagnostic at %v:%v:%v, want test.wacc:%v", test.name, d.File, d.Line, d.Column, test.line)
+		}
+		if d.Kind != test.kind || d.Severity != SeverityError || d.Message == "" {
+			t.Errorf("%s: diagnostic %q is a %v %v, want a %v error", test.name, d.Message, d.Severity, d.Kind, test.kind)
+		}
+		if !strings.Contains(d.Pretty(), d.Message) {
+			t.Errorf("%s: Pretty() = %q doesn't contain the message", test.name, d.Pretty())
+		}
+	}
+}
+
+func TestCompileModuleDiagnostics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wacc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	module := "begin\n  int answer() is\n    bool b = 42 ;\n    return 42\n  end\n  skip\nend\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "answer.wacc"), []byte(module), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	source := "begin\n  import answer\n  int x = call answer() ;\n  println x\nend\n"
+	_, diagnostics, err := compileString(source, Options{ModulePath: dir})
+	if err != ErrSemantic || len(diagnostics) == 0 {
+		t.Fatalf("Compile returned %v and %v, want a semantic error", err, diagnostics)
+	}
+
+	// The error is in the module, so it is reported against the module's
+	// file and quotes its source rather than the program's
+	d := diagnostics[0]
+	if d.File != filepath.Join(dir, "answer.wacc") || d.Line != 3 {
+		t.Errorf("diagnostic at %v:%v, want %v:3", d.File, d.Line, filepath.Join(dir, "answer.wacc"))
+	}
+	if pretty := d.Pretty(); !strings.Contains(pretty, "bool b = 42") || strings.Contains(pretty, "call answer()") {
+		t.Errorf("Pretty() = %q, want it to quote line 3 of the module", pretty)
+	}
+}
+
+func TestCompileLargeFunction(t *testing.T) {
+	// Each println loads its constant from the literal pool, which must be
+	// placed within 4KB of the loads
+	source := "begin\n" + strings.Repeat("  println 123456789 ;\n  println -123456789 ;\n", 600) + "  skip\nend\n"
+	result, _, err := compileString(source, Options{})
+	if err != nil {
+		t.Fatalf("Compile returned %v, want no error", err)
+	}
+	if _, err := arm.Assemble(result.Assembly); err != nil {
+		t.Errorf("Assemble returned %v", err)
+	}
+}
+
+func TestCompileInternalError(t *testing.T) {
+	// Without the semantic checks, an undeclared variable gets as far as the
+	// backend
+	result, _, err := compileString("begin\n  println x\nend\n", Options{SkipSemanticChecks: true})
+	if err == nil || err == ErrSyntax || err == ErrSemantic {
+		t.Fatalf("Compile returned %v, want an internal compiler error", err)
+	}
+	if !strings.Contains(err.Error(), "internal compiler error") || !strings.Contains(err.Error(), "non-existent variable 'x'") {
+		t.Errorf("Compile returned %q, want it to describe the internal error", err)
+	}
+	if result != nil {
+		t.Errorf("Compile returned a result after an internal error")
+	}
+}